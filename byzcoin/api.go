@@ -2,14 +2,22 @@ package byzcoin
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"math"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/darc/expression"
 	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
@@ -22,8 +30,23 @@ const ServiceName = "ByzCoin"
 // Client is a structure to communicate with the ByzCoin service.
 type Client struct {
 	*onet.Client
-	ID     skipchain.SkipBlockID
-	Roster onet.Roster
+	ID skipchain.SkipBlockID
+	// MaxProofLag is the number of blocks a node can be behind the most
+	// recent one before GetProofFromLatest reports it as lagging.
+	MaxProofLag int
+
+	// rosterMut protects the roster, the outcome of the last requests to
+	// the leader and the index of the block the roster has been taken from.
+	rosterMut   sync.Mutex
+	roster      onet.Roster
+	failed      []bool
+	configIndex int
+
+	// genesis is the genesis block of the chain, used to verify the proofs.
+	// It is fetched the first time it is needed and protected by
+	// genesisMut.
+	genesis    *skipchain.SkipBlock
+	genesisMut sync.Mutex
 }
 
 // NewClient instantiates a new ByzCoin client.
@@ -31,7 +54,7 @@ func NewClient(ID skipchain.SkipBlockID, Roster onet.Roster) *Client {
 	return &Client{
 		Client: onet.NewClient(cothority.Suite, ServiceName),
 		ID:     ID,
-		Roster: Roster,
+		roster: Roster,
 	}
 }
 
@@ -41,7 +64,7 @@ func NewClientKeep(ID skipchain.SkipBlockID, Roster onet.Roster) *Client {
 	return &Client{
 		Client: onet.NewClientKeep(cothority.Suite, ServiceName),
 		ID:     ID,
-		Roster: Roster,
+		roster: Roster,
 	}
 }
 
@@ -70,23 +93,263 @@ func (c *Client) AddTransaction(tx ClientTransaction) (*AddTxResponse, error) {
 }
 
 // AddTransactionAndWait adds a transaction and will wait for it to be included
-// in the ledger, up to a maximum of wait block intervals. It does not return
-// any feedback on the transaction. The Client's Roster and ID should be
-// initialized before calling this method (see NewClientFromConfig).
+// in the ledger, up to a maximum of wait block intervals. If the transaction
+// has been refused, a *TxRejectedError is returned that indicates the failing
+// instruction. The Client's Roster and ID should be initialized before calling
+// this method (see NewClientFromConfig).
 func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxResponse, error) {
 	reply := &AddTxResponse{}
-	err := c.SendProtobuf(c.Roster.List[0], &AddTxRequest{
+	err := c.sendToLeader(&AddTxRequest{
 		Version:       CurrentVersion,
 		SkipchainID:   c.ID,
 		Transaction:   tx,
 		InclusionWait: wait,
 	}, reply)
+	if err != nil {
+		if wait > 0 {
+			// Try to find out why the transaction has been refused.
+			status, errStatus := c.GetTxStatus(tx.Instructions.Hash())
+			if errStatus == nil && status.Included && !status.Accepted {
+				return nil, newTxRejectedError(status)
+			}
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ErrUnknownOutcome is returned by AddTransactionWithRetry if it cannot find
+// out whether the transaction has been included in the ledger. Sending the
+// same transaction again is safe, as it will be refused if it has already
+// been included. But signing the instructions again with new counters might
+// apply them twice.
+var ErrUnknownOutcome = errors.New("cannot find out whether the transaction has been included")
+
+// AddTransactionWithRetry sends the transaction like AddTransactionAndWait,
+// but if no answer is received within wait blocks, it checks whether the
+// transaction has been included in the meantime before sending it again, up
+// to attempts times. The transaction is only sent again if the counters of
+// its signers show that it has not been included. If the transaction has
+// been included, a response is returned without sending it again. If this
+// cannot be decided, ErrUnknownOutcome is returned.
+func (c *Client) AddTransactionWithRetry(tx ClientTransaction, wait, attempts int) (*AddTxResponse, error) {
+	if wait <= 0 {
+		return nil, errors.New("need to wait for at least one block")
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		var reply *AddTxResponse
+		reply, err = c.AddTransactionAndWait(tx, wait)
+		if err == nil {
+			return reply, nil
+		}
+		if _, ok := err.(*TxRejectedError); ok {
+			return nil, err
+		}
+		included, errOutcome := c.txIncluded(tx)
+		if errOutcome != nil {
+			return nil, errOutcome
+		}
+		if included {
+			return &AddTxResponse{Version: CurrentVersion}, nil
+		}
+		log.Lvlf2("transaction has not been included, sending it again: %v", err)
+	}
+	return nil, err
+}
+
+// txIncluded returns true if the transaction has been accepted, false if it
+// has certainly not been included yet, and an error if it has been refused or
+// if it is not possible to decide.
+func (c *Client) txIncluded(tx ClientTransaction) (bool, error) {
+	status, err := c.GetTxStatus(tx.Instructions.Hash())
+	if err == nil && status.Included {
+		if status.Accepted {
+			return true, nil
+		}
+		return false, newTxRejectedError(status)
+	}
+
+	// If the transaction has been accepted, the counters of all signers are
+	// at least as high as the lowest counter they used in the transaction.
+	var ids []string
+	lowest := make(map[string]uint64)
+	for _, instr := range tx.Instructions {
+		if len(instr.SignerCounter) != len(instr.Signatures) {
+			return false, errors.New("the number of counters doesn't match the number of signatures")
+		}
+		for i, sig := range instr.Signatures {
+			id := sig.Signer.String()
+			ctr, ok := lowest[id]
+			if !ok {
+				ids = append(ids, id)
+			}
+			if !ok || instr.SignerCounter[i] < ctr {
+				lowest[id] = instr.SignerCounter[i]
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return false, ErrUnknownOutcome
+	}
+	ctrs, err := c.GetSignerCounters(ids...)
+	if err != nil || len(ctrs.Counters) != len(ids) {
+		return false, ErrUnknownOutcome
+	}
+	var used int
+	for i, id := range ids {
+		if ctrs.Counters[i] >= lowest[id] {
+			used++
+		}
+	}
+	if used == 0 {
+		return false, nil
+	}
+
+	// The counters have been used, but maybe by another transaction. If
+	// one of the instances spawned by the transaction exists, it has been
+	// accepted.
+	for _, instr := range tx.Instructions {
+		if instr.Spawn == nil {
+			continue
+		}
+		id := instr.DeriveID("").Slice()
+		p, err := c.GetProof(id)
+		if err == nil && p.Proof.InclusionProof.Match(id) {
+			return true, nil
+		}
+	}
+	return false, ErrUnknownOutcome
+}
+
+// GetTxStatus asks the leader whether the transaction with the given hash of
+// the instructions has been accepted in one of the latest blocks, and if it
+// has been refused, which instruction failed.
+func (c *Client) GetTxStatus(txHash []byte) (*GetTxStatusResponse, error) {
+	reply := &GetTxStatusResponse{}
+	err := c.sendToLeader(&GetTxStatus{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		TxHash:      txHash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetProofAt returns a proof of the state of the instance as it was after the
+// block with the given index. The proof can be verified like the ones of
+// GetProof, and its Latest block is the requested block. If the block is
+// older than the retention horizon of the leader, ErrProofTooOld is returned.
+func (c *Client) GetProofAt(id InstanceID, index int) (*GetProofAtResponse, error) {
+	reply := &GetProofAtResponse{}
+	err := c.sendToLeader(&GetProofAt{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		InstanceID:  id,
+		BlockIndex:  index,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.TooOld {
+		return nil, ErrProofTooOld
+	}
+	return reply, nil
+}
+
+// GetBlockStateChanges returns the state changes created by the block with
+// the given index. Use Verify on the reply to check them against the block.
+func (c *Client) GetBlockStateChanges(index int) (*GetBlockStateChangesResponse, error) {
+	reply := &GetBlockStateChangesResponse{}
+	err := c.sendToLeader(&GetBlockStateChanges{
+		Version:     CurrentVersion,
+		SkipChainID: c.ID,
+		BlockIndex:  index,
+	}, reply)
 	if err != nil {
 		return nil, err
 	}
 	return reply, nil
 }
 
+// Verify checks that the state changes are the ones committed to in the
+// header of the given block, which must be the block of the reply.
+func (r *GetBlockStateChangesResponse) Verify(sb *skipchain.SkipBlock) error {
+	if sb == nil || !sb.Hash.Equal(r.BlockHash) || !sb.CalculateHash().Equal(sb.Hash) {
+		return errors.New("wrong block")
+	}
+	var header DataHeader
+	err := protobuf.Decode(sb.Data, &header)
+	if err != nil {
+		return errors.New("couldn't unmarshal header: " + err.Error())
+	}
+	if !bytes.Equal(StateChanges(r.StateChanges).Hash(), header.StateChangesHash) {
+		return errors.New("state changes don't match the hash in the block")
+	}
+	return nil
+}
+
+// GetPendingTransactions asks the given node for the transactions it has not
+// yet passed on to the leader. The request is signed with priv, which must
+// be the private key of the node.
+func (c *Client) GetPendingTransactions(si *network.ServerIdentity, priv kyber.Scalar) (*GetPendingTransactionsResponse, error) {
+	req := &GetPendingTransactions{
+		Version:     CurrentVersion,
+		SkipChainID: c.ID,
+		Timestamp:   time.Now().UnixNano(),
+	}
+	sig, err := schnorr.Sign(cothority.Suite, priv, req.Hash())
+	if err != nil {
+		return nil, err
+	}
+	req.Signature = sig
+	reply := &GetPendingTransactionsResponse{}
+	err = c.SendProtobuf(si, req, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Hash returns the hash of the request that is signed by the node. The
+// hash starts with the name of the request, so that the signature cannot be
+// used for another message.
+func (r *GetPendingTransactions) Hash() []byte {
+	h := sha256.New()
+	h.Write([]byte("GetPendingTransactions"))
+	h.Write(r.SkipChainID)
+	binary.Write(h, binary.LittleEndian, r.Timestamp)
+	return h.Sum(nil)
+}
+
+// ListInstancesByContract returns all instances of the given contract. It
+// fetches pageSize instances per request, a pageSize of 0 lets the service
+// choose.
+func (c *Client) ListInstancesByContract(contractID string, pageSize int) ([]InstanceInfo, error) {
+	var instances []InstanceInfo
+	var page []byte
+	for {
+		reply := &ListInstancesByContractResponse{}
+		err := c.sendToLeader(&ListInstancesByContract{
+			Version:     CurrentVersion,
+			SkipchainID: c.ID,
+			ContractID:  contractID,
+			Page:        page,
+			PageSize:    pageSize,
+		}, reply)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, reply.Instances...)
+		if len(reply.Next) == 0 {
+			return instances, nil
+		}
+		page = reply.Next
+	}
+}
+
 // GetProof returns a proof for the key stored in the skipchain by sending a
 // message to the node on index 0 of the roster. The proof can be verified with
 // the genesis skipblock and can prove the existence or the absence of the key.
@@ -94,7 +357,7 @@ func (c *Client) AddTransactionAndWait(tx ClientTransaction, wait int) (*AddTxRe
 // (see NewClientFromConfig).
 func (c *Client) GetProof(key []byte) (*GetProofResponse, error) {
 	reply := &GetProofResponse{}
-	err := c.SendProtobuf(c.Roster.List[0], &GetProof{
+	err := c.sendToLeader(&GetProof{
 		Version: CurrentVersion,
 		ID:      c.ID,
 		Key:     key,
@@ -105,11 +368,90 @@ func (c *Client) GetProof(key []byte) (*GetProofResponse, error) {
 	return reply, nil
 }
 
+// LaggingNode describes a node that returned a proof anchored in a block
+// older than the most recent proof received.
+type LaggingNode struct {
+	ServerIdentity *network.ServerIdentity
+	// Index of the latest block of the proof returned by this node.
+	Index int
+}
+
+// LaggingNodesError is returned by GetProofFromLatest together with a
+// valid proof if some of the nodes returned a proof that is more than
+// Client.MaxProofLag blocks behind the best one.
+type LaggingNodesError struct {
+	// Latest is the index of the block the returned proof is anchored in.
+	Latest int
+	Nodes  []LaggingNode
+}
+
+func (e *LaggingNodesError) Error() string {
+	var nodes []string
+	for _, n := range e.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%s@%d", n.ServerIdentity.Address, n.Index))
+	}
+	return fmt.Sprintf("nodes lagging behind block %d: %s", e.Latest,
+		strings.Join(nodes, ", "))
+}
+
+// GetProofFromLatest asks up to n distinct nodes of the roster for a proof of
+// the given key. Every proof is verified against the ID of the client and the
+// one anchored in the block with the highest index is returned. If some nodes
+// returned a proof more than Client.MaxProofLag blocks behind the best one,
+// a *LaggingNodesError is returned together with the best proof.
+func (c *Client) GetProofFromLatest(key []byte, n int) (*GetProofResponse, error) {
+	if n <= 0 {
+		return nil, errors.New("need to ask at least one node")
+	}
+	roster := c.Roster()
+	if n > len(roster.List) {
+		n = len(roster.List)
+	}
+
+	var best *GetProofResponse
+	var answers []LaggingNode
+	for _, i := range rand.Perm(len(roster.List))[:n] {
+		si := roster.List[i]
+		reply := &GetProofResponse{}
+		err := c.SendProtobuf(si, &GetProof{
+			Version: CurrentVersion,
+			ID:      c.ID,
+			Key:     key,
+		}, reply)
+		if err != nil {
+			log.Warn("couldn't get proof from", si.Address, ":", err)
+			continue
+		}
+		if err = reply.Proof.Verify(c.ID); err != nil {
+			log.Warn("got invalid proof from", si.Address, ":", err)
+			continue
+		}
+		answers = append(answers, LaggingNode{si, reply.Proof.Latest.Index})
+		if best == nil || reply.Proof.Latest.Index > best.Proof.Latest.Index {
+			best = reply
+		}
+	}
+	if best == nil {
+		return nil, errors.New("none of the nodes returned a valid proof")
+	}
+
+	lagErr := &LaggingNodesError{Latest: best.Proof.Latest.Index}
+	for _, a := range answers {
+		if lagErr.Latest-a.Index > c.MaxProofLag {
+			lagErr.Nodes = append(lagErr.Nodes, a)
+		}
+	}
+	if len(lagErr.Nodes) > 0 {
+		return best, lagErr
+	}
+	return best, nil
+}
+
 // CheckAuthorization verifies which actions the given set of identities can
 // execute in the given darc.
 func (c *Client) CheckAuthorization(dID darc.ID, ids ...darc.Identity) ([]darc.Action, error) {
 	reply := &CheckAuthorizationResponse{}
-	err := c.SendProtobuf(c.Roster.List[0], &CheckAuthorization{
+	err := c.sendToLeader(&CheckAuthorization{
 		Version:    CurrentVersion,
 		ByzCoinID:  c.ID,
 		DarcID:     dID,
@@ -126,13 +468,17 @@ func (c *Client) CheckAuthorization(dID darc.ID, ids ...darc.Identity) ([]darc.A
 }
 
 // GetGenDarc uses the GetProof method to fetch the latest version of the
-// Genesis Darc from ByzCoin and parses it.
+// Genesis Darc from ByzCoin and parses it. The proofs are verified against
+// the ID of the client.
 func (c *Client) GetGenDarc() (*darc.Darc, error) {
 	// Get proof of the genesis darc.
 	p, err := c.GetProof(NewInstanceID(nil).Slice())
 	if err != nil {
 		return nil, err
 	}
+	if err = c.verifyProof(&p.Proof); err != nil {
+		return nil, err
+	}
 	ok, err := p.Proof.InclusionProof.Exists(NewInstanceID(nil).Slice())
 	if err != nil {
 		return nil, err
@@ -151,41 +497,123 @@ func (c *Client) GetGenDarc() (*darc.Darc, error) {
 	}
 
 	// Find the actual darc.
-	p, err = c.GetProof(darcID)
+	d, _, err := getLatestDarc(c, darcID)
+	return d, err
+}
+
+// GetChainConfig uses the GetProof method to fetch the chain config
+// from ByzCoin. The proof is verified against the ID of the client.
+func (c *Client) GetChainConfig() (*ChainConfig, error) {
+	p, err := c.GetProof(NewInstanceID(nil).Slice())
 	if err != nil {
 		return nil, err
 	}
-	ok, err = p.Proof.InclusionProof.Exists(darcID)
-	if err != nil {
+	if err = c.verifyProof(&p.Proof); err != nil {
 		return nil, err
 	}
-	if !ok {
-		return nil, errors.New("cannot find genesis Darc")
-	}
+	return chainConfigFromProof(&p.Proof)
+}
 
-	// Check and parse the darc.
-	_, darcBuf, contract, _, err := p.Proof.KeyValue()
+// verifyProof returns an error if the proof doesn't come from the skipchain
+// of the client, so that its values can't be trusted. The proof is verified
+// against the genesis block and not against the roster that the conode puts
+// in the first link of the proof.
+func (c *Client) verifyProof(p *Proof) error {
+	genesis, err := c.GenesisBlock()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if contract != ContractDarcID {
-		return nil, errors.New("expected contract to be darc but got: " + contract)
+	if _, _, _, _, err = VerifyProofOffline(genesis, p); err != nil {
+		return fmt.Errorf("proof does not verify against chain %x: %v", c.ID, err)
 	}
-	d, err := darc.NewFromProtobuf(darcBuf)
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// GenesisBlock returns the genesis block of the chain of the client. It is
+// fetched from the roster the first time and must hash to the ID of the
+// client, so it can be used to verify proofs with VerifyProofOffline.
+func (c *Client) GenesisBlock() (*skipchain.SkipBlock, error) {
+	c.genesisMut.Lock()
+	defer c.genesisMut.Unlock()
+	if c.genesis != nil {
+		return c.genesis, nil
 	}
-	return d, nil
+	// Any node can be asked, as the block is checked against the ID.
+	var errs []string
+	cl := skipchain.NewClient()
+	for _, si := range c.Roster().List {
+		sb := &skipchain.SkipBlock{}
+		err := cl.SendProtobuf(si, &skipchain.GetSingleBlock{ID: c.ID}, sb)
+		if err == nil && (sb.SkipBlockFix == nil || sb.Index != 0 ||
+			!sb.Hash.Equal(c.ID) || !sb.CalculateHash().Equal(sb.Hash)) {
+			err = errors.New("wrong genesis block")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", si.Address, err))
+			continue
+		}
+		c.genesis = sb
+		return sb, nil
+	}
+	return nil, errors.New("couldn't get genesis block: " +
+		strings.Join(errs, ", "))
 }
 
-// GetChainConfig uses the GetProof method to fetch the chain config
-// from ByzCoin.
-func (c *Client) GetChainConfig() (*ChainConfig, error) {
-	p, err := c.GetProof(NewInstanceID(nil).Slice())
-	if err != nil {
-		return nil, err
+// rosterRefreshWindow is the number of the last requests to the leader that
+// are looked at to decide whether the client refreshes its roster: it does
+// so if more than half of them failed.
+const rosterRefreshWindow = 6
+
+// FetchChainConfig asks the nodes of the roster, one after the other, for a
+// proof of the chain config. The first proof that verifies against the
+// genesis block of the chain, and whose latest block is not older than the
+// one of the last fetched config, is used to replace the roster of the client
+// with the one of the chain config, which is then returned. This allows the
+// client to follow roster changes of the chain, without a node being able to
+// roll it back to an old roster.
+func (c *Client) FetchChainConfig() (*ChainConfig, error) {
+	var errs []string
+	c.rosterMut.Lock()
+	index := c.configIndex
+	c.rosterMut.Unlock()
+	for _, si := range c.Roster().List {
+		reply := &GetProofResponse{}
+		err := c.SendProtobuf(si, &GetProof{
+			Version: CurrentVersion,
+			ID:      c.ID,
+			Key:     NewInstanceID(nil).Slice(),
+		}, reply)
+		if err == nil {
+			err = c.verifyProof(&reply.Proof)
+		}
+		if err == nil && reply.Proof.Latest.Index < index {
+			err = fmt.Errorf("proof of block %d is older than block %d",
+				reply.Proof.Latest.Index, index)
+		}
+		var config *ChainConfig
+		if err == nil {
+			config, err = chainConfigFromProof(&reply.Proof)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", si.Address, err))
+			continue
+		}
+
+		c.rosterMut.Lock()
+		if reply.Proof.Latest.Index >= c.configIndex {
+			c.roster = config.Roster
+			c.configIndex = reply.Proof.Latest.Index
+		}
+		c.failed = nil
+		c.rosterMut.Unlock()
+		return config, nil
 	}
-	ok, err := p.Proof.InclusionProof.Exists(NewInstanceID(nil).Slice())
+	return nil, errors.New("couldn't fetch chain config: " +
+		strings.Join(errs, ", "))
+}
+
+func chainConfigFromProof(p *Proof) (*ChainConfig, error) {
+	ok, err := p.InclusionProof.Exists(NewInstanceID(nil).Slice())
 	if err != nil {
 		return nil, err
 	}
@@ -193,7 +621,10 @@ func (c *Client) GetChainConfig() (*ChainConfig, error) {
 		return nil, errors.New("cannot find config")
 	}
 
-	_, configBuf, contract, _, err := p.Proof.KeyValue()
+	_, configBuf, contract, _, err := p.KeyValue()
+	if err != nil {
+		return nil, err
+	}
 	if contract != ContractConfigID {
 		return nil, errors.New("expected contract to be config but got: " + contract)
 	}
@@ -205,6 +636,54 @@ func (c *Client) GetChainConfig() (*ChainConfig, error) {
 	return config, nil
 }
 
+// Roster returns a copy of the roster the client sends its requests to.
+func (c *Client) Roster() onet.Roster {
+	c.rosterMut.Lock()
+	defer c.rosterMut.Unlock()
+	return c.roster
+}
+
+// SetRoster replaces the roster the client sends its requests to. It doesn't
+// change the roster of the chain.
+func (c *Client) SetRoster(r onet.Roster) {
+	c.rosterMut.Lock()
+	defer c.rosterMut.Unlock()
+	c.roster = r
+	c.failed = nil
+}
+
+// sendToLeader sends the message to the first node of the roster. If more
+// than half of the last rosterRefreshWindow requests failed, the roster is
+// refreshed using FetchChainConfig.
+func (c *Client) sendToLeader(msg, reply interface{}) error {
+	err := c.SendProtobuf(c.Roster().List[0], msg, reply)
+	if c.recordRequest(err != nil) {
+		log.Lvl2("Too many failed requests, refreshing the roster")
+		if _, errFetch := c.FetchChainConfig(); errFetch != nil {
+			log.Warn("couldn't refresh the roster:", errFetch)
+		}
+	}
+	return err
+}
+
+// recordRequest adds the outcome of a request to the leader to the window,
+// and returns true if more than half of the requests of the window failed.
+func (c *Client) recordRequest(failed bool) bool {
+	c.rosterMut.Lock()
+	defer c.rosterMut.Unlock()
+	c.failed = append(c.failed, failed)
+	if len(c.failed) > rosterRefreshWindow {
+		c.failed = c.failed[1:]
+	}
+	failures := 0
+	for _, f := range c.failed {
+		if f {
+			failures++
+		}
+	}
+	return 2*failures > rosterRefreshWindow
+}
+
 // WaitProof will poll ByzCoin until a given instanceID exists.
 // It will return the proof of the instance created. If value is
 // non-nil, it will wait for the value of the proof to be equal to
@@ -253,7 +732,7 @@ func (c *Client) StreamTransactions(handler func(StreamingResponse, error)) erro
 	req := StreamingRequest{
 		ID: c.ID,
 	}
-	conn, err := c.Stream(c.Roster.List[0], &req)
+	conn, err := c.Stream(c.Roster().List[0], &req)
 	if err != nil {
 		return err
 	}
@@ -278,34 +757,62 @@ func (c *Client) GetSignerCounters(ids ...string) (*GetSignerCountersResponse, e
 		SignerIDs:   ids,
 	}
 	var reply GetSignerCountersResponse
-	err := c.SendProtobuf(c.Roster.List[0], &req, &reply)
+	err := c.sendToLeader(&req, &reply)
 	if err != nil {
 		return nil, err
 	}
 	return &reply, nil
 }
 
+// SimulateTransaction asks the service to execute the transaction against
+// the current state without adding it to the ledger. The returned response
+// holds the result of every instruction up to the first one that has been
+// rejected. The signer counters of the transaction need to be set as if it
+// would be sent with AddTransaction.
+func (c *Client) SimulateTransaction(tx ClientTransaction) (*SimulateTransactionResponse, error) {
+	reply := &SimulateTransactionResponse{}
+	err := c.sendToLeader(&SimulateTransaction{
+		Version:     CurrentVersion,
+		SkipchainID: c.ID,
+		Transaction: tx,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
 // DownloadState is used by a new node to ask to download the global state.
-// The first call to DownloadState needs to have start = 0, so that the
+// The first call to DownloadState needs to have nonce = 0, so that the
 // service creates a snapshot of the current state which it will serve over
 // multiple requests.
 //
-// Every subsequent request should have start incremented by 'len'.
-// If start > than the number of StateChanges available, an empty slice of
-// StateChanges is returned.
+// Every subsequent request should use the nonce of the first reply, and
+// returns the next entries of the state. If all entries have been served,
+// an empty slice of KeyValues is returned.
 //
-// If less than 'len' StateChanges are available, only the remaining
-// StateChanges are returned.
+// If less than 'len' entries are available, only the remaining entries are
+// returned.
 //
-// The first StateChange with start == 0 holds the metadata of the
-// trie which can be `protobuf.Decode`d into a struct{map[string][]byte}.
+// The reply to the first request holds a proof for the block the snapshot
+// corresponds to. Once all entries are stored, the root of the trie must be
+// equal to the root of this proof.
 func (c *Client) DownloadState(byzcoinID skipchain.SkipBlockID, nonce uint64, length int) (reply *DownloadStateResponse, err error) {
+	return c.DownloadStatePage(byzcoinID, nonce, 0, length)
+}
+
+// DownloadStatePage is like DownloadState, but asks for the given page of
+// the state, starting at 1. A page that has already been served can be
+// requested again, which allows to resume a download after an error. A page
+// of 0 returns the page following the last one served.
+func (c *Client) DownloadStatePage(byzcoinID skipchain.SkipBlockID, nonce uint64, page, length int) (reply *DownloadStateResponse, err error) {
 	if length <= 0 {
 		return nil, errors.New("invalid parameter")
 	}
 
 	reply = &DownloadStateResponse{}
-	l := len(c.Roster.List)
+	roster := c.Roster()
+	l := len(roster.List)
 	index := l - 1
 	if l > 2 {
 		// This is the leader plus the subleaders, don't contact them
@@ -316,15 +823,16 @@ func (c *Client) DownloadState(byzcoinID skipchain.SkipBlockID, nonce uint64, le
 	// Because the last elements of the roster might be a view-changed,
 	// defective old leader, we start from the first non-subleader.
 	for index < l {
-		err = c.SendProtobuf(c.Roster.List[index], &DownloadState{
+		err = c.SendProtobuf(roster.List[index], &DownloadState{
 			ByzCoinID: byzcoinID,
 			Nonce:     nonce,
 			Length:    length,
+			Page:      page,
 		}, reply)
 		if err == nil {
 			return reply, nil
 		}
-		log.Error("Couldn't download from", c.Roster.List[index], ":", err)
+		log.Error("Couldn't download from", roster.List[index], ":", err)
 		index++
 	}
 	return nil, errors.New("Error while downloading state from nodes")
@@ -358,3 +866,176 @@ func DefaultGenesisMsg(v Version, r *onet.Roster, rules []string, ids ...darc.Id
 	}
 	return &m, nil
 }
+
+// GenesisOption is used by NewGenesisMsg to change the genesis message.
+type GenesisOption func(*genesisMsg) error
+
+// genesisMsg is the genesis message being built by NewGenesisMsg, with the
+// signers of the spawns that are signed once all the options are applied.
+type genesisMsg struct {
+	*CreateGenesisBlock
+	spawnSigners [][]darc.Signer
+}
+
+// WithBlockInterval sets the block interval of the new chain.
+func WithBlockInterval(d time.Duration) GenesisOption {
+	return func(m *genesisMsg) error {
+		if d <= 0 {
+			return errors.New("block interval must be bigger than zero")
+		}
+		m.BlockInterval = d
+		return nil
+	}
+}
+
+// WithMaxBlockSize sets the maximum size of a block of the new chain.
+func WithMaxBlockSize(n int) GenesisOption {
+	return func(m *genesisMsg) error {
+		if n < minMaxBlockSize || n > maxMaxBlockSize {
+			return fmt.Errorf("max block size must be between %d and %d",
+				minMaxBlockSize, int(maxMaxBlockSize))
+		}
+		m.MaxBlockSize = n
+		return nil
+	}
+}
+
+// WithSpawn adds a spawn instruction of the given contract to the genesis
+// block. It is executed on the genesis darc once the configuration has been
+// created and is signed by the signers, which must satisfy the spawn rule of
+// the genesis darc.
+func WithSpawn(contractID string, args Arguments, signers ...darc.Signer) GenesisOption {
+	return func(m *genesisMsg) error {
+		if contractID == "" {
+			return errors.New("missing contract ID")
+		}
+		if len(signers) == 0 {
+			return errors.New("need at least one signer")
+		}
+		if m.SpawnTransaction == nil {
+			m.SpawnTransaction = &ClientTransaction{}
+		}
+		m.SpawnTransaction.Instructions = append(m.SpawnTransaction.Instructions, Instruction{
+			Spawn: &Spawn{
+				ContractID: contractID,
+				Args:       args,
+			},
+		})
+		m.spawnSigners = append(m.spawnSigners, signers)
+		return nil
+	}
+}
+
+// signSpawns signs the instructions of the spawn transaction. It must be
+// called once the genesis darc is final, as the instructions are sent to it.
+// The signer counters of a new chain are all 0, so the first instruction of
+// every signer uses the counter 1.
+func (m *genesisMsg) signSpawns() error {
+	ctx := m.SpawnTransaction
+	if ctx == nil {
+		return nil
+	}
+	counters := make(map[string]uint64)
+	for i := range ctx.Instructions {
+		ctx.Instructions[i].InstanceID = NewInstanceID(m.GenesisDarc.GetBaseID())
+		ctx.Instructions[i].SignerCounter = nil
+		for _, signer := range m.spawnSigners[i] {
+			id := signer.Identity().String()
+			counters[id]++
+			ctx.Instructions[i].SignerCounter = append(ctx.Instructions[i].SignerCounter, counters[id])
+		}
+	}
+	ctx.InstructionsHash = ctx.Instructions.Hash()
+	for i := range ctx.Instructions {
+		if err := ctx.Instructions[i].SignWith(ctx.InstructionsHash, m.spawnSigners[i]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AdminPolicy is the number of admin identities that must sign to evolve
+// the genesis darc or to use any of its rules, see WithAdmins.
+type AdminPolicy int
+
+const (
+	// AllAdmins requires the signatures of all the admins.
+	AllAdmins AdminPolicy = 0
+	// AnyAdmin requires the signature of one of the admins.
+	AnyAdmin AdminPolicy = 1
+)
+
+// WithAdmins replaces the admin of the genesis darc by the given identities.
+// The rules of the genesis darc that are given to the admin, including its
+// evolution, need the signatures of as many admins as given by policy, which
+// can be AnyAdmin, AllAdmins or a threshold k between 1 and the number of
+// admins. Duplicate identities are counted once. The rules with another
+// expression, like the view-change rule of the roster, are kept.
+func WithAdmins(policy AdminPolicy, ids ...darc.Identity) GenesisOption {
+	return func(m *genesisMsg) error {
+		expr, err := adminExpr(policy, ids)
+		if err != nil {
+			return err
+		}
+		admin := m.GenesisDarc.Rules.GetSignExpr()
+		rules := m.GenesisDarc.Rules.List
+		for i := range rules {
+			if bytes.Equal(rules[i].Expr, admin) {
+				rules[i].Expr = expr
+			}
+		}
+		return nil
+	}
+}
+
+// adminExpr returns the expression of the given policy over the unique
+// identities.
+func adminExpr(policy AdminPolicy, ids []darc.Identity) (expression.Expr, error) {
+	var admins []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		s := id.String()
+		if !seen[s] {
+			seen[s] = true
+			admins = append(admins, s)
+		}
+	}
+	if len(admins) == 0 {
+		return nil, errors.New("need at least one admin identity")
+	}
+	k := int(policy)
+	if policy == AllAdmins {
+		k = len(admins)
+	}
+	switch {
+	case k < 0 || k > len(admins):
+		return nil, fmt.Errorf("policy must be between 1 and %d admins, got %d",
+			len(admins), policy)
+	case k == 1:
+		return expression.InitOrExpr(admins...), nil
+	case k == len(admins):
+		return expression.InitAndExpr(admins...), nil
+	}
+	return expression.Expr(fmt.Sprintf("threshold<%d:%d>(%s)", k, len(admins),
+		strings.Join(admins, ","))), nil
+}
+
+// NewGenesisMsg is like DefaultGenesisMsg, but takes a list of options to
+// set the block interval, the maximum block size or additional instances
+// that are created in the genesis block.
+func NewGenesisMsg(v Version, r *onet.Roster, rules []string, admin darc.Identity, opts ...GenesisOption) (*CreateGenesisBlock, error) {
+	m, err := DefaultGenesisMsg(v, r, rules, admin)
+	if err != nil {
+		return nil, err
+	}
+	gm := &genesisMsg{CreateGenesisBlock: m}
+	for _, opt := range opts {
+		if err := opt(gm); err != nil {
+			return nil, err
+		}
+	}
+	if err := gm.signSpawns(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
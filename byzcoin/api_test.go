@@ -1,12 +1,22 @@
 package byzcoin
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/trie"
 	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/network"
 	"github.com/dedis/protobuf"
@@ -61,6 +71,12 @@ func TestClient_GetProof(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, k, newID)
 	require.Equal(t, value, v0)
+
+	// The proof can also be verified without the service.
+	k, v0, _, _, err = VerifyProofOffline(csr.Skipblock, &p.Proof)
+	require.Nil(t, err)
+	require.Equal(t, k, newID)
+	require.Equal(t, value, v0)
 }
 
 // Create a streaming client and add blocks in the background. The client
@@ -156,3 +172,711 @@ func TestClient_Streaming(t *testing.T) {
 		require.Nil(t, err)
 	}
 }
+
+// Let a node outside of the roster serve proofs from a snapshot of the
+// genesis block, then check that GetProofFromLatest returns the newest proof
+// and reports the lagging node.
+func TestClient_GetProofFromLatest(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(4, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := DefaultGenesisMsg(CurrentVersion, onet.NewRoster(roster.List[:3]),
+		[]string{"spawn:dummy"}, signer.Identity())
+	require.Nil(t, err)
+	msg.BlockInterval = 100 * time.Millisecond
+	d := msg.GenesisDarc
+
+	c, csr, err := NewLedger(msg, false)
+	require.Nil(t, err)
+
+	// The last node only knows about the genesis block.
+	laggard := l.GetServices(servers, ByzCoinID)[3].(*Service)
+	_, err = laggard.db().StoreBlocks([]*skipchain.SkipBlock{csr.Skipblock})
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		tx, err := createOneClientTxWithCounter(d.GetBaseID(), "dummy", []byte{byte(i)}, signer, uint64(i)+1)
+		require.Nil(t, err)
+		_, err = c.AddTransactionAndWait(tx, 10)
+		require.Nil(t, err)
+	}
+
+	c.SetRoster(*roster)
+	key := NewInstanceID(nil).Slice()
+	p, err := c.GetProofFromLatest(key, len(roster.List))
+	require.NotNil(t, p)
+	require.Nil(t, p.Proof.Verify(c.ID))
+	require.Equal(t, 2, p.Proof.Latest.Index)
+
+	lagErr, ok := err.(*LaggingNodesError)
+	require.True(t, ok, "expected a LaggingNodesError")
+	require.Equal(t, 2, lagErr.Latest)
+	require.Equal(t, 1, len(lagErr.Nodes))
+	require.True(t, lagErr.Nodes[0].ServerIdentity.Equal(laggard.ServerIdentity()))
+	require.Equal(t, 0, lagErr.Nodes[0].Index)
+
+	// Allowing enough lag removes the error.
+	c.MaxProofLag = 2
+	p, err = c.GetProofFromLatest(key, len(roster.List))
+	require.Nil(t, err)
+	require.Equal(t, 2, p.Proof.Latest.Index)
+}
+
+func TestNewGenesisMsg_Options(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	l := onet.NewLocalTest(cothority.Suite)
+	_, roster, _ := l.GenTree(1, false)
+	defer l.CloseAll()
+	newMsg := func(opts ...GenesisOption) (*CreateGenesisBlock, error) {
+		return NewGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"},
+			signer.Identity(), opts...)
+	}
+
+	msg, err := newMsg()
+	require.Nil(t, err)
+	require.Equal(t, defaultInterval, msg.BlockInterval)
+	require.Nil(t, msg.SpawnTransaction)
+
+	msg, err = newMsg(WithBlockInterval(time.Second))
+	require.Nil(t, err)
+	require.Equal(t, time.Second, msg.BlockInterval)
+	_, err = newMsg(WithBlockInterval(0))
+	require.NotNil(t, err)
+	_, err = newMsg(WithBlockInterval(-time.Second))
+	require.NotNil(t, err)
+
+	msg, err = newMsg(WithMaxBlockSize(minMaxBlockSize))
+	require.Nil(t, err)
+	require.Equal(t, minMaxBlockSize, msg.MaxBlockSize)
+	_, err = newMsg(WithMaxBlockSize(minMaxBlockSize - 1))
+	require.NotNil(t, err)
+	_, err = newMsg(WithMaxBlockSize(maxMaxBlockSize + 1))
+	require.NotNil(t, err)
+
+	args := Arguments{{Name: "data", Value: []byte("genesis")}}
+	other := darc.NewSignerEd25519(nil, nil)
+	msg, err = newMsg(WithSpawn("dummy", args, signer), WithSpawn("dummy", args, signer, other))
+	require.Nil(t, err)
+	instrs := msg.SpawnTransaction.Instructions
+	require.Equal(t, 2, len(instrs))
+	require.Equal(t, "dummy", instrs[0].Spawn.ContractID)
+	require.Equal(t, args, instrs[0].Spawn.Args)
+	require.Equal(t, NewInstanceID(msg.GenesisDarc.GetBaseID()), instrs[0].InstanceID)
+	require.Equal(t, []uint64{1}, instrs[0].SignerCounter)
+	require.Equal(t, []uint64{2, 1}, instrs[1].SignerCounter)
+	require.Equal(t, instrs.Hash(), msg.SpawnTransaction.InstructionsHash)
+	require.Equal(t, 1, len(instrs[0].Signatures))
+	require.Equal(t, 2, len(instrs[1].Signatures))
+	_, err = newMsg(WithSpawn("", args, signer))
+	require.NotNil(t, err)
+	_, err = newMsg(WithSpawn("dummy", args))
+	require.NotNil(t, err)
+}
+
+func TestClient_NewLedgerWithSpawn(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	value := []byte("genesis")
+	newMsg := func(spawner darc.Signer, contractID string) *CreateGenesisBlock {
+		msg, err := NewGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"},
+			signer.Identity(), WithBlockInterval(100*time.Millisecond),
+			WithSpawn(contractID, Arguments{{Name: "data", Value: value}}, spawner))
+		require.Nil(t, err)
+		return msg
+	}
+	msg := newMsg(signer, "dummy")
+
+	c, csr, err := NewLedger(msg, false)
+	require.Nil(t, err)
+
+	// The instance must be available right after the genesis block.
+	newID := msg.SpawnTransaction.Instructions[0].Hash()
+	p, err := c.GetProof(newID)
+	require.Nil(t, err)
+	require.True(t, p.Proof.InclusionProof.Match(newID))
+	require.Nil(t, p.Proof.Verify(csr.Skipblock.SkipChainID()))
+	_, v0, cid, _, err := p.Proof.KeyValue()
+	require.Nil(t, err)
+	require.Equal(t, "dummy", cid)
+	require.Equal(t, value, v0)
+
+	// Unknown contracts must make the genesis block fail.
+	_, _, err = NewLedger(newMsg(signer, "unknown"), false)
+	require.NotNil(t, err)
+
+	// The spawns are verified against the genesis darc.
+	_, _, err = NewLedger(newMsg(darc.NewSignerEd25519(nil, nil), "dummy"), false)
+	require.NotNil(t, err)
+	msg = newMsg(signer, "dummy")
+	msg.SpawnTransaction.Instructions[0].Signatures = nil
+	_, _, err = NewLedger(msg, false)
+	require.NotNil(t, err)
+	msg = newMsg(signer, "dummy")
+	msg.SpawnTransaction.Instructions[0].Spawn.Args[0].Value = []byte("other")
+	msg.SpawnTransaction.InstructionsHash = msg.SpawnTransaction.Instructions.Hash()
+	_, _, err = NewLedger(msg, false)
+	require.NotNil(t, err)
+
+	// Only spawns on the genesis darc can be added to the genesis block.
+	msg = newMsg(signer, "dummy")
+	msg.SpawnTransaction.Instructions[0].InstanceID = ConfigInstanceID
+	_, _, err = NewLedger(msg, false)
+	require.NotNil(t, err)
+}
+
+func TestNewGenesisMsg_Admins(t *testing.T) {
+	l := onet.NewLocalTest(cothority.Suite)
+	_, roster, _ := l.GenTree(1, false)
+	defer l.CloseAll()
+	var ids []darc.Identity
+	var strs []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, darc.NewSignerEd25519(nil, nil).Identity())
+		strs = append(strs, ids[i].String())
+	}
+	newMsg := func(opts ...GenesisOption) (*CreateGenesisBlock, error) {
+		return NewGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy", "spawn:other"},
+			ids[0], opts...)
+	}
+
+	msg, err := newMsg(WithAdmins(AnyAdmin, ids...))
+	require.Nil(t, err)
+	rules := msg.GenesisDarc.Rules
+	require.Equal(t, expression.InitOrExpr(strs...), rules.Get("spawn:dummy"))
+	require.Equal(t, expression.InitOrExpr(strs...), rules.Get(invokeEvolve))
+	require.Equal(t, expression.InitOrExpr(strs...), rules.GetSignExpr())
+	require.NotEqual(t, rules.Get("spawn:dummy"), rules.Get("invoke:view_change"))
+
+	msg, err = newMsg(WithAdmins(AllAdmins, append(ids, ids[0])...))
+	require.Nil(t, err)
+	require.Equal(t, expression.InitAndExpr(strs...), msg.GenesisDarc.Rules.Get("spawn:dummy"))
+
+	msg, err = newMsg(WithAdmins(2, ids...))
+	require.Nil(t, err)
+	require.Equal(t, "threshold<2:3>("+strings.Join(strs, ",")+")",
+		string(msg.GenesisDarc.Rules.Get("spawn:dummy")))
+
+	// A rule that has been given another expression is kept.
+	other := expression.Expr(darc.NewSignerEd25519(nil, nil).Identity().String())
+	msg, err = newMsg(func(m *genesisMsg) error {
+		return m.GenesisDarc.Rules.UpdateRule("spawn:other", other)
+	}, WithAdmins(AnyAdmin, ids...))
+	require.Nil(t, err)
+	require.Equal(t, expression.InitOrExpr(strs...), msg.GenesisDarc.Rules.Get("spawn:dummy"))
+	require.Equal(t, other, msg.GenesisDarc.Rules.Get("spawn:other"))
+
+	_, err = newMsg(WithAdmins(AnyAdmin))
+	require.NotNil(t, err)
+	_, err = newMsg(WithAdmins(4, ids...))
+	require.NotNil(t, err)
+	_, err = newMsg(WithAdmins(-1, ids...))
+	require.NotNil(t, err)
+}
+
+func TestClient_NewLedgerAdmins(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	var admins []darc.Signer
+	var ids []darc.Identity
+	for i := 0; i < 3; i++ {
+		admins = append(admins, darc.NewSignerEd25519(nil, nil))
+		ids = append(ids, admins[i].Identity())
+	}
+	msg, err := NewGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"},
+		ids[0], WithBlockInterval(100*time.Millisecond), WithAdmins(2, ids...))
+	require.Nil(t, err)
+	c, _, err := NewLedger(msg, false)
+	require.Nil(t, err)
+	gID := NewInstanceID(msg.GenesisDarc.GetBaseID())
+	args := Arguments{{Name: "data", Value: []byte("admins")}}
+
+	// One admin is not enough.
+	_, _, err = NewTxBuilder(c).Spawn(gID, dummyContract, args, admins[0]).
+		SignAndSubmit(darc.Signer{}, 10)
+	require.NotNil(t, err)
+
+	// Two admins are.
+	_, _, err = NewTxBuilder(c).Spawn(gID, dummyContract, args, admins[0], admins[2]).
+		SignAndSubmit(darc.Signer{}, 10)
+	require.Nil(t, err)
+}
+
+func TestClient_FetchChainConfig(t *testing.T) {
+	s := newSerN(t, 1, 100*time.Millisecond, 4, false)
+	defer s.local.CloseAll()
+	c := s.client()
+
+	config, err := c.FetchChainConfig()
+	require.Nil(t, err)
+	require.True(t, config.Roster.ID.Equal(s.roster.ID))
+	require.Equal(t, s.interval, config.BlockInterval)
+	require.Equal(t, int(defaultMaxBlockSize), config.MaxBlockSize)
+
+	// Change the leader of the chain.
+	newRoster := onet.NewRoster([]*network.ServerIdentity{
+		s.roster.List[1], s.roster.List[2], s.roster.List[3], s.roster.List[0]})
+	config.Roster = *newRoster
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	_, _, err = NewTxBuilder(c).Invoke(NewInstanceID(nil), "update_config",
+		Arguments{{Name: "config", Value: configBuf}}).SignAndSubmit(s.signer, 10)
+	require.Nil(t, err)
+
+	config, err = c.FetchChainConfig()
+	require.Nil(t, err)
+	require.True(t, config.Roster.ID.Equal(newRoster.ID))
+	require.True(t, c.Roster().List[0].Equal(s.roster.List[1]))
+	_, err = c.GetProof(NewInstanceID(nil).Slice())
+	require.Nil(t, err)
+
+	// A proof older than the block of the current s.roster is refused.
+	index := c.configIndex
+	c.configIndex = index + 100
+	_, err = c.FetchChainConfig()
+	require.NotNil(t, err)
+	require.True(t, c.Roster().ID.Equal(newRoster.ID))
+	c.configIndex = index
+
+	// A client whose first node is gone refreshes its s.roster, but only
+	// once more than half of the requests of the window failed.
+	dead := network.NewServerIdentity(cothority.Suite.Point().Pick(cothority.Suite.RandomStream()),
+		network.NewAddress(network.PlainTCP, "127.0.0.1:1"))
+	oldRoster := onet.NewRoster(append([]*network.ServerIdentity{dead}, s.roster.List...))
+	c2 := NewClient(c.ID, *oldRoster)
+	for i := 0; i <= rosterRefreshWindow/2; i++ {
+		require.True(t, c2.Roster().ID.Equal(oldRoster.ID))
+		_, err = c2.GetProof(NewInstanceID(nil).Slice())
+		require.NotNil(t, err)
+	}
+	require.True(t, c2.Roster().ID.Equal(newRoster.ID))
+	_, err = c2.GetProof(NewInstanceID(nil).Slice())
+	require.Nil(t, err)
+}
+
+func TestClient_RecordRequest(t *testing.T) {
+	c := NewClient(nil, onet.Roster{})
+	record := func(outcomes ...bool) (refresh bool) {
+		for _, failed := range outcomes {
+			refresh = c.recordRequest(failed)
+		}
+		return
+	}
+
+	// Half of the requests failing is not enough.
+	require.False(t, record(true, false, true, false, true, false))
+	require.False(t, record(true, false, true, false, true, false))
+
+	// Failures that are not consecutive count.
+	require.True(t, record(true, true, false, true))
+
+	// Only the requests of the window count.
+	c.SetRoster(onet.Roster{})
+	require.False(t, record(true, true, true))
+	require.False(t, record(false, false, false, false, false, false))
+	require.False(t, record(true, true, true))
+	require.True(t, record(true))
+}
+
+func TestClient_VerifyProof(t *testing.T) {
+	s := newSerN(t, 1, 100*time.Millisecond, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	p, err := c.GetProof(NewInstanceID(nil).Slice())
+	require.Nil(t, err)
+	require.Nil(t, c.verifyProof(&p.Proof))
+
+	// A conode that makes up a chain of its own, starting with a first
+	// link that gives its own s.roster to the genesis block.
+	memTrie, err := trie.NewTrie(trie.NewMemDB(), []byte("nonce"))
+	require.Nil(t, err)
+	st := &stateTrie{Trie: *memTrie}
+	require.Nil(t, st.StoreAll(StateChanges{{
+		StateAction: Create,
+		InstanceID:  NewInstanceID(nil).Slice(),
+		ContractID:  []byte(ContractConfigID),
+		Value:       []byte("forged"),
+	}}, 1))
+	pr, err := st.GetProof(NewInstanceID(nil).Slice())
+	require.Nil(t, err)
+	fakeRoster, fakePrivs := genRoster(1)
+	from := skipchain.NewSkipBlock()
+	from.Roster = fakeRoster
+	from.Hash = c.ID
+	latest := skipchain.NewSkipBlock()
+	latest.Index = 1
+	latest.Roster = fakeRoster
+	latest.GenesisID = c.ID
+	latest.Data, err = protobuf.Encode(&DataHeader{TrieRoot: st.GetRoot()})
+	require.Nil(t, err)
+	latest.Hash = latest.CalculateHash()
+	forged := Proof{
+		InclusionProof: *pr,
+		Links: []skipchain.ForwardLink{
+			{From: []byte{}, To: c.ID, NewRoster: fakeRoster},
+			*genForwardLink(t, from, latest, fakePrivs)[0],
+		},
+		Latest: *latest,
+	}
+	require.Nil(t, forged.Verify(c.ID))
+	err = c.verifyProof(&forged)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "proof does not verify against chain")
+
+	// The genesis block must be the one of the ID.
+	c2 := NewClient(skipchain.SkipBlockID("unknown"), *s.roster)
+	_, err = c2.GenesisBlock()
+	require.NotNil(t, err)
+}
+
+func TestClient_TxRejected(t *testing.T) {
+	s := newSerN(t, 1, 100*time.Millisecond, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	dID := NewInstanceID(s.darc.GetBaseID())
+
+	// The second instruction is signed by someone who is not allowed to
+	// spawn dummy instances.
+	other := darc.NewSignerEd25519(nil, nil)
+	ctx, err := NewTxBuilder(c).
+		Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte{1}}}).
+		Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte{2}}}, other).
+		Sign(s.signer)
+	require.Nil(t, err)
+	_, err = c.AddTransactionAndWait(*ctx, 10)
+	require.NotNil(t, err)
+	rejected, ok := err.(*TxRejectedError)
+	require.True(t, ok, "wrong error type: %v", err)
+	require.Equal(t, 1, rejected.InstructionIndex)
+	require.Contains(t, rejected.Reason, "spawn:dummy")
+	require.Contains(t, err.Error(), "instruction 1")
+
+	status, err := c.GetTxStatus(ctx.Instructions.Hash())
+	require.Nil(t, err)
+	require.True(t, status.Included)
+	require.False(t, status.Accepted)
+
+	// An accepted transaction is reported as such.
+	ctx, err = NewTxBuilder(c).
+		Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte{3}}}).
+		Sign(s.signer)
+	require.Nil(t, err)
+	_, err = c.AddTransactionAndWait(*ctx, 10)
+	require.Nil(t, err)
+	status, err = c.GetTxStatus(ctx.Instructions.Hash())
+	require.Nil(t, err)
+	require.True(t, status.Included)
+	require.True(t, status.Accepted)
+
+	// Unknown transactions are not included.
+	status, err = c.GetTxStatus([]byte("unknown"))
+	require.Nil(t, err)
+	require.False(t, status.Included)
+}
+
+func TestClient_FillSignersAndSignWith(t *testing.T) {
+	s := newSerN(t, 1, 100*time.Millisecond, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	dID := NewInstanceID(s.darc.GetBaseID())
+
+	// The counters are fetched from the ledger for every transaction.
+	for i := byte(0); i < 2; i++ {
+		ctx := ClientTransaction{Instructions: Instructions{
+			{InstanceID: dID, Spawn: &Spawn{ContractID: dummyContract,
+				Args: Arguments{{Name: "data", Value: []byte{i, 1}}}}},
+			{InstanceID: dID, Spawn: &Spawn{ContractID: dummyContract,
+				Args: Arguments{{Name: "data", Value: []byte{i, 2}}}}},
+		}}
+		require.Nil(t, ctx.FillSignersAndSignWith(c, s.signer))
+		_, err := c.AddTransactionAndWait(ctx, 10)
+		require.Nil(t, err)
+	}
+	ctrs, err := c.GetSignerCounters(s.signer.Identity().String())
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), ctrs.Counters[0])
+}
+
+func TestClient_AddTransactionWithRetry(t *testing.T) {
+	s := newSerN(t, 1, testInterval, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	dID := NewInstanceID(s.darc.GetBaseID())
+
+	// Slow transactions are spread over more than one block, so waiting
+	// for one block isn't enough for the last transaction.
+	b := NewTxBuilder(c)
+	for i := byte(0); i < 5; i++ {
+		ctx, err := b.Spawn(dID, slowContract, Arguments{{Name: "data", Value: []byte{i}}}).
+			Sign(s.signer)
+		require.Nil(t, err)
+		_, err = c.AddTransaction(*ctx)
+		require.Nil(t, err)
+	}
+	ctx, err := b.Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte{5}}}).
+		Sign(s.signer)
+	require.Nil(t, err)
+	_, err = c.AddTransactionWithRetry(*ctx, 1, 10)
+	require.Nil(t, err)
+
+	// The transaction must have been applied once.
+	ctrs, err := c.GetSignerCounters(s.signer.Identity().String())
+	require.Nil(t, err)
+	require.Equal(t, uint64(6), ctrs.Counters[0])
+	status, err := c.GetTxStatus(ctx.Instructions.Hash())
+	require.Nil(t, err)
+	require.True(t, status.Accepted)
+	included, err := c.txIncluded(*ctx)
+	require.Nil(t, err)
+	require.True(t, included)
+
+	// A transaction that has not been sent is not included.
+	notSent, err := b.Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte{6}}}).
+		Sign(s.signer)
+	require.Nil(t, err)
+	included, err = c.txIncluded(*notSent)
+	require.Nil(t, err)
+	require.False(t, included)
+
+	// If the counter is used by another transaction, the outcome is unknown.
+	other, _, err := NewTxBuilder(c).
+		Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte{7}}}).
+		SignAndSubmit(s.signer, 10)
+	require.Nil(t, err)
+	require.Equal(t, notSent.Instructions[0].SignerCounter, other.Instructions[0].SignerCounter)
+	_, err = c.txIncluded(*notSent)
+	require.Equal(t, ErrUnknownOutcome, err)
+	_, err = c.AddTransactionWithRetry(*notSent, 1, 3)
+	require.NotNil(t, err)
+	ctrs, err = c.GetSignerCounters(s.signer.Identity().String())
+	require.Nil(t, err)
+	require.Equal(t, uint64(7), ctrs.Counters[0])
+}
+
+func TestClient_GetProofAt(t *testing.T) {
+	s := newSerN(t, 1, 100*time.Millisecond, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	dID := NewInstanceID(s.darc.GetBaseID())
+
+	// Spawn an instance, then update the config and remove the instance.
+	ctx, _, err := NewTxBuilder(c).
+		Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte{1}}}).
+		SignAndSubmit(s.signer, 10)
+	require.Nil(t, err)
+	dummyID := NewInstanceID(ctx.Instructions[0].Hash())
+	p, err := c.GetProof(dummyID.Slice())
+	require.Nil(t, err)
+	spawnIndex := p.Proof.Latest.Index
+
+	config, err := c.FetchChainConfig()
+	require.Nil(t, err)
+	config.BlockInterval = 200 * time.Millisecond
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	_, _, err = NewTxBuilder(c).
+		Invoke(ConfigInstanceID, "update_config", Arguments{{Name: "config", Value: configBuf}}).
+		Delete(dummyID).
+		SignAndSubmit(s.signer, 10)
+	require.Nil(t, err)
+	p, err = c.GetProof(ConfigInstanceID.Slice())
+	require.Nil(t, err)
+	updateIndex := p.Proof.Latest.Index
+	require.True(t, updateIndex > spawnIndex)
+
+	// Both proofs are valid and show the state at their block.
+	for _, index := range []int{spawnIndex, updateIndex} {
+		p, err := c.GetProofAt(ConfigInstanceID, index)
+		require.Nil(t, err)
+		require.Equal(t, index, p.Proof.Latest.Index)
+		require.Nil(t, p.Proof.Verify(c.ID))
+		_, value, _, _, err := VerifyProofOffline(s.genesis, p.Proof)
+		require.Nil(t, err)
+		var cc ChainConfig
+		require.Nil(t, protobuf.DecodeWithConstructors(value, &cc, network.DefaultConstructors(cothority.Suite)))
+		if index == spawnIndex {
+			require.Equal(t, s.interval, cc.BlockInterval)
+		} else {
+			require.Equal(t, config.BlockInterval, cc.BlockInterval)
+		}
+
+		p, err = c.GetProofAt(dummyID, index)
+		require.Nil(t, err)
+		require.Nil(t, p.Proof.Verify(c.ID))
+		require.Equal(t, index == spawnIndex, p.Proof.InclusionProof.Match(dummyID.Slice()))
+	}
+
+	_, err = c.GetProofAt(dummyID, updateIndex+10)
+	require.NotNil(t, err)
+
+	// Blocks older than the retention horizon are refused.
+	for _, service := range s.services {
+		service.SetProofRetention(updateIndex - spawnIndex - 1)
+	}
+	_, err = c.GetProofAt(dummyID, spawnIndex)
+	require.Equal(t, ErrProofTooOld, err)
+	_, err = c.GetProofAt(dummyID, updateIndex)
+	require.Nil(t, err)
+}
+
+func TestClient_GetPendingTransactions(t *testing.T) {
+	// With a long block interval, the transactions stay in the buffer of
+	// the leader for some time.
+	s := newSerN(t, 1, 5*time.Second, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	dID := NewInstanceID(s.darc.GetBaseID())
+	leader := s.service()
+	require.NotNil(t, leader.SetMaxPendingTransactions(0))
+	require.Nil(t, leader.SetMaxPendingTransactions(2))
+
+	// The third transaction is refused, the first two are kept.
+	b := NewTxBuilder(nil)
+	b.counters[s.signer.Identity().String()] = 0
+	other := darc.NewSignerEd25519(nil, nil)
+	b.counters[other.Identity().String()] = 0
+	var ctxs []*ClientTransaction
+	for i, s := range []darc.Signer{other, s.signer, s.signer} {
+		ctx, err := b.Spawn(dID, dummyContract,
+			Arguments{{Name: "data", Value: []byte{byte(i)}}}).Sign(s)
+		require.Nil(t, err)
+		_, err = c.AddTransaction(*ctx)
+		if i < 2 {
+			require.Nil(t, err)
+		} else {
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), "buffer is full")
+		}
+		ctxs = append(ctxs, ctx)
+	}
+
+	priv := s.local.GetPrivate(s.hosts[0])
+	resp, err := c.GetPendingTransactions(s.roster.List[0], priv)
+	require.Nil(t, err)
+	require.Equal(t, 2, resp.Size)
+	require.Equal(t, 2, resp.MaxSize)
+	require.Equal(t, 1, resp.Dropped)
+	require.True(t, resp.OldestAge > 0)
+	require.Equal(t, 2, len(resp.Transactions))
+	for i, pt := range resp.Transactions {
+		require.Equal(t, ctxs[i].Instructions.Hash(), pt.TxHash)
+		require.Equal(t, []InstanceID{dID}, pt.InstanceIDs)
+	}
+	require.Equal(t, []string{other.Identity().String()}, resp.Transactions[0].Signers)
+	require.Equal(t, []string{s.signer.Identity().String()}, resp.Transactions[1].Signers)
+	require.True(t, resp.Transactions[0].Arrival <= resp.Transactions[1].Arrival)
+
+	// Only the node itself can ask.
+	_, err = c.GetPendingTransactions(s.roster.List[0], s.local.GetPrivate(s.hosts[1]))
+	require.NotNil(t, err)
+
+	// A signature on the request without the name of the request is
+	// refused.
+	req := &GetPendingTransactions{
+		Version:     CurrentVersion,
+		SkipChainID: c.ID,
+		Timestamp:   time.Now().UnixNano(),
+	}
+	h := sha256.New()
+	h.Write(req.SkipChainID)
+	binary.Write(h, binary.LittleEndian, req.Timestamp)
+	req.Signature, err = schnorr.Sign(cothority.Suite, priv, h.Sum(nil))
+	require.Nil(t, err)
+	require.NotNil(t, c.SendProtobuf(s.roster.List[0], req, &GetPendingTransactionsResponse{}))
+
+	// Once the transactions are included, the buffer is empty.
+	_, err = c.WaitProof(NewInstanceID(ctxs[1].Instructions[0].Hash()), 2*s.interval, nil)
+	require.Nil(t, err)
+	resp, err = c.GetPendingTransactions(s.roster.List[0], priv)
+	require.Nil(t, err)
+	require.Equal(t, 0, resp.Size)
+	require.Equal(t, 0, len(resp.Transactions))
+	require.Equal(t, 1, resp.Dropped)
+}
+
+func TestClient_ECDSASigner(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	signer, err := darc.NewSignerECDSA(nil, nil)
+	require.Nil(t, err)
+	msg, err := DefaultGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"}, signer.Identity())
+	require.Nil(t, err)
+	msg.BlockInterval = 100 * time.Millisecond
+	d := msg.GenesisDarc
+	require.Contains(t, string(d.Rules.Get("spawn:dummy")), "ecdsa:")
+	c, _, err := NewLedger(msg, false)
+	require.Nil(t, err)
+
+	value := []byte{5, 6, 7, 8}
+	tx, err := createOneClientTx(d.GetBaseID(), "dummy", value, signer)
+	require.Nil(t, err)
+	_, err = c.AddTransactionAndWait(tx, 10)
+	require.Nil(t, err)
+	p, err := c.GetProof(tx.Instructions[0].Hash())
+	require.Nil(t, err)
+	require.True(t, p.Proof.InclusionProof.Match(tx.Instructions[0].Hash()))
+
+	// A transaction signed by another key is refused.
+	other, err := darc.NewSignerECDSA(nil, nil)
+	require.Nil(t, err)
+	tx, err = createOneClientTx(d.GetBaseID(), "dummy", value, other)
+	require.Nil(t, err)
+	_, err = c.AddTransactionAndWait(tx, 10)
+	require.NotNil(t, err)
+}
+
+type unavailableBackend struct {
+	public kyber.Point
+}
+
+func (u unavailableBackend) Public() kyber.Point {
+	return u.public
+}
+
+func (u unavailableBackend) Sign(msg []byte) ([]byte, error) {
+	return nil, errors.New("hsm unavailable")
+}
+
+func TestClient_BackendSigner(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	kp := key.NewKeyPair(cothority.Suite)
+	signer := darc.NewSignerBackend(darc.NewMemoryBackend(kp.Public, kp.Private))
+	msg, err := DefaultGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"}, signer.Identity())
+	require.Nil(t, err)
+	msg.BlockInterval = 100 * time.Millisecond
+	d := msg.GenesisDarc
+	c, _, err := NewLedger(msg, false)
+	require.Nil(t, err)
+
+	value := []byte{5, 6, 7, 8}
+	tx, err := createOneClientTx(d.GetBaseID(), "dummy", value, signer)
+	require.Nil(t, err)
+	_, err = c.AddTransactionAndWait(tx, 10)
+	require.Nil(t, err)
+	p, err := c.GetProof(tx.Instructions[0].Hash())
+	require.Nil(t, err)
+	require.True(t, p.Proof.InclusionProof.Match(tx.Instructions[0].Hash()))
+
+	// The error of an unavailable backend is returned by SignWith.
+	signer = darc.NewSignerBackend(unavailableBackend{kp.Public})
+	instr := createInstr(d.GetBaseID(), "dummy", "data", value)
+	err = instr.SignWith([]byte("digest"), signer)
+	require.IsType(t, &darc.BackendError{}, err)
+	require.Contains(t, err.Error(), "hsm unavailable")
+}
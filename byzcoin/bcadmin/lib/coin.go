@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/protobuf"
+)
+
+// Balance is the state of a coin account, as returned by GetBalance.
+type Balance struct {
+	// Address is the instance ID of the account, in hex.
+	Address string `json:"address"`
+	// Exists is false if no account has been spawned at Address yet.
+	Exists bool `json:"exists"`
+	// Coin is the name of the coin, in hex, if the account exists.
+	Coin    string `json:"coin,omitempty"`
+	Balance uint64 `json:"balance"`
+	// Darc is the ID of the darc of the account, in hex, if it exists.
+	Darc string `json:"darc,omitempty"`
+}
+
+// GetBalance gets the proof of the coin account at id from ByzCoin and
+// returns its balance. The proof is verified against the genesis block, also
+// if it shows that the account doesn't exist. An error is returned if the
+// proof doesn't verify or if the instance is not a coin account.
+func GetBalance(cl *byzcoin.Client, id byzcoin.InstanceID) (*Balance, error) {
+	genesis, err := cl.GenesisBlock()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cl.GetProof(id.Slice())
+	if err != nil {
+		return nil, err
+	}
+	p := &reply.Proof
+	if err = verifyProof(genesis, p); err != nil {
+		return nil, fmt.Errorf("proof does not verify against chain %x: %v", genesis.Hash, err)
+	}
+	b := &Balance{Address: hex.EncodeToString(id.Slice())}
+	if !p.InclusionProof.Match(id.Slice()) {
+		return b, nil
+	}
+	value, contractID, darcID, err := p.Get(id.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if contractID != contracts.ContractCoinID {
+		return nil, fmt.Errorf("instance %x is not a coin account but a %s", id.Slice(), contractID)
+	}
+	var coin byzcoin.Coin
+	if err = protobuf.Decode(value, &coin); err != nil {
+		return nil, fmt.Errorf("couldn't decode coin account: %v", err)
+	}
+	b.Exists = true
+	b.Coin = hex.EncodeToString(coin.Name.Slice())
+	b.Balance = coin.Value
+	b.Darc = hex.EncodeToString(darcID)
+	return b, nil
+}
+
+// verifyProof verifies the proof against the trusted genesis block, like
+// byzcoin.VerifyProofOffline, but also accepts proofs of absence.
+func verifyProof(genesis *skipchain.SkipBlock, p *byzcoin.Proof) error {
+	// Proof.Verify takes the roster of the genesis block from the first
+	// link, so it must be the trusted one.
+	if len(p.Links) == 0 || p.Links[0].NewRoster == nil ||
+		!p.Links[0].To.Equal(genesis.Hash) {
+		return byzcoin.ErrorVerifySkipchain
+	}
+	r := onet.NewRoster(p.Links[0].NewRoster.List)
+	if r == nil || !r.ID.Equal(genesis.Roster.ID) {
+		return byzcoin.ErrorVerifySkipchain
+	}
+	return p.Verify(genesis.SkipChainID())
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBalance(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:coin", "invoke:mint"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	// An account that is spawned for a public key and gets some coins.
+	pub, err := signer.Ed25519.Point.MarshalBinary()
+	require.Nil(t, err)
+	id := contracts.CoinHash(pub)
+	coins := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coins, 42)
+	_, _, err = byzcoin.NewTxBuilder(cl).
+		Spawn(byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID()), contracts.ContractCoinID,
+			byzcoin.Arguments{{Name: "public", Value: pub}}).
+		Invoke(id, "mint", byzcoin.Arguments{{Name: "coins", Value: coins}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+
+	b, err := GetBalance(cl, id)
+	require.Nil(t, err)
+	require.True(t, b.Exists)
+	require.Equal(t, uint64(42), b.Balance)
+	require.Equal(t, hex.EncodeToString(id.Slice()), b.Address)
+	require.Equal(t, hex.EncodeToString(contracts.CoinName.Slice()), b.Coin)
+	require.Equal(t, hex.EncodeToString(msg.GenesisDarc.GetBaseID()), b.Darc)
+
+	// An account that has never been spawned.
+	other, err := darc.NewSignerEd25519(nil, nil).Ed25519.Point.MarshalBinary()
+	require.Nil(t, err)
+	b, err = GetBalance(cl, contracts.CoinHash(other))
+	require.Nil(t, err)
+	require.False(t, b.Exists)
+	require.Equal(t, uint64(0), b.Balance)
+
+	// An instance that is not a coin account.
+	_, err = GetBalance(cl, byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID()))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not a coin account")
+
+	// A proof that doesn't come from the genesis block.
+	reply, err := cl.GetProof(id.Slice())
+	require.Nil(t, err)
+	genesis, err := cl.GenesisBlock()
+	require.Nil(t, err)
+	require.Nil(t, verifyProof(genesis, &reply.Proof))
+	reply.Proof.Links[0].NewRoster = onet.NewRoster(roster.List[:2])
+	require.Equal(t, byzcoin.ErrorVerifySkipchain, verifyProof(genesis, &reply.Proof))
+}
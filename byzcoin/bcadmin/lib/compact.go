@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// compactVersion is the version of the encoding of the compact configs.
+const compactVersion = 1
+
+// compactChecksumLen is the number of bytes of the checksum appended to the
+// compact configs.
+const compactChecksumLen = 4
+
+type compactConfig struct {
+	Version       uint32
+	ByzCoinID     skipchain.SkipBlockID
+	Servers       []compactServer
+	GenesisDarcID darc.ID
+}
+
+type compactServer struct {
+	Address network.Address
+	Public  []byte
+}
+
+// ExportCompact returns the config as a single line that can be sent in a
+// chat message or a QR code. It holds the ByzCoin ID, the addresses and
+// public keys of the roster and the base ID of the genesis darc, but not the
+// admin identity. ImportCompact decodes it.
+func ExportCompact(cfg Config) (string, error) {
+	cc := compactConfig{
+		Version:       compactVersion,
+		ByzCoinID:     cfg.ByzCoinID,
+		GenesisDarcID: cfg.GenesisDarc.GetBaseID(),
+	}
+	for _, si := range cfg.Roster.List {
+		pub, err := si.Public.MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		cc.Servers = append(cc.Servers, compactServer{si.Address, pub})
+	}
+	buf, err := protobuf.Encode(&cc)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(append(buf, sum[:compactChecksumLen]...)), nil
+}
+
+// ImportCompact returns the config encoded by ExportCompact, after checking
+// its checksum and its roster. As the compact config only holds the base ID
+// of the genesis darc, it is the only field set in the GenesisDarc of the
+// returned config: FetchCompact also fetches the darc itself.
+func ImportCompact(code string) (Config, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid code: %v", err)
+	}
+	if len(buf) <= compactChecksumLen {
+		return Config{}, errors.New("invalid code: too short")
+	}
+	payload, checksum := buf[:len(buf)-compactChecksumLen], buf[len(buf)-compactChecksumLen:]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:compactChecksumLen], checksum) {
+		return Config{}, errors.New("invalid code: wrong checksum")
+	}
+
+	var cc compactConfig
+	if err = protobuf.Decode(payload, &cc); err != nil {
+		return Config{}, fmt.Errorf("invalid code: %v", err)
+	}
+	if cc.Version != compactVersion {
+		return Config{}, fmt.Errorf("unsupported code version %d", cc.Version)
+	}
+	if len(cc.ByzCoinID) == 0 || len(cc.GenesisDarcID) == 0 {
+		return Config{}, errors.New("invalid code: missing ByzCoin ID or genesis darc")
+	}
+
+	var list []*network.ServerIdentity
+	for _, s := range cc.Servers {
+		pub := cothority.Suite.Point()
+		if err = pub.UnmarshalBinary(s.Public); err != nil {
+			return Config{}, fmt.Errorf("invalid public key for %v: %v", s.Address, err)
+		}
+		list = append(list, network.NewServerIdentity(pub, s.Address))
+	}
+	if err = checkRoster(list); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		Roster:    *onet.NewRoster(list),
+		ByzCoinID: cc.ByzCoinID,
+	}
+	cfg.GenesisDarc.BaseID = cc.GenesisDarcID
+	return cfg, nil
+}
+
+// FetchCompact returns the config encoded by ExportCompact, like
+// ImportCompact, with the genesis darc fetched from the roster of the config.
+// The darc must have the base ID given in the compact config.
+func FetchCompact(code string) (Config, error) {
+	cfg, err := ImportCompact(code)
+	if err != nil {
+		return Config{}, err
+	}
+	gd, err := byzcoin.NewClient(cfg.ByzCoinID, cfg.Roster).GetGenDarc()
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't get genesis darc: %v", err)
+	}
+	if !gd.GetBaseID().Equal(cfg.GenesisDarc.BaseID) {
+		return Config{}, fmt.Errorf("genesis darc is %x, but the code gives %x",
+			gd.GetBaseID(), cfg.GenesisDarc.BaseID)
+	}
+	cfg.GenesisDarc = *gd
+	return cfg, nil
+}
+
+// checkRoster verifies that the servers have valid addresses and that no
+// address or public key is used twice.
+func checkRoster(list []*network.ServerIdentity) error {
+	if len(list) == 0 {
+		return errors.New("empty roster")
+	}
+	for i, si := range list {
+		if !si.Address.Valid() {
+			return fmt.Errorf("invalid address %v", si.Address)
+		}
+		for _, other := range list[:i] {
+			if si.Address == other.Address {
+				return fmt.Errorf("duplicate address %v", si.Address)
+			}
+			if si.Public.Equal(other.Public) {
+				return fmt.Errorf("duplicate public key %v", si.Public)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	cfg := newTestConfig()
+	kp := key.NewKeyPair(cothority.Suite)
+	cfg.Roster.List = append(cfg.Roster.List,
+		network.NewServerIdentity(kp.Public, network.NewAddress(network.TLS, "127.0.0.1:7772")))
+
+	code, err := ExportCompact(cfg)
+	require.Nil(t, err)
+	cfg2, err := ImportCompact(code)
+	require.Nil(t, err)
+	require.Equal(t, cfg.ByzCoinID, cfg2.ByzCoinID)
+	require.Equal(t, cfg.GenesisDarc.GetBaseID(), cfg2.GenesisDarc.BaseID)
+	require.Equal(t, 2, len(cfg2.Roster.List))
+	for i, si := range cfg.Roster.List {
+		require.Equal(t, si.Address, cfg2.Roster.List[i].Address)
+		require.True(t, si.Public.Equal(cfg2.Roster.List[i].Public))
+	}
+
+	// Any change is detected by the checksum.
+	buf, err := base64.RawURLEncoding.DecodeString(code)
+	require.Nil(t, err)
+	buf[len(buf)/2] ^= 1
+	_, err = ImportCompact(base64.RawURLEncoding.EncodeToString(buf))
+	require.Contains(t, err.Error(), "wrong checksum")
+	_, err = ImportCompact(code[:len(code)-2])
+	require.NotNil(t, err)
+	_, err = ImportCompact("not a code")
+	require.NotNil(t, err)
+}
+
+// encodeCompact encodes cc like ExportCompact, so that invalid configs can
+// be created.
+func encodeCompact(t *testing.T, cc compactConfig) string {
+	buf, err := protobuf.Encode(&cc)
+	require.Nil(t, err)
+	sum := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(append(buf, sum[:compactChecksumLen]...))
+}
+
+func TestCompact_Roster(t *testing.T) {
+	cfg := newTestConfig()
+	pub, err := cfg.Roster.List[0].Public.MarshalBinary()
+	require.Nil(t, err)
+	server := compactServer{cfg.Roster.List[0].Address, pub}
+	cc := compactConfig{
+		Version:       compactVersion,
+		ByzCoinID:     cfg.ByzCoinID,
+		Servers:       []compactServer{server},
+		GenesisDarcID: cfg.GenesisDarc.GetBaseID(),
+	}
+	_, err = ImportCompact(encodeCompact(t, cc))
+	require.Nil(t, err)
+
+	cc.Version = compactVersion + 1
+	_, err = ImportCompact(encodeCompact(t, cc))
+	require.Contains(t, err.Error(), "unsupported code version")
+	cc.Version = compactVersion
+
+	cc.Servers = nil
+	_, err = ImportCompact(encodeCompact(t, cc))
+	require.Contains(t, err.Error(), "empty roster")
+
+	cc.Servers = []compactServer{{"127.0.0.1:7770", pub}}
+	_, err = ImportCompact(encodeCompact(t, cc))
+	require.Contains(t, err.Error(), "invalid address")
+
+	cc.Servers = []compactServer{server, server}
+	_, err = ImportCompact(encodeCompact(t, cc))
+	require.Contains(t, err.Error(), "duplicate address")
+
+	other := server
+	other.Address = network.NewAddress(network.TLS, "127.0.0.1:7772")
+	cc.Servers = []compactServer{server, other}
+	_, err = ImportCompact(encodeCompact(t, cc))
+	require.Contains(t, err.Error(), "duplicate public key")
+
+	other.Public = []byte("not a point")
+	cc.Servers = []compactServer{server, other}
+	_, err = ImportCompact(encodeCompact(t, cc))
+	require.Contains(t, err.Error(), "invalid public key")
+}
@@ -6,9 +6,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib/keystore"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet"
@@ -30,16 +32,25 @@ type Config struct {
 	AdminIdentity darc.Identity
 }
 
-// LoadKey returns the signer of a given identity. It searches it in the ConfigPath.
+// Keys is the keystore used to load and save the keys. If it is nil, the
+// keys are stored unencrypted in the ConfigPath.
+var Keys *keystore.Keystore
+
+// LoadKey returns the signer of a given identity. It searches it in the
+// keystore, or in the ConfigPath if there is none.
 func LoadKey(id darc.Identity) (*darc.Signer, error) {
-	// Find private key file.
-	fn := fmt.Sprintf("key-%s.cfg", id)
-	fn = filepath.Join(ConfigPath, fn)
-	return LoadSigner(fn)
+	return LoadKeyFromString(id.String())
 }
 
 // LoadKeyFromString returns a signer based on a string representing the public identity of the signer
 func LoadKeyFromString(id string) (*darc.Signer, error) {
+	if Keys != nil {
+		signer, err := Keys.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		return &signer, nil
+	}
 	// Find private key file.
 	fn := fmt.Sprintf("key-%s.cfg", id)
 	fn = filepath.Join(ConfigPath, fn)
@@ -63,8 +74,12 @@ func LoadSigner(fn string) (*darc.Signer, error) {
 	return &signer, err
 }
 
-// SaveKey stores a signer in a file.
+// SaveKey stores a signer in the keystore, or in a file in the ConfigPath if
+// there is no keystore.
 func SaveKey(signer darc.Signer) error {
+	if Keys != nil {
+		return Keys.Import(signer.Identity().String(), signer)
+	}
 	os.MkdirAll(ConfigPath, 0755)
 
 	fn := fmt.Sprintf("key-%s.cfg", signer.Identity())
@@ -92,8 +107,7 @@ func SaveKey(signer darc.Signer) error {
 func SaveConfig(cfg Config) (string, error) {
 	os.MkdirAll(ConfigPath, 0755)
 
-	fn := fmt.Sprintf("bc-%x.cfg", cfg.ByzCoinID)
-	fn = filepath.Join(ConfigPath, fn)
+	fn := ConfigFile(cfg.ByzCoinID)
 
 	buf, err := protobuf.Encode(&cfg)
 	if err != nil {
@@ -107,6 +121,84 @@ func SaveConfig(cfg Config) (string, error) {
 	return fn, nil
 }
 
+// ConfigFile returns the pathname used by SaveConfig for the config of the
+// given ByzCoin.
+func ConfigFile(byzcoinID skipchain.SkipBlockID) string {
+	return filepath.Join(ConfigPath, fmt.Sprintf("bc-%x.cfg", byzcoinID))
+}
+
+// StoredConfigs returns the pathnames of the configs stored by SaveConfig,
+// sorted by ByzCoin ID.
+func StoredConfigs() ([]string, error) {
+	return filepath.Glob(filepath.Join(ConfigPath, "bc-*.cfg"))
+}
+
+// FindConfig returns the pathname of the config given by bc, which is
+// either the pathname of a config file, the name of a chain registered with
+// SaveConfigAs, or a prefix of the hex-encoded ByzCoin ID of a config stored
+// in the ConfigPath. They are tried in this order, so an existing file wins
+// over a name, and a name over a prefix. As SaveConfigAs refuses names that
+// are prefixes of other stored chains, a name can only collide with a prefix
+// if such a chain is stored later; FindConfig then returns an error instead
+// of choosing one. If bc is empty, the default chain of the registry is
+// returned, or the only stored config if no chain is registered.
+func FindConfig(bc string) (string, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return "", err
+	}
+	files, err := StoredConfigs()
+	if err != nil {
+		return "", err
+	}
+	if bc == "" {
+		if e := reg.get(reg.Default); e != nil {
+			return ConfigFile(e.ByzCoinID), nil
+		}
+		switch len(files) {
+		case 0:
+			return "", errors.New("--bc flag is required")
+		case 1:
+			return files[0], nil
+		}
+		return "", errors.New("several chains are known, please choose one with --bc")
+	}
+	if _, err = os.Stat(bc); err == nil {
+		return bc, nil
+	}
+
+	found := matchPrefix(files, bc)
+	if e := reg.get(bc); e != nil {
+		fn := ConfigFile(e.ByzCoinID)
+		for _, f := range found {
+			if f != fn {
+				return "", fmt.Errorf("%v is the name of chain %x and a prefix of %v, "+
+					"please give the file or a longer prefix", bc, e.ByzCoinID, f)
+			}
+		}
+		return fn, nil
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no config file or chain found for %v", bc)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%v matches %d chains, please give a longer prefix", bc, len(found))
+}
+
+// matchPrefix returns the files of StoredConfigs whose ByzCoin ID starts
+// with prefix.
+func matchPrefix(files []string, prefix string) []string {
+	var found []string
+	for _, f := range files {
+		if strings.HasPrefix(strings.TrimPrefix(filepath.Base(f), "bc-"), prefix) {
+			found = append(found, f)
+		}
+	}
+	return found
+}
+
 // LoadConfig returns a config read from the file and an initialized
 // Client that can be used to communicate with ByzCoin.
 func LoadConfig(file string) (cfg Config, cl *byzcoin.Client, err error) {
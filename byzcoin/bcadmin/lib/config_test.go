@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bcadmin")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	oldPath := ConfigPath
+	ConfigPath = dir
+	defer func() { ConfigPath = oldPath }()
+
+	_, err = FindConfig("")
+	require.Contains(t, err.Error(), "--bc flag is required")
+
+	cfg1 := newTestConfig()
+	cfg1.ByzCoinID[0] = 0xaa
+	fn1, err := SaveConfig(cfg1)
+	require.Nil(t, err)
+	require.Equal(t, ConfigFile(cfg1.ByzCoinID), fn1)
+
+	// The only config is the default one.
+	fn, err := FindConfig("")
+	require.Nil(t, err)
+	require.Equal(t, fn1, fn)
+
+	cfg2 := newTestConfig()
+	cfg2.ByzCoinID[0] = 0xab
+	fn2, err := SaveConfig(cfg2)
+	require.Nil(t, err)
+	files, err := StoredConfigs()
+	require.Nil(t, err)
+	require.Equal(t, []string{fn1, fn2}, files)
+
+	_, err = FindConfig("")
+	require.Contains(t, err.Error(), "several chains")
+	fn, err = FindConfig(fn2)
+	require.Nil(t, err)
+	require.Equal(t, fn2, fn)
+	fn, err = FindConfig(fmt.Sprintf("%x", cfg1.ByzCoinID[:2]))
+	require.Nil(t, err)
+	require.Equal(t, fn1, fn)
+	_, err = FindConfig("a")
+	require.Contains(t, err.Error(), "matches 2 chains")
+	_, err = FindConfig("cc")
+	require.Contains(t, err.Error(), "no config file or chain found")
+}
@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// FetchConfig contacts the conode at addr and builds the config of the
+// ByzCoin ledger with the given ID. Nothing the conode returns is trusted
+// without verification: the genesis block must hash to byzcoinID and the
+// latest roster is found by following the forward links from the genesis
+// block to the latest block. The chain config and the genesis darc are then
+// fetched from this roster, with proofs that are verified against the
+// genesis block.
+//
+// The AdminIdentity of the returned config is not set, as the admin key is
+// not known.
+func FetchConfig(addr network.Address, byzcoinID skipchain.SkipBlockID) (Config, error) {
+	if !addr.Valid() {
+		return Config{}, fmt.Errorf("invalid address %v", addr)
+	}
+	if len(byzcoinID) == 0 {
+		return Config{}, errors.New("missing ByzCoin ID")
+	}
+	// The public key of the conode is not known, but it is not needed to
+	// send requests to it.
+	si := network.NewServerIdentity(cothority.Suite.Point().Null(), addr)
+	conode := onet.NewRoster([]*network.ServerIdentity{si})
+
+	scl := skipchain.NewClient()
+	genesis, err := scl.GetSingleBlock(conode, byzcoinID)
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't get genesis block: %v", err)
+	}
+	if genesis.SkipBlockFix == nil || genesis.Index != 0 ||
+		!genesis.Hash.Equal(byzcoinID) || !genesis.CalculateHash().Equal(byzcoinID) {
+		return Config{}, fmt.Errorf("conode didn't return the genesis block of ByzCoin %x", byzcoinID)
+	}
+	update, err := scl.GetUpdateChain(conode, byzcoinID)
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't get update chain: %v", err)
+	}
+	roster, err := followChain(genesis, update.Update)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cl := byzcoin.NewClient(byzcoinID, *roster)
+	configBuf, darcID, err := fetchValue(cl, genesis, byzcoin.NewInstanceID(nil).Slice(),
+		byzcoin.ContractConfigID)
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't get chain config: %v", err)
+	}
+	var config byzcoin.ChainConfig
+	err = protobuf.DecodeWithConstructors(configBuf, &config,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't decode chain config: %v", err)
+	}
+	darcBuf, _, err := fetchValue(cl, genesis, darcID, byzcoin.ContractDarcID)
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't get genesis darc: %v", err)
+	}
+	gd, err := darc.NewFromProtobuf(darcBuf)
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't decode genesis darc: %v", err)
+	}
+
+	return Config{
+		Roster:      config.Roster,
+		ByzCoinID:   byzcoinID,
+		GenesisDarc: *gd,
+	}, nil
+}
+
+// followChain verifies that the blocks go from the genesis block to the
+// latest block and returns the roster of the latest block. Every block after
+// the genesis block is verified with the forward link of the previous block,
+// signed by the roster of the previous block.
+func followChain(genesis *skipchain.SkipBlock, blocks []*skipchain.SkipBlock) (*onet.Roster, error) {
+	if len(blocks) == 0 || blocks[0] == nil || blocks[0].SkipBlockFix == nil ||
+		!blocks[0].Hash.Equal(genesis.Hash) || !blocks[0].CalculateHash().Equal(genesis.Hash) {
+		return nil, errors.New("update chain doesn't start with the genesis block")
+	}
+	// The genesis block of the update holds the forward links.
+	prev := blocks[0]
+	for _, next := range blocks[1:] {
+		if next == nil || next.SkipBlockFix == nil {
+			return nil, errors.New("empty block")
+		}
+		if !next.Hash.Equal(next.CalculateHash()) {
+			return nil, fmt.Errorf("wrong hash of block %d", next.Index)
+		}
+		if !next.SkipChainID().Equal(genesis.Hash) {
+			return nil, fmt.Errorf("block %d is from another skipchain", next.Index)
+		}
+		if next.Index <= prev.Index {
+			return nil, fmt.Errorf("block %d does not come after block %d", next.Index, prev.Index)
+		}
+		if next.Roster == nil {
+			return nil, fmt.Errorf("block %d has no roster", next.Index)
+		}
+		var link *skipchain.ForwardLink
+		for _, fl := range prev.ForwardLink {
+			if fl != nil && !fl.IsEmpty() && fl.From.Equal(prev.Hash) && fl.To.Equal(next.Hash) {
+				link = fl
+			}
+		}
+		if link == nil {
+			return nil, fmt.Errorf("no forward link from block %d to block %d", prev.Index, next.Index)
+		}
+		if err := link.Verify(cothority.Suite, prev.Roster.Publics()); err != nil {
+			return nil, fmt.Errorf("wrong forward link from block %d to block %d: %v",
+				prev.Index, next.Index, err)
+		}
+		prev = next
+	}
+	return prev.Roster, nil
+}
+
+// fetchValue gets the proof of the key from ByzCoin, verifies it against the
+// genesis block and returns the value and the darc ID of the instance, if it
+// is of the given contract.
+func fetchValue(cl *byzcoin.Client, genesis *skipchain.SkipBlock, key []byte, contract string) ([]byte, []byte, error) {
+	reply, err := cl.GetProof(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	k, value, contractID, darcID, err := byzcoin.VerifyProofOffline(genesis, &reply.Proof)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(k, key) {
+		return nil, nil, errors.New("proof is for another key")
+	}
+	if string(contractID) != contract {
+		return nil, nil, fmt.Errorf("expected contract to be %s but got: %s", contract, contractID)
+	}
+	return value, darcID, nil
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchConfig(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:darc"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	cfg, err := FetchConfig(roster.List[1].Address, cl.ID)
+	require.Nil(t, err)
+	require.True(t, cfg.ByzCoinID.Equal(cl.ID))
+	require.True(t, cfg.Roster.ID.Equal(roster.ID))
+	require.Equal(t, msg.GenesisDarc.GetID(), cfg.GenesisDarc.GetID())
+
+	_, err = FetchConfig(roster.List[1].Address, skipchain.SkipBlockID("unknown"))
+	require.NotNil(t, err)
+	_, err = FetchConfig("tcp://127.0.0.1", cl.ID)
+	require.Contains(t, err.Error(), "invalid address")
+}
+
+func TestFetchCompact(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:darc"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	code, err := ExportCompact(Config{
+		Roster:      *roster,
+		ByzCoinID:   cl.ID,
+		GenesisDarc: msg.GenesisDarc,
+	})
+	require.Nil(t, err)
+	cfg, err := FetchCompact(code)
+	require.Nil(t, err)
+	require.True(t, cfg.ByzCoinID.Equal(cl.ID))
+	require.Equal(t, msg.GenesisDarc.GetID(), cfg.GenesisDarc.GetID())
+
+	// The genesis darc must be the one of the code.
+	other := darc.NewDarc(darc.InitRules([]darc.Identity{signer.Identity()}, nil), []byte("other"))
+	code, err = ExportCompact(Config{
+		Roster:      *roster,
+		ByzCoinID:   cl.ID,
+		GenesisDarc: *other,
+	})
+	require.Nil(t, err)
+	_, err = FetchCompact(code)
+	require.Contains(t, err.Error(), "genesis darc is")
+}
+
+func TestFollowChain(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	scl := skipchain.NewClient()
+	genesis, err := scl.CreateGenesis(roster, 1, 1, skipchain.VerificationNone, nil, nil)
+	require.Nil(t, err)
+	_, err = scl.StoreSkipBlock(genesis, roster, []byte{1})
+	require.Nil(t, err)
+	update, err := scl.GetUpdateChain(roster, genesis.Hash)
+	require.Nil(t, err)
+	blocks := update.Update
+	require.Equal(t, 2, len(blocks))
+
+	r, err := followChain(genesis, blocks)
+	require.Nil(t, err)
+	require.True(t, r.ID.Equal(roster.ID))
+
+	_, err = followChain(genesis, blocks[1:])
+	require.Contains(t, err.Error(), "genesis block")
+
+	tampered := blocks[1].Copy()
+	tampered.Data = []byte{2}
+	tampered.Hash = tampered.CalculateHash()
+	_, err = followChain(genesis, []*skipchain.SkipBlock{blocks[0], tampered})
+	require.Contains(t, err.Error(), "no forward link")
+
+	// A forward link not signed by the roster of the genesis block.
+	other := blocks[0].Copy()
+	other.Roster = onet.NewRoster(roster.List[:2])
+	other.Hash = other.CalculateHash()
+	_, err = followChain(other, []*skipchain.SkipBlock{other, blocks[1]})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib/keystore"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// keyExportVersion is the version of the encoding of the exported keys.
+const keyExportVersion = 2
+
+type keyExport struct {
+	Version   uint32
+	Identity  string
+	ByzCoinID skipchain.SkipBlockID
+	Salt      []byte
+	Nonce     []byte
+	Box       []byte
+}
+
+// keyExportBox is encrypted in the Box of keyExport. It holds a copy of the
+// fields of keyExport that are in clear, so that they cannot be changed.
+type keyExportBox struct {
+	Identity  string
+	ByzCoinID skipchain.SkipBlockID
+	Signer    []byte
+}
+
+// ExportKey encrypts the signer with a key derived from passphrase, so that
+// it can be moved to another machine. The identity of the signer and the
+// ByzCoin ID it is used with are stored in clear, and encrypted with the
+// signer so that ImportKey can check them.
+func ExportKey(signer darc.Signer, byzcoinID skipchain.SkipBlockID, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	salt, err := keystore.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	sb, err := keystore.NewSecretBox(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	ke := keyExport{
+		Version:   keyExportVersion,
+		Identity:  signer.Identity().String(),
+		ByzCoinID: byzcoinID,
+		Salt:      salt,
+	}
+	kb := keyExportBox{
+		Identity:  ke.Identity,
+		ByzCoinID: ke.ByzCoinID,
+	}
+	if kb.Signer, err = protobuf.Encode(&signer); err != nil {
+		return nil, err
+	}
+	buf, err := protobuf.Encode(&kb)
+	if err != nil {
+		return nil, err
+	}
+	if ke.Nonce, ke.Box, err = sb.Seal(buf); err != nil {
+		return nil, err
+	}
+	return protobuf.Encode(&ke)
+}
+
+// ImportKey decrypts a signer exported with ExportKey. It returns an error if
+// the passphrase is wrong, if the signer has been exported for another
+// ByzCoin ID, or if the exported key has been modified.
+func ImportKey(buf []byte, byzcoinID skipchain.SkipBlockID, passphrase string) (*darc.Signer, error) {
+	var ke keyExport
+	if err := protobuf.Decode(buf, &ke); err != nil {
+		return nil, errors.New("couldn't decode exported key: " + err.Error())
+	}
+	if ke.Version != keyExportVersion {
+		return nil, fmt.Errorf("unsupported key version %d", ke.Version)
+	}
+	if !ke.ByzCoinID.Equal(byzcoinID) {
+		return nil, fmt.Errorf("key has been exported for ByzCoin %x", ke.ByzCoinID)
+	}
+	sb, err := keystore.NewSecretBox(passphrase, ke.Salt)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = sb.Open(ke.Nonce, ke.Box)
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	var kb keyExportBox
+	if err = protobuf.Decode(buf, &kb); err != nil {
+		return nil, errors.New("couldn't decode key: " + err.Error())
+	}
+	if kb.Identity != ke.Identity || !kb.ByzCoinID.Equal(ke.ByzCoinID) {
+		return nil, errors.New("identity or ByzCoin ID of the exported key doesn't match the encrypted ones")
+	}
+	var signer darc.Signer
+	err = protobuf.DecodeWithConstructors(kb.Signer, &signer,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't decode key: " + err.Error())
+	}
+	if signer.Identity().String() != ke.Identity {
+		return nil, errors.New("key doesn't match its identity")
+	}
+	return &signer, nil
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportKey(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	bcID := skipchain.SkipBlockID("bcid")
+
+	_, err := ExportKey(signer, bcID, "")
+	require.NotNil(t, err)
+	buf, err := ExportKey(signer, bcID, "secret")
+	require.Nil(t, err)
+	secret, err := signer.GetPrivate()
+	require.Nil(t, err)
+	secretBuf, err := secret.MarshalBinary()
+	require.Nil(t, err)
+	require.NotContains(t, string(buf), string(secretBuf))
+
+	signer2, err := ImportKey(buf, bcID, "secret")
+	require.Nil(t, err)
+	require.Equal(t, signer.Identity().String(), signer2.Identity().String())
+	secret2, err := signer2.GetPrivate()
+	require.Nil(t, err)
+	require.True(t, secret.Equal(secret2))
+
+	_, err = ImportKey(buf, bcID, "wrong")
+	require.Contains(t, err.Error(), "wrong passphrase")
+	_, err = ImportKey(buf, skipchain.SkipBlockID("other"), "secret")
+	require.Contains(t, err.Error(), "exported for ByzCoin")
+
+	// The identity and the ByzCoin ID in clear must match the encrypted
+	// ones.
+	var ke keyExport
+	require.Nil(t, protobuf.Decode(buf, &ke))
+	ke.Identity = darc.NewSignerEd25519(nil, nil).Identity().String()
+	changed, err := protobuf.Encode(&ke)
+	require.Nil(t, err)
+	_, err = ImportKey(changed, bcID, "secret")
+	require.Contains(t, err.Error(), "doesn't match")
+	require.Nil(t, protobuf.Decode(buf, &ke))
+	ke.ByzCoinID = skipchain.SkipBlockID("other")
+	changed, err = protobuf.Encode(&ke)
+	require.Nil(t, err)
+	_, err = ImportKey(changed, skipchain.SkipBlockID("other"), "secret")
+	require.Contains(t, err.Error(), "doesn't match")
+}
@@ -0,0 +1,322 @@
+// Package keystore stores the keys of the command line tools in a directory,
+// encrypted with a passphrase, so that the same identity can be used by all
+// of them. Every key is stored in its own file, named after its alias, and
+// the directory is locked while a Keystore is open.
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+const (
+	// storeFile holds the salt of the passphrase and a box to verify it.
+	storeFile = "keystore.cfg"
+	lockFile  = ".lock"
+	keySuffix = ".key"
+	// legacyPrefix is the prefix of the key files of bcadmin.
+	legacyPrefix = "key-"
+	// checkValue is encrypted in storeFile to verify the passphrase.
+	checkValue = "keystore"
+)
+
+// ErrWrongPassphrase is returned by Open if the passphrase does not decrypt
+// the keystore.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// ErrLocked is returned by Open if the keystore is already open.
+var ErrLocked = errors.New("keystore is locked by another process")
+
+// ErrEmptyPassphrase is returned by Open if the passphrase is empty.
+var ErrEmptyPassphrase = errors.New("the passphrase of the keystore cannot be empty")
+
+// Keystore holds the keys of a directory. It must be closed to release the
+// lock of the directory.
+type Keystore struct {
+	dir string
+	box *SecretBox
+}
+
+type storeHeader struct {
+	Salt  []byte
+	Nonce []byte
+	Check []byte
+}
+
+type keyFile struct {
+	Identity string
+	Nonce    []byte
+	Box      []byte
+}
+
+// Open opens the keystore in dir, or creates it if dir holds no keystore. The
+// keys are encrypted with a key derived from passphrase, which cannot be
+// empty.
+func Open(dir, passphrase string) (*Keystore, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := lock(dir); err != nil {
+		return nil, err
+	}
+	ks := &Keystore{dir: dir}
+	if err := ks.init(passphrase); err != nil {
+		ks.Close()
+		return nil, err
+	}
+	return ks, nil
+}
+
+// lock creates the lock file of dir, which holds the PID of the process. A
+// lock file left by a process that is not running anymore, for example
+// because it has been killed, is replaced.
+func lock(dir string) error {
+	fn := filepath.Join(dir, lockFile)
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(fn, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d", os.Getpid())
+			if errClose := f.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				os.Remove(fn)
+			}
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if !staleLock(fn) {
+			return ErrLocked
+		}
+		log.Warn("Removing the lock of the keystore left by a process that is not running")
+		if err = os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return ErrLocked
+}
+
+// staleLock returns true if the lock file holds the PID of a process that is
+// not running. A lock file that cannot be read is not stale, as it might be
+// written by another process.
+func staleLock(fn string) bool {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	if se, ok := err.(*os.SyscallError); ok && se.Err == syscall.EPERM {
+		// The process exists, but belongs to another user.
+		return false
+	}
+	return err != nil
+}
+
+func (ks *Keystore) init(passphrase string) error {
+	fn := filepath.Join(ks.dir, storeFile)
+	var hdr storeHeader
+	buf, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		hdr.Salt, err = NewSalt()
+		if err != nil {
+			return err
+		}
+		ks.box, err = NewSecretBox(passphrase, hdr.Salt)
+		if err != nil {
+			return err
+		}
+		hdr.Nonce, hdr.Check, err = ks.box.Seal([]byte(checkValue))
+		if err != nil {
+			return err
+		}
+		buf, err = protobuf.Encode(&hdr)
+		if err != nil {
+			return err
+		}
+		return writeFile(fn, buf)
+	} else if err != nil {
+		return err
+	}
+
+	if err = protobuf.Decode(buf, &hdr); err != nil {
+		return fmt.Errorf("could not decode %v: %v", fn, err)
+	}
+	ks.box, err = NewSecretBox(passphrase, hdr.Salt)
+	if err != nil {
+		return err
+	}
+	if _, err = ks.box.Open(hdr.Nonce, hdr.Check); err != nil {
+		return ErrWrongPassphrase
+	}
+	return nil
+}
+
+// Close releases the lock of the directory.
+func (ks *Keystore) Close() error {
+	return os.Remove(filepath.Join(ks.dir, lockFile))
+}
+
+// Generate creates a new Ed25519 key of suite and stores it as alias.
+func (ks *Keystore) Generate(alias string, suite key.Suite) (darc.Signer, error) {
+	kp := key.NewKeyPair(suite)
+	signer := darc.NewSignerEd25519(kp.Public, kp.Private)
+	return signer, ks.Import(alias, signer)
+}
+
+// Get returns the signer stored as alias.
+func (ks *Keystore) Get(alias string) (darc.Signer, error) {
+	buf, err := ks.Export(alias)
+	if err != nil {
+		return darc.Signer{}, err
+	}
+	return decodeSigner(buf)
+}
+
+// List returns the sorted aliases of the keys.
+func (ks *Keystore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), keySuffix) {
+			aliases = append(aliases, strings.TrimSuffix(f.Name(), keySuffix))
+		}
+	}
+	sort.Strings(aliases)
+	return aliases, nil
+}
+
+// Import stores signer as alias. It refuses to overwrite another key.
+func (ks *Keystore) Import(alias string, signer darc.Signer) error {
+	fn, err := ks.keyPath(alias)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(fn); err == nil {
+		return fmt.Errorf("key %v already exists", alias)
+	}
+	buf, err := protobuf.Encode(&signer)
+	if err != nil {
+		return err
+	}
+	kf := keyFile{Identity: signer.Identity().String()}
+	kf.Nonce, kf.Box, err = ks.box.Seal(buf)
+	if err != nil {
+		return err
+	}
+	buf, err = protobuf.Encode(&kf)
+	if err != nil {
+		return err
+	}
+	return writeFile(fn, buf)
+}
+
+// Export returns the key stored as alias, decrypted and encoded like the
+// key files of bcadmin, so that it can be imported in another keystore.
+func (ks *Keystore) Export(alias string) ([]byte, error) {
+	fn, err := ks.keyPath(alias)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no key %v", alias)
+		}
+		return nil, err
+	}
+	var kf keyFile
+	if err = protobuf.Decode(buf, &kf); err != nil {
+		return nil, fmt.Errorf("could not decode key %v: %v", alias, err)
+	}
+	buf, err = ks.box.Open(kf.Nonce, kf.Box)
+	if err != nil {
+		return nil, fmt.Errorf("key %v: %v", alias, err)
+	}
+	return buf, nil
+}
+
+// MigrateKeyFiles imports the key files of bcadmin found in dir, using the
+// identity of the key as alias, and removes them once they are imported. It
+// returns the aliases of the imported keys.
+func (ks *Keystore) MigrateKeyFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, legacyPrefix+"*.cfg"))
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for _, fn := range files {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return aliases, err
+		}
+		signer, err := decodeSigner(buf)
+		if err != nil {
+			return aliases, fmt.Errorf("could not decode %v: %v", fn, err)
+		}
+		alias := signer.Identity().String()
+		if _, err = ks.Get(alias); err != nil {
+			if err = ks.Import(alias, signer); err != nil {
+				return aliases, err
+			}
+		}
+		if err = os.Remove(fn); err != nil {
+			return aliases, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+func (ks *Keystore) keyPath(alias string) (string, error) {
+	if alias == "" || strings.HasPrefix(alias, ".") || strings.ContainsAny(alias, "/\\") {
+		return "", fmt.Errorf("invalid alias %q", alias)
+	}
+	return filepath.Join(ks.dir, alias+keySuffix), nil
+}
+
+func decodeSigner(buf []byte) (darc.Signer, error) {
+	var signer darc.Signer
+	err := protobuf.DecodeWithConstructors(buf, &signer,
+		network.DefaultConstructors(cothority.Suite))
+	return signer, err
+}
+
+// writeFile writes the file through a temporary file, so that a key is never
+// half written.
+func writeFile(fn string, buf []byte) error {
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
@@ -0,0 +1,144 @@
+package keystore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = Open(dir, "")
+	require.Equal(t, ErrEmptyPassphrase, err)
+	ks, err := Open(dir, "secret")
+	require.Nil(t, err)
+	_, err = Open(dir, "secret")
+	require.Equal(t, ErrLocked, err)
+
+	signer, err := ks.Generate("alice", cothority.Suite)
+	require.Nil(t, err)
+	_, err = ks.Generate("alice", cothority.Suite)
+	require.Contains(t, err.Error(), "already exists")
+	_, err = ks.Generate("../alice", cothority.Suite)
+	require.Contains(t, err.Error(), "invalid alias")
+	require.Nil(t, ks.Import("bob", darc.NewSignerEd25519(nil, nil)))
+	aliases, err := ks.List()
+	require.Nil(t, err)
+	require.Equal(t, []string{"alice", "bob"}, aliases)
+	require.Nil(t, ks.Close())
+
+	// The keys are encrypted at rest.
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "alice"+keySuffix))
+	require.Nil(t, err)
+	secret, err := signer.GetPrivate()
+	require.Nil(t, err)
+	secretBuf, err := secret.MarshalBinary()
+	require.Nil(t, err)
+	require.NotContains(t, string(buf), string(secretBuf))
+
+	_, err = Open(dir, "wrong")
+	require.Equal(t, ErrWrongPassphrase, err)
+
+	ks, err = Open(dir, "secret")
+	require.Nil(t, err)
+	defer ks.Close()
+	signer2, err := ks.Get("alice")
+	require.Nil(t, err)
+	require.Equal(t, signer.Identity().String(), signer2.Identity().String())
+	secret2, err := signer2.GetPrivate()
+	require.Nil(t, err)
+	require.True(t, secret.Equal(secret2))
+	_, err = ks.Get("carol")
+	require.Contains(t, err.Error(), "no key carol")
+
+	// Export and import in another keystore.
+	dir2, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir2)
+	ks2, err := Open(dir2, "other")
+	require.Nil(t, err)
+	defer ks2.Close()
+	buf, err = ks.Export("alice")
+	require.Nil(t, err)
+	signer3, err := decodeSigner(buf)
+	require.Nil(t, err)
+	require.Nil(t, ks2.Import("alice", signer3))
+	signer3, err = ks2.Get("alice")
+	require.Nil(t, err)
+	require.Equal(t, signer.Identity().String(), signer3.Identity().String())
+}
+
+func TestKeystore_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, lockFile)
+
+	// A lock of a process that is not running is replaced.
+	cmd := exec.Command("true")
+	require.Nil(t, cmd.Run())
+	require.Nil(t, ioutil.WriteFile(fn, []byte(fmt.Sprint(cmd.Process.Pid)), 0600))
+	ks, err := Open(dir, "secret")
+	require.Nil(t, err)
+	buf, err := ioutil.ReadFile(fn)
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprint(os.Getpid()), string(buf))
+	require.Nil(t, ks.Close())
+
+	// A lock that cannot be read is kept.
+	require.Nil(t, ioutil.WriteFile(fn, []byte{}, 0600))
+	_, err = Open(dir, "secret")
+	require.Equal(t, ErrLocked, err)
+}
+
+func TestKeystore_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	legacy, err := ioutil.TempDir("", "bcadmin")
+	require.Nil(t, err)
+	defer os.RemoveAll(legacy)
+
+	// Key files as written by bcadmin.
+	var signers []darc.Signer
+	for i := 0; i < 2; i++ {
+		signer := darc.NewSignerEd25519(nil, nil)
+		buf, err := protobuf.Encode(&signer)
+		require.Nil(t, err)
+		fn := filepath.Join(legacy, fmt.Sprintf("key-%s.cfg", signer.Identity()))
+		require.Nil(t, ioutil.WriteFile(fn, buf, 0400))
+		signers = append(signers, signer)
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(legacy, "bc-1234.cfg"), []byte("config"), 0644))
+
+	ks, err := Open(dir, "secret")
+	require.Nil(t, err)
+	defer ks.Close()
+	migrated, err := ks.MigrateKeyFiles(legacy)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(migrated))
+	for _, signer := range signers {
+		s, err := ks.Get(signer.Identity().String())
+		require.Nil(t, err)
+		require.Equal(t, signer.Identity().String(), s.Identity().String())
+	}
+
+	// The legacy files are read only once.
+	files, err := filepath.Glob(filepath.Join(legacy, "*"))
+	require.Nil(t, err)
+	require.Equal(t, []string{filepath.Join(legacy, "bc-1234.cfg")}, files)
+	migrated, err = ks.MigrateKeyFiles(legacy)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(migrated))
+}
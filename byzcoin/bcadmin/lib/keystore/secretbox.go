@@ -0,0 +1,61 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretBox encrypts and authenticates messages with a key derived from a
+// passphrase. It is used by the keystore and to export keys, so that both
+// use the same parameters.
+type SecretBox struct {
+	key [32]byte
+}
+
+// NewSalt returns a random salt for NewSecretBox.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// NewSecretBox derives the key of the box from the passphrase and the salt
+// with scrypt.
+func NewSecretBox(passphrase string, salt []byte) (*SecretBox, error) {
+	b := &SecretBox{}
+	k, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, len(b.key))
+	if err != nil {
+		return nil, err
+	}
+	copy(b.key[:], k)
+	return b, nil
+}
+
+// Seal encrypts msg with a random nonce.
+func (b *SecretBox) Seal(msg []byte) (nonce, box []byte, err error) {
+	var n [24]byte
+	if _, err = rand.Read(n[:]); err != nil {
+		return
+	}
+	return n[:], secretbox.Seal(nil, msg, &n, &b.key), nil
+}
+
+// Open decrypts a box created by Seal. It returns an error if the box has
+// not been sealed with the same key.
+func (b *SecretBox) Open(nonce, box []byte) ([]byte, error) {
+	var n [24]byte
+	if len(nonce) != len(n) {
+		return nil, errors.New("invalid nonce")
+	}
+	copy(n[:], nonce)
+	msg, ok := secretbox.Open(nil, box, &n, &b.key)
+	if !ok {
+		return nil, errors.New("could not decrypt")
+	}
+	return msg, nil
+}
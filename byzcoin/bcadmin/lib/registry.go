@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/protobuf"
+)
+
+// registryFile is the name of the file in the ConfigPath directory that
+// holds the aliases of the chains and the default chain.
+const registryFile = "chains.cfg"
+
+// ChainEntry describes a chain registered with SaveConfigAs.
+type ChainEntry struct {
+	// Name is the alias of the chain.
+	Name      string
+	ByzCoinID skipchain.SkipBlockID
+	// Default is true for the chain returned by FindConfig if no chain is
+	// given.
+	Default bool
+}
+
+// File returns the pathname of the config file of the chain.
+func (e ChainEntry) File() string {
+	return ConfigFile(e.ByzCoinID)
+}
+
+type registry struct {
+	Default string
+	Chains  []registryEntry
+}
+
+type registryEntry struct {
+	Name      string
+	ByzCoinID skipchain.SkipBlockID
+}
+
+func loadRegistry() (*registry, error) {
+	reg := &registry{}
+	buf, err := ioutil.ReadFile(filepath.Join(ConfigPath, registryFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return reg, nil
+		}
+		return nil, err
+	}
+	if err = protobuf.Decode(buf, reg); err != nil {
+		return nil, fmt.Errorf("could not decode %v: %v", registryFile, err)
+	}
+	return reg, nil
+}
+
+func (reg *registry) save() error {
+	if err := os.MkdirAll(ConfigPath, 0755); err != nil {
+		return err
+	}
+	buf, err := protobuf.Encode(reg)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(ConfigPath, registryFile), buf, 0644)
+}
+
+func (reg *registry) get(name string) *registryEntry {
+	for i := range reg.Chains {
+		if reg.Chains[i].Name == name {
+			return &reg.Chains[i]
+		}
+	}
+	return nil
+}
+
+// SaveConfigAs stores the config like SaveConfig and registers it under
+// name, so that FindConfig finds it by this name. The first chain that is
+// registered becomes the default one. A chain can only have one name, and
+// a name can only be reused to update the config of the same chain. The
+// name cannot be a prefix of the ByzCoin ID of another stored config, as
+// FindConfig couldn't tell them apart. It returns the pathname of the stored
+// file.
+func SaveConfigAs(name string, cfg Config) (string, error) {
+	if name == "" {
+		return "", errors.New("the name of the chain cannot be empty")
+	}
+	reg, err := loadRegistry()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range reg.Chains {
+		if e.Name == name && !bytes.Equal(e.ByzCoinID, cfg.ByzCoinID) {
+			return "", fmt.Errorf("the name %v is already used for chain %x", name, e.ByzCoinID)
+		}
+		if e.Name != name && bytes.Equal(e.ByzCoinID, cfg.ByzCoinID) {
+			return "", fmt.Errorf("chain %x is already registered as %v", cfg.ByzCoinID, e.Name)
+		}
+	}
+
+	files, err := StoredConfigs()
+	if err != nil {
+		return "", err
+	}
+	for _, f := range matchPrefix(files, name) {
+		if f != ConfigFile(cfg.ByzCoinID) {
+			return "", fmt.Errorf("the name %v is a prefix of the chain in %v", name, f)
+		}
+	}
+
+	fn, err := SaveConfig(cfg)
+	if err != nil {
+		return fn, err
+	}
+	if reg.get(name) == nil {
+		reg.Chains = append(reg.Chains, registryEntry{name, cfg.ByzCoinID})
+	}
+	if reg.Default == "" {
+		reg.Default = name
+	}
+	return fn, reg.save()
+}
+
+// ListConfigs returns the chains registered with SaveConfigAs, in the order
+// in which they have been registered.
+func ListConfigs() ([]ChainEntry, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ChainEntry, len(reg.Chains))
+	for i, e := range reg.Chains {
+		entries[i] = ChainEntry{
+			Name:      e.Name,
+			ByzCoinID: e.ByzCoinID,
+			Default:   e.Name == reg.Default,
+		}
+	}
+	return entries, nil
+}
+
+// SetDefault makes the chain registered as name the one returned by
+// FindConfig if no chain is given.
+func SetDefault(name string) error {
+	reg, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+	if reg.get(name) == nil {
+		return fmt.Errorf("no chain registered as %v", name)
+	}
+	reg.Default = name
+	return reg.save()
+}
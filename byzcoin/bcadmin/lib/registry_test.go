@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/kyber/util/random"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConfig() Config {
+	kp := key.NewKeyPair(cothority.Suite)
+	si := network.NewServerIdentity(kp.Public, network.NewAddress(network.TLS, "127.0.0.1:7770"))
+	signer := darc.NewSignerEd25519(nil, nil)
+	return Config{
+		Roster:        *onet.NewRoster([]*network.ServerIdentity{si}),
+		ByzCoinID:     random.Bits(256, true, random.New()),
+		GenesisDarc:   *darc.NewDarc(darc.InitRules([]darc.Identity{signer.Identity()}, nil), []byte("genesis")),
+		AdminIdentity: signer.Identity(),
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bcadmin")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	oldPath := ConfigPath
+	ConfigPath = dir
+	defer func() { ConfigPath = oldPath }()
+
+	cfg1 := newTestConfig()
+	cfg1.ByzCoinID[0] = 0x01
+	cfg2 := newTestConfig()
+	cfg2.ByzCoinID[0] = 0x02
+	_, err = SaveConfigAs("", cfg1)
+	require.NotNil(t, err)
+	fn, err := SaveConfigAs("main", cfg1)
+	require.Nil(t, err)
+	_, err = os.Stat(fn)
+	require.Nil(t, err)
+	_, err = SaveConfigAs("test", cfg2)
+	require.Nil(t, err)
+
+	// The first chain is the default one.
+	entries, err := ListConfigs()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, "main", entries[0].Name)
+	require.True(t, entries[0].Default)
+	require.Equal(t, cfg1.ByzCoinID, entries[0].ByzCoinID)
+	require.Equal(t, fn, entries[0].File())
+	require.Equal(t, "test", entries[1].Name)
+	require.False(t, entries[1].Default)
+
+	// The default chain is found if no chain is given.
+	found, err := FindConfig("")
+	require.Nil(t, err)
+	require.Equal(t, fn, found)
+
+	// Switching the default chain.
+	require.NotNil(t, SetDefault("unknown"))
+	require.Nil(t, SetDefault("test"))
+	found, err = FindConfig("")
+	require.Nil(t, err)
+	require.Equal(t, ConfigFile(cfg2.ByzCoinID), found)
+	entries, err = ListConfigs()
+	require.Nil(t, err)
+	require.False(t, entries[0].Default)
+	require.True(t, entries[1].Default)
+
+	// Loading by alias.
+	found, err = FindConfig("main")
+	require.Nil(t, err)
+	require.Equal(t, fn, found)
+	cfg, _, err := LoadConfig(found)
+	require.Nil(t, err)
+	require.True(t, cfg1.AdminIdentity.Equal(&cfg.AdminIdentity))
+	_, err = FindConfig("unknown")
+	require.NotNil(t, err)
+
+	// A chain has only one alias, and an alias only one chain.
+	_, err = SaveConfigAs("other", cfg1)
+	require.Contains(t, err.Error(), "already registered as main")
+	_, err = SaveConfigAs("main", cfg2)
+	require.Contains(t, err.Error(), "already used")
+
+	// The config of a registered chain can be updated.
+	cfg1.AdminIdentity = darc.NewSignerEd25519(nil, nil).Identity()
+	_, err = SaveConfigAs("main", cfg1)
+	require.Nil(t, err)
+	cfg, _, err = LoadConfig(fn)
+	require.Nil(t, err)
+	require.True(t, cfg1.AdminIdentity.Equal(&cfg.AdminIdentity))
+	entries, err = ListConfigs()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+
+	// A name cannot be a prefix of another chain, and a chain stored later
+	// with such a prefix makes the name ambiguous.
+	cfg3 := newTestConfig()
+	cfg3.ByzCoinID[0] = 0xde
+	cfg4 := newTestConfig()
+	cfg4.ByzCoinID[0] = 0xbe
+	fn3, err := SaveConfig(cfg3)
+	require.Nil(t, err)
+	_, err = SaveConfigAs("de", cfg4)
+	require.Contains(t, err.Error(), "is a prefix of the chain")
+	_, err = SaveConfigAs("be", cfg4)
+	require.Nil(t, err)
+	found, err = FindConfig("be")
+	require.Nil(t, err)
+	require.Equal(t, ConfigFile(cfg4.ByzCoinID), found)
+	cfg5 := newTestConfig()
+	cfg5.ByzCoinID[0] = 0xbe
+	_, err = SaveConfig(cfg5)
+	require.Nil(t, err)
+	_, err = FindConfig("be")
+	require.Contains(t, err.Error(), "is the name of chain")
+	// A file still wins over a name.
+	found, err = FindConfig(fn3)
+	require.Nil(t, err)
+	require.Equal(t, fn3, found)
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+)
+
+// NodeStatus is the state of a conode of the roster, as returned by
+// RosterStatus.
+type NodeStatus struct {
+	Address network.Address `json:"address"`
+	// Reachable is false if the conode didn't answer in time, the reason
+	// is in Error.
+	Reachable bool `json:"reachable"`
+	// Valid is false if the conode answered, but not with a proof that
+	// verifies against the genesis block, the reason is in Error.
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	// Latency is the time the conode took to answer.
+	Latency time.Duration `json:"latency"`
+	// Index is the index of the latest block of the ByzCoin known to the
+	// conode, if the proof is valid.
+	Index int `json:"index"`
+}
+
+// RosterStatus asks every conode of the roster of the config for a proof of
+// the chain config, in parallel, and returns the state of the conodes in the
+// order of the roster. A conode that doesn't answer within timeout is
+// unreachable, and doesn't stop the others from being asked. The proofs are
+// verified against the genesis block of the ByzCoin.
+func RosterStatus(cfg Config, timeout time.Duration) []NodeStatus {
+	type result struct {
+		genesis *skipchain.SkipBlock
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		genesis, err := byzcoin.NewClient(cfg.ByzCoinID, cfg.Roster).GenesisBlock()
+		done <- result{genesis, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(timeout):
+		r.err = fmt.Errorf("no answer after %v", timeout)
+	}
+	if r.err != nil {
+		r.err = fmt.Errorf("couldn't get genesis block: %v", r.err)
+	}
+	return rosterStatus(cfg, r.genesis, r.err, timeout)
+}
+
+// rosterStatus is RosterStatus with the genesis block. If errGenesis is not
+// nil, the proofs cannot be verified and it is the error of every conode
+// that answers.
+func rosterStatus(cfg Config, genesis *skipchain.SkipBlock, errGenesis error, timeout time.Duration) []NodeStatus {
+	statuses := make([]NodeStatus, len(cfg.Roster.List))
+	var wg sync.WaitGroup
+	for i, si := range cfg.Roster.List {
+		wg.Add(1)
+		go func(ns *NodeStatus, si *network.ServerIdentity) {
+			defer wg.Done()
+			ns.Address = si.Address
+			reply, err := getProof(si, cfg.ByzCoinID, timeout)
+			ns.Latency = reply.latency
+			if err != nil {
+				ns.Reachable = cothority.IsServiceError(err)
+				ns.Error = err.Error()
+				return
+			}
+			ns.Reachable = true
+			if errGenesis != nil {
+				ns.Error = errGenesis.Error()
+				return
+			}
+			if _, _, _, _, err = byzcoin.VerifyProofOffline(genesis, &reply.Proof); err != nil {
+				ns.Error = "invalid proof: " + err.Error()
+				return
+			}
+			ns.Valid = true
+			ns.Index = reply.Proof.Latest.Index
+		}(&statuses[i], si)
+	}
+	wg.Wait()
+	return statuses
+}
+
+type proofReply struct {
+	byzcoin.GetProofResponse
+	latency time.Duration
+}
+
+// getProof asks si for the proof of the chain config. Every conode is asked
+// with its own client, as the requests of a client are sent one after the
+// other. The request is abandoned after timeout, and its connection closed.
+func getProof(si *network.ServerIdentity, id skipchain.SkipBlockID, timeout time.Duration) (*proofReply, error) {
+	type result struct {
+		reply *proofReply
+		err   error
+	}
+	cl := onet.NewClient(cothority.Suite, byzcoin.ServiceName)
+	done := make(chan result, 1)
+	go func() {
+		reply := &proofReply{}
+		start := time.Now()
+		// The reply is read on the streaming connection, so that the
+		// client can be closed while the reply is awaited, which
+		// SendProtobuf would prevent.
+		conn, err := cl.Stream(si, &byzcoin.GetProof{
+			Version: byzcoin.CurrentVersion,
+			ID:      id,
+			Key:     byzcoin.NewInstanceID(nil).Slice(),
+		})
+		if err == nil {
+			err = conn.ReadMessage(&reply.GetProofResponse)
+		}
+		reply.latency = time.Since(start)
+		done <- result{reply, err}
+	}()
+	select {
+	case r := <-done:
+		cl.Close()
+		return r.reply, r.err
+	case <-time.After(timeout):
+		// Closing the connection makes the pending read fail. Close
+		// waits for a connection that is still being opened, so it
+		// must not block the caller.
+		go cl.Close()
+		return &proofReply{latency: timeout}, fmt.Errorf("no answer after %v", timeout)
+	}
+}
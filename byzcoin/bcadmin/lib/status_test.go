@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRosterStatus(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:darc"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	// A node that is not running.
+	kp := key.NewKeyPair(cothority.Suite)
+	down := network.NewServerIdentity(kp.Public, network.NewAddress(network.PlainTCP, "127.0.0.1:2"))
+	// A node that accepts connections, but never answers. The websocket
+	// of a conode listens on the port after the one of its address.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Closed once the listener is closed.
+			defer c.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	silent := network.NewServerIdentity(kp.Public,
+		network.NewAddress(network.PlainTCP, "127.0.0.1:"+strconv.Itoa(port-1)))
+	list := append(roster.List, down, silent)
+
+	cfg := Config{
+		Roster:    *onet.NewRoster(list),
+		ByzCoinID: cl.ID,
+	}
+	statuses := RosterStatus(cfg, time.Second)
+	require.Equal(t, len(list), len(statuses))
+	for i, ns := range statuses[:3] {
+		require.Equal(t, roster.List[i].Address, ns.Address)
+		require.True(t, ns.Reachable, ns.Error)
+		require.True(t, ns.Valid, ns.Error)
+		require.Equal(t, 0, ns.Index)
+	}
+	require.Equal(t, down.Address, statuses[3].Address)
+	require.False(t, statuses[3].Reachable)
+	require.NotEqual(t, "", statuses[3].Error)
+	require.False(t, statuses[4].Reachable)
+	require.Contains(t, statuses[4].Error, "no answer")
+
+	// The proofs of another ByzCoin don't verify against the genesis
+	// block.
+	msg2, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:darc"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl2, _, err := byzcoin.NewLedger(msg2, false)
+	require.Nil(t, err)
+	genesis2, err := cl2.GenesisBlock()
+	require.Nil(t, err)
+	cfg.Roster = *roster
+	for _, ns := range rosterStatus(cfg, genesis2, nil, time.Second) {
+		require.True(t, ns.Reachable)
+		require.False(t, ns.Valid)
+		require.Contains(t, ns.Error, "invalid proof")
+	}
+
+	// An unknown ByzCoin gives an error of the conodes.
+	cfg.ByzCoinID = genesis2.Hash[:4]
+	for _, ns := range RosterStatus(cfg, time.Second) {
+		require.True(t, ns.Reachable)
+		require.False(t, ns.Valid)
+		require.NotEqual(t, "", ns.Error)
+	}
+}
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib/keystore"
+	"github.com/dedis/cothority/byzcoin/contracts"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/app"
@@ -42,6 +52,19 @@ var cmds = cli.Commands{
 				Usage: "the block interval for this ledger",
 				Value: 5 * time.Second,
 			},
+			cli.StringSliceFlag{
+				Name:  "admin",
+				Usage: "another admin of the genesis darc, like ed25519:a35020c70b8d735...0357 (can be repeated)",
+			},
+			cli.StringFlag{
+				Name:  "policy",
+				Usage: "how many admins must sign: any, all or a number",
+				Value: "any",
+			},
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "register the config under this name, see the chains command",
+			},
 		},
 		Action: create,
 	},
@@ -51,22 +74,93 @@ var cmds = cli.Commands{
 		Aliases: []string{"s"},
 		Flags: []cli.Flag{
 			cli.StringFlag{
-				Name:   "bc",
+				Name:   "bc, chain",
 				EnvVar: "BC",
-				Usage:  "the ByzCoin config to use",
+				Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
 			},
 		},
 		Action: show,
 	},
+	{
+		Name:  "code",
+		Usage: "print the config as a single line that can be shared with other users",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "bc, chain",
+				EnvVar: "BC",
+				Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+			},
+		},
+		Action: code,
+	},
+	{
+		Name:      "join",
+		Usage:     "create the config of an existing ByzCoin by contacting one of its conodes",
+		ArgsUsage: "byzcoin-id",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "url",
+				Usage: "the address of a conode of the ByzCoin, like tls://host:port",
+			},
+			cli.StringFlag{
+				Name:  "code",
+				Usage: "the config printed by the code command, instead of --url and the ID",
+			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "overwrite the config if there is already one for this ByzCoin",
+			},
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "register the config under this name, see the chains command",
+			},
+		},
+		Action: join,
+	},
+	{
+		Name:   "chains",
+		Usage:  "list the ByzCoin configs of the configuration-directory",
+		Action: chains,
+		Subcommands: cli.Commands{
+			{
+				Name:      "default",
+				Usage:     "use the chain registered under this name if --bc is not given",
+				ArgsUsage: "name",
+				Action:    chainsDefault,
+			},
+		},
+	},
+	{
+		Name:  "status",
+		Usage: "contact every conode of the roster and show its latest block",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "bc, chain",
+				EnvVar: "BC",
+				Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+			},
+			cli.StringFlag{
+				Name:  "format, f",
+				Value: "txt",
+				Usage: "output format: \"txt\" (default) or \"json\"",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Value: 10 * time.Second,
+				Usage: "how long to wait for the answer of a conode",
+			},
+		},
+		Action: status,
+	},
 	{
 		Name:    "add",
 		Usage:   "add a rule and signer to the base darc",
 		Aliases: []string{"a"},
 		Flags: []cli.Flag{
 			cli.StringFlag{
-				Name:   "bc",
+				Name:   "bc, chain",
 				EnvVar: "BC",
-				Usage:  "the ByzCoin config to use",
+				Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
 			},
 			cli.StringFlag{
 				Name:  "identity",
@@ -94,19 +188,62 @@ var cmds = cli.Commands{
 			},
 		},
 		Action: key,
+		Subcommands: cli.Commands{
+			{
+				Name:      "export",
+				Usage:     "encrypts a key with a passphrase and writes it to a file",
+				ArgsUsage: "file",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "bc, chain",
+						EnvVar: "BC",
+						Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+					},
+					cli.StringFlag{
+						Name:  "identity",
+						Usage: "the identity of the key to export (AdminIdentity by default)",
+					},
+					cli.StringFlag{
+						Name:  "passphrase-file",
+						Usage: "file holding the passphrase, which is asked for if not given",
+					},
+				},
+				Action: keyExport,
+			},
+			{
+				Name:      "import",
+				Usage:     "decrypts a key written by export and stores it",
+				ArgsUsage: "file",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "bc, chain",
+						EnvVar: "BC",
+						Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+					},
+					cli.StringFlag{
+						Name:  "passphrase-file",
+						Usage: "file holding the passphrase, which is asked for if not given",
+					},
+				},
+				Action: keyImport,
+			},
+		},
 	},
 	{
 		Name: "darc",
-		Usage: "tool used to manage darcs: it can be used with multiple subcommands (add, show, rule)\n" +
+		Usage: "tool used to manage darcs: it can be used with multiple subcommands (add, show, rule, add-signer)\n" +
 			"add : adds a new DARC with specified characteristics\n" +
-			"show: shows the specified DARC\n" +
-			"rule: allow to add, update or delete a rule of the DARC",
+			"show [darc-id]: shows the specified DARC\n" +
+			"rule: allow to add, update or delete a rule of the DARC\n" +
+			"rule add <darc-id> <action> <expression>: adds or, with --replace, updates a rule\n" +
+			"rule rm <darc-id> <action>: deletes a rule\n" +
+			"add-signer <darc-id> <identity>: adds an identity to the signers of the DARC",
 		Aliases: []string{"d"},
 		Flags: []cli.Flag{
 			cli.StringFlag{
-				Name:   "bc",
+				Name:   "bc, chain",
 				EnvVar: "BC",
-				Usage:  "the ByzCoin config to use (always use)",
+				Usage:  "the ByzCoin config to use, its name or a prefix of its ID (always use)",
 			},
 			cli.StringFlag{
 				Name:  "owner",
@@ -151,6 +288,90 @@ var cmds = cli.Commands{
 		},
 		Action: darcCli,
 	},
+	{
+		Name:  "wallet",
+		Usage: "manage coin accounts",
+		Subcommands: cli.Commands{
+			{
+				Name:  "show",
+				Usage: "show the coin account of the admin, or of the owner given by --identity",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "bc, chain",
+						EnvVar: "BC",
+						Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+					},
+					cli.StringFlag{
+						Name:  "identity",
+						Usage: "the owner of the account, like ed25519:a35020c70b8d735...0357 (AdminIdentity by default)",
+					},
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the account as JSON, the log goes to stderr",
+					},
+				},
+				Action: walletShow,
+			},
+			{
+				Name:      "balance",
+				Usage:     "show the balance of a coin account, given by its address or the public key of its owner",
+				ArgsUsage: "address | ed25519:public-key",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "bc, chain",
+						EnvVar: "BC",
+						Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+					},
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the balance as JSON, the log goes to stderr",
+					},
+				},
+				Action: walletBalance,
+			},
+			{
+				Name:      "mint",
+				Usage:     "mint coins into a coin account, spawning it if it doesn't exist",
+				ArgsUsage: "amount",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "bc, chain",
+						EnvVar: "BC",
+						Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+					},
+					cli.StringFlag{
+						Name:  "identity",
+						Usage: "the owner of the account, like ed25519:a35020c70b8d735...0357 (AdminIdentity by default)",
+					},
+					cli.StringFlag{
+						Name:  "sign",
+						Usage: "the key that signs the transaction, it must be stored locally (AdminIdentity by default)",
+					},
+				},
+				Action: walletMint,
+			},
+			{
+				Name:  "init-account",
+				Usage: "spawn the coin account of the admin, or of the owner given by --identity",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:   "bc, chain",
+						EnvVar: "BC",
+						Usage:  "the ByzCoin config to use, its name or a prefix of its ID",
+					},
+					cli.StringFlag{
+						Name:  "identity",
+						Usage: "the owner of the account, like ed25519:a35020c70b8d735...0357 (AdminIdentity by default)",
+					},
+					cli.StringFlag{
+						Name:  "sign",
+						Usage: "the key that signs the transaction, it must be stored locally (the key of the owner if the genesis darc allows it, else AdminIdentity)",
+					},
+				},
+				Action: walletInitAccount,
+			},
+		},
+	},
 }
 
 var cliApp = cli.NewApp()
@@ -171,15 +392,59 @@ func init() {
 		},
 		cli.StringFlag{
 			Name:  "config, c",
-			Value: getDataPath(cliApp.Name),
-			Usage: "path to configuration-directory",
+			Usage: "path to configuration-directory, the data directory of bcadmin by default",
+		},
+		cli.StringFlag{
+			Name:  "keys",
+			Usage: "path to a keystore shared with other tools, the keys of the configuration-directory are moved to it",
+		},
+		cli.StringFlag{
+			Name:   "passphrase",
+			EnvVar: "BC_PASSPHRASE",
+			Usage:  "the passphrase of the keystore",
 		},
 	}
 	cliApp.Before = func(c *cli.Context) error {
 		log.SetDebugVisible(c.Int("debug"))
 		lib.ConfigPath = c.String("config")
+		if lib.ConfigPath == "" {
+			// Not given as the default value of the flag, so that the
+			// tests can change getDataPath.
+			lib.ConfigPath = getDataPath(cliApp.Name)
+		}
+		return openKeystore(c)
+	}
+	cliApp.After = func(c *cli.Context) error {
+		if lib.Keys == nil {
+			return nil
+		}
+		err := lib.Keys.Close()
+		lib.Keys = nil
+		return err
+	}
+}
+
+// openKeystore opens the keystore given by --keys and moves the keys of the
+// configuration-directory into it.
+func openKeystore(c *cli.Context) error {
+	dir := c.String("keys")
+	if dir == "" {
 		return nil
 	}
+	ks, err := keystore.Open(dir, c.String("passphrase"))
+	if err != nil {
+		return err
+	}
+	migrated, err := ks.MigrateKeyFiles(lib.ConfigPath)
+	if err != nil {
+		ks.Close()
+		return err
+	}
+	for _, alias := range migrated {
+		log.Info("Moved key", alias, "to the keystore")
+	}
+	lib.Keys = ks
+	return nil
 }
 
 func main() {
@@ -200,11 +465,27 @@ func create(c *cli.Context) error {
 
 	owner := darc.NewSignerEd25519(nil, nil)
 
-	req, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, r, []string{"spawn:darc"}, owner.Identity())
+	opts := []byzcoin.GenesisOption{byzcoin.WithBlockInterval(interval)}
+	if admins := c.StringSlice("admin"); len(admins) > 0 {
+		policy, err := parsePolicy(c.String("policy"))
+		if err != nil {
+			return err
+		}
+		ids := []darc.Identity{owner.Identity()}
+		for _, a := range admins {
+			id, err := parseIdentity(a)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		opts = append(opts, byzcoin.WithAdmins(policy, ids...))
+	}
+
+	req, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, r, []string{"spawn:darc"}, owner.Identity(), opts...)
 	if err != nil {
 		return err
 	}
-	req.BlockInterval = interval
 
 	cl := onet.NewClient(cothority.Suite, byzcoin.ServiceName)
 
@@ -220,7 +501,7 @@ func create(c *cli.Context) error {
 		GenesisDarc:   req.GenesisDarc,
 		AdminIdentity: owner.Identity(),
 	}
-	fn, err = lib.SaveConfig(cfg)
+	fn, err = saveConfig(c, cfg)
 	if err != nil {
 		return err
 	}
@@ -239,13 +520,57 @@ func create(c *cli.Context) error {
 	return nil
 }
 
-func show(c *cli.Context) error {
-	bcArg := c.String("bc")
-	if bcArg == "" {
-		return errors.New("--bc flag is required")
+// saveConfig stores the config, registering it under the name given by the
+// --name flag if there is one.
+func saveConfig(c *cli.Context, cfg lib.Config) (string, error) {
+	if name := c.String("name"); name != "" {
+		return lib.SaveConfigAs(name, cfg)
 	}
+	return lib.SaveConfig(cfg)
+}
 
-	cfg, cl, err := lib.LoadConfig(bcArg)
+// loadConfig loads the config given by the --bc flag, see lib.FindConfig.
+func loadConfig(c *cli.Context) (lib.Config, *byzcoin.Client, error) {
+	fn, err := lib.FindConfig(c.String("bc"))
+	if err != nil {
+		return lib.Config{}, nil, err
+	}
+	return lib.LoadConfig(fn)
+}
+
+// parsePolicy reads the --policy flag of create.
+func parsePolicy(p string) (byzcoin.AdminPolicy, error) {
+	switch p {
+	case "any":
+		return byzcoin.AnyAdmin, nil
+	case "all":
+		return byzcoin.AllAdmins, nil
+	}
+	k, err := strconv.Atoi(p)
+	if err != nil || k < 1 {
+		return 0, fmt.Errorf("invalid policy %q: must be any, all or a number", p)
+	}
+	return byzcoin.AdminPolicy(k), nil
+}
+
+// parseIdentity reads an ed25519 identity given as ed25519:<public key in hex>.
+func parseIdentity(s string) (darc.Identity, error) {
+	if !strings.HasPrefix(s, "ed25519:") {
+		return darc.Identity{}, fmt.Errorf("invalid identity %q: only ed25519 is supported", s)
+	}
+	buf, err := hex.DecodeString(strings.TrimPrefix(s, "ed25519:"))
+	if err != nil {
+		return darc.Identity{}, fmt.Errorf("invalid identity %q: %v", s, err)
+	}
+	pub := cothority.Suite.Point()
+	if err = pub.UnmarshalBinary(buf); err != nil {
+		return darc.Identity{}, fmt.Errorf("invalid identity %q: %v", s, err)
+	}
+	return darc.NewIdentityEd25519(pub), nil
+}
+
+func show(c *cli.Context) error {
+	cfg, cl, err := loadConfig(c)
 	if err != nil {
 		return err
 	}
@@ -268,13 +593,148 @@ func show(c *cli.Context) error {
 	return err
 }
 
-func add(c *cli.Context) error {
-	bcArg := c.String("bc")
-	if bcArg == "" {
-		return errors.New("--bc flag is required")
+func code(c *cli.Context) error {
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
 	}
 
-	cfg, cl, err := lib.LoadConfig(bcArg)
+	s, err := lib.ExportCompact(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, s)
+	return nil
+}
+
+func join(c *cli.Context) error {
+	var cfg lib.Config
+	var err error
+	if code := c.String("code"); code != "" {
+		cfg, err = lib.ImportCompact(code)
+		if err != nil {
+			return err
+		}
+		if err = checkJoined(c, cfg.ByzCoinID); err != nil {
+			return err
+		}
+		cfg, err = lib.FetchCompact(code)
+		if err != nil {
+			return err
+		}
+	} else {
+		addr := c.String("url")
+		if addr == "" {
+			return errors.New("--url or --code flag is required")
+		}
+		if c.NArg() != 1 {
+			return errors.New("please give the ByzCoin ID")
+		}
+		id, err := hex.DecodeString(c.Args().First())
+		if err != nil {
+			return fmt.Errorf("invalid ByzCoin ID: %v", err)
+		}
+		if err = checkJoined(c, id); err != nil {
+			return err
+		}
+		cfg, err = lib.FetchConfig(network.Address(addr), id)
+		if err != nil {
+			return err
+		}
+	}
+	fn, err := saveConfig(c, cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.App.Writer, "Joined ByzCoin with ID %x.\n", cfg.ByzCoinID)
+	fmt.Fprintf(c.App.Writer, "export BC=\"%v\"\n", fn)
+
+	// For the tests to use.
+	c.App.Metadata["BC"] = fn
+
+	return nil
+}
+
+// checkJoined refuses to join a ByzCoin that already has a config, unless
+// --force is given.
+func checkJoined(c *cli.Context, id skipchain.SkipBlockID) error {
+	if _, err := os.Stat(lib.ConfigFile(id)); err == nil && !c.Bool("force") {
+		return fmt.Errorf("there is already a config for ByzCoin %x, use --force to overwrite it", id)
+	}
+	return nil
+}
+
+func chains(c *cli.Context) error {
+	files, err := lib.StoredConfigs()
+	if err != nil {
+		return err
+	}
+	entries, err := lib.ListConfigs()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for _, e := range entries {
+		names[e.File()] = e.Name
+		if e.Default {
+			names[e.File()] += " (default)"
+		}
+	}
+	for _, fn := range files {
+		cfg, _, err := lib.LoadConfig(fn)
+		if err != nil {
+			return err
+		}
+		name, ok := names[fn]
+		if !ok {
+			name = "-"
+		}
+		fmt.Fprintf(c.App.Writer, "%x\t%s\t%d nodes\t%s\n", cfg.ByzCoinID, name, len(cfg.Roster.List), fn)
+	}
+	return nil
+}
+
+func chainsDefault(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the name of the chain")
+	}
+	return lib.SetDefault(c.Args().First())
+}
+
+func status(c *cli.Context) error {
+	format := c.String("format")
+	if format != "txt" && format != "json" {
+		return fmt.Errorf("unknown format %q", format)
+	}
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	statuses := lib.RosterStatus(cfg, c.Duration("timeout"))
+	if format == "json" {
+		e := json.NewEncoder(c.App.Writer)
+		e.SetIndent("", "  ")
+		return e.Encode(statuses)
+	}
+	for _, ns := range statuses {
+		if !ns.Reachable {
+			fmt.Fprintf(c.App.Writer, "%s\tunreachable\t%v\n", ns.Address, ns.Error)
+			continue
+		}
+		if !ns.Valid {
+			fmt.Fprintf(c.App.Writer, "%s\tinvalid\t%v\n", ns.Address, ns.Error)
+			continue
+		}
+		fmt.Fprintf(c.App.Writer, "%s\tok\t%v\tblock %d\n", ns.Address,
+			ns.Latency.Round(time.Millisecond), ns.Index)
+	}
+	return nil
+}
+
+func add(c *cli.Context) error {
+	cfg, cl, err := loadConfig(c)
 	if err != nil {
 		return err
 	}
@@ -328,14 +788,6 @@ func add(c *cli.Context) error {
 		return err
 	}
 
-	signatureCtr, err := cl.GetSignerCounters(signer.Identity().String())
-	if err != nil {
-		return err
-	}
-	if len(signatureCtr.Counters) != 1 {
-		return errors.New("invalid result from GetSignerCounters")
-	}
-
 	invoke := byzcoin.Invoke{
 		Command: "evolve",
 		Args: []byzcoin.Argument{
@@ -350,14 +802,10 @@ func add(c *cli.Context) error {
 			{
 				InstanceID: byzcoin.NewInstanceID(d2.GetBaseID()),
 				Invoke:     &invoke,
-				Signatures: []darc.Signature{
-					darc.Signature{Signer: signer.Identity()},
-				},
-				SignerCounter: []uint64{signatureCtr.Counters[0] + 1},
 			},
 		},
 	}
-	err = ctx.SignWith(*signer)
+	err = ctx.FillSignersAndSignWith(cl, *signer)
 	if err != nil {
 		return err
 	}
@@ -391,13 +839,86 @@ func key(c *cli.Context) error {
 	return nil
 }
 
-func darcCli(c *cli.Context) error {
-	bcArg := c.String("bc")
-	if bcArg == "" {
-		return errors.New("--bc flag is required")
+func keyExport(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the file to write the key to")
+	}
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	id := c.String("identity")
+	if id == "" {
+		id = cfg.AdminIdentity.String()
+	}
+	signer, err := lib.LoadKeyFromString(id)
+	if err != nil {
+		return err
+	}
+	pass, err := readPassphrase(c)
+	if err != nil {
+		return err
+	}
+	buf, err := lib.ExportKey(*signer, cfg.ByzCoinID, pass)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.Args().First(), buf, 0600)
+}
+
+func keyImport(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the file to read the key from")
+	}
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+	pass, err := readPassphrase(c)
+	if err != nil {
+		return err
+	}
+	signer, err := lib.ImportKey(buf, cfg.ByzCoinID, pass)
+	if err != nil {
+		return err
+	}
+	// The keys are stored under their identity, so a stored key with the
+	// same identity is the same key.
+	if _, err = lib.LoadKey(signer.Identity()); err == nil {
+		fmt.Fprintln(c.App.Writer, "Key", signer.Identity(), "is already stored")
+		return nil
+	}
+	if err = lib.SaveKey(*signer); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, "Imported key", signer.Identity())
+	return nil
+}
+
+// readPassphrase reads the passphrase from --passphrase-file, or asks for it
+// on the terminal.
+func readPassphrase(c *cli.Context) (string, error) {
+	if fn := c.String("passphrase-file"); fn != "" {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
 	}
+	fmt.Fprint(c.App.ErrWriter, "Passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
 
-	cfg, cl, err := lib.LoadConfig(bcArg)
+func darcCli(c *cli.Context) error {
+	cfg, cl, err := loadConfig(c)
 	if err != nil {
 		return err
 	}
@@ -409,7 +930,14 @@ func darcCli(c *cli.Context) error {
 
 	var d *darc.Darc
 
+	// The darc can also be given as argument.
 	dstr := c.String("darc")
+	switch {
+	case arg[0] == "show" && len(arg) > 1, arg[0] == "add-signer" && len(arg) > 1:
+		dstr = arg[1]
+	case arg[0] == "rule" && len(arg) > 2:
+		dstr = arg[2]
+	}
 	if dstr == "" {
 		d, err = cl.GetGenDarc()
 		if err != nil {
@@ -428,10 +956,111 @@ func darcCli(c *cli.Context) error {
 	case "add":
 		return darcAdd(c, d, cfg, cl)
 	case "rule":
+		if len(arg) > 1 {
+			return darcRuleArgs(c, d, arg[1:], cfg, cl)
+		}
 		return darcRule(c, d, c.Bool("replace"), c.Bool("delete"), cfg, cl)
+	case "add-signer":
+		return darcAddSigner(c, d, arg[1:], cfg, cl)
 	default:
-		return errors.New("Invalid argument for darc command : add, show and rule are the valid options")
+		return errors.New("Invalid argument for darc command : add, show, rule and add-signer are the valid options")
+	}
+}
+
+// darcSigner returns the signer given with --sign, or the admin of the
+// ledger.
+func darcSigner(c *cli.Context, cfg lib.Config) (*darc.Signer, error) {
+	sstr := c.String("sign")
+	if sstr == "" {
+		return lib.LoadKey(cfg.AdminIdentity)
+	}
+	return lib.LoadKeyFromString(sstr)
+}
+
+// darcRuleArgs handles "rule add <darc-id> <action> <expression>" and
+// "rule rm <darc-id> <action>".
+func darcRuleArgs(c *cli.Context, d *darc.Darc, arg cli.Args, cfg lib.Config, cl *byzcoin.Client) error {
+	signer, err := darcSigner(c, cfg)
+	if err != nil {
+		return err
+	}
+
+	switch arg[0] {
+	case "add":
+		if len(arg) != 4 {
+			return errors.New("usage: darc rule add <darc-id> <action> <expression>")
+		}
+		action := darc.Action(arg[2])
+		expr := expression.Expr(arg[3])
+		if err := checkExpression(expr); err != nil {
+			return err
+		}
+		if c.Bool("replace") && d.Rules.Contains(action) {
+			return evolveDarc(c, cl, signer, d, byzcoin.DarcUpdateRule(action, expr))
+		}
+		return evolveDarc(c, cl, signer, d, byzcoin.DarcAddRule(action, expr))
+	case "rm":
+		if len(arg) != 3 {
+			return errors.New("usage: darc rule rm <darc-id> <action>")
+		}
+		return evolveDarc(c, cl, signer, d, byzcoin.DarcRemoveRule(darc.Action(arg[2])))
+	default:
+		return errors.New("Invalid argument for darc rule command : add and rm are the valid options")
+	}
+}
+
+// darcAddSigner handles "add-signer <darc-id> <identity>", which adds
+// the identity to the sign rule of the darc.
+func darcAddSigner(c *cli.Context, d *darc.Darc, arg cli.Args, cfg lib.Config, cl *byzcoin.Client) error {
+	if len(arg) != 2 {
+		return errors.New("usage: darc add-signer <darc-id> <identity>")
+	}
+	identity, err := parseSignerIdentity(arg[1])
+	if err != nil {
+		return err
+	}
+
+	signer, err := darcSigner(c, cfg)
+	if err != nil {
+		return err
+	}
+
+	return evolveDarc(c, cl, signer, d, byzcoin.DarcAddSigner(identity))
+}
+
+// parseSignerIdentity reads the identity of a signer of a darc, which is
+// either another darc, given as darc:<base id in hex>, or an ed25519 key,
+// see parseIdentity.
+func parseSignerIdentity(s string) (darc.Identity, error) {
+	if !strings.HasPrefix(s, "darc:") {
+		return parseIdentity(s)
+	}
+	id, err := hex.DecodeString(strings.TrimPrefix(s, "darc:"))
+	if err != nil || len(id) == 0 {
+		return darc.Identity{}, fmt.Errorf("invalid identity %q", s)
+	}
+	return darc.NewIdentityDarc(id), nil
+}
+
+// checkExpression makes sure the expression is valid before it is sent to the
+// ledger.
+func checkExpression(expr expression.Expr) error {
+	if err := expression.Validate(expr); err != nil {
+		return fmt.Errorf("invalid expression '%s': %v", expr, err)
+	}
+	return nil
+}
+
+// evolveDarc evolves d with the mutations, see byzcoin.EvolveDarc, and shows
+// the new version stored in the ledger.
+func evolveDarc(c *cli.Context, cl *byzcoin.Client, signer *darc.Signer, d *darc.Darc,
+	mutations ...byzcoin.DarcMutation) error {
+	d2, _, err := byzcoin.EvolveDarc(cl, *signer, d, mutations...)
+	if err != nil {
+		return err
 	}
+	fmt.Fprintln(c.App.Writer, d2.String())
+	return nil
 }
 
 func darcAdd(c *cli.Context, dGen *darc.Darc, cfg lib.Config, cl *byzcoin.Client) error {
@@ -478,8 +1107,6 @@ func darcAdd(c *cli.Context, dGen *darc.Darc, cfg lib.Config, cl *byzcoin.Client
 
 	instID := byzcoin.NewInstanceID(dGen.GetBaseID())
 
-	counters, err := cl.GetSignerCounters(signer.Identity().String())
-
 	spawn := byzcoin.Spawn{
 		ContractID: "darc",
 		Args: []byzcoin.Argument{
@@ -490,11 +1117,10 @@ func darcAdd(c *cli.Context, dGen *darc.Darc, cfg lib.Config, cl *byzcoin.Client
 		},
 	}
 	instr := byzcoin.Instruction{
-		InstanceID:    instID,
-		Spawn:         &spawn,
-		SignerCounter: []uint64{counters.Counters[0] + 1},
+		InstanceID: instID,
+		Spawn:      &spawn,
 	}
-	ctx, err := combineInstrsAndSign(*signer, instr)
+	ctx, err := combineInstrsAndSign(cl, *signer, instr)
 	if err != nil {
 		return err
 	}
@@ -560,7 +1186,7 @@ func darcShow(c *cli.Context, d *darc.Darc) error {
 
 		fo.Close()
 	} else {
-		fmt.Println(d.String())
+		fmt.Fprintln(c.App.Writer, d.String())
 	}
 
 	return nil
@@ -615,8 +1241,6 @@ func darcRule(c *cli.Context, d *darc.Darc, update bool, delete bool, cfg lib.Co
 		return err
 	}
 
-	counters, err := cl.GetSignerCounters(signer.Identity().String())
-
 	invoke := byzcoin.Invoke{
 		Command: "evolve",
 		Args: []byzcoin.Argument{
@@ -627,11 +1251,10 @@ func darcRule(c *cli.Context, d *darc.Darc, update bool, delete bool, cfg lib.Co
 		},
 	}
 	instr := byzcoin.Instruction{
-		InstanceID:    byzcoin.NewInstanceID(d2.GetBaseID()),
-		Invoke:        &invoke,
-		SignerCounter: []uint64{counters.Counters[0] + 1},
+		InstanceID: byzcoin.NewInstanceID(d2.GetBaseID()),
+		Invoke:     &invoke,
 	}
-	ctx, err := combineInstrsAndSign(*signer, instr)
+	ctx, err := combineInstrsAndSign(cl, *signer, instr)
 	if err != nil {
 		return err
 	}
@@ -660,8 +1283,6 @@ func darcRuleDel(c *cli.Context, d *darc.Darc, action string, signer *darc.Signe
 		return err
 	}
 
-	counters, err := cl.GetSignerCounters(signer.Identity().String())
-
 	invoke := byzcoin.Invoke{
 		Command: "evolve",
 		Args: []byzcoin.Argument{
@@ -672,11 +1293,10 @@ func darcRuleDel(c *cli.Context, d *darc.Darc, action string, signer *darc.Signe
 		},
 	}
 	instr := byzcoin.Instruction{
-		InstanceID:    byzcoin.NewInstanceID(d2.GetBaseID()),
-		Invoke:        &invoke,
-		SignerCounter: []uint64{counters.Counters[0] + 1},
+		InstanceID: byzcoin.NewInstanceID(d2.GetBaseID()),
+		Invoke:     &invoke,
 	}
-	ctx, err := combineInstrsAndSign(*signer, instr)
+	ctx, err := combineInstrsAndSign(cl, *signer, instr)
 	if err != nil {
 		return err
 	}
@@ -689,6 +1309,297 @@ func darcRuleDel(c *cli.Context, d *darc.Darc, action string, signer *darc.Signe
 	return nil
 }
 
+// walletAccount is the coin account printed by wallet show --json.
+type walletAccount struct {
+	PublicKey   string `json:"publicKey"`
+	CoinAddress string `json:"coinAddress"`
+	Balance     uint64 `json:"balance"`
+	ByzCoinID   string `json:"byzcoinID"`
+}
+
+func walletShow(c *cli.Context) error {
+	if c.Bool("json") {
+		defer logToStderr(c)()
+	}
+	cfg, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	owner, err := walletIdentity(c, cfg)
+	if err != nil {
+		return err
+	}
+	id, err := coinAddress(owner)
+	if err != nil {
+		return err
+	}
+	b, err := lib.GetBalance(cl, id)
+	if err != nil {
+		return err
+	}
+	a := walletAccount{
+		PublicKey:   owner.Ed25519.Point.String(),
+		CoinAddress: b.Address,
+		Balance:     b.Balance,
+		ByzCoinID:   fmt.Sprintf("%x", cfg.ByzCoinID),
+	}
+	const hint = "account not initialized yet - run init-account"
+	if c.Bool("json") {
+		if !b.Exists {
+			fmt.Fprintln(c.App.ErrWriter, hint)
+		}
+		return json.NewEncoder(c.App.Writer).Encode(a)
+	}
+	fmt.Fprintln(c.App.Writer, "ByzCoinID:", a.ByzCoinID)
+	fmt.Fprintln(c.App.Writer, "Public key:", a.PublicKey)
+	fmt.Fprintln(c.App.Writer, "Address:", a.CoinAddress)
+	if !b.Exists {
+		fmt.Fprintln(c.App.Writer, hint)
+		return nil
+	}
+	fmt.Fprintln(c.App.Writer, "Balance:", a.Balance)
+	return nil
+}
+
+func walletInitAccount(c *cli.Context) error {
+	cfg, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	owner, err := walletIdentity(c, cfg)
+	if err != nil {
+		return err
+	}
+	id, err := coinAddress(owner)
+	if err != nil {
+		return err
+	}
+	b, err := lib.GetBalance(cl, id)
+	if err != nil {
+		return err
+	}
+	if b.Exists {
+		return fmt.Errorf("account %s already exists", b.Address)
+	}
+	gd, err := cl.GetGenDarc()
+	if err != nil {
+		return err
+	}
+	action := darc.Action("spawn:" + contracts.ContractCoinID)
+	signer, err := initAccountSigner(c, cfg, cl, gd, action, owner)
+	if err != nil {
+		return err
+	}
+	if err = checkRule(cl, gd, action, *signer); err != nil {
+		return err
+	}
+	pub, err := owner.Ed25519.Point.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, _, err = byzcoin.NewTxBuilder(cl).
+		Spawn(byzcoin.NewInstanceID(gd.GetBaseID()), contracts.ContractCoinID,
+			byzcoin.Arguments{{Name: "public", Value: pub}}).
+		SignAndSubmit(*signer, 10)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, "Spawned account", b.Address)
+	return nil
+}
+
+// initAccountSigner returns the signer given with --sign, else the key of
+// the owner if it is stored locally and allowed to spawn the account, else
+// the admin of the ledger.
+func initAccountSigner(c *cli.Context, cfg lib.Config, cl *byzcoin.Client, gd *darc.Darc,
+	action darc.Action, owner darc.Identity) (*darc.Signer, error) {
+	if c.String("sign") != "" {
+		return darcSigner(c, cfg)
+	}
+	if signer, err := lib.LoadKey(owner); err == nil && checkRule(cl, gd, action, *signer) == nil {
+		return signer, nil
+	}
+	return lib.LoadKey(cfg.AdminIdentity)
+}
+
+// logToStderr keeps the log of the command until the returned function is
+// called, which writes it to the error writer of the app, so that only the
+// output of the command goes to its writer.
+func logToStderr(c *cli.Context) func() {
+	log.OutputToBuf()
+	return func() {
+		fmt.Fprint(c.App.ErrWriter, log.GetStdOut(), log.GetStdErr())
+		log.OutputToOs()
+	}
+}
+
+func walletBalance(c *cli.Context) error {
+	if c.Bool("json") {
+		defer logToStderr(c)()
+	}
+	if c.NArg() != 1 {
+		return errors.New("please give the address of the account or the public key of its owner")
+	}
+	id, err := parseCoinAddress(c.Args().First())
+	if err != nil {
+		return err
+	}
+	_, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	b, err := lib.GetBalance(cl, id)
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		return json.NewEncoder(c.App.Writer).Encode(b)
+	}
+	fmt.Fprintln(c.App.Writer, "Address:", b.Address)
+	if !b.Exists {
+		fmt.Fprintln(c.App.Writer, "The account does not exist")
+		return nil
+	}
+	fmt.Fprintln(c.App.Writer, "Coin:", b.Coin)
+	fmt.Fprintln(c.App.Writer, "Balance:", b.Balance)
+	return nil
+}
+
+func walletMint(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("please give the number of coins to mint")
+	}
+	amount, err := strconv.ParseUint(c.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount %q: %v", c.Args().First(), err)
+	}
+	cfg, cl, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	signer, err := darcSigner(c, cfg)
+	if err != nil {
+		return err
+	}
+	owner, err := walletIdentity(c, cfg)
+	if err != nil {
+		return err
+	}
+	id, err := coinAddress(owner)
+	if err != nil {
+		return err
+	}
+	b, err := lib.GetBalance(cl, id)
+	if err != nil {
+		return err
+	}
+
+	tb := byzcoin.NewTxBuilder(cl)
+	var d *darc.Darc
+	if b.Exists {
+		d, err = getDarcByString(cl, b.Darc)
+		if err != nil {
+			return err
+		}
+	} else {
+		// The account is spawned with the genesis darc, which then
+		// also controls it.
+		d, err = cl.GetGenDarc()
+		if err != nil {
+			return err
+		}
+		if err = checkRule(cl, d, darc.Action("spawn:"+contracts.ContractCoinID), *signer); err != nil {
+			return err
+		}
+		pub, err := owner.Ed25519.Point.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		tb.Spawn(byzcoin.NewInstanceID(d.GetBaseID()), contracts.ContractCoinID,
+			byzcoin.Arguments{{Name: "public", Value: pub}})
+	}
+	if err = checkRule(cl, d, "invoke:mint", *signer); err != nil {
+		return err
+	}
+	coins := make([]byte, 8)
+	binary.LittleEndian.PutUint64(coins, amount)
+	_, _, err = tb.Invoke(id, "mint", byzcoin.Arguments{{Name: "coins", Value: coins}}).
+		SignAndSubmit(*signer, 10)
+	if err != nil {
+		return err
+	}
+
+	b, err = lib.GetBalance(cl, id)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.App.Writer, "Address:", b.Address)
+	fmt.Fprintln(c.App.Writer, "Balance:", b.Balance)
+	return nil
+}
+
+// walletIdentity returns the identity given with --identity, or the admin of
+// the ledger.
+func walletIdentity(c *cli.Context, cfg lib.Config) (darc.Identity, error) {
+	if id := c.String("identity"); id != "" {
+		return parseIdentity(id)
+	}
+	if cfg.AdminIdentity.Ed25519 == nil {
+		return darc.Identity{}, errors.New("the config has no admin identity, use --identity")
+	}
+	return cfg.AdminIdentity, nil
+}
+
+// checkRule returns an error if the signer alone cannot sign for the action
+// of the darc, so that the transaction isn't sent for nothing.
+func checkRule(cl *byzcoin.Client, d *darc.Darc, action darc.Action, signer darc.Signer) error {
+	if !d.Rules.Contains(action) {
+		return fmt.Errorf("darc %x has no rule %s", d.GetBaseID(), action)
+	}
+	getDarc := func(s string, latest bool) *darc.Darc {
+		d, err := getDarcByString(cl, s)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+	if err := darc.EvalExpr(d.Rules.Get(action), getDarc, signer.Identity().String()); err != nil {
+		return fmt.Errorf("%s is not allowed to %s with darc %x: %v",
+			signer.Identity(), action, d.GetBaseID(), err)
+	}
+	return nil
+}
+
+// parseCoinAddress reads the address of a coin account, which is either its
+// instance ID in hex, or the public key of its owner given as
+// ed25519:<public key in hex>, see contracts.CoinHash.
+func parseCoinAddress(s string) (byzcoin.InstanceID, error) {
+	if strings.HasPrefix(s, "ed25519:") {
+		id, err := parseIdentity(s)
+		if err != nil {
+			return byzcoin.InstanceID{}, err
+		}
+		return coinAddress(id)
+	}
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf) != len(byzcoin.InstanceID{}) {
+		return byzcoin.InstanceID{}, fmt.Errorf("invalid address %q: must be 32 bytes in hex", s)
+	}
+	return byzcoin.NewInstanceID(buf), nil
+}
+
+// coinAddress returns the address of the coin account owned by id.
+func coinAddress(id darc.Identity) (byzcoin.InstanceID, error) {
+	if id.Ed25519 == nil {
+		return byzcoin.InstanceID{}, errors.New("only ed25519 identities own coin accounts")
+	}
+	pub, err := id.Ed25519.Point.MarshalBinary()
+	if err != nil {
+		return byzcoin.InstanceID{}, err
+	}
+	return contracts.CoinHash(pub), nil
+}
+
 type configPrivate struct {
 	Owner darc.Signer
 }
@@ -716,8 +1627,10 @@ func rosterToServers(r *onet.Roster) []network.Address {
 }
 
 func getDarcByString(cl *byzcoin.Client, id string) (*darc.Darc, error) {
-	var xrep []byte
-	fmt.Sscanf(id[5:], "%x", &xrep)
+	xrep, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid darc ID '%s': %v", id, err)
+	}
 	return getDarcByID(cl, xrep)
 }
 
@@ -726,13 +1639,27 @@ func getDarcByID(cl *byzcoin.Client, id []byte) (*darc.Darc, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	p := &pr.Proof
-	var vs []byte
-	_, vs, _, _, err = p.KeyValue()
+	genesis, err := cl.GenesisBlock()
 	if err != nil {
 		return nil, err
 	}
+	return darcFromProof(genesis, id, &pr.Proof)
+}
+
+// darcFromProof returns the darc stored in the proof, after checking that
+// the proof comes from the ByzCoin of the genesis block and holds the darc
+// id.
+func darcFromProof(genesis *skipchain.SkipBlock, id []byte, p *byzcoin.Proof) (*darc.Darc, error) {
+	key, vs, contract, _, err := byzcoin.VerifyProofOffline(genesis, p)
+	if err != nil {
+		return nil, fmt.Errorf("proof does not verify against chain %x: %v", genesis.Hash, err)
+	}
+	if !bytes.Equal(key, id) {
+		return nil, fmt.Errorf("cannot find darc %x", id)
+	}
+	if string(contract) != byzcoin.ContractDarcID {
+		return nil, errors.New("expected contract to be darc but got: " + string(contract))
+	}
 
 	d, err := darc.NewFromProtobuf(vs)
 	if err != nil {
@@ -742,15 +1669,10 @@ func getDarcByID(cl *byzcoin.Client, id []byte) (*darc.Darc, error) {
 	return d, nil
 }
 
-func combineInstrsAndSign(signer darc.Signer, instrs ...byzcoin.Instruction) (byzcoin.ClientTransaction, error) {
+func combineInstrsAndSign(cl *byzcoin.Client, signer darc.Signer, instrs ...byzcoin.Instruction) (byzcoin.ClientTransaction, error) {
 	t := byzcoin.ClientTransaction{
 		Instructions: instrs,
 	}
-	t.InstructionsHash = t.Instructions.Hash()
-	for i := range t.Instructions {
-		if err := t.Instructions[i].SignWith(t.InstructionsHash, signer); err != nil {
-			return t, err
-		}
-	}
-	return t, nil
+	err := t.FillSignersAndSignWith(cl, signer)
+	return t, err
 }
@@ -2,16 +2,24 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/bcadmin/lib"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/app"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/require"
 )
 
@@ -57,7 +65,7 @@ func TestCli(t *testing.T) {
 	b := &bytes.Buffer{}
 	cliApp.Writer = b
 	cliApp.ErrWriter = b
-	args := []string{"bcadmin", "create", "-roster", rf, "--interval", interval.String()}
+	args := []string{"bcadmin", "create", "-roster", rf, "--interval", interval.String(), "--name", "main"}
 	err = cliApp.Run(args)
 	require.NoError(t, err)
 	require.Contains(t, string(b.Bytes()), "Created")
@@ -78,6 +86,35 @@ func TestCli(t *testing.T) {
 	require.Contains(t, string(b.Bytes()), "Roster: tcp://127.0.0.1")
 	require.Contains(t, string(b.Bytes()), "spawn:darc")
 
+	log.Lvl1("code: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	cliApp.ErrWriter = b
+	args = []string{"bcadmin", "code"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	shared := strings.TrimSpace(b.String())
+	cfg, err := lib.ImportCompact(shared)
+	require.NoError(t, err)
+	require.Equal(t, len(roster.List), len(cfg.Roster.List))
+
+	log.Lvl1("key export: ")
+	pf := path.Join(dir, "passphrase")
+	require.NoError(t, ioutil.WriteFile(pf, []byte("secret\n"), 0600))
+	kf := path.Join(dir, "key.export")
+	args = []string{"bcadmin", "key", "export", "--passphrase-file", pf, kf}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+
+	log.Lvl1("key import: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	cliApp.ErrWriter = b
+	args = []string{"bcadmin", "key", "import", "--passphrase-file", pf, kf}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "already stored")
+
 	log.Lvl1("add: ")
 	b = &bytes.Buffer{}
 	cliApp.Writer = b
@@ -97,4 +134,304 @@ func TestCli(t *testing.T) {
 	require.NoError(t, err)
 	require.Contains(t, string(b.Bytes()), "Roster: tcp://127.0.0.1")
 	require.Contains(t, string(b.Bytes()), "spawn:xxx - \"ed25519:XXX\"")
+
+	log.Lvl1("darc add: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	cliApp.ErrWriter = b
+	idFile := path.Join(dir, "darc_id.txt")
+	keyFile := path.Join(dir, "darc_key.txt")
+	args = []string{"bcadmin", "darc", "--out_id", idFile, "--out_key", keyFile, "add"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	id, err := ioutil.ReadFile(idFile)
+	require.NoError(t, err)
+	key, err := ioutil.ReadFile(keyFile)
+	require.NoError(t, err)
+
+	log.Lvl1("darc rule add: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "darc", "--sign", string(key), "rule", "add", string(id),
+		"spawn:xxx", "ed25519:aa | ed25519:bb"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Ver:\t1")
+	require.Contains(t, b.String(), "spawn:xxx - \"ed25519:aa | ed25519:bb\"")
+
+	// Invalid expressions are refused before being sent.
+	args = []string{"bcadmin", "darc", "--sign", string(key), "rule", "add", string(id),
+		"spawn:yyy", "ed25519:aa &"}
+	err = cliApp.Run(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid expression")
+	require.Contains(t, err.Error(), "offset 12")
+	args = []string{"bcadmin", "darc", "--sign", string(key), "rule", "add", string(id),
+		"spawn:yyy", "ed25519:aa | ed25519:bb & ed25519:cc"}
+	err = cliApp.Run(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "use parentheses")
+
+	log.Lvl1("darc add-signer: ")
+	newSigner := darc.NewSignerEd25519(nil, nil).Identity().String()
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "darc", "--sign", string(key), "add-signer", string(id), newSigner}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Ver:\t2")
+	args = []string{"bcadmin", "darc", "--sign", string(key), "add-signer", string(id), newSigner}
+	require.Error(t, cliApp.Run(args))
+	args = []string{"bcadmin", "darc", "--sign", string(key), "add-signer", string(id), "ed25519:cc"}
+	require.Error(t, cliApp.Run(args))
+
+	log.Lvl1("darc show: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "darc", "show", string(id)}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Ver:\t2")
+	require.Contains(t, b.String(), "spawn:xxx - \"ed25519:aa | ed25519:bb\"")
+	require.Contains(t, b.String(), "_sign - \""+string(key)+" | "+newSigner+"\"")
+
+	log.Lvl1("darc rule rm: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "darc", "--sign", string(key), "rule", "rm", string(id), "spawn:xxx"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Ver:\t3")
+	require.NotContains(t, b.String(), "spawn:xxx")
+
+	log.Lvl1("chains: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "chains"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), ol.(string))
+	require.Contains(t, b.String(), "\tmain (default)\t")
+	args = []string{"bcadmin", "chains", "default", "unknown"}
+	require.Error(t, cliApp.Run(args))
+	args = []string{"bcadmin", "chains", "default", "main"}
+	require.NoError(t, cliApp.Run(args))
+
+	log.Lvl1("status: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "status"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Equal(t, len(roster.List), strings.Count(b.String(), "\tok\t"))
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "status", "--format", "json"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Equal(t, len(roster.List), strings.Count(b.String(), "\"reachable\": true"))
+
+	log.Lvl1("wallet balance: ")
+	wcfg, _, err := lib.LoadConfig(ol.(string))
+	require.NoError(t, err)
+	admin := wcfg.AdminIdentity.String()
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "balance", admin}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "The account does not exist")
+	args = []string{"bcadmin", "wallet", "balance", "abcd"}
+	require.Error(t, cliApp.Run(args))
+	args = []string{"bcadmin", "wallet", "balance", wcfg.GenesisDarc.GetIdentityString()[len("darc:"):]}
+	require.Error(t, cliApp.Run(args))
+
+	log.Lvl1("wallet mint: ")
+	args = []string{"bcadmin", "wallet", "mint", "42"}
+	err = cliApp.Run(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has no rule spawn:coin")
+	args = []string{"bcadmin", "add", "--identity", admin, "spawn:coin"}
+	require.NoError(t, cliApp.Run(args))
+	args = []string{"bcadmin", "add", "--identity", admin, "invoke:mint"}
+	require.NoError(t, cliApp.Run(args))
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "mint", "42"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Balance: 42")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "mint", "--identity", admin, "8"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Balance: 50")
+	args = []string{"bcadmin", "wallet", "mint", "--sign", string(key), "1"}
+	err = cliApp.Run(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not allowed to invoke:mint")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "balance", "--json", admin}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "\"exists\":true")
+	require.Contains(t, b.String(), "\"balance\":50")
+
+	log.Lvl1("wallet show: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "show"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Public key: "+wcfg.AdminIdentity.Ed25519.Point.String())
+	require.Contains(t, b.String(), "Balance: 50")
+	// With --json, the output is a single JSON object.
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "--debug", "1", "wallet", "show", "--json"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	var account walletAccount
+	require.NoError(t, json.Unmarshal(b.Bytes(), &account))
+	require.Equal(t, wcfg.AdminIdentity.Ed25519.Point.String(), account.PublicKey)
+	require.Equal(t, uint64(50), account.Balance)
+	require.Equal(t, fmt.Sprintf("%x", wcfg.ByzCoinID), account.ByzCoinID)
+	coinID, err := coinAddress(wcfg.AdminIdentity)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%x", coinID.Slice()), account.CoinAddress)
+
+	log.Lvl1("wallet init-account: ")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "show", "--identity", string(key)}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "account not initialized yet - run init-account")
+	require.NotContains(t, b.String(), "Balance:")
+	// The owner is not allowed to spawn the account, so the admin does.
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "init-account", "--identity", string(key)}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Spawned account")
+	args = []string{"bcadmin", "wallet", "init-account", "--identity", string(key)}
+	err = cliApp.Run(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already exists")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "show", "--identity", string(key)}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Balance: 0")
+	// Only the owner is allowed to spawn the account, so it signs.
+	ownerFile := path.Join(dir, "owner.txt")
+	args = []string{"bcadmin", "key", "--save", ownerFile}
+	require.NoError(t, cliApp.Run(args))
+	owner, err := ioutil.ReadFile(ownerFile)
+	require.NoError(t, err)
+	ownerID := strings.TrimSpace(string(owner))
+	args = []string{"bcadmin", "add", "--replace", "--identity", ownerID, "spawn:coin"}
+	require.NoError(t, cliApp.Run(args))
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "wallet", "init-account", "--identity", ownerID}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Spawned account")
+
+	log.Lvl1("show with an ID prefix: ")
+	cfg, _, err = lib.LoadConfig(ol.(string))
+	require.NoError(t, err)
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "show", "--bc", fmt.Sprintf("%x", cfg.ByzCoinID[:4])}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), fmt.Sprintf("%x", cfg.ByzCoinID))
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "show", "--chain", "main"}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), fmt.Sprintf("%x", cfg.ByzCoinID))
+
+	log.Lvl1("join: ")
+	args = []string{"bcadmin", "join", "--url", string(roster.List[1].Address),
+		fmt.Sprintf("%x", cfg.ByzCoinID)}
+	err = cliApp.Run(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--force")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "join", "--force", "--url", string(roster.List[1].Address),
+		fmt.Sprintf("%x", cfg.ByzCoinID)}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Joined ByzCoin")
+	require.Equal(t, ol, cliApp.Metadata["BC"])
+	joined, _, err := lib.LoadConfig(ol.(string))
+	require.NoError(t, err)
+	require.True(t, joined.Roster.ID.Equal(cfg.Roster.ID))
+	// The genesis darc has been evolved by add.
+	require.Equal(t, cfg.GenesisDarc.GetBaseID(), joined.GenesisDarc.GetBaseID())
+	require.Contains(t, joined.GenesisDarc.String(), "spawn:xxx")
+	args = []string{"bcadmin", "join", "--url", string(roster.List[1].Address), "abcd"}
+	require.Error(t, cliApp.Run(args))
+
+	log.Lvl1("join with a code: ")
+	args = []string{"bcadmin", "join", "--code", shared}
+	err = cliApp.Run(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--force")
+	b = &bytes.Buffer{}
+	cliApp.Writer = b
+	args = []string{"bcadmin", "join", "--force", "--code", shared}
+	err = cliApp.Run(args)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "Joined ByzCoin")
+	joined, _, err = lib.LoadConfig(ol.(string))
+	require.NoError(t, err)
+	require.Contains(t, joined.GenesisDarc.String(), "spawn:xxx")
+}
+
+func TestDarcFromProof(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:darc"}, signer.Identity())
+	require.NoError(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.NoError(t, err)
+	id := msg.GenesisDarc.GetBaseID()
+
+	pr, err := cl.GetProof(id)
+	require.NoError(t, err)
+	genesis, err := cl.GenesisBlock()
+	require.NoError(t, err)
+	d, err := darcFromProof(genesis, id, &pr.Proof)
+	require.NoError(t, err)
+	require.Equal(t, msg.GenesisDarc.GetID(), d.GetID())
+
+	_, err = darcFromProof(genesis, []byte("other"), &pr.Proof)
+	require.Contains(t, err.Error(), "cannot find darc")
+	other := *genesis
+	other.Hash = skipchain.SkipBlockID("other")
+	_, err = darcFromProof(&other, id, &pr.Proof)
+	require.Contains(t, err.Error(), "proof does not verify against chain")
+
+	// A conode that changes the trie root of the latest block.
+	pr.Proof.Latest.Data, err = protobuf.Encode(&byzcoin.DataHeader{
+		TrieRoot: pr.Proof.InclusionProof.GetRoot(),
+	})
+	require.NoError(t, err)
+	pr.Proof.Latest.Hash = pr.Proof.Latest.CalculateHash()
+	_, err = darcFromProof(genesis, id, &pr.Proof)
+	require.Contains(t, err.Error(), "proof does not verify against chain")
 }
@@ -0,0 +1,131 @@
+package byzcoin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// BlockSummary is a readable form of a ByzCoin block, as returned by
+// DecodeBlock. The binary values are hex-encoded.
+type BlockSummary struct {
+	Index     int    `json:"index"`
+	Hash      string `json:"hash"`
+	TrieRoot  string `json:"trie_root,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	// Transactions is empty for blocks without transactions and for blocks
+	// whose payload could not be decoded.
+	Transactions []TxSummary `json:"transactions"`
+	// Warnings lists the parts of the block that could not be decoded,
+	// e.g. because the block has been created by another version.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// TxSummary describes one transaction of a block.
+type TxSummary struct {
+	Hash         string               `json:"hash"`
+	Accepted     bool                 `json:"accepted"`
+	Instructions []InstructionSummary `json:"instructions"`
+}
+
+// InstructionSummary describes one instruction of a transaction. The
+// contract ID is only known for spawn instructions, as the other ones only
+// point to the instance.
+type InstructionSummary struct {
+	Type       string            `json:"type"`
+	InstanceID string            `json:"instance_id"`
+	ContractID string            `json:"contract_id,omitempty"`
+	Command    string            `json:"command,omitempty"`
+	Args       []ArgumentSummary `json:"args,omitempty"`
+	Signers    []string          `json:"signers"`
+	Counters   []uint64          `json:"counters"`
+}
+
+// ArgumentSummary gives the name and the size of the value of an argument.
+type ArgumentSummary struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// DecodeBlock unpacks the header and the transactions of a ByzCoin block.
+// Parts of the block that cannot be decoded are reported in the Warnings of
+// the summary instead of returning an error, so that blocks of other
+// versions can still be shown.
+func DecodeBlock(sb *skipchain.SkipBlock) (*BlockSummary, error) {
+	if sb == nil || sb.SkipBlockFix == nil {
+		return nil, errors.New("no block given")
+	}
+	sum := &BlockSummary{
+		Index:        sb.Index,
+		Hash:         hex.EncodeToString(sb.Hash),
+		Transactions: []TxSummary{},
+	}
+
+	var header DataHeader
+	err := protobuf.DecodeWithConstructors(sb.Data, &header, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		sum.Warnings = append(sum.Warnings, "couldn't decode header: "+err.Error())
+	} else {
+		sum.TrieRoot = hex.EncodeToString(header.TrieRoot)
+		sum.Timestamp = header.Timestamp
+	}
+
+	if len(sb.Payload) == 0 {
+		return sum, nil
+	}
+	var body DataBody
+	err = protobuf.DecodeWithConstructors(sb.Payload, &body, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		sum.Warnings = append(sum.Warnings, "couldn't decode transactions: "+err.Error())
+		return sum, nil
+	}
+	for _, tx := range body.TxResults {
+		ts := TxSummary{
+			Hash:         hex.EncodeToString(tx.ClientTransaction.Instructions.Hash()),
+			Accepted:     tx.Accepted,
+			Instructions: make([]InstructionSummary, len(tx.ClientTransaction.Instructions)),
+		}
+		for i, instr := range tx.ClientTransaction.Instructions {
+			ts.Instructions[i] = summarizeInstruction(instr)
+		}
+		sum.Transactions = append(sum.Transactions, ts)
+	}
+	return sum, nil
+}
+
+func summarizeInstruction(instr Instruction) InstructionSummary {
+	is := InstructionSummary{
+		InstanceID: hex.EncodeToString(instr.InstanceID[:]),
+		Signers:    instr.GetIdentityStrings(),
+		Counters:   instr.SignerCounter,
+	}
+	var args Arguments
+	switch instr.GetType() {
+	case SpawnType:
+		is.Type = "spawn"
+		is.ContractID = instr.Spawn.ContractID
+		args = instr.Spawn.Args
+	case InvokeType:
+		is.Type = "invoke"
+		is.Command = instr.Invoke.Command
+		args = instr.Invoke.Args
+	case DeleteType:
+		is.Type = "delete"
+	default:
+		is.Type = "invalid"
+	}
+	for _, arg := range args {
+		is.Args = append(is.Args, ArgumentSummary{Name: arg.Name, Size: len(arg.Value)})
+	}
+	return is
+}
+
+// JSON returns the indented JSON representation of the summary.
+func (sum *BlockSummary) JSON() ([]byte, error) {
+	return json.MarshalIndent(sum, "", "  ")
+}
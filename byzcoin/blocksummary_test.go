@@ -0,0 +1,94 @@
+package byzcoin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeBlock(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := NewGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy", "invoke:update_config"},
+		signer.Identity(), WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	c, _, err := NewLedger(msg, false)
+	require.Nil(t, err)
+	dID := NewInstanceID(msg.GenesisDarc.GetBaseID())
+
+	config, err := c.FetchChainConfig()
+	require.Nil(t, err)
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	ctx, _, err := NewTxBuilder(c).
+		Spawn(dID, dummyContract, Arguments{{Name: "data", Value: []byte("12345")}}).
+		Invoke(ConfigInstanceID, "update_config", Arguments{{Name: "config", Value: configBuf}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	p, err := c.GetProof(dID.Slice())
+	require.Nil(t, err)
+
+	sum, err := DecodeBlock(&p.Proof.Latest)
+	require.Nil(t, err)
+	require.Equal(t, p.Proof.Latest.Index, sum.Index)
+	require.Equal(t, hex.EncodeToString(p.Proof.Latest.Hash), sum.Hash)
+	require.Equal(t, hex.EncodeToString(p.Proof.InclusionProof.GetRoot()), sum.TrieRoot)
+	require.Equal(t, 0, len(sum.Warnings))
+	require.Equal(t, 1, len(sum.Transactions))
+	tx := sum.Transactions[0]
+	require.Equal(t, hex.EncodeToString(ctx.Instructions.Hash()), tx.Hash)
+	require.True(t, tx.Accepted)
+	require.Equal(t, 2, len(tx.Instructions))
+
+	spawn := tx.Instructions[0]
+	require.Equal(t, "spawn", spawn.Type)
+	require.Equal(t, hex.EncodeToString(dID[:]), spawn.InstanceID)
+	require.Equal(t, dummyContract, spawn.ContractID)
+	require.Equal(t, []ArgumentSummary{{Name: "data", Size: 5}}, spawn.Args)
+	require.Equal(t, []string{signer.Identity().String()}, spawn.Signers)
+	require.Equal(t, []uint64{1}, spawn.Counters)
+
+	invoke := tx.Instructions[1]
+	require.Equal(t, "invoke", invoke.Type)
+	require.Equal(t, "update_config", invoke.Command)
+	require.Equal(t, "", invoke.ContractID)
+	require.Equal(t, []ArgumentSummary{{Name: "config", Size: len(configBuf)}}, invoke.Args)
+	require.Equal(t, []uint64{2}, invoke.Counters)
+
+	buf, err := sum.JSON()
+	require.Nil(t, err)
+	var decoded BlockSummary
+	require.Nil(t, json.Unmarshal(buf, &decoded))
+	require.Equal(t, *sum, decoded)
+
+	// The genesis block holds the transaction creating the ledger.
+	sb, err := skipchain.NewClient().GetSingleBlockByIndex(roster, c.ID, 0)
+	require.Nil(t, err)
+	sum, err = DecodeBlock(sb.SkipBlock)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sum.Transactions))
+	require.Equal(t, "spawn", sum.Transactions[0].Instructions[0].Type)
+
+	// Unknown payloads are reported but don't make the decoding fail.
+	unknown := p.Proof.Latest.Copy()
+	unknown.Payload = []byte{0xff, 0xff, 0xff}
+	sum, err = DecodeBlock(unknown)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(sum.Transactions))
+	require.Equal(t, 1, len(sum.Warnings))
+
+	_, err = DecodeBlock(nil)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,163 @@
+package byzcoin
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+)
+
+// defaultPageSize is the number of instances returned by
+// ListInstancesByContract if the request doesn't give a page size.
+const defaultPageSize = 100
+
+// maxPageSize is the maximum number of instances returned by
+// ListInstancesByContract.
+const maxPageSize = 1000
+
+type indexEntry struct {
+	version uint64
+	darcID  darc.ID
+}
+
+// chainIndex holds the instances of every contract of one skipchain.
+type chainIndex struct {
+	// contracts maps a contract ID to its instances.
+	contracts map[string]map[string]indexEntry
+	// contractOf maps an instance ID to its contract ID, so that removed
+	// instances can be found.
+	contractOf map[string]string
+}
+
+func newChainIndex() *chainIndex {
+	return &chainIndex{
+		contracts:  make(map[string]map[string]indexEntry),
+		contractOf: make(map[string]string),
+	}
+}
+
+func (ci *chainIndex) set(iID []byte, contractID string, e indexEntry) {
+	ci.remove(iID)
+	if ci.contracts[contractID] == nil {
+		ci.contracts[contractID] = make(map[string]indexEntry)
+	}
+	ci.contracts[contractID][string(iID)] = e
+	ci.contractOf[string(iID)] = contractID
+}
+
+func (ci *chainIndex) remove(iID []byte) {
+	contractID, ok := ci.contractOf[string(iID)]
+	if !ok {
+		return
+	}
+	delete(ci.contracts[contractID], string(iID))
+	if len(ci.contracts[contractID]) == 0 {
+		delete(ci.contracts, contractID)
+	}
+	delete(ci.contractOf, string(iID))
+}
+
+// contractIndex is a secondary index of the state tries, mapping the
+// contract IDs to the instances of this contract. The index of a skipchain
+// is built from its state trie the first time it is used, which is the case
+// after every restart of the service, and then kept up to date with the
+// state changes of the new blocks.
+type contractIndex struct {
+	sync.Mutex
+	chains map[string]*chainIndex
+}
+
+func newContractIndex() contractIndex {
+	return contractIndex{chains: make(map[string]*chainIndex)}
+}
+
+// apply updates the index of the given skipchain with the state changes of
+// a new block. Nothing is done if the index has not been built yet.
+func (idx *contractIndex) apply(scID skipchain.SkipBlockID, scs StateChanges) {
+	idx.Lock()
+	defer idx.Unlock()
+	ci, ok := idx.chains[string(scID)]
+	if !ok {
+		return
+	}
+	for _, sc := range scs {
+		switch sc.StateAction {
+		case Create, Update:
+			ci.set(sc.InstanceID, string(sc.ContractID),
+				indexEntry{version: sc.Version, darcID: sc.DarcID})
+		case Remove:
+			ci.remove(sc.InstanceID)
+		}
+	}
+}
+
+// reset drops the index of the given skipchain, so that it is built again
+// the next time it is used.
+func (idx *contractIndex) reset(scID skipchain.SkipBlockID) {
+	idx.Lock()
+	defer idx.Unlock()
+	delete(idx.chains, string(scID))
+}
+
+// list returns up to size instances of the given contract, in the order of
+// their IDs, starting after the instance ID given in start. The returned
+// slice is the continuation token for the next page and is nil if there are
+// no more instances.
+func (idx *contractIndex) list(scID skipchain.SkipBlockID, st *stateTrie, contractID string,
+	start []byte, size int) ([]InstanceInfo, []byte, error) {
+	idx.Lock()
+	defer idx.Unlock()
+	ci, ok := idx.chains[string(scID)]
+	if !ok {
+		var err error
+		ci, err = buildChainIndex(st)
+		if err != nil {
+			return nil, nil, err
+		}
+		idx.chains[string(scID)] = ci
+	}
+
+	entries := ci.contracts[contractID]
+	ids := make([]string, 0, len(entries))
+	for id := range entries {
+		if bytes.Compare([]byte(id), start) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var next []byte
+	if len(ids) > size {
+		ids = ids[:size]
+		next = []byte(ids[size-1])
+	}
+	infos := make([]InstanceInfo, len(ids))
+	for i, id := range ids {
+		infos[i] = InstanceInfo{
+			InstanceID: NewInstanceID([]byte(id)),
+			Version:    entries[id].version,
+			DarcID:     entries[id].darcID,
+		}
+	}
+	return infos, next, nil
+}
+
+// buildChainIndex goes through all the instances stored in the trie.
+func buildChainIndex(st *stateTrie) (*chainIndex, error) {
+	ci := newChainIndex()
+	err := st.ForEach(func(k, v []byte) error {
+		body, err := decodeStateChangeBody(v)
+		if err != nil {
+			return err
+		}
+		ci.set(k, string(body.ContractID),
+			indexEntry{version: body.Version, darcID: body.DarcID})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ci, nil
+}
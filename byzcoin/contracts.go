@@ -2,8 +2,10 @@ package byzcoin
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dedis/cothority"
@@ -60,6 +62,35 @@ func LoadDarcFromTrie(st ReadOnlyStateTrie, key []byte) (*darc.Darc, error) {
 	return d, nil
 }
 
+// GetDarcFromTrie returns the callback used to evaluate darc expressions
+// against the trie. It returns the darcs of "darc:" identities and nil for
+// all other identities or if the darc is not stored.
+func GetDarcFromTrie(st ReadOnlyStateTrie) darc.GetDarc {
+	return func(str string, latest bool) *darc.Darc {
+		id, ok := darcIDFromIdentity(str)
+		if !ok {
+			return nil
+		}
+		d, err := LoadDarcFromTrie(st, id)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+}
+
+// darcIDFromIdentity returns the ID of the darc of a "darc:" identity.
+func darcIDFromIdentity(str string) (darc.ID, bool) {
+	if !strings.HasPrefix(str, "darc:") {
+		return nil, false
+	}
+	id, err := hex.DecodeString(str[5:])
+	if err != nil {
+		return nil, false
+	}
+	return id, true
+}
+
 // ContractConfig can only be instantiated once per skipchain, and only for
 // the genesis block.
 func (s *Service) ContractConfig(cdb ReadOnlyStateTrie, inst Instruction, ctxHash []byte, coins []Coin) (sc []StateChange, c []Coin, err error) {
@@ -195,6 +226,7 @@ func spawnContractConfig(cdb ReadOnlyStateTrie, inst Instruction, coins []Coin)
 		BlockInterval: time.Duration(interval),
 		Roster:        roster,
 		MaxBlockSize:  int(maxsz),
+		Version:       CurrentChainVersion,
 	}
 	if err = config.sanityCheck(nil); err != nil {
 		return
@@ -0,0 +1,181 @@
+package contracts
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// ContractAnchorID denotes a contract that follows another skipchain and
+// stores its latest verified block.
+var ContractAnchorID = "anchor"
+
+// Anchor is the data stored in an anchor instance.
+type Anchor struct {
+	// GenesisID is the ID of the followed skipchain.
+	GenesisID skipchain.SkipBlockID
+	// LatestID and LatestIndex are the hash and the index of the latest
+	// anchored block.
+	LatestID    skipchain.SkipBlockID
+	LatestIndex int
+	// Roster is the roster of the latest anchored block, which signs the
+	// forward links to the next blocks.
+	Roster onet.Roster
+}
+
+// AnchorUpdate is the argument "update" of the invoke:anchor instruction.
+// The blocks must start with the latest anchored block, as returned by
+// skipchain.Client.GetUpdateChain, and every block must have a forward link
+// to the next one.
+type AnchorUpdate struct {
+	Blocks []*skipchain.SkipBlock
+}
+
+// ContractAnchor records verified checkpoints of another skipchain.
+//  - spawn takes the genesis block of the other skipchain in the argument
+//    "genesis", encoded with protobuf, and stores its hash and its roster
+//  - invoke:anchor takes an AnchorUpdate in the argument "update", encoded
+//    with protobuf. It verifies the forward links from the latest anchored
+//    block to the last block of the update, following the roster changes,
+//    and stores the last block as the latest anchored block.
+func ContractAnchor(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte, c []byzcoin.Coin) (sc []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	cOut = c
+
+	err = inst.Verify(cdb, ctxHash)
+	if err != nil {
+		return
+	}
+
+	var value []byte
+	var darcID darc.ID
+	value, _, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return
+	}
+
+	switch inst.GetType() {
+	case byzcoin.SpawnType:
+		var genesis skipchain.SkipBlock
+		err = protobuf.DecodeWithConstructors(inst.Spawn.Args.Search("genesis"), &genesis,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, nil, errors.New("couldn't decode genesis block: " + err.Error())
+		}
+		if genesis.SkipBlockFix == nil || genesis.Index != 0 || genesis.Roster == nil {
+			return nil, nil, errors.New("not a genesis block")
+		}
+		if !genesis.Hash.Equal(genesis.CalculateHash()) {
+			return nil, nil, errors.New("wrong hash of genesis block")
+		}
+		var buf []byte
+		buf, err = protobuf.Encode(&Anchor{
+			GenesisID:   genesis.Hash,
+			LatestID:    genesis.Hash,
+			LatestIndex: 0,
+			Roster:      *genesis.Roster,
+		})
+		if err != nil {
+			return
+		}
+		return []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""),
+				ContractAnchorID, buf, darcID),
+		}, c, nil
+	case byzcoin.InvokeType:
+		if inst.Invoke.Command != "anchor" {
+			return nil, nil, errors.New("Anchor contract can only anchor")
+		}
+		var anchor Anchor
+		err = protobuf.DecodeWithConstructors(value, &anchor,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, nil, errors.New("couldn't decode anchor: " + err.Error())
+		}
+		var update AnchorUpdate
+		err = protobuf.DecodeWithConstructors(inst.Invoke.Args.Search("update"), &update,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, nil, errors.New("couldn't decode update: " + err.Error())
+		}
+		if err = anchor.apply(update.Blocks); err != nil {
+			return
+		}
+		var buf []byte
+		buf, err = protobuf.Encode(&anchor)
+		if err != nil {
+			return
+		}
+		return []byzcoin.StateChange{
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractAnchorID, buf, darcID),
+		}, c, nil
+	case byzcoin.DeleteType:
+		return byzcoin.StateChanges{
+			byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractAnchorID, nil, darcID),
+		}, c, nil
+	}
+	return nil, nil, errors.New("didn't find any instruction")
+}
+
+// apply verifies that the blocks go from the latest anchored block to a
+// newer one and stores the last block as the latest anchored block. Every
+// block after the first one is verified with the forward link of the
+// previous block, signed by the roster of the previous block.
+func (a *Anchor) apply(blocks []*skipchain.SkipBlock) error {
+	if len(blocks) < 2 {
+		return errors.New("need the latest anchored block and at least one newer block")
+	}
+	for _, b := range blocks {
+		if b == nil || b.SkipBlockFix == nil {
+			return errors.New("empty block")
+		}
+	}
+	if !blocks[0].Hash.Equal(a.LatestID) || !blocks[0].CalculateHash().Equal(a.LatestID) {
+		return errors.New("the first block is not the latest anchored block")
+	}
+
+	roster := a.Roster
+	for i, next := range blocks[1:] {
+		prev := blocks[i]
+		if !next.Hash.Equal(next.CalculateHash()) {
+			return fmt.Errorf("wrong hash of block %d", next.Index)
+		}
+		if !next.SkipChainID().Equal(a.GenesisID) {
+			return fmt.Errorf("block %d is from another skipchain", next.Index)
+		}
+		if next.Index <= prev.Index {
+			return fmt.Errorf("block %d does not come after block %d", next.Index, prev.Index)
+		}
+		if next.Roster == nil {
+			return fmt.Errorf("block %d has no roster", next.Index)
+		}
+		var link *skipchain.ForwardLink
+		for _, fl := range prev.ForwardLink {
+			if fl != nil && !fl.IsEmpty() && fl.From.Equal(prev.Hash) && fl.To.Equal(next.Hash) {
+				link = fl
+			}
+		}
+		if link == nil {
+			return fmt.Errorf("no forward link from block %d to block %d", prev.Index, next.Index)
+		}
+		if err := link.Verify(cothority.Suite, roster.Publics()); err != nil {
+			return fmt.Errorf("wrong forward link from block %d to block %d: %v",
+				prev.Index, next.Index, err)
+		}
+		// The hash of next covers its roster.
+		roster = *next.Roster
+	}
+
+	last := blocks[len(blocks)-1]
+	a.LatestID = last.Hash
+	a.LatestIndex = last.Index
+	a.Roster = roster
+	return nil
+}
@@ -0,0 +1,134 @@
+package contracts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnchor(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(4, true)
+	defer l.CloseAll()
+
+	// Chain A is the ledger holding the anchor.
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:anchor", "invoke:anchor"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+	gID := byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID())
+
+	// Chain B is the followed skipchain.
+	rosterB := onet.NewRoster(roster.List[:3])
+	scl := skipchain.NewClient()
+	genesis, err := scl.CreateGenesis(rosterB, 2, 3, skipchain.VerificationNone, nil, nil)
+	require.Nil(t, err)
+	latestB := genesis
+	addBlocks := func(r *onet.Roster, n int) {
+		for i := 0; i < n; i++ {
+			reply, err := scl.StoreSkipBlock(latestB, r, []byte{byte(i)})
+			require.Nil(t, err)
+			latestB = reply.Latest
+		}
+	}
+	addBlocks(rosterB, 3)
+
+	genesisBuf, err := protobuf.Encode(genesis)
+	require.Nil(t, err)
+	ctx, _, err := byzcoin.NewTxBuilder(cl).
+		Spawn(gID, ContractAnchorID, byzcoin.Arguments{{Name: "genesis", Value: genesisBuf}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	anchorID := ctx.Instructions[0].DeriveID("")
+	anchor := getAnchor(t, cl, anchorID)
+	require.Equal(t, genesis.Hash, anchor.GenesisID)
+	require.Equal(t, 0, anchor.LatestIndex)
+
+	// update returns the blocks from the latest anchored block to the
+	// latest block of B.
+	update := func(from skipchain.SkipBlockID, r *onet.Roster) []byte {
+		reply, err := scl.GetUpdateChain(r, from)
+		require.Nil(t, err)
+		buf, err := protobuf.Encode(&AnchorUpdate{Blocks: reply.Update})
+		require.Nil(t, err)
+		return buf
+	}
+	invoke := func(buf []byte) error {
+		_, _, err := byzcoin.NewTxBuilder(cl).
+			Invoke(anchorID, "anchor", byzcoin.Arguments{{Name: "update", Value: buf}}).
+			SignAndSubmit(signer, 10)
+		return err
+	}
+
+	buf := update(anchor.LatestID, rosterB)
+	require.Nil(t, invoke(buf))
+	anchor = getAnchor(t, cl, anchorID)
+	require.Equal(t, latestB.Hash, anchor.LatestID)
+	require.Equal(t, 3, anchor.LatestIndex)
+
+	// The same update does not advance and is refused.
+	require.NotNil(t, invoke(buf))
+
+	// Anchoring across a roster change of B, which replaces its last node.
+	rosterB2 := onet.NewRoster([]*network.ServerIdentity{roster.List[0], roster.List[1], roster.List[3]})
+	addBlocks(rosterB2, 3)
+	require.Nil(t, invoke(update(anchor.LatestID, onet.NewRoster(roster.List[:2]))))
+	anchor = getAnchor(t, cl, anchorID)
+	require.Equal(t, latestB.Hash, anchor.LatestID)
+	require.Equal(t, 6, anchor.LatestIndex)
+	require.True(t, anchor.Roster.ID.Equal(rosterB2.ID))
+}
+
+func TestAnchor_Apply(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	scl := skipchain.NewClient()
+	genesis, err := scl.CreateGenesis(roster, 1, 1, skipchain.VerificationNone, nil, nil)
+	require.Nil(t, err)
+	reply, err := scl.StoreSkipBlock(genesis, roster, []byte{1})
+	require.Nil(t, err)
+	update, err := scl.GetUpdateChain(roster, genesis.Hash)
+	require.Nil(t, err)
+	blocks := update.Update
+	require.Equal(t, 2, len(blocks))
+
+	newAnchor := func() *Anchor {
+		return &Anchor{GenesisID: genesis.Hash, LatestID: genesis.Hash, Roster: *roster}
+	}
+	require.Nil(t, newAnchor().apply(blocks))
+	require.Contains(t, newAnchor().apply(blocks[:1]).Error(), "at least one newer block")
+	require.Contains(t, newAnchor().apply([]*skipchain.SkipBlock{blocks[1], blocks[0]}).Error(), "not the latest anchored")
+
+	// A tampered block.
+	tampered := reply.Latest.Copy()
+	tampered.Data = []byte{2}
+	tampered.Hash = tampered.CalculateHash()
+	err = newAnchor().apply([]*skipchain.SkipBlock{blocks[0], tampered})
+	require.Contains(t, err.Error(), "no forward link")
+
+	// A forward link not signed by the roster of the anchor.
+	a := newAnchor()
+	a.Roster = *onet.NewRoster(roster.List[:2])
+	require.Contains(t, a.apply(blocks).Error(), "wrong forward link")
+}
+
+func getAnchor(t *testing.T, cl *byzcoin.Client, id byzcoin.InstanceID) Anchor {
+	pr, err := cl.GetProof(id.Slice())
+	require.Nil(t, err)
+	var anchor Anchor
+	require.Nil(t, pr.Proof.VerifyAndDecode(cothority.Suite, ContractAnchorID, &anchor))
+	return anchor
+}
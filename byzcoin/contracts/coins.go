@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 
+	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/onet/log"
@@ -20,7 +21,9 @@ var CoinName = iid("olCoin")
 
 // ContractCoin is a coin implementation that holds one instance per coin.
 // If you spawn a new ContractCoin, it will create an account with a value
-// of 0 coins.
+// of 0 coins. If the spawn instruction has the argument "public", the
+// marshalled ed25519 public key of the owner of the account, the account is
+// stored under CoinHash(public), so that it can be found from the key.
 // The following methods are available:
 //  - mint will add the number of coins in the argument "coins" to the
 //    current coin instance. The argument must be a 64-bit uint in LittleEndian
@@ -61,6 +64,12 @@ func ContractCoin(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHa
 	case byzcoin.SpawnType:
 		// Spawn creates a new coin account as a separate instance.
 		ca := inst.DeriveID("")
+		if pub := inst.Spawn.Args.Search("public"); pub != nil {
+			if err = cothority.Suite.Point().UnmarshalBinary(pub); err != nil {
+				return nil, nil, errors.New("public needs to be an ed25519 public key: " + err.Error())
+			}
+			ca = CoinHash(pub)
+		}
 		log.Lvlf3("Spawning coin to %x", ca.Slice())
 		if t := inst.Spawn.Args.Search("type"); t != nil {
 			if len(t) != len(byzcoin.InstanceID{}) {
@@ -182,6 +191,15 @@ func ContractCoin(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHa
 	return
 }
 
+// CoinHash returns the ID of the coin account of the marshalled public key,
+// as spawned with the argument "public".
+func CoinHash(public []byte) byzcoin.InstanceID {
+	h := sha256.New()
+	h.Write([]byte(ContractCoinID))
+	h.Write(public)
+	return byzcoin.NewInstanceID(h.Sum(nil))
+}
+
 // iid uses sha256(in) in order to manufacture an InstanceID from in
 // thereby handling the case where len(in) != 32.
 //
@@ -5,11 +5,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/byzcoin/trie"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/require"
@@ -65,6 +69,39 @@ func TestCoin_Spawn(t *testing.T) {
 	require.Equal(t, 0, len(co))
 }
 
+func TestCoin_SpawnPublic(t *testing.T) {
+	// The account of a public key is stored under its CoinHash.
+	ct := newCT("spawn:coin")
+	ct.setSignatureCounter(gsigner.Identity().String(), 0)
+
+	pub, err := gsigner.Ed25519.Point.MarshalBinary()
+	require.Nil(t, err)
+	inst := byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(gdarc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: ContractCoinID,
+			Args:       byzcoin.Arguments{{Name: "public", Value: pub}},
+		},
+		SignerCounter: []uint64{1},
+	}
+	dummyCtxHash := []byte("dummy_ctx_hash")
+	require.Nil(t, inst.SignWith(dummyCtxHash, gsigner))
+
+	sc, _, err := ContractCoin(ct, inst, dummyCtxHash, []byzcoin.Coin{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sc))
+	require.Equal(t, byzcoin.NewStateChange(byzcoin.Create, CoinHash(pub),
+		ContractCoinID, ciZero, gdarc.GetBaseID()), sc[0])
+	require.NotEqual(t, CoinHash(pub), inst.DeriveID(""))
+
+	// Only public keys are accepted.
+	inst.Spawn.Args = byzcoin.Arguments{{Name: "public", Value: []byte("not a key")}}
+	inst.SignerCounter = []uint64{1}
+	require.Nil(t, inst.SignWith(dummyCtxHash, gsigner))
+	_, _, err = ContractCoin(ct, inst, dummyCtxHash, []byzcoin.Coin{})
+	require.NotNil(t, err)
+}
+
 func TestCoin_InvokeMint(t *testing.T) {
 	// Test that a coin can be minted
 	ct := newCT("invoke:mint")
@@ -231,6 +268,145 @@ func TestCoin_InvokeTransfer(t *testing.T) {
 	require.Equal(t, byzcoin.NewStateChange(byzcoin.Update, coAddr1, ContractCoinID, ciZero, gdarc.GetBaseID()), sc[1])
 }
 
+func TestCoin_SimulateTransfer(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:coin", "invoke:mint", "invoke:transfer"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	// Create two accounts and put two coins into the first one.
+	gID := byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID())
+	ctx, _, err := byzcoin.NewTxBuilder(cl).
+		Spawn(gID, ContractCoinID, nil).
+		Spawn(gID, ContractCoinID, nil).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	acc1 := ctx.Instructions[0].DeriveID("")
+	acc2 := ctx.Instructions[1].DeriveID("")
+	_, _, err = byzcoin.NewTxBuilder(cl).
+		Invoke(acc1, "mint", byzcoin.Arguments{{Name: "coins", Value: coinTwo}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+
+	transfer := func(coins []byte) *byzcoin.ClientTransaction {
+		ctx, err := byzcoin.NewTxBuilder(cl).
+			Invoke(acc1, "transfer", byzcoin.Arguments{
+				{Name: "coins", Value: coins},
+				{Name: "destination", Value: acc2.Slice()}}).
+			Sign(signer)
+		require.Nil(t, err)
+		return ctx
+	}
+
+	// A valid transfer is accepted and the state changes are returned.
+	resp, err := cl.SimulateTransaction(*transfer(coinOne))
+	require.Nil(t, err)
+	require.True(t, resp.Accepted)
+	require.Equal(t, 1, len(resp.Instructions))
+	require.True(t, resp.Instructions[0].Accepted)
+	require.Equal(t, 2, len(resp.Instructions[0].StateChanges))
+	sc := resp.Instructions[0].StateChanges[0]
+	require.Equal(t, acc2.Slice(), sc.InstanceID)
+	h := sha256.Sum256(ciOne)
+	require.Equal(t, h[:], sc.Value)
+
+	// Transferring more than the balance is rejected.
+	resp, err = cl.SimulateTransaction(*transfer(coinThree()))
+	require.Nil(t, err)
+	require.False(t, resp.Accepted)
+	require.Equal(t, 1, len(resp.Instructions))
+	require.False(t, resp.Instructions[0].Accepted)
+	require.Contains(t, resp.Instructions[0].Error, "underflow")
+
+	// Nothing has been stored by the simulations.
+	pr, err := cl.GetProof(acc1.Slice())
+	require.Nil(t, err)
+	_, v, _, _, err := pr.Proof.KeyValue()
+	require.Nil(t, err)
+	require.Equal(t, ciTwo, v)
+	ctrs, err := cl.GetSignerCounters(signer.Identity().String())
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), ctrs.Counters[0])
+}
+
+func TestCoin_GetBlockStateChanges(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:coin", "invoke:mint", "invoke:transfer"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	gID := byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID())
+	ctx, _, err := byzcoin.NewTxBuilder(cl).
+		Spawn(gID, ContractCoinID, nil).
+		Spawn(gID, ContractCoinID, nil).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	acc1 := ctx.Instructions[0].DeriveID("")
+	acc2 := ctx.Instructions[1].DeriveID("")
+	_, _, err = byzcoin.NewTxBuilder(cl).
+		Invoke(acc1, "mint", byzcoin.Arguments{{Name: "coins", Value: coinTwo}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	_, _, err = byzcoin.NewTxBuilder(cl).
+		Invoke(acc1, "transfer", byzcoin.Arguments{
+			{Name: "coins", Value: coinOne},
+			{Name: "destination", Value: acc2.Slice()}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	pr, err := cl.GetProof(acc1.Slice())
+	require.Nil(t, err)
+	index := pr.Proof.Latest.Index
+
+	// Besides the update of the signer counter, the block holds the
+	// updates of both accounts.
+	resp, err := cl.GetBlockStateChanges(index)
+	require.Nil(t, err)
+	var coinChanges []byzcoin.StateChange
+	for _, sc := range resp.StateChanges {
+		if string(sc.ContractID) == ContractCoinID {
+			coinChanges = append(coinChanges, sc)
+		}
+	}
+	require.Equal(t, 3, len(resp.StateChanges))
+	require.Equal(t, 2, len(coinChanges))
+	require.Equal(t, acc2.Slice(), coinChanges[0].InstanceID)
+	require.Equal(t, acc1.Slice(), coinChanges[1].InstanceID)
+	for _, sc := range coinChanges {
+		require.Equal(t, byzcoin.Update, sc.StateAction)
+		require.Equal(t, ciOne, sc.Value)
+	}
+
+	// The state changes correspond to the hash in the block.
+	sb, err := skipchain.NewClient().GetSingleBlockByIndex(roster, cl.ID, index)
+	require.Nil(t, err)
+	require.Nil(t, resp.Verify(sb.SkipBlock))
+	resp.StateChanges = resp.StateChanges[:1]
+	require.NotNil(t, resp.Verify(sb.SkipBlock))
+
+	_, err = cl.GetBlockStateChanges(index + 1)
+	require.NotNil(t, err)
+}
+
+func coinThree() []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 3)
+	return buf
+}
+
 type cvTest struct {
 	values      map[string][]byte
 	contractIDs map[string]string
@@ -55,3 +55,74 @@ func TestValue_Spawn(t *testing.T) {
 
 	local.WaitDone(genesisMsg.BlockInterval)
 }
+
+func TestValue_ListInstancesByContract(t *testing.T) {
+	local := onet.NewTCPTest(cothority.Suite)
+	defer local.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	_, roster, _ := local.GenTree(3, true)
+
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:value", "spawn:coin", "delete"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	cl, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+	gID := byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID())
+
+	// The first request builds the index from the state trie.
+	list, err := cl.ListInstancesByContract(ContractValueID, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(list))
+	list, err = cl.ListInstancesByContract("darc", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(list))
+	require.True(t, gID.Equal(list[0].InstanceID))
+
+	// The new instances are added to the index.
+	b := byzcoin.NewTxBuilder(cl)
+	for i := 0; i < 5; i++ {
+		b.Spawn(gID, ContractValueID, byzcoin.Arguments{{Name: "value", Value: []byte{byte(i)}}})
+		if i%2 == 0 {
+			b.Spawn(gID, ContractCoinID, nil)
+		}
+	}
+	ctx, _, err := b.SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	values := make(map[byzcoin.InstanceID]bool)
+	coins := make(map[byzcoin.InstanceID]bool)
+	for _, instr := range ctx.Instructions {
+		if instr.Spawn.ContractID == ContractValueID {
+			values[instr.DeriveID("")] = true
+		} else {
+			coins[instr.DeriveID("")] = true
+		}
+	}
+
+	checkList := func(contractID string, exp map[byzcoin.InstanceID]bool) {
+		for _, size := range []int{0, 1, 2, 10} {
+			list, err := cl.ListInstancesByContract(contractID, size)
+			require.Nil(t, err)
+			require.Equal(t, len(exp), len(list))
+			for _, inst := range list {
+				require.True(t, exp[inst.InstanceID])
+				require.Equal(t, uint64(0), inst.Version)
+				require.Equal(t, msg.GenesisDarc.GetBaseID(), inst.DarcID)
+			}
+		}
+	}
+	checkList(ContractValueID, values)
+	checkList(ContractCoinID, coins)
+
+	// Removed instances are removed from the index.
+	var removed byzcoin.InstanceID
+	for removed = range values {
+		break
+	}
+	_, _, err = b.Delete(removed).SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	delete(values, removed)
+	checkList(ContractValueID, values)
+	checkList(ContractCoinID, coins)
+}
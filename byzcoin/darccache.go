@@ -0,0 +1,145 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dedis/cothority/darc"
+)
+
+// darcCache memoizes the darcs and the evaluations of their rules while the
+// instructions of one block are executed, so that busy darcs are not decoded
+// and evaluated again for every instruction. It is created for every block
+// and must be reset if state changes are discarded, because the versions of
+// the darcs can then be reused for another content. All methods can be
+// called on a nil cache, which doesn't cache anything.
+type darcCache struct {
+	// darcs holds the decoded darcs by their key in the trie.
+	darcs map[string]cachedDarc
+	// evaluations holds the results of the evaluations by evaluationKey.
+	evaluations map[string]cachedEvaluation
+}
+
+type cachedDarc struct {
+	version uint64
+	darc    *darc.Darc
+}
+
+type cachedEvaluation struct {
+	// deps holds the versions in the trie of the darcs that have been
+	// used through delegations, or missingDarc for the darcs that could not
+	// be found.
+	deps map[string]uint64
+	err  error
+}
+
+// missingDarc is the version of a dependency that is not in the trie, so that
+// an evaluation that failed because of a missing darc is done again once the
+// darc has been spawned.
+const missingDarc = ^uint64(0)
+
+// darcVersion returns the version of the instance at key, or missingDarc if
+// it cannot be read.
+func darcVersion(st ReadOnlyStateTrie, key []byte) uint64 {
+	_, v, _, _, err := st.GetValues(key)
+	if err != nil {
+		return missingDarc
+	}
+	return v
+}
+
+func newDarcCache() *darcCache {
+	c := &darcCache{}
+	c.reset()
+	return c
+}
+
+// darcCacheOf returns the cache of the block st is used for, or nil.
+func darcCacheOf(st ReadOnlyStateTrie) *darcCache {
+	if sst, ok := st.(*stagingStateTrie); ok && sst.block != nil {
+		return sst.block.cache
+	}
+	return nil
+}
+
+// reset removes all entries.
+func (c *darcCache) reset() {
+	if c == nil {
+		return
+	}
+	c.darcs = make(map[string]cachedDarc)
+	c.evaluations = make(map[string]cachedEvaluation)
+}
+
+// loadDarc returns the darc stored at key and its version in the trie.
+func (c *darcCache) loadDarc(st ReadOnlyStateTrie, key []byte) (*darc.Darc, uint64, error) {
+	buf, version, contract, _, err := st.GetValues(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if contract != ContractDarcID {
+		return nil, 0, errors.New("expected contract to be darc but got: " + contract)
+	}
+	if c != nil {
+		if cd, ok := c.darcs[string(key)]; ok && cd.version == version {
+			return cd.darc, version, nil
+		}
+	}
+	d, err := darc.NewFromProtobuf(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c != nil {
+		c.darcs[string(key)] = cachedDarc{version, d}
+	}
+	return d, version, nil
+}
+
+// instanceDarc returns the darc controlling the instance iid.
+func (c *darcCache) instanceDarc(st ReadOnlyStateTrie, iid InstanceID) (*darc.Darc, error) {
+	_, _, _, dID, err := st.GetValues(iid.Slice())
+	if err != nil {
+		return nil, err
+	}
+	d, _, err := c.loadDarc(st, dID)
+	if err != nil {
+		return nil, fmt.Errorf("for instance %v, %v", iid, err)
+	}
+	return d, nil
+}
+
+// evaluationKey returns the key of the evaluation of the rule of action in d
+// for the given signers.
+func evaluationKey(d *darc.Darc, action darc.Action, ids []string) string {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("%x/%d/%s/%s", d.GetBaseID(), d.Version, action, strings.Join(sorted, ","))
+}
+
+// evaluation returns the result of a previous evaluation. found is false if
+// there is none or if the darcs it depends on have changed since.
+func (c *darcCache) evaluation(st ReadOnlyStateTrie, key string) (found bool, err error) {
+	if c == nil {
+		return false, nil
+	}
+	ce, ok := c.evaluations[key]
+	if !ok {
+		return false, nil
+	}
+	for dep, version := range ce.deps {
+		if darcVersion(st, []byte(dep)) != version {
+			return false, nil
+		}
+	}
+	return true, ce.err
+}
+
+// storeEvaluation stores the result of an evaluation.
+func (c *darcCache) storeEvaluation(key string, deps map[string]uint64, err error) {
+	if c == nil {
+		return
+	}
+	c.evaluations[key] = cachedEvaluation{deps, err}
+}
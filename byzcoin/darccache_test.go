@@ -0,0 +1,167 @@
+package byzcoin
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin/trie"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/stretchr/testify/require"
+)
+
+// newCacheTrie returns a staging trie with the darcs stored at their keys
+// and the counter of signer set to 0.
+func newCacheTrie(t testing.TB, signer darc.Signer, darcs map[string]*darc.Darc) *stagingStateTrie {
+	tr, err := trie.NewTrie(trie.NewMemDB(), []byte("my nonce"))
+	require.NoError(t, err)
+	sst := &stagingStateTrie{StagingTrie: *tr.MakeStagingTrie()}
+	for key, d := range darcs {
+		storeCacheDarc(t, sst, []byte(key), d, Create)
+	}
+	require.NoError(t, setSignerCounter(sst, signer.Identity().String(), 0))
+	return sst
+}
+
+func storeCacheDarc(t testing.TB, sst *stagingStateTrie, key []byte, d *darc.Darc, action StateAction) {
+	buf, err := d.ToProto()
+	require.NoError(t, err)
+	require.NoError(t, sst.StoreAll([]StateChange{{
+		InstanceID:  key,
+		StateAction: action,
+		ContractID:  []byte(ContractDarcID),
+		Value:       buf,
+		DarcID:      key,
+		Version:     d.Version,
+	}}))
+}
+
+func TestDarcCache_EvolveInstanceDarc(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	other := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	require.NoError(t, d.Rules.AddRule("spawn:dummy_kind", expression.Expr(signer.Identity().String())))
+	ctx, err := createOneClientTx(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
+	require.NoError(t, err)
+
+	sst := newCacheTrie(t, signer, map[string]*darc.Darc{string(d.GetBaseID()): d})
+	sst.block = &blockInfo{cache: newDarcCache()}
+	require.NoError(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+	require.NoError(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+	require.Equal(t, 1, len(sst.block.cache.evaluations))
+
+	// Evolving the darc in the same block must be taken into account.
+	d2 := d.Copy()
+	require.NoError(t, d2.EvolveFrom(d))
+	require.NoError(t, d2.Rules.UpdateRule("spawn:dummy_kind", expression.Expr(other.Identity().String())))
+	storeCacheDarc(t, sst, d.GetBaseID(), d2, Update)
+	require.Error(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+}
+
+func TestDarcCache_EvolveDelegatedDarc(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	other := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	keyA := bytes.Repeat([]byte{0xaa}, 32)
+
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	require.NoError(t, d.Rules.AddRule("spawn:dummy_kind", expression.Expr(darc.NewIdentityDarc(keyA).String())))
+	ctx, err := createOneClientTx(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
+	require.NoError(t, err)
+	dA := darc.NewDarc(darc.InitRules(ids, ids), []byte("darc A"))
+
+	sst := newCacheTrie(t, signer, map[string]*darc.Darc{string(d.GetBaseID()): d, string(keyA): dA})
+	sst.block = &blockInfo{cache: newDarcCache()}
+	require.NoError(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+
+	// Only the delegated darc changes, so the key of the evaluation stays
+	// the same, but the result must not be taken from the cache.
+	dA2 := dA.Copy()
+	require.NoError(t, dA2.EvolveFrom(dA))
+	require.NoError(t, dA2.Rules.UpdateSign(expression.Expr(other.Identity().String())))
+	storeCacheDarc(t, sst, keyA, dA2, Update)
+	require.Error(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+
+	// And back again.
+	dA3 := dA2.Copy()
+	require.NoError(t, dA3.EvolveFrom(dA2))
+	require.NoError(t, dA3.Rules.UpdateSign(expression.Expr(signer.Identity().String())))
+	storeCacheDarc(t, sst, keyA, dA3, Update)
+	require.NoError(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+}
+
+func TestDarcCache_SpawnDelegatedDarc(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	keyA := bytes.Repeat([]byte{0xaa}, 32)
+
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	require.NoError(t, d.Rules.AddRule("spawn:dummy_kind", expression.Expr(darc.NewIdentityDarc(keyA).String())))
+	ctx, err := createOneClientTx(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
+	require.NoError(t, err)
+
+	sst := newCacheTrie(t, signer, map[string]*darc.Darc{string(d.GetBaseID()): d})
+	sst.block = &blockInfo{cache: newDarcCache()}
+	require.Error(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+
+	// The delegated darc is spawned in the same block, so the failed
+	// evaluation must not be taken from the cache.
+	dA := darc.NewDarc(darc.InitRules(ids, ids), []byte("darc A"))
+	storeCacheDarc(t, sst, keyA, dA, Create)
+	require.NoError(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+}
+
+func TestDarcCache_Reset(t *testing.T) {
+	var c *darcCache
+	c.reset()
+	found, err := c.evaluation(nil, "key")
+	require.False(t, found)
+	require.NoError(t, err)
+
+	c = newDarcCache()
+	c.storeEvaluation("key", nil, fmt.Errorf("refused"))
+	found, err = c.evaluation(nil, "key")
+	require.True(t, found)
+	require.Error(t, err)
+	c.reset()
+	found, _ = c.evaluation(nil, "key")
+	require.False(t, found)
+}
+
+// BenchmarkDarcCache verifies a block of 200 instructions signed by the same
+// signer and controlled by the same darc.
+func BenchmarkDarcCache(b *testing.B) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	var expr []string
+	for i := 0; i < 20; i++ {
+		expr = append(expr, darc.NewSignerEd25519(nil, nil).Identity().String())
+	}
+	expr = append(expr, signer.Identity().String())
+	require.NoError(b, d.Rules.AddRule("spawn:dummy_kind", expression.InitOrExpr(expr...)))
+
+	ctxs := make([]ClientTransaction, 200)
+	for i := range ctxs {
+		var err error
+		ctxs[i], err = createOneClientTx(d.GetBaseID(), "dummy_kind", []byte(fmt.Sprintf("value %d", i)), signer)
+		require.NoError(b, err)
+	}
+	sst := newCacheTrie(b, signer, map[string]*darc.Darc{string(d.GetBaseID()): d})
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				sst.block = &blockInfo{}
+				if cached {
+					sst.block.cache = newDarcCache()
+				}
+				for _, ctx := range ctxs {
+					require.NoError(b, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package byzcoin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/onet/log"
+)
+
+// evolveDarcWait is the number of blocks EvolveDarc waits for the evolution
+// to be included.
+const evolveDarcWait = 10
+
+// DarcMutation is a change of one rule of a darc, as applied by EvolveDarc.
+// It is created by DarcAddRule, DarcUpdateRule, DarcRemoveRule or
+// DarcAddSigner.
+type DarcMutation struct {
+	action darc.Action
+	apply  func(d *darc.Darc) error
+}
+
+// DarcAddRule adds a rule to the darc. It fails if the rule already exists.
+func DarcAddRule(action darc.Action, expr expression.Expr) DarcMutation {
+	return DarcMutation{action, func(d *darc.Darc) error {
+		if err := expression.Validate(expr); err != nil {
+			return err
+		}
+		return d.Rules.AddRule(action, expr)
+	}}
+}
+
+// DarcUpdateRule replaces the expression of an existing rule.
+func DarcUpdateRule(action darc.Action, expr expression.Expr) DarcMutation {
+	return DarcMutation{action, func(d *darc.Darc) error {
+		if err := expression.Validate(expr); err != nil {
+			return err
+		}
+		return d.Rules.UpdateRule(action, expr)
+	}}
+}
+
+// DarcRemoveRule removes a rule from the darc.
+func DarcRemoveRule(action darc.Action) DarcMutation {
+	return DarcMutation{action, func(d *darc.Darc) error {
+		return d.Rules.DeleteRules(action)
+	}}
+}
+
+// DarcAddSigner adds id as an alternative to the sign rule of the darc.
+func DarcAddSigner(id darc.Identity) DarcMutation {
+	return DarcMutation{darc.Action("_sign"), func(d *darc.Darc) error {
+		idStr := id.String()
+		signExpr := string(d.Rules.GetSignExpr())
+		for _, s := range strings.Split(signExpr, "|") {
+			if strings.TrimSpace(s) == idStr {
+				return fmt.Errorf("%s is already a signer", idStr)
+			}
+		}
+		if signExpr == "" {
+			return d.Rules.UpdateSign(expression.Expr(idStr))
+		}
+		if strings.Contains(signExpr, "&") {
+			signExpr = "(" + signExpr + ")"
+		}
+		expr := expression.Expr(signExpr + " | " + idStr)
+		if err := expression.Validate(expr); err != nil {
+			return err
+		}
+		return d.Rules.UpdateSign(expr)
+	}}
+}
+
+// errDarcConflict is returned by evolveDarcOnce if the darc has been
+// evolved by somebody else in the meantime.
+var errDarcConflict = errors.New("the darc has been evolved in the meantime")
+
+// EvolveDarc applies all mutations to the latest version of the darc base in
+// one evolution, which is signed by signer. Every rule can only be changed
+// by one mutation. If the darc is evolved by somebody else before the
+// evolution is included, the mutations are applied again to the new version,
+// once. It returns the new darc and its proof.
+func EvolveDarc(c *Client, signer darc.Signer, base *darc.Darc, mutations ...DarcMutation) (*darc.Darc, *Proof, error) {
+	if len(mutations) == 0 {
+		return nil, nil, errors.New("no mutations given")
+	}
+	seen := make(map[darc.Action]bool)
+	for _, m := range mutations {
+		if seen[m.action] {
+			return nil, nil, fmt.Errorf("rule %s is changed more than once", m.action)
+		}
+		seen[m.action] = true
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var latest *darc.Darc
+		latest, _, err = getLatestDarc(c, base.GetBaseID())
+		if err != nil {
+			return nil, nil, err
+		}
+		var newD *darc.Darc
+		var p *Proof
+		newD, p, err = evolveDarcOnce(c, signer, latest, mutations)
+		if err != errDarcConflict {
+			return newD, p, err
+		}
+		log.Lvl2("darc has been evolved in the meantime, applying the mutations again")
+	}
+	return nil, nil, err
+}
+
+// evolveDarcOnce applies the mutations to latest and sends the evolution. If
+// the evolution fails because the darc has been evolved in the meantime,
+// errDarcConflict is returned.
+func evolveDarcOnce(c *Client, signer darc.Signer, latest *darc.Darc, mutations []DarcMutation) (*darc.Darc, *Proof, error) {
+	newD := latest.Copy()
+	if err := newD.EvolveFrom(latest); err != nil {
+		return nil, nil, err
+	}
+	for _, m := range mutations {
+		if err := m.apply(newD); err != nil {
+			return nil, nil, fmt.Errorf("rule %s: %v", m.action, err)
+		}
+	}
+	buf, err := newD.ToProto()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := NewInstanceID(latest.GetBaseID())
+	_, _, err = NewTxBuilder(c).
+		Invoke(id, CmdDarcEvolve, Arguments{{Name: "darc", Value: buf}}).
+		SignAndSubmit(signer, evolveDarcWait)
+	if err != nil {
+		current, _, errGet := getLatestDarc(c, latest.GetBaseID())
+		if errGet == nil && current.Version != latest.Version {
+			return nil, nil, errDarcConflict
+		}
+		return nil, nil, err
+	}
+
+	stored, p, err := getLatestDarc(c, latest.GetBaseID())
+	if err != nil {
+		return nil, nil, err
+	}
+	storedBuf, err := stored.ToProto()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(storedBuf, buf) {
+		return nil, nil, errors.New("the evolved darc is not in the ledger")
+	}
+	return stored, p, nil
+}
+
+// getLatestDarc fetches the latest version of the darc id and its proof,
+// which is verified against the ID of the client.
+func getLatestDarc(c *Client, id darc.ID) (*darc.Darc, *Proof, error) {
+	p, err := c.GetProof(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = c.verifyProof(&p.Proof); err != nil {
+		return nil, nil, err
+	}
+	ok, err := p.Proof.InclusionProof.Exists(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot find darc %x", id)
+	}
+	_, darcBuf, contract, _, err := p.Proof.KeyValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	if contract != ContractDarcID {
+		return nil, nil, errors.New("expected contract to be darc but got: " + contract)
+	}
+	d, err := darc.NewFromProtobuf(darcBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, &p.Proof, nil
+}
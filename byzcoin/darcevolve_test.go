@@ -0,0 +1,55 @@
+package byzcoin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvolveDarc(t *testing.T) {
+	s := newSerN(t, 1, 100*time.Millisecond, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	other := darc.NewSignerEd25519(nil, nil)
+
+	id := s.signer.Identity().String()
+	both := expression.Expr(id + " & " + other.Identity().String())
+	d2, p, err := EvolveDarc(c, s.signer, s.darc,
+		DarcAddRule("spawn:a", expression.Expr(id)),
+		DarcAddRule("spawn:b", both),
+		DarcUpdateRule("spawn:dummy", expression.Expr(other.Identity().String())),
+		DarcAddSigner(other.Identity()))
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), d2.Version)
+	require.Equal(t, expression.Expr(id), d2.Rules.Get("spawn:a"))
+	require.Equal(t, both, d2.Rules.Get("spawn:b"))
+	require.Equal(t, expression.Expr(other.Identity().String()), d2.Rules.Get("spawn:dummy"))
+	require.Equal(t, expression.Expr(id+" | "+other.Identity().String()), d2.Rules.GetSignExpr())
+	require.True(t, p.InclusionProof.Match(s.darc.GetBaseID()))
+
+	// The helper uses the latest version, even if it gets an old one.
+	d3, _, err := EvolveDarc(c, s.signer, s.darc, DarcRemoveRule("spawn:a"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), d3.Version)
+	require.False(t, d3.Rules.Contains("spawn:a"))
+	require.True(t, d3.Rules.Contains("spawn:b"))
+
+	// Invalid mutations are refused before anything is sent.
+	_, _, err = EvolveDarc(c, s.signer, s.darc, DarcAddRule("spawn:c", expression.Expr(id)),
+		DarcRemoveRule("spawn:c"))
+	require.Contains(t, err.Error(), "changed more than once")
+	_, _, err = EvolveDarc(c, s.signer, s.darc, DarcAddRule("spawn:c", expression.Expr(id+" &")))
+	require.Contains(t, err.Error(), "rule spawn:c: parsing failed")
+	_, _, err = EvolveDarc(c, s.signer, s.darc, DarcAddSigner(other.Identity()))
+	require.Contains(t, err.Error(), "already a signer")
+
+	// An evolution of an old version is detected as a conflict.
+	_, _, err = evolveDarcOnce(c, s.signer, d2, []DarcMutation{DarcRemoveRule("spawn:b")})
+	require.Equal(t, errDarcConflict, err)
+	latest, err := c.GetGenDarc()
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), latest.Version)
+}
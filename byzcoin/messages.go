@@ -14,6 +14,12 @@ func init() {
 		&CreateGenesisBlock{}, &CreateGenesisBlockResponse{},
 		&AddTxRequest{}, &AddTxResponse{},
 		&GetSignerCounters{}, &GetSignerCountersResponse{},
+		&SimulateTransaction{}, &SimulateTransactionResponse{},
+		&GetTxStatus{}, &GetTxStatusResponse{},
+		&ListInstancesByContract{}, &ListInstancesByContractResponse{},
+		&GetProofAt{}, &GetProofAtResponse{},
+		&GetBlockStateChanges{}, &GetBlockStateChangesResponse{},
+		&GetPendingTransactions{}, &GetPendingTransactionsResponse{},
 	)
 }
 
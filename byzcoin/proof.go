@@ -8,6 +8,7 @@ import (
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
+	"github.com/dedis/onet"
 	"github.com/dedis/onet/network"
 	"github.com/dedis/protobuf"
 )
@@ -101,9 +102,91 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 			publics = l.NewRoster.Publics()
 		}
 	}
+	// The trie root is read from the latest block, so it must be the block
+	// the links lead to.
+	if !sbID.Equal(p.Latest.Hash) || !p.Latest.CalculateHash().Equal(p.Latest.Hash) {
+		return ErrorVerifySkipchain
+	}
 	return nil
 }
 
+// VerifyProofOffline verifies the proof against a trusted genesis block,
+// without contacting any node. It checks that the chain of forward links
+// goes from the genesis block to the latest block of the proof, that every
+// link is signed by the roster of the block it starts from, that the trie
+// root is stored in the latest block and that the inclusion proof is valid.
+// Only proofs of existence are accepted, as the key is taken from the proof
+// itself. The caller must check that the returned key is the expected one.
+func VerifyProofOffline(genesis *skipchain.SkipBlock, p *Proof) (key, value, contractID, darcID []byte, err error) {
+	if genesis == nil || genesis.SkipBlockFix == nil || genesis.Index != 0 {
+		err = errors.New("not a genesis block")
+		return
+	}
+	if !genesis.CalculateHash().Equal(genesis.Hash) {
+		err = errors.New("wrong hash of genesis block")
+		return
+	}
+	if p == nil || len(p.Links) == 0 {
+		err = ErrorVerifySkipchain
+		return
+	}
+	// The first link only points to the genesis block, its roster is
+	// replaced by the trusted one.
+	if !p.Links[0].To.Equal(genesis.Hash) {
+		err = ErrorVerifySkipchain
+		return
+	}
+	sbID := genesis.Hash
+	publics := genesis.Roster.Publics()
+	for _, l := range p.Links[1:] {
+		if !l.From.Equal(sbID) {
+			err = ErrorVerifySkipchain
+			return
+		}
+		if err = l.Verify(cothority.Suite, publics); err != nil {
+			err = ErrorVerifySkipchain
+			return
+		}
+		sbID = l.To
+		if l.NewRoster != nil {
+			// Only the ID of the roster is signed, so the keys must
+			// correspond to the ID.
+			r := onet.NewRoster(l.NewRoster.List)
+			if r == nil || !r.ID.Equal(l.NewRoster.ID) {
+				err = ErrorVerifySkipchain
+				return
+			}
+			publics = r.Publics()
+		}
+	}
+	if p.Latest.SkipBlockFix == nil || !sbID.Equal(p.Latest.Hash) ||
+		!p.Latest.CalculateHash().Equal(p.Latest.Hash) {
+		err = ErrorVerifySkipchain
+		return
+	}
+
+	var header DataHeader
+	err = protobuf.DecodeWithConstructors(p.Latest.Data, &header, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return
+	}
+	if len(p.InclusionProof.Interiors) == 0 ||
+		!bytes.Equal(p.InclusionProof.GetRoot(), header.TrieRoot) {
+		err = ErrorVerifyTrieRoot
+		return
+	}
+	k, vals := p.InclusionProof.KeyValue()
+	if len(k) == 0 || !p.InclusionProof.Match(k) {
+		err = ErrorVerifyTrie
+		return
+	}
+	body, err := decodeStateChangeBody(vals)
+	if err != nil {
+		return
+	}
+	return k, body.Value, body.ContractID, body.DarcID, nil
+}
+
 // KeyValue returns the key and the values stored in the proof. The caller
 // should check both the key and the value because it should not trust the
 // service to always return a key/value pair (via the proof) that corresponds
@@ -2,13 +2,16 @@ package byzcoin
 
 import (
 	"crypto/sha256"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"testing"
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/trie"
 	"github.com/dedis/cothority/byzcoinx"
+	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/cosi"
@@ -52,6 +55,149 @@ func TestVerify(t *testing.T) {
 	})
 	require.Nil(t, err)
 	require.Equal(t, ErrorVerifyTrieRoot, p.Verify(s.genesis.SkipChainID()))
+
+	// The latest block must be the one the links lead to.
+	p, err = NewProof(s.c, s.s, s.genesis.Hash, s.key)
+	require.Nil(t, err)
+	p.Latest.GenesisID = getSBID("other")
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(s.genesis.SkipChainID()))
+	p.Latest.Hash = p.Latest.CalculateHash()
+	require.Equal(t, ErrorVerifySkipchain, p.Verify(s.genesis.SkipChainID()))
+}
+
+var updateFixtures = flag.Bool("update", false, "regenerate the test fixtures")
+
+// offlineProofFixture holds the offlineProofVectors used to test
+// VerifyProofOffline. Run the test with -update to regenerate it.
+const offlineProofFixture = "testdata/offline_proof.bin"
+
+type offlineProofVectors struct {
+	Genesis   skipchain.SkipBlock
+	Valid     Proof
+	Corrupted []corruptedProof
+}
+
+type corruptedProof struct {
+	Name  string
+	Proof Proof
+}
+
+func TestVerifyProofOffline(t *testing.T) {
+	if *updateFixtures {
+		buf, err := protobuf.Encode(genOfflineProofVectors(t))
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(offlineProofFixture, buf, 0644))
+	}
+	buf, err := ioutil.ReadFile(offlineProofFixture)
+	require.Nil(t, err)
+	var v offlineProofVectors
+	require.Nil(t, protobuf.DecodeWithConstructors(buf, &v, network.DefaultConstructors(cothority.Suite)))
+
+	key, value, contractID, darcID, err := VerifyProofOffline(&v.Genesis, &v.Valid)
+	require.Nil(t, err)
+	require.Equal(t, []byte("key"), key)
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, []byte("value"), contractID)
+	require.Equal(t, []byte(getSBID("darc")), darcID)
+
+	require.NotEqual(t, 0, len(v.Corrupted))
+	for _, c := range v.Corrupted {
+		_, _, _, _, err := VerifyProofOffline(&v.Genesis, &c.Proof)
+		require.NotNil(t, err, c.Name)
+	}
+
+	// The proof must come from the given genesis block.
+	other := skipchain.NewSkipBlock()
+	other.Roster, _ = genRoster(1)
+	other.Hash = other.CalculateHash()
+	_, _, _, _, err = VerifyProofOffline(other, &v.Valid)
+	require.Equal(t, ErrorVerifySkipchain, err)
+	other.Hash = v.Genesis.Hash
+	_, _, _, _, err = VerifyProofOffline(other, &v.Valid)
+	require.NotNil(t, err)
+}
+
+// genOfflineProofVectors creates a chain of three blocks, with a roster
+// change in the second block, and a proof for a key stored in the latest
+// block. The corrupted proofs are copies of this proof.
+func genOfflineProofVectors(t *testing.T) *offlineProofVectors {
+	memTrie, err := trie.NewTrie(trie.NewMemDB(), []byte("nonce"))
+	require.Nil(t, err)
+	st := &stateTrie{Trie: *memTrie}
+	oldRoot := st.GetRoot()
+	require.Nil(t, st.StoreAll(StateChanges{{
+		StateAction: Create,
+		InstanceID:  []byte("key"),
+		ContractID:  []byte("value"),
+		Value:       []byte("value"),
+		DarcID:      darc.ID(getSBID("darc")),
+	}}, 2))
+	pr, err := st.GetProof([]byte("key"))
+	require.Nil(t, err)
+
+	rosterA, privsA := genRoster(1)
+	rosterB, privsB := genRoster(1)
+	genesis := skipchain.NewSkipBlock()
+	genesis.Roster = rosterA
+	genesis.Hash = genesis.CalculateHash()
+	newBlock := func(index int, root []byte) *skipchain.SkipBlock {
+		sb := skipchain.NewSkipBlock()
+		sb.Index = index
+		sb.Roster = rosterB
+		sb.GenesisID = genesis.Hash
+		sb.Data, err = protobuf.Encode(&DataHeader{TrieRoot: root})
+		require.Nil(t, err)
+		sb.Hash = sb.CalculateHash()
+		return sb
+	}
+	sb1 := newBlock(1, oldRoot)
+	sb2 := newBlock(2, st.GetRoot())
+
+	v := &offlineProofVectors{
+		Genesis: *genesis,
+		Valid: Proof{
+			InclusionProof: *pr,
+			Links: []skipchain.ForwardLink{
+				{From: []byte{}, To: genesis.Hash, NewRoster: rosterA},
+				*genForwardLink(t, genesis, sb1, privsA)[0],
+				*genForwardLink(t, sb1, sb2, privsB)[0],
+			},
+			Latest: *sb2,
+		},
+	}
+	validBuf, err := protobuf.Encode(&v.Valid)
+	require.Nil(t, err)
+	corrupt := func(name string, f func(p *Proof)) {
+		var p Proof
+		err := protobuf.DecodeWithConstructors(validBuf, &p, network.DefaultConstructors(cothority.Suite))
+		require.Nil(t, err)
+		f(&p)
+		v.Corrupted = append(v.Corrupted, corruptedProof{Name: name, Proof: p})
+	}
+	corrupt("bad signature", func(p *Proof) {
+		p.Links[2].Signature.Sig[0] ^= 1
+	})
+	corrupt("truncated links", func(p *Proof) {
+		p.Links = p.Links[:2]
+	})
+	corrupt("missing links", func(p *Proof) {
+		p.Links = p.Links[:1]
+	})
+	corrupt("wrong roster", func(p *Proof) {
+		rosterC, _ := genRoster(1)
+		rosterC.ID = rosterB.ID
+		p.Links[1].NewRoster = rosterC
+	})
+	corrupt("tampered latest block", func(p *Proof) {
+		p.Latest.Data = sb1.Data
+	})
+	corrupt("mismatched key", func(p *Proof) {
+		p.InclusionProof.Leaf.Key = []byte("other key")
+	})
+	corrupt("mismatched value", func(p *Proof) {
+		p.InclusionProof.Leaf.Value = []byte("other value")
+	})
+	return v
 }
 
 type sc struct {
@@ -64,6 +64,12 @@ type CreateGenesisBlock struct {
 	// Maximum block size. Zero (or not present in protobuf) means use the default, 4 megs.
 	// optional
 	MaxBlockSize int
+	// SpawnTransaction is added to the genesis block after the
+	// configuration has been created. Its spawns on the genesis darc are
+	// verified like in any other transaction, so they must be signed by the
+	// admin.
+	// optional
+	SpawnTransaction *ClientTransaction
 }
 
 // CreateGenesisBlockResponse holds the genesis-block of the new skipchain.
@@ -114,6 +120,32 @@ type GetProofResponse struct {
 	Proof Proof
 }
 
+// GetProofAt returns the proof of the state of an instance as it was after
+// the block with the given index.
+type GetProofAt struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// InstanceID of the instance to prove.
+	InstanceID InstanceID
+	// BlockIndex is the index of the block holding the trie root of the
+	// proof.
+	BlockIndex int
+}
+
+// GetProofAtResponse holds a proof whose latest block is the requested one.
+type GetProofAtResponse struct {
+	// Version of the protocol
+	Version Version
+	// Proof contains everything necessary to prove the inclusion or the
+	// absence of the instance in the requested block.
+	Proof *Proof
+	// TooOld is true if the block is older than the retention horizon of
+	// the node, in which case Proof is nil.
+	TooOld bool
+}
+
 // CheckAuthorization returns the list of actions that could be executed if the
 // signatures of the given identities are present and valid
 type CheckAuthorization struct {
@@ -141,6 +173,9 @@ type ChainConfig struct {
 	BlockInterval time.Duration
 	Roster        onet.Roster
 	MaxBlockSize  int
+	// Version of the rules used to create the blocks of the chain. Chains
+	// created before it was introduced have version 0.
+	Version int
 }
 
 // Proof represents everything necessary to verify a given
@@ -267,9 +302,9 @@ type StreamingResponse struct {
 }
 
 // DownloadState requests the current global state of that node.
-// If it is the first call to the service, then Reset
-// must be true, else an error will be returned, or old data
-// might be used.
+// If it is the first call to the service, then Nonce
+// must be 0 and Page must be 0 or 1, else an error will be returned,
+// or old data might be used.
 type DownloadState struct {
 	// ByzCoinID of the state to download
 	ByzCoinID skipchain.SkipBlockID
@@ -282,6 +317,13 @@ type DownloadState struct {
 	Nonce uint64
 	// Length of the statechanges to download
 	Length int
+	// Page is the number of the page to download, starting at 1. The pages
+	// are cut from a snapshot of the state, so a page that has already been
+	// downloaded can be requested again to resume an interrupted download.
+	// Pages cannot be skipped. If Page is 0, the page following the last
+	// one served is returned.
+	// optional
+	Page int
 }
 
 // DownloadStateResponse is returned by the service. If there are no
@@ -294,6 +336,15 @@ type DownloadStateResponse struct {
 	// is generated by the server, and will be set
 	// for every subsequent reply, too.
 	Nonce uint64
+	// Index of the block corresponding to the state being downloaded.
+	// optional
+	Index int
+	// Proof is only set in the reply to the first page. It is the proof
+	// of the config instance in the block of the state being downloaded,
+	// so that the root of the rebuilt trie can be verified against the
+	// skipchain.
+	// optional
+	Proof *Proof
 }
 
 // DBKeyValue represents one element in bboltdb
@@ -378,3 +429,184 @@ type CheckStateChangeValidityResponse struct {
 	StateChanges []StateChange
 	BlockID      skipchain.SkipBlockID
 }
+
+// GetBlockStateChanges requests the state changes created by the
+// transactions of a block.
+type GetBlockStateChanges struct {
+	Version     Version
+	SkipChainID skipchain.SkipBlockID
+	BlockIndex  int
+}
+
+// GetBlockStateChangesResponse holds the state changes of a block, in the
+// order they have been applied. Their hash can be checked against the
+// StateChangesHash of the header of the block with Verify.
+type GetBlockStateChangesResponse struct {
+	Version      Version
+	StateChanges []StateChange
+	BlockHash    skipchain.SkipBlockID
+}
+
+// GetPendingTransactions asks a node for the transactions it has received
+// but not yet passed on to the leader. As it gives away information about
+// the clients, the request must be signed with the private key of the node.
+type GetPendingTransactions struct {
+	Version     Version
+	SkipChainID skipchain.SkipBlockID
+	// Timestamp is the time of the request in unix nanoseconds. Requests
+	// older than a minute are refused.
+	Timestamp int64
+	// Signature is the schnorr signature of the hash of the request,
+	// see GetPendingTransactions.Hash.
+	Signature []byte
+}
+
+// GetPendingTransactionsResponse lists the pending transactions, oldest
+// first, and gives statistics about the buffer of the node.
+type GetPendingTransactionsResponse struct {
+	Version      Version
+	Transactions []PendingTransaction
+	// Size is the number of pending transactions.
+	Size int
+	// MaxSize is the number of pending transactions after which new ones
+	// are refused.
+	MaxSize int
+	// OldestAge is the time since the arrival of the oldest pending
+	// transaction, in nanoseconds.
+	OldestAge int64
+	// Dropped is the number of transactions refused since the start of the
+	// node because the buffer was full.
+	Dropped int
+}
+
+// PendingTransaction describes a transaction waiting to be included in a
+// block. The arguments of the instructions are not given.
+type PendingTransaction struct {
+	// TxHash is the hash of the instructions of the transaction.
+	TxHash []byte
+	// Arrival is the time the node received the transaction, in unix
+	// nanoseconds.
+	Arrival int64
+	// Signers holds the identities of the signers of the instructions.
+	Signers []string
+	// InstanceIDs holds the instances the instructions are sent to.
+	InstanceIDs []InstanceID
+}
+
+// SimulateTransaction asks the service to execute the transaction against
+// the current state, without storing it in the ledger.
+type SimulateTransaction struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Transaction to be simulated
+	Transaction ClientTransaction
+}
+
+// SimulateTransactionResponse holds the outcome of the simulation of the
+// transaction. The simulation stops at the first instruction that is
+// rejected.
+type SimulateTransactionResponse struct {
+	// Version of the protocol
+	Version Version
+	// Accepted is true if all instructions have been accepted.
+	Accepted bool
+	// Instructions holds the results of the executed instructions.
+	Instructions []InstructionResult
+}
+
+// InstructionResult is the outcome of the simulation of one instruction.
+type InstructionResult struct {
+	// Accepted is true if the instruction would be accepted.
+	Accepted bool
+	// Error holds the reason why the instruction has been rejected.
+	// optional
+	Error string
+	// StateChanges that the instruction would produce. The Value of every
+	// state change is replaced by its sha256 hash.
+	StateChanges []StateChange
+}
+
+// GetTxStatus asks for the outcome of a transaction that has been included
+// in one of the latest blocks.
+type GetTxStatus struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// TxHash is the hash of the instructions of the transaction.
+	TxHash []byte
+}
+
+// GetTxStatusResponse tells whether the transaction has been accepted and if
+// not, which instruction has been refused.
+type GetTxStatusResponse struct {
+	// Version of the protocol
+	Version Version
+	// Included is false if the transaction is not in one of the latest
+	// blocks. All other fields are only valid if it is true.
+	Included bool
+	// Accepted is true if the transaction has been accepted.
+	Accepted bool
+	// BlockIndex of the block holding the transaction.
+	BlockIndex int
+	// InstructionIndex is the index of the refused instruction, or -1 if
+	// the transaction itself is invalid.
+	InstructionIndex int
+	// Error holds the reason why the instruction has been refused.
+	// optional
+	Error string
+	// CounterIdentity is set if the instruction has been refused because
+	// of the counter of this signer.
+	// optional
+	CounterIdentity string
+	// Counter is the counter of CounterIdentity used in the instruction.
+	// optional
+	Counter uint64
+	// ExpectedCounter is the counter of CounterIdentity the instruction
+	// needed.
+	// optional
+	ExpectedCounter uint64
+}
+
+// ListInstancesByContract asks for the instances of a given contract. The
+// answer is split in pages: the first request leaves Page empty, the
+// following requests set it to the Next field of the previous response.
+type ListInstancesByContract struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// ContractID of the instances to list.
+	ContractID string
+	// Page is the continuation token returned by the previous request.
+	// optional
+	Page []byte
+	// PageSize is the maximum number of instances to return. If it is 0, a
+	// default size is used.
+	PageSize int
+}
+
+// ListInstancesByContractResponse holds one page of instances, ordered by
+// their instance IDs.
+type ListInstancesByContractResponse struct {
+	// Version of the protocol
+	Version Version
+	// Instances of the requested contract.
+	Instances []InstanceInfo
+	// Next is the continuation token for the next page. It is empty if
+	// there are no more instances.
+	// optional
+	Next []byte
+}
+
+// InstanceInfo describes an instance without its value.
+type InstanceInfo struct {
+	// InstanceID of the instance.
+	InstanceID InstanceID
+	// Version is the current version of the instance.
+	Version uint64
+	// DarcID is the Darc controlling access to this instance.
+	DarcID darc.ID
+}
@@ -50,6 +50,20 @@ func incrementSignerCounters(st ReadOnlyStateTrie, sigs []darc.Signature) (State
 	return scs, nil
 }
 
+// CounterError is returned when an instruction is verified if the counter of
+// one of its signers is not the next one.
+type CounterError struct {
+	Identity string
+	// Counter is the counter used in the instruction.
+	Counter uint64
+	// Expected is the counter the instruction needed.
+	Expected uint64
+}
+
+func (e *CounterError) Error() string {
+	return fmt.Sprintf("for pk %s, got version %v, but need %v", e.Identity, e.Counter, e.Expected)
+}
+
 // verifySignerCounters verifies whether the given counters are valid with
 // respect to the current counters.
 func verifySignerCounters(st ReadOnlyStateTrie, counters []uint64, sigs []darc.Signature) error {
@@ -69,7 +83,7 @@ func verifySignerCounters(st ReadOnlyStateTrie, counters []uint64, sigs []darc.S
 		// to 0, this is the intended behaviour, otherwise the client
 		// will not be able to make more transactions.
 		if counter != c+1 {
-			return fmt.Errorf("for pk %s, got version %v, but need %v", id, counter, c+1)
+			return &CounterError{Identity: id, Counter: counter, Expected: c + 1}
 		}
 	}
 	return nil
@@ -8,7 +8,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
@@ -21,6 +23,7 @@ import (
 	cosiprotocol "github.com/dedis/cothority/ftcosi/protocol"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/util/random"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
@@ -131,13 +134,143 @@ type Service struct {
 	catchingUp           bool
 
 	downloadState downloadState
+	// downloadStateLock protects downloadState. It is not held while the
+	// snapshot of a new download is created.
+	downloadStateLock sync.Mutex
+
+	simulateLimiter rateLimiter
+
+	txStatuses txStatuses
+
+	contractIndex contractIndex
+
+	// proofRetention is the number of blocks for which GetProofAt can
+	// return a proof. It is protected by updateCollectionLock.
+	proofRetention int
+	trieSnapshots  trieSnapshots
 }
 
+// downloadState is the snapshot of the state served to a downloading node.
+// The snapshot is a copy of the entries of the state trie in a temporary
+// database, so that all pages are cut from the same state without keeping a
+// transaction of the database of the service open, nor the whole state in
+// memory.
 type downloadState struct {
-	id    skipchain.SkipBlockID
-	nonce uint64
-	read  chan DBKeyValue
-	stop  chan bool
+	id       skipchain.SkipBlockID
+	nonce    uint64
+	length   int
+	index    int
+	proof    *Proof
+	snapshot *bolt.DB
+	// starts holds the first key of every page that has been served, and
+	// of the next one. A nil key means that there are no more entries.
+	starts [][]byte
+	// served is the number of pages that have been served.
+	served int
+	timer  *time.Timer
+}
+
+// downloadTimeout is the time after which an unused download is aborted.
+var downloadTimeout = time.Minute
+
+// downloadBucket is the bucket of the snapshot of a download.
+var downloadBucket = []byte("download")
+
+// downloadBatch is the number of entries copied to the snapshot of a
+// download in one transaction, which bounds the memory used by the copy.
+const downloadBatch = 1000
+
+// page returns the entries of the given page, starting at 1. Only the pages
+// that have already been served and the next one are available. Page 0 is
+// the page following the last one served.
+func (ds *downloadState) page(p int) ([]DBKeyValue, error) {
+	if p == 0 {
+		p = ds.served + 1
+	}
+	start := ds.starts[p-1]
+	if start == nil {
+		return nil, nil
+	}
+	var kvs []DBKeyValue
+	var next []byte
+	err := ds.snapshot.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(downloadBucket).Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			if len(kvs) == ds.length {
+				next = append([]byte{}, k...)
+				break
+			}
+			kvs = append(kvs, DBKeyValue{append([]byte{}, k...), append([]byte{}, v...)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == len(ds.starts) {
+		ds.starts = append(ds.starts, next)
+	}
+	if p > ds.served {
+		ds.served = p
+	}
+	return kvs, nil
+}
+
+// close stops the download and removes its snapshot.
+func (ds *downloadState) close() {
+	if ds.timer != nil {
+		ds.timer.Stop()
+	}
+	if ds.snapshot != nil {
+		if err := ds.snapshot.Close(); err != nil {
+			log.Error("couldn't close download snapshot:", err)
+		}
+		if err := os.Remove(ds.snapshot.Path()); err != nil {
+			log.Error("couldn't remove download snapshot:", err)
+		}
+	}
+	*ds = downloadState{}
+}
+
+// rateLimiter allows up to simulateRate requests per simulatePeriod for
+// every key, and keeps track of at most maxRateKeys keys at once.
+type rateLimiter struct {
+	sync.Mutex
+	windows map[string]rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// allow returns false if the key already used up all its requests of the
+// current period, or if it is a new key and too many keys are in use.
+func (rl *rateLimiter) allow(key string) bool {
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	if rl.windows == nil {
+		rl.windows = make(map[string]rateWindow)
+	}
+	for k, w := range rl.windows {
+		if now.Sub(w.start) > simulatePeriod {
+			delete(rl.windows, k)
+		}
+	}
+	w, ok := rl.windows[key]
+	if !ok {
+		if len(rl.windows) >= maxRateKeys {
+			return false
+		}
+		w.start = now
+	}
+	if w.count >= simulateRate {
+		return false
+	}
+	w.count++
+	rl.windows[key] = w
+	return true
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -151,6 +284,52 @@ const defaultInterval = 5 * time.Second
 // defaultMaxBlockSize is used when the config cannot be loaded.
 const defaultMaxBlockSize = 4 * 1e6
 
+// minMaxBlockSize is the smallest accepted maximum block size. A smaller one
+// would make it impossible to even send through a config update tx to fix
+// it.
+const minMaxBlockSize = 16000
+
+// maxMaxBlockSize is the biggest accepted maximum block size.
+// onet/network.MaxPacketSize is 10 megs, leave some headroom anyway.
+const maxMaxBlockSize = 8 * 1e6
+
+// The versions of the rules used to create the blocks, as stored in the
+// ChainConfig. A change that gives other blocks for the same transactions
+// needs a new version, so that the existing blocks can still be verified.
+const (
+	// ChainVersionInitial keeps the state changes of the successful
+	// instructions of refused transactions.
+	ChainVersionInitial = iota
+	// ChainVersionAcceptedStateChanges only keeps the state changes of
+	// accepted transactions.
+	ChainVersionAcceptedStateChanges
+)
+
+// CurrentChainVersion is the version of the new chains.
+const CurrentChainVersion = ChainVersionAcceptedStateChanges
+
+// simulateRate is the number of SimulateTransaction requests a set of
+// signers can send during simulatePeriod.
+const simulateRate = 10
+
+const simulatePeriod = time.Second
+
+// maxRateKeys is the number of sets of signers that can send
+// SimulateTransaction requests during the same simulatePeriod.
+const maxRateKeys = 1000
+
+// defaultProofRetention is the number of blocks for which GetProofAt returns
+// proofs, unless changed with SetProofRetention.
+const defaultProofRetention = 1000
+
+// ErrProofTooOld is returned by Client.GetProofAt if the requested block is
+// older than the retention horizon of the node.
+var ErrProofTooOld = errors.New("block is older than the retention horizon")
+
+// pendingRequestWindow is how far the timestamp of a GetPendingTransactions
+// request can be from the time of the node.
+const pendingRequestWindow = time.Minute
+
 // bcStorage is used to save our data locally.
 type bcStorage struct {
 	// PropTimeout is used when sending the request to integrate a new block
@@ -229,8 +408,25 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 		}},
 	}
 	ctx.InstructionsHash = ctx.Instructions.Hash()
+	txs := NewTxResults(ctx)
+
+	// Additional instances are spawned from the genesis darc by a second
+	// transaction, which is verified like any other transaction.
+	if req.SpawnTransaction != nil {
+		if len(req.SpawnTransaction.Instructions) == 0 {
+			return nil, errors.New("the spawn transaction has no instructions")
+		}
+		genesisDarcID := NewInstanceID(req.GenesisDarc.GetBaseID())
+		for _, instr := range req.SpawnTransaction.Instructions {
+			if instr.Spawn == nil || instr.Spawn.ContractID == "" ||
+				instr.InstanceID != genesisDarcID {
+				return nil, errors.New("the spawn transaction must only spawn from the genesis darc")
+			}
+		}
+		txs = append(txs, NewTxResults(*req.SpawnTransaction)...)
+	}
 
-	sb, err := s.createNewBlock(nil, &req.Roster, NewTxResults(ctx))
+	sb, err := s.createNewBlock(nil, &req.Roster, txs)
 	if err != nil {
 		return nil, err
 	}
@@ -292,7 +488,9 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 		z := s.notifications.registerForBlocks(blockCh)
 		defer s.notifications.unregisterForBlocks(z)
 
-		s.txBuffer.add(string(req.SkipchainID), req.Transaction)
+		if err := s.txBuffer.add(string(req.SkipchainID), req.Transaction); err != nil {
+			return nil, err
+		}
 
 		// In case we don't have any blocks, because there are no transactions,
 		// have a hard timeout in twice the minimal expected time to create the
@@ -321,7 +519,9 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 			}
 		}
 	} else {
-		s.txBuffer.add(string(req.SkipchainID), req.Transaction)
+		if err := s.txBuffer.add(string(req.SkipchainID), req.Transaction); err != nil {
+			return nil, err
+		}
 	}
 
 	return &AddTxResponse{
@@ -367,6 +567,76 @@ func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 	return
 }
 
+// GetProofAt returns a proof of the state of an instance after the given
+// block. The state trie of this block is rebuilt from the stored state
+// changes, without holding the lock of the state trie, and the last rebuilt
+// tries are kept in memory. For blocks that are older than the retention
+// horizon, the reply has TooOld set and no proof.
+func (s *Service) GetProofAt(req *GetProofAt) (*GetProofAtResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	s.updateCollectionLock.Lock()
+	if s.catchingUp {
+		s.updateCollectionLock.Unlock()
+		return nil, errors.New("currently catching up on our state")
+	}
+	st, err := s.getStateTrie(req.SkipchainID)
+	if err != nil {
+		s.updateCollectionLock.Unlock()
+		return nil, err
+	}
+	latest := st.GetIndex()
+	if req.BlockIndex < 0 || req.BlockIndex > latest {
+		s.updateCollectionLock.Unlock()
+		return nil, errors.New("unknown block index")
+	}
+	if latest-req.BlockIndex > s.proofRetention {
+		s.updateCollectionLock.Unlock()
+		return &GetProofAtResponse{Version: CurrentVersion, TooOld: true}, nil
+	}
+	var proof *Proof
+	if req.BlockIndex == latest {
+		proof, err = NewProof(st, s.db(), req.SkipchainID, req.InstanceID.Slice())
+		s.updateCollectionLock.Unlock()
+	} else {
+		nonce := st.GetNonce()
+		s.updateCollectionLock.Unlock()
+		var old *stateTrie
+		old, err = s.trieSnapshots.getOrBuild(req.SkipchainID, req.BlockIndex, func() (*stateTrie, error) {
+			return s.stateChangeStorage.getStateTrieAt(req.SkipchainID, req.BlockIndex, nonce)
+		})
+		if err != nil {
+			return nil, err
+		}
+		proof, err = NewProof(old, s.db(), req.SkipchainID, req.InstanceID.Slice())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if proof.Latest.Index != req.BlockIndex {
+		return nil, errors.New("couldn't find the links to the block")
+	}
+	if err = proof.Verify(req.SkipchainID); err != nil {
+		if err == ErrorVerifyTrieRoot {
+			return nil, errors.New("the state changes of this block are not available anymore")
+		}
+		return nil, err
+	}
+	return &GetProofAtResponse{
+		Version: CurrentVersion,
+		Proof:   proof,
+	}, nil
+}
+
+// SetProofRetention sets the number of blocks, counted from the latest one,
+// for which GetProofAt returns proofs.
+func (s *Service) SetProofRetention(blocks int) {
+	s.updateCollectionLock.Lock()
+	s.proofRetention = blocks
+	s.updateCollectionLock.Unlock()
+}
+
 // CheckAuthorization verifies whether a given combination of identities can
 // fulfill a given rule of a given darc. Because all darcs are now used in
 // an online fashion, we need to offer this check.
@@ -407,7 +677,7 @@ func (s *Service) CheckAuthorization(req *CheckAuthorization) (resp *CheckAuthor
 		ids = append(ids, i.String())
 	}
 	for _, r := range d.Rules.List {
-		err = darc.EvalExprDarc(r.Expr, getDarcs, true, ids...)
+		err = darc.EvalExprDarcAttrs(r.Expr, getDarcs, true, attrs(st), ids...)
 		if err == nil {
 			resp.Actions = append(resp.Actions, r.Action)
 		}
@@ -443,72 +713,178 @@ func (s *Service) GetSignerCounters(req *GetSignerCounters) (*GetSignerCountersR
 }
 
 // DownloadState creates a snapshot of the current state and then returns the
-// instances in small chunks.
+// instances in small chunks. The chunks are numbered, starting at 1, and can
+// be requested again as long as the download is active, so that a node can
+// resume an interrupted download. A request for page 0 returns the chunk
+// following the last one served.
 func (s *Service) DownloadState(req *DownloadState) (resp *DownloadStateResponse, err error) {
-	s.updateCollectionLock.Lock()
-	defer s.updateCollectionLock.Unlock()
 	if req.Length <= 0 {
 		return nil, errors.New("length must be bigger than 0")
 	}
 
 	if req.Nonce == 0 {
 		log.Lvl2("Creating new download")
-		if !s.downloadState.id.IsNull() {
-			log.Lvlf2("Aborting download of nonce %x", s.downloadState.nonce)
-			close(s.downloadState.stop)
+		if req.Page > 1 {
+			return nil, errors.New("a new download must start at page 1")
 		}
 		sb := s.db().GetByID(req.ByzCoinID)
 		if sb == nil || sb.Index > 0 {
 			return nil, errors.New("unknown byzcoinID")
 		}
-		s.downloadState.id = req.ByzCoinID
-		s.downloadState.read = make(chan DBKeyValue)
-		s.downloadState.stop = make(chan bool)
-		nonce := binary.LittleEndian.Uint64(random.Bits(64, true, random.New()))
-		s.downloadState.nonce = nonce
-		go func(ds downloadState) {
-			idStr := fmt.Sprintf("%x", ds.id)
-			db, bucketName := s.GetAdditionalBucket([]byte(idStr))
-			err := db.View(func(tx *bolt.Tx) error {
-				bucket := tx.Bucket(bucketName)
-				return bucket.ForEach(func(k []byte, v []byte) error {
-					key := make([]byte, len(k))
-					copy(key, k)
-					value := make([]byte, len(v))
-					copy(value, v)
-					select {
-					case ds.read <- DBKeyValue{key, value}:
-					case <-ds.stop:
-						return errors.New("closed")
-					case <-time.After(time.Minute):
-						return errors.New("timed out while waiting for next read")
-					}
-					return nil
-				})
-			})
-			if err != nil {
-				log.Error("while serving current database:", err)
-			}
-			close(ds.read)
-		}(s.downloadState)
-	} else if !s.downloadState.id.Equal(req.ByzCoinID) || req.Nonce != s.downloadState.nonce {
-		return nil, errors.New("download has been aborted in favor of another download")
+		// The snapshot is created without holding downloadStateLock, so
+		// that the current download can go on in the meantime.
+		ds, err := s.newDownload(req)
+		if err != nil {
+			return nil, err
+		}
+		s.downloadStateLock.Lock()
+		defer s.downloadStateLock.Unlock()
+		if !s.downloadState.id.IsNull() {
+			log.Lvlf2("Aborting download of nonce %x", s.downloadState.nonce)
+			s.downloadState.close()
+		}
+		s.startDownload(ds)
+	} else {
+		s.downloadStateLock.Lock()
+		defer s.downloadStateLock.Unlock()
+		switch {
+		case !s.downloadState.id.Equal(req.ByzCoinID) || req.Nonce != s.downloadState.nonce:
+			return nil, errors.New("download has been aborted in favor of another download")
+		case req.Length != s.downloadState.length:
+			return nil, errors.New("length cannot change during a download")
+		case req.Page < 0 || req.Page > s.downloadState.served+1:
+			return nil, fmt.Errorf("page %d is not available", req.Page)
+		}
 	}
 
+	s.downloadState.timer.Reset(downloadTimeout)
+	first := req.Page == 1 || (req.Page == 0 && s.downloadState.served == 0)
+	kvs, err := s.downloadState.page(req.Page)
+	if err != nil {
+		return nil, errors.New("couldn't read download snapshot: " + err.Error())
+	}
 	resp = &DownloadStateResponse{
-		Nonce: s.downloadState.nonce,
+		KeyValues: kvs,
+		Nonce:     s.downloadState.nonce,
+		Index:     s.downloadState.index,
 	}
-query:
-	for i := 0; i < req.Length; i++ {
-		select {
-		case kv, ok := <-s.downloadState.read:
-			if !ok {
-				break query
+	if first {
+		resp.Proof = s.downloadState.proof
+	}
+	return
+}
+
+// newDownload creates the snapshot of the state of a new download. It holds
+// updateCollectionLock only while the proof is created and the transaction
+// of the database is started, so that both correspond to the same block. The
+// entries are then copied to a temporary database.
+func (s *Service) newDownload(req *DownloadState) (*downloadState, error) {
+	s.updateCollectionLock.Lock()
+	st, err := s.getStateTrie(req.ByzCoinID)
+	if err != nil {
+		s.updateCollectionLock.Unlock()
+		return nil, err
+	}
+	proof, err := NewProof(st, s.db(), req.ByzCoinID, NewInstanceID(nil).Slice())
+	if err != nil {
+		s.updateCollectionLock.Unlock()
+		return nil, err
+	}
+	index := st.GetIndex()
+	db, bucket := s.GetAdditionalBucket([]byte(fmt.Sprintf("%x", req.ByzCoinID)))
+	tx, err := db.Begin(false)
+	s.updateCollectionLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, first, err := copyToSnapshot(tx.Bucket(bucket))
+	if errRb := tx.Rollback(); err == nil {
+		err = errRb
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &downloadState{
+		id:       req.ByzCoinID,
+		length:   req.Length,
+		index:    index,
+		proof:    proof,
+		snapshot: snapshot,
+		starts:   [][]byte{first},
+	}, nil
+}
+
+// copyToSnapshot copies all entries of the bucket to a new temporary
+// database, in transactions of downloadBatch entries. It returns the
+// database and the first key of the bucket, which is nil if it is empty.
+func copyToSnapshot(b *bolt.Bucket) (*bolt.DB, []byte, error) {
+	f, err := ioutil.TempFile("", "byzcoin-download")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, nil, err
+	}
+	snapshot, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	// The snapshot is thrown away if the node crashes.
+	snapshot.NoSync = true
+	fail := func(err error) (*bolt.DB, []byte, error) {
+		snapshot.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+
+	c := b.Cursor()
+	k, v := c.First()
+	var first []byte
+	if k != nil {
+		first = append([]byte{}, k...)
+	}
+	for done := false; !done; {
+		err = snapshot.Update(func(tx *bolt.Tx) error {
+			sb, err := tx.CreateBucketIfNotExists(downloadBucket)
+			if err != nil {
+				return err
 			}
-			resp.KeyValues = append(resp.KeyValues, kv)
+			// The keys are added in order.
+			sb.FillPercent = 1
+			for i := 0; i < downloadBatch; i++ {
+				if k == nil {
+					done = true
+					return nil
+				}
+				if err := sb.Put(k, v); err != nil {
+					return err
+				}
+				k, v = c.Next()
+			}
+			return nil
+		})
+		if err != nil {
+			return fail(err)
 		}
 	}
-	return
+	return snapshot, first, nil
+}
+
+// startDownload makes ds the current download, with a new nonce. It must be
+// called with downloadStateLock held.
+func (s *Service) startDownload(ds *downloadState) {
+	nonce := binary.LittleEndian.Uint64(random.Bits(64, true, random.New()))
+	ds.nonce = nonce
+	ds.timer = time.AfterFunc(downloadTimeout, func() {
+		s.downloadStateLock.Lock()
+		defer s.downloadStateLock.Unlock()
+		if s.downloadState.nonce == nonce {
+			log.Lvlf2("Download of nonce %x timed out", nonce)
+			s.downloadState.close()
+		}
+	})
+	s.downloadState = *ds
 }
 
 func entryToResponse(sce *StateChangeEntry, ok bool, err error) (*GetInstanceVersionResponse, error) {
@@ -595,6 +971,247 @@ func (s *Service) CheckStateChangeValidity(req *CheckStateChangeValidity) (*Chec
 	}, nil
 }
 
+// GetBlockStateChanges returns the state changes created by the transactions
+// of the block with the given index. As the state changes are only kept for
+// a limited number of blocks, an error is returned if some of them have
+// already been cleaned up.
+func (s *Service) GetBlockStateChanges(req *GetBlockStateChanges) (*GetBlockStateChangesResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	reply, err := s.skService().GetSingleBlockByIndex(&skipchain.GetSingleBlockByIndex{
+		Genesis: req.SkipChainID,
+		Index:   req.BlockIndex,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var header DataHeader
+	err = protobuf.Decode(reply.SkipBlock.Data, &header)
+	if err != nil {
+		return nil, errors.New("couldn't unmarshal header: " + err.Error())
+	}
+
+	sces, err := s.stateChangeStorage.getByBlock(req.SkipChainID, req.BlockIndex)
+	if err != nil {
+		return nil, err
+	}
+	scs := make(StateChanges, len(sces))
+	for i, e := range sces {
+		scs[i] = e.StateChange
+	}
+	if !bytes.Equal(scs.Hash(), header.StateChangesHash) {
+		return nil, errors.New("the state changes of this block are not available anymore")
+	}
+
+	return &GetBlockStateChangesResponse{
+		Version:      CurrentVersion,
+		StateChanges: scs,
+		BlockHash:    reply.SkipBlock.Hash,
+	}, nil
+}
+
+// SetStateChangeRetention sets the number of blocks, counted from the latest
+// one, for which the state changes are kept. If it is 0, the state changes
+// are only cleaned up when the storage gets too big.
+func (s *Service) SetStateChangeRetention(blocks int) {
+	s.stateChangeStorage.setMaxNbrBlock(blocks)
+}
+
+// GetPendingTransactions returns the transactions of the given skipchain
+// that this node has received but not yet passed on to the leader, together
+// with statistics about the buffer. The request must be signed by the
+// private key of the node.
+func (s *Service) GetPendingTransactions(req *GetPendingTransactions) (*GetPendingTransactionsResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	age := time.Since(time.Unix(0, req.Timestamp))
+	if age < -pendingRequestWindow || age > pendingRequestWindow {
+		return nil, errors.New("request timestamp is out of the accepted window")
+	}
+	err := schnorr.Verify(cothority.Suite, s.ServerIdentity().Public, req.Hash(), req.Signature)
+	if err != nil {
+		return nil, errors.New("wrong signature: " + err.Error())
+	}
+
+	btxs, dropped, maxSize := s.txBuffer.pending(string(req.SkipChainID))
+	resp := &GetPendingTransactionsResponse{
+		Version:      CurrentVersion,
+		Transactions: make([]PendingTransaction, len(btxs)),
+		Size:         len(btxs),
+		MaxSize:      maxSize,
+		Dropped:      dropped,
+	}
+	if len(btxs) > 0 {
+		resp.OldestAge = int64(time.Since(btxs[0].arrival))
+	}
+	for i, btx := range btxs {
+		pt := PendingTransaction{
+			TxHash:  btx.tx.Instructions.Hash(),
+			Arrival: btx.arrival.UnixNano(),
+		}
+		signers := make(map[string]bool)
+		instances := make(map[InstanceID]bool)
+		for _, instr := range btx.tx.Instructions {
+			for _, sig := range instr.Signatures {
+				id := sig.Signer.String()
+				if !signers[id] {
+					signers[id] = true
+					pt.Signers = append(pt.Signers, id)
+				}
+			}
+			if !instances[instr.InstanceID] {
+				instances[instr.InstanceID] = true
+				pt.InstanceIDs = append(pt.InstanceIDs, instr.InstanceID)
+			}
+		}
+		resp.Transactions[i] = pt
+	}
+	return resp, nil
+}
+
+// SetMaxPendingTransactions sets the number of transactions a node keeps per
+// skipchain before it refuses new ones. It must be at least 1.
+func (s *Service) SetMaxPendingTransactions(size int) error {
+	return s.txBuffer.setMaxSize(size)
+}
+
+// GetTxStatus returns whether the transaction has been included in one of the
+// latest blocks, and if it has been refused, which instruction failed and why.
+func (s *Service) GetTxStatus(req *GetTxStatus) (*GetTxStatusResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	resp := &GetTxStatusResponse{Version: CurrentVersion}
+	st, ok := s.txStatuses.get(req.SkipchainID, req.TxHash)
+	if !ok {
+		return resp, nil
+	}
+	resp.Included = true
+	resp.Accepted = st.accepted
+	resp.BlockIndex = st.blockIndex
+	resp.InstructionIndex = st.instrIndex
+	resp.Error = st.reason
+	if st.counter != nil {
+		resp.CounterIdentity = st.counter.Identity
+		resp.Counter = st.counter.Counter
+		resp.ExpectedCounter = st.counter.Expected
+	}
+	return resp, nil
+}
+
+// ListInstancesByContract returns one page of the instances of the given
+// contract, ordered by instance ID.
+func (s *Service) ListInstancesByContract(req *ListInstancesByContract) (*ListInstancesByContractResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if req.ContractID == "" {
+		return nil, errors.New("missing contract ID")
+	}
+	size := req.PageSize
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+	st, err := s.getStateTrie(req.SkipchainID)
+	if err != nil {
+		return nil, err
+	}
+	instances, next, err := s.contractIndex.list(req.SkipchainID, st, req.ContractID, req.Page, size)
+	if err != nil {
+		return nil, err
+	}
+	return &ListInstancesByContractResponse{
+		Version:   CurrentVersion,
+		Instances: instances,
+		Next:      next,
+	}, nil
+}
+
+// SimulateTransaction executes the transaction on a copy of the latest state
+// of the given skipchain and returns the result of every instruction. Neither
+// the state nor the transaction buffer are changed. The number of requests
+// is limited for every set of signers of the first instruction, once their
+// signatures have been verified.
+func (s *Service) SimulateTransaction(req *SimulateTransaction) (*SimulateTransactionResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	ctx := req.Transaction
+	if len(ctx.Instructions) == 0 {
+		return nil, errors.New("no instructions to simulate")
+	}
+	if !bytes.Equal(ctx.InstructionsHash, ctx.Instructions.Hash()) {
+		return nil, errors.New("invalid instructions hash")
+	}
+	// Only verified signers are counted, else anybody could use up the
+	// requests of somebody else.
+	instr := ctx.Instructions[0]
+	if len(instr.Signatures) == 0 {
+		return nil, errors.New("the first instruction is not signed")
+	}
+	for _, sig := range instr.Signatures {
+		if err := sig.Signer.Verify(ctx.InstructionsHash, sig.Signature); err != nil {
+			return nil, errors.New("invalid signature: " + err.Error())
+		}
+	}
+	key := strings.Join(instr.GetIdentityStrings(), ",")
+	if !s.simulateLimiter.allow(key) {
+		return nil, errors.New("too many simulation requests, try again later")
+	}
+
+	st, err := s.getStateTrie(req.SkipchainID)
+	if err != nil {
+		return nil, err
+	}
+	sst := st.MakeStagingStateTrie()
+	sst.block, err = s.nextBlockInfo(req.SkipchainID, sst.GetIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &SimulateTransactionResponse{
+		Version:  CurrentVersion,
+		Accepted: true,
+	}
+	var cin []Coin
+	for _, instr := range ctx.Instructions {
+		scs, cout, err := s.executeInstruction(sst, cin, instr, ctx.InstructionsHash)
+		if err == nil {
+			var counterScs StateChanges
+			counterScs, err = incrementSignerCounters(sst, instr.Signatures)
+			if err == nil {
+				err = sst.StoreAll(append(scs, counterScs...))
+			}
+		}
+		if err != nil {
+			msg := err.Error()
+			if failed := instr.explain(sst); failed != "" {
+				msg += " - failed: " + failed
+			}
+			resp.Accepted = false
+			resp.Instructions = append(resp.Instructions, InstructionResult{
+				Error: msg,
+			})
+			break
+		}
+
+		res := InstructionResult{Accepted: true}
+		for _, sc := range scs {
+			h := sha256.Sum256(sc.Value)
+			sc.Value = h[:]
+			res.StateChanges = append(res.StateChanges, sc)
+		}
+		resp.Instructions = append(resp.Instructions, res)
+		cin = cout
+	}
+	return resp, nil
+}
+
 // SetPropagationTimeout overrides the default propagation timeout that is used
 // when a new block is announced to the nodes as well as the skipchain
 // propagation timeout.
@@ -664,10 +1281,20 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, tx
 	var txRes TxResults
 
 	log.Lvl3("Creating state changes")
-	mr, txRes, scs = s.createStateChanges(sst, scID, tx, noTimeout)
+	mr, txRes, scs, err = s.createStateChanges(sst, scID, tx, noTimeout)
+	if err != nil {
+		return nil, err
+	}
 	if len(txRes) == 0 {
 		return nil, errors.New("no transactions")
 	}
+	if scID.IsNull() {
+		for _, tx := range txRes {
+			if !tx.Accepted {
+				return nil, errors.New("genesis transaction has been refused")
+			}
+		}
+	}
 
 	// Store transactions in the body
 	body := &DataBody{TxResults: txRes}
@@ -731,7 +1358,7 @@ func (s *Service) downloadDB(sb *skipchain.SkipBlock) error {
 			_, err := s.getStateTrie(sb.SkipChainID())
 			if err == nil {
 				// Suppose we _do_ have a statetrie
-				db, stBucket := s.GetAdditionalBucket(sb.SkipChainID())
+				db, stBucket := s.GetAdditionalBucket([]byte(idStr))
 				err := db.Update(func(tx *bolt.Tx) error {
 					return tx.DeleteBucket(stBucket)
 				})
@@ -741,22 +1368,29 @@ func (s *Service) downloadDB(sb *skipchain.SkipBlock) error {
 				s.stateTriesLock.Lock()
 				delete(s.stateTries, idStr)
 				s.stateTriesLock.Unlock()
+				s.contractIndex.reset(sb.SkipChainID())
 			}
 
 			// Then start downloading the stateTrie over the network.
 			cl := NewClient(sb.SkipChainID(), *roster)
-			var db *bolt.DB
-			var bucketName []byte
+			db, bucketName := s.GetAdditionalBucket([]byte(idStr))
 			var nonce uint64
-			for {
-				resp, err := cl.DownloadState(sb.SkipChainID(), nonce, catchupFetchDBEntries)
-				if db == nil {
-					db, bucketName = s.GetAdditionalBucket([]byte(idStr))
-					nonce = resp.Nonce
+			var proof *Proof
+			for page := 1; ; page++ {
+				resp, err := cl.DownloadStatePage(sb.SkipChainID(), nonce, page, catchupFetchDBEntries)
+				if err != nil && page > 1 {
+					// Resume the download by asking for the same page
+					// again.
+					log.Lvlf2("Retrying page %d: %s", page, err)
+					resp, err = cl.DownloadStatePage(sb.SkipChainID(), nonce, page, catchupFetchDBEntries)
 				}
 				if err != nil {
 					return errors.New("cannot download trie: " + err.Error())
 				}
+				if page == 1 {
+					nonce = resp.Nonce
+					proof = resp.Proof
+				}
 				// And store all entries in our local database.
 				err = db.Update(func(tx *bolt.Tx) error {
 					bucket := tx.Bucket(bucketName)
@@ -781,23 +1415,8 @@ func (s *Service) downloadDB(sb *skipchain.SkipBlock) error {
 			if err != nil {
 				return errors.New("couldn't load state trie: " + err.Error())
 			}
-			if sb.Index != st.GetIndex() {
-				log.Lvl2("Downloading corresponding block")
-				cl := skipchain.NewClient()
-				// TODO: make sure the downloaded block is correct
-				search, err := cl.GetSingleBlockByIndex(roster, sb.SkipChainID(), st.GetIndex())
-				if err != nil {
-					return errors.New("couldn't get correct block for verification: " + err.Error())
-				}
-				sb = search.SkipBlock
-			}
-			var header DataHeader
-			err = protobuf.DecodeWithConstructors(sb.Data, &header, network.DefaultConstructors(cothority.Suite))
-			if err != nil {
-				return errors.New("couldn't unmarshal header: " + err.Error())
-			}
-			if !bytes.Equal(st.GetRoot(), header.TrieRoot) {
-				return errors.New("got wrong database, merkle roots don't work out")
+			if err := s.verifyDownloadedTrie(sb, st, proof); err != nil {
+				return err
 			}
 
 			// Finally initialize the stateTrie using the new database.
@@ -814,6 +1433,36 @@ func (s *Service) downloadDB(sb *skipchain.SkipBlock) error {
 	return errors.New("none of the non-leader and non-subleader nodes were able to give us a copy of the state")
 }
 
+// verifyDownloadedTrie checks that the root of a downloaded trie is the one
+// stored in the block given in the proof, and that this block is part of the
+// skipchain of sb.
+func (s *Service) verifyDownloadedTrie(sb *skipchain.SkipBlock, st *stateTrie, proof *Proof) error {
+	if proof == nil {
+		return errors.New("didn't get a proof for the downloaded state")
+	}
+	genesis := s.db().GetByID(sb.SkipChainID())
+	if genesis == nil {
+		var err error
+		genesis, err = skipchain.NewClient().GetSingleBlock(sb.Roster, sb.SkipChainID())
+		if err != nil {
+			return errors.New("couldn't get genesis block: " + err.Error())
+		}
+		if !genesis.Hash.Equal(sb.SkipChainID()) {
+			return errors.New("got wrong genesis block")
+		}
+	}
+	if _, _, _, _, err := VerifyProofOffline(genesis, proof); err != nil {
+		return errors.New("invalid proof for the downloaded state: " + err.Error())
+	}
+	if st.GetIndex() != proof.Latest.Index {
+		return errors.New("downloaded state doesn't correspond to the block of the proof")
+	}
+	if !bytes.Equal(st.GetRoot(), proof.InclusionProof.GetRoot()) {
+		return errors.New("got wrong database, merkle roots don't work out")
+	}
+	return nil
+}
+
 // catchUp takes a skipblock as reference for the roster, the current index,
 // and the skipchainID to download either new blocks if it's less than
 // `catchupDownloadAll` behind, or calls downloadDB to start the download of
@@ -839,8 +1488,15 @@ func (s *Service) catchUp(sb *skipchain.SkipBlock) {
 		err := s.downloadDB(sb)
 		if err != nil {
 			log.Error("Error while downloading trie:", err)
+			return
 		}
-		return
+		// Only the blocks created during the download are missing.
+		st, err = s.getStateTrie(sb.SkipChainID())
+		if err != nil {
+			log.Error("problem with trie:", err)
+			return
+		}
+		trieIndex = st.GetIndex()
 	}
 
 	cl := skipchain.NewClient()
@@ -965,7 +1621,11 @@ func (s *Service) updateTrieCallback(sbID skipchain.SkipBlockID) error {
 	}
 
 	log.Lvlf2("%s Updating transactions for %x on index %v", s.ServerIdentity(), sb.SkipChainID(), sb.Index)
-	_, _, scs := s.createStateChanges(st.MakeStagingStateTrie(), sb.SkipChainID(), body.TxResults, noTimeout)
+	_, _, scs, err := s.createStateChanges(st.MakeStagingStateTrie(), sb.SkipChainID(), body.TxResults, noTimeout)
+	if err != nil {
+		log.Error(s.ServerIdentity(), "couldn't create the state changes", err)
+		return err
+	}
 
 	// Store old config before the global state gets updated, so that we can compare
 	// with the previous roster to know if something has changed.
@@ -995,7 +1655,10 @@ func (s *Service) updateTrieCallback(sbID skipchain.SkipBlockID) error {
 			"mean that the db is broken. Error: " + err.Error())
 	}
 
+	s.contractIndex.apply(sb.SkipChainID(), scs)
+
 	// Notify all waiting channels for processed ClientTransactions.
+	s.txStatuses.included(sb.SkipChainID(), sb.Index, body.TxResults)
 	for _, t := range body.TxResults {
 		s.notifications.informWaitChannel(t.ClientTransaction.Instructions.Hash(), t.Accepted)
 	}
@@ -1349,7 +2012,11 @@ func (s *Service) startPolling(scID skipchain.SkipBlockID) chan bool {
 				if err != nil {
 					panic("the state trie must exist because we only start polling after creating/loading the skipchain")
 				}
-				_, txOut, _ := s.createStateChanges(st.MakeStagingStateTrie(), scID, txIn, bcConfig.BlockInterval/2)
+				_, txOut, _, err := s.createStateChanges(st.MakeStagingStateTrie(), scID, txIn, bcConfig.BlockInterval/2)
+				if err != nil {
+					log.Error(s.ServerIdentity(), "couldn't create new block: "+err.Error())
+					continue
+				}
 
 				txs = txs[len(txOut):]
 				if len(txs) > 0 {
@@ -1436,7 +2103,11 @@ func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool
 		}
 		sst = st.MakeStagingStateTrie()
 	}
-	mtr, txOut, scs := s.createStateChanges(sst, newSB.SkipChainID(), body.TxResults, noTimeout)
+	mtr, txOut, scs, err := s.createStateChanges(sst, newSB.SkipChainID(), body.TxResults, noTimeout)
+	if err != nil {
+		log.Error(s.ServerIdentity(), err)
+		return false
+	}
 
 	// Check that the locally generated list of accepted/rejected txs match the list
 	// the leader proposed.
@@ -1532,10 +2203,12 @@ func txSize(txr ...TxResult) (out int) {
 // State caching is implemented here, which is critical to performance, because
 // on the leader it reduces the number of contract executions by 1/3 and on
 // followers by 1/2.
-func (s *Service) createStateChanges(sst *stagingStateTrie, scID skipchain.SkipBlockID, txIn TxResults, timeout time.Duration) (merkleRoot []byte, txOut TxResults, states StateChanges) {
+//
+// An error is returned if the previous block cannot be read, as the darc
+// expressions depend on its timestamp.
+func (s *Service) createStateChanges(sst *stagingStateTrie, scID skipchain.SkipBlockID, txIn TxResults, timeout time.Duration) (merkleRoot []byte, txOut TxResults, states StateChanges, err error) {
 	// If what we want is in the cache, then take it from there. Otherwise
 	// ignore the error and compute the state changes.
-	var err error
 	merkleRoot, txOut, states, err = s.stateChangeCache.get(scID, txIn.Hash())
 	if err == nil {
 		log.Lvl3(s.ServerIdentity(), "loaded state changes from cache")
@@ -1552,12 +2225,42 @@ func (s *Service) createStateChanges(sst *stagingStateTrie, scID skipchain.SkipB
 
 	deadline := time.Now().Add(timeout)
 
+	if sst.block == nil {
+		sst.block, err = s.nextBlockInfo(scID, sst.GetIndex())
+		if err != nil {
+			return
+		}
+	}
+	// Older chains keep the state changes of the successful instructions
+	// of refused transactions. A missing config is a new chain.
+	version := CurrentChainVersion
+	if config, errConfig := loadConfigFromTrie(sst); errConfig == nil {
+		version = config.Version
+	}
 	sstTemp := sst.Clone()
 	var cin []Coin
+	refused := func(tx TxResult, txStates StateChanges, i int, err error) {
+		if version < ChainVersionAcceptedStateChanges {
+			states = append(states, txStates...)
+		}
+		// The state changes of the transaction are discarded, so the
+		// darcs it changed must not be used from the cache.
+		sst.block.cache.reset()
+		if scID.IsNull() {
+			return
+		}
+		st, errSt := s.getStateTrie(scID)
+		if errSt != nil {
+			return
+		}
+		s.txStatuses.refused(scID, st.GetIndex(),
+			tx.ClientTransaction.Instructions.Hash(), i, err)
+	}
 clientTransactions:
 	for _, tx := range txIn {
 		if !bytes.Equal(tx.ClientTransaction.InstructionsHash, tx.ClientTransaction.Instructions.Hash()) {
 			log.Error(s.ServerIdentity(), "invalid instruction hash")
+			refused(tx, nil, -1, errors.New("invalid instruction hash"))
 			tx.Accepted = false
 			txOut = append(txOut, tx)
 			continue clientTransactions
@@ -1568,10 +2271,12 @@ clientTransactions:
 		// sucessfully implemented and changes applied, then keep it
 		// (via cdbTemp = cdbI.c), otherwise dump it.
 		sstTempC := sstTemp.Clone()
-		for _, instr := range tx.ClientTransaction.Instructions {
+		var txStates StateChanges
+		for i, instr := range tx.ClientTransaction.Instructions {
 			scs, cout, err := s.executeInstruction(sstTempC, cin, instr, tx.ClientTransaction.InstructionsHash)
 			if err != nil {
 				log.Errorf("%s Call to contract returned error: %s", s.ServerIdentity(), err)
+				refused(tx, txStates, i, err)
 				tx.Accepted = false
 				txOut = append(txOut, tx)
 				continue clientTransactions
@@ -1579,18 +2284,20 @@ clientTransactions:
 			var counterScs StateChanges
 			if counterScs, err = incrementSignerCounters(sstTempC, instr.Signatures); err != nil {
 				log.Errorf("%s failed to update signature counters: %s", s.ServerIdentity(), err)
+				refused(tx, txStates, i, err)
 				tx.Accepted = false
 				txOut = append(txOut, tx)
 				continue clientTransactions
 			}
 			if err = sstTempC.StoreAll(append(scs, counterScs...)); err != nil {
 				log.Errorf("%s StoreAll failed: %s", s.ServerIdentity(), err)
+				refused(tx, txStates, i, err)
 				tx.Accepted = false
 				txOut = append(txOut, tx)
 				continue clientTransactions
 			}
-			states = append(states, scs...)
-			states = append(states, counterScs...)
+			txStates = append(txStates, scs...)
+			txStates = append(txStates, counterScs...)
 			cin = cout
 		}
 
@@ -1623,6 +2330,7 @@ clientTransactions:
 		}
 
 		sstTemp = sstTempC
+		states = append(states, txStates...)
 		tx.Accepted = true
 		txOut = append(txOut, tx)
 		blocksz += txsz
@@ -1801,6 +2509,12 @@ func (s *Service) cleanupGoroutines() {
 	}
 	s.pollChanMut.Unlock()
 	s.pollChanWG.Wait()
+
+	s.downloadStateLock.Lock()
+	if !s.downloadState.id.IsNull() {
+		s.downloadState.close()
+	}
+	s.downloadStateLock.Unlock()
 }
 
 func (s *Service) monitorLeaderFailure() {
@@ -2047,6 +2761,28 @@ func (s *Service) trySyncAll() {
 	}
 }
 
+// nextBlockInfo returns the information about the block following the block
+// at index. The timestamp is 0 for the genesis block, which has no previous
+// block, and an error is returned if the block at index cannot be read.
+func (s *Service) nextBlockInfo(scID skipchain.SkipBlockID, index int) (*blockInfo, error) {
+	bi := &blockInfo{index: index + 1, cache: newDarcCache()}
+	if scID.IsNull() || index < 0 {
+		return bi, nil
+	}
+	reply, err := s.skService().GetSingleBlockByIndex(
+		&skipchain.GetSingleBlockByIndex{Genesis: scID, Index: index})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get block %d: %v", index, err)
+	}
+	var header DataHeader
+	err = protobuf.DecodeWithConstructors(reply.SkipBlock.Data, &header, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't unmarshal header: " + err.Error())
+	}
+	bi.prevTimestamp = header.Timestamp
+	return bi, nil
+}
+
 // getBlockTx fetches the block with the given id and then decode the payload
 // to return the list of transactions
 func (s *Service) getBlockTx(sid skipchain.SkipBlockID) (TxResults, *skipchain.SkipBlock, error) {
@@ -2073,6 +2809,11 @@ func (s *Service) buildStateChanges(sid skipchain.SkipBlockID, sst *stagingState
 		return nil, err
 	}
 
+	sst.block, err = s.nextBlockInfo(sb.SkipChainID(), sb.Index-1)
+	if err != nil {
+		return nil, err
+	}
+
 	// when an error occured, we stop where we are because those state changes
 	// should be generated without errors then something else went wrong
 	// (e.g. storage issue)
@@ -2124,6 +2865,10 @@ func newService(c *onet.Context) (onet.Service, error) {
 		storage:                &bcStorage{},
 		darcToSc:               make(map[string]skipchain.SkipBlockID),
 		stateChangeCache:       newStateChangeCache(),
+		txStatuses:             newTxStatuses(),
+		contractIndex:          newContractIndex(),
+		proofRetention:         defaultProofRetention,
+		trieSnapshots:          newTrieSnapshots(),
 		stateChangeStorage:     newStateChangeStorage(c),
 		heartbeatsTimeout:      make(chan string, 1),
 		closeLeaderMonitorChan: make(chan bool, 1),
@@ -2142,7 +2887,13 @@ func newService(c *onet.Context) (onet.Service, error) {
 		s.GetInstanceVersion,
 		s.GetLastInstanceVersion,
 		s.GetAllInstanceVersion,
-		s.CheckStateChangeValidity)
+		s.CheckStateChangeValidity,
+		s.SimulateTransaction,
+		s.GetTxStatus,
+		s.ListInstancesByContract,
+		s.GetProofAt,
+		s.GetBlockStateChanges,
+		s.GetPendingTransactions)
 	if err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
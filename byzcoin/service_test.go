@@ -6,11 +6,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"math"
+	"strconv"
 	"testing"
 	"time"
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin/trie"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/darc/expression"
 	"github.com/dedis/cothority/skipchain"
@@ -826,12 +828,41 @@ func TestService_StateChange(t *testing.T) {
 	ct2 := ClientTransaction{Instructions: instrs2}
 	ct2.InstructionsHash = ct2.Instructions.Hash()
 
-	_, txOut, scs := s.service().createStateChanges(cdb.MakeStagingStateTrie(), s.genesis.SkipChainID(), NewTxResults(ct1, ct2), noTimeout)
-	require.Equal(t, 2, len(txOut))
+	// The first instruction succeeds, but the second one refuses the
+	// transaction: none of its state changes must be returned.
+	ct3 := ClientTransaction{Instructions: []Instruction{
+		{InstanceID: inst, Spawn: &Spawn{ContractID: "add"}},
+		instrs2[0],
+	}}
+	ct3.InstructionsHash = ct3.Instructions.Hash()
+
+	_, txOut, scs, err := s.service().createStateChanges(cdb.MakeStagingStateTrie(), s.genesis.SkipChainID(), NewTxResults(ct1, ct2, ct3), noTimeout)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(txOut))
 	require.True(t, txOut[0].Accepted)
 	require.False(t, txOut[1].Accepted)
+	require.False(t, txOut[2].Accepted)
 	require.Equal(t, n, len(scs))
 	require.Equal(t, latest, int64(n-1))
+
+	// Chains of the initial version keep the state change of the first
+	// instruction of the refused transaction.
+	sst := cdb.MakeStagingStateTrie()
+	config, err := loadConfigFromTrie(sst)
+	require.NoError(t, err)
+	config.Version = ChainVersionInitial
+	configBuf, err := protobuf.Encode(config)
+	require.NoError(t, err)
+	_, _, _, darcID, err := sst.GetValues(ConfigInstanceID.Slice())
+	require.NoError(t, err)
+	require.NoError(t, sst.StoreAll(StateChanges{
+		NewStateChange(Update, ConfigInstanceID, ContractConfigID, configBuf, darcID)}))
+	s.service().stateChangeCache = newStateChangeCache()
+	_, txOut, scs, err = s.service().createStateChanges(sst, s.genesis.SkipChainID(), NewTxResults(ct1, ct2, ct3), noTimeout)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(txOut))
+	require.False(t, txOut[2].Accepted)
+	require.Equal(t, n+1, len(scs))
 }
 
 func TestService_DarcEvolutionFail(t *testing.T) {
@@ -1465,6 +1496,91 @@ func TestService_DownloadState(t *testing.T) {
 	}
 }
 
+func TestService_DownloadStatePages(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	ct := addDummyTxs(t, s, 10, 30, 1)
+	st, err := s.service().getStateTrie(s.genesis.SkipChainID())
+	require.Nil(t, err)
+	root := st.GetRoot()
+	index := st.GetIndex()
+
+	download := func(nonce uint64, page int) *DownloadStateResponse {
+		resp, err := s.service().DownloadState(&DownloadState{
+			ByzCoinID: s.genesis.SkipChainID(),
+			Nonce:     nonce,
+			Length:    50,
+			Page:      page,
+		})
+		require.Nil(t, err)
+		return resp
+	}
+	resp := download(0, 1)
+	nonce := resp.Nonce
+	require.Equal(t, index, resp.Index)
+	require.NotNil(t, resp.Proof)
+	_, _, _, _, err = VerifyProofOffline(s.genesis, resp.Proof)
+	require.Nil(t, err)
+	require.Equal(t, index, resp.Proof.Latest.Index)
+	require.Equal(t, root, resp.Proof.InclusionProof.GetRoot())
+
+	// The download is not disturbed by new blocks.
+	addDummyTxs(t, s, 1, 1, ct)
+
+	// Pages cannot be skipped, and the length cannot change.
+	_, err = s.service().DownloadState(&DownloadState{
+		ByzCoinID: s.genesis.SkipChainID(),
+		Nonce:     nonce,
+		Length:    50,
+		Page:      3,
+	})
+	require.NotNil(t, err)
+	_, err = s.service().DownloadState(&DownloadState{
+		ByzCoinID: s.genesis.SkipChainID(),
+		Nonce:     nonce,
+		Length:    10,
+		Page:      2,
+	})
+	require.NotNil(t, err)
+
+	// Rebuild the trie, requesting every page twice to simulate resumed
+	// downloads.
+	db := trie.NewMemDB()
+	for page := 1; ; page++ {
+		resp = download(nonce, page)
+		again := download(nonce, page)
+		require.Equal(t, resp.KeyValues, again.KeyValues)
+		require.Equal(t, index, resp.Index)
+		require.Nil(t, db.Update(func(b trie.Bucket) error {
+			for _, kv := range resp.KeyValues {
+				if err := b.Put(kv.Key, kv.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		if len(resp.KeyValues) < 50 {
+			break
+		}
+	}
+	rebuilt, err := trie.LoadTrie(db)
+	require.Nil(t, err)
+	require.Equal(t, root, rebuilt.GetRoot())
+
+	// A new node rebuilds the current state.
+	st, err = s.service().getStateTrie(s.genesis.SkipChainID())
+	require.Nil(t, err)
+	servers, _, _ := s.local.MakeSRS(cothority.Suite, 1, ByzCoinID)
+	service := s.local.GetServices(servers, ByzCoinID)[0].(*Service)
+	require.Nil(t, service.downloadDB(s.genesis))
+	stCopy, err := service.getStateTrie(s.genesis.SkipChainID())
+	require.Nil(t, err)
+	require.Equal(t, st.GetIndex(), stCopy.GetIndex())
+	require.Equal(t, st.GetRoot(), stCopy.GetRoot())
+	require.NotEqual(t, root, stCopy.GetRoot())
+}
+
 func TestService_SetBadConfig(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
@@ -1662,7 +1778,8 @@ func TestService_StateChangeCache(t *testing.T) {
 
 	txs := NewTxResults(tx1, tx2)
 	require.NoError(t, err)
-	root, txOut, states := s.service().createStateChanges(sst, scID, txs, noTimeout)
+	root, txOut, states, err := s.service().createStateChanges(sst, scID, txs, noTimeout)
+	require.NoError(t, err)
 	require.Equal(t, 2, len(txOut))
 	require.Equal(t, 1, ctr)
 	// we expect one state change to increment the signature counter
@@ -1675,7 +1792,8 @@ func TestService_StateChangeCache(t *testing.T) {
 	// createStateChanges when making the block), then it should load it from the
 	// cache, which means that ctr is still one (we do not call the
 	// contract twice).
-	root1, txOut1, states1 := s.service().createStateChanges(sst, scID, txOut, noTimeout)
+	root1, txOut1, states1, err := s.service().createStateChanges(sst, scID, txOut, noTimeout)
+	require.NoError(t, err)
 	require.Equal(t, 1, ctr)
 	require.Equal(t, root, root1)
 	require.Equal(t, txOut, txOut1)
@@ -1684,8 +1802,8 @@ func TestService_StateChangeCache(t *testing.T) {
 	// If we remove the cache, then we expect the contract to be called
 	// again, i.e., ctr == 2.
 	s.service().stateChangeCache = newStateChangeCache()
+	root2, txOut2, states2, err := s.service().createStateChanges(sst, scID, txs, noTimeout)
 	require.NoError(t, err)
-	root2, txOut2, states2 := s.service().createStateChanges(sst, scID, txs, noTimeout)
 	require.Equal(t, root, root2)
 	require.Equal(t, txOut, txOut2)
 	require.Equal(t, states, states2)
@@ -1703,6 +1821,32 @@ func TestService_UpdateTrieCallback(t *testing.T) {
 	require.Nil(t, err)
 }
 
+// Blocks must not be built nor verified without the timestamp of the previous
+// block.
+func TestService_NextBlockInfo(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	scID := s.genesis.SkipChainID()
+	bi, err := s.service().nextBlockInfo(scID, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, bi.index)
+	require.NotEqual(t, int64(0), bi.prevTimestamp)
+	bi, err = s.service().nextBlockInfo(scID, -1)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), bi.prevTimestamp)
+	_, err = s.service().nextBlockInfo(scID, 100)
+	require.NotNil(t, err)
+
+	st, err := s.service().getStateTrie(scID)
+	require.Nil(t, err)
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+	require.Nil(t, err)
+	_, _, _, err = s.service().createStateChanges(st.MakeStagingStateTrie(),
+		skipchain.SkipBlockID(genID().Slice()), NewTxResults(tx), noTimeout)
+	require.NotNil(t, err)
+}
+
 // This tests that the state change storage will actually
 // store them and increase the versions accordingly over
 // several transactions and instructions
@@ -1893,6 +2037,105 @@ func TestService_StateChangeCatchUp(t *testing.T) {
 	require.Equal(t, uint64(n+1), sc.StateChange.Version)
 }
 
+func TestService_SimulateTransaction(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, s.signer)
+	require.Nil(t, err)
+	req := &SimulateTransaction{
+		Version:     CurrentVersion,
+		SkipchainID: s.genesis.SkipChainID(),
+		Transaction: tx,
+	}
+	resp, err := s.service().SimulateTransaction(req)
+	require.Nil(t, err)
+	require.True(t, resp.Accepted)
+	require.Equal(t, 1, len(resp.Instructions))
+	require.Equal(t, 1, len(resp.Instructions[0].StateChanges))
+	h := sha256.Sum256(s.value)
+	require.Equal(t, h[:], resp.Instructions[0].StateChanges[0].Value)
+
+	// Neither the state nor the transaction buffer have been touched.
+	time.Sleep(2 * s.interval)
+	pr, err := s.service().GetProof(&GetProof{
+		Version: CurrentVersion,
+		Key:     tx.Instructions[0].Hash(),
+		ID:      s.genesis.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.False(t, pr.Proof.InclusionProof.Match(tx.Instructions[0].Hash()))
+	ctrs, err := s.service().GetSignerCounters(&GetSignerCounters{
+		SignerIDs:   []string{s.signer.Identity().String()},
+		SkipchainID: s.genesis.SkipChainID(),
+	})
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), ctrs.Counters[0])
+
+	// A wrong counter is reported.
+	req.Transaction, err = createOneClientTxWithCounter(s.darc.GetBaseID(),
+		dummyContract, s.value, s.signer, 2)
+	require.Nil(t, err)
+	resp, err = s.service().SimulateTransaction(req)
+	require.Nil(t, err)
+	require.False(t, resp.Accepted)
+	require.NotEqual(t, "", resp.Instructions[0].Error)
+
+	// The part of the rule that is not satisfied is explained.
+	other := darc.NewSignerEd25519(nil, nil)
+	otherReq := *req
+	otherReq.Transaction, err = createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, other)
+	require.Nil(t, err)
+	resp, err = s.service().SimulateTransaction(&otherReq)
+	require.Nil(t, err)
+	require.False(t, resp.Accepted)
+	require.Contains(t, resp.Instructions[0].Error,
+		"- failed: "+s.signer.Identity().String()+" [no signature]")
+
+	// Requests with forged signatures don't count for the signer.
+	forged := *req
+	forged.Transaction, err = createOneClientTx(s.darc.GetBaseID(), dummyContract, s.value, other)
+	require.Nil(t, err)
+	forged.Transaction.Instructions[0].Signatures[0].Signer = s.signer.Identity()
+	for i := 0; i < simulateRate; i++ {
+		_, err = s.service().SimulateTransaction(&forged)
+		require.Contains(t, err.Error(), "invalid signature")
+	}
+	_, err = s.service().SimulateTransaction(req)
+	require.Nil(t, err)
+
+	// Too many requests are refused.
+	for i := 0; i < simulateRate; i++ {
+		s.service().SimulateTransaction(req)
+	}
+	_, err = s.service().SimulateTransaction(req)
+	require.NotNil(t, err)
+}
+
+func TestRateLimiter(t *testing.T) {
+	var rl rateLimiter
+	for i := 0; i < simulateRate; i++ {
+		require.True(t, rl.allow("a"))
+	}
+	require.False(t, rl.allow("a"))
+
+	for i := 1; i < maxRateKeys; i++ {
+		require.True(t, rl.allow(strconv.Itoa(i)))
+	}
+	require.False(t, rl.allow("new"))
+
+	// Expired keys are forgotten.
+	rl.Lock()
+	for k, w := range rl.windows {
+		w.start = w.start.Add(-2 * simulatePeriod)
+		rl.windows[k] = w
+	}
+	rl.Unlock()
+	require.True(t, rl.allow("new"))
+	require.True(t, rl.allow("a"))
+	require.Equal(t, 2, len(rl.windows))
+}
+
 func createBadConfigTx(t *testing.T, s *ser, intervalBad, szBad bool) (ClientTransaction, ChainConfig) {
 	switch {
 	case intervalBad:
@@ -1909,6 +2152,7 @@ func createConfigTxWithCounter(t *testing.T, interval time.Duration, roster onet
 		BlockInterval: interval,
 		Roster:        roster,
 		MaxBlockSize:  size,
+		Version:       CurrentChainVersion,
 	}
 	configBuf, err := protobuf.Encode(&config)
 	require.NoError(t, err)
@@ -1969,6 +2213,11 @@ func (s *ser) service() *Service {
 	return s.services[0]
 }
 
+// client returns a Client for the chain of s.
+func (s *ser) client() *Client {
+	return NewClient(s.genesis.SkipChainID(), *s.roster)
+}
+
 func (s *ser) waitProof(t *testing.T, id InstanceID) Proof {
 	return s.waitProofWithIdx(t, id.Slice(), 0)
 }
@@ -23,6 +23,28 @@ type ReadOnlyStateTrie interface {
 // byzcoin.
 type stagingStateTrie struct {
 	trie.StagingTrie
+	// block is the block the instructions executed on this trie are for. It
+	// is nil if the block is not known.
+	block *blockInfo
+}
+
+// blockInfo holds the values of a block that the attributes of the darc
+// expressions are evaluated against. As they must be the same on every node,
+// the timestamp is the one of the previous block: the timestamp of a new block
+// is only known after its instructions have been executed.
+type blockInfo struct {
+	index         int
+	prevTimestamp int64
+	cache         *darcCache
+}
+
+// attrs returns the function evaluating the attributes of the darc
+// expressions for instructions executed on st.
+func attrs(st ReadOnlyStateTrie) darc.AttrFn {
+	if sst, ok := st.(*stagingStateTrie); ok && sst.block != nil {
+		return darc.BlockAttrs(sst.block.index, sst.block.prevTimestamp)
+	}
+	return darc.BlockAttrs(st.GetIndex()+1, 0)
 }
 
 // Clone makes a copy of the staged data of the structure, the source Trie is
@@ -30,6 +52,7 @@ type stagingStateTrie struct {
 func (t *stagingStateTrie) Clone() *stagingStateTrie {
 	return &stagingStateTrie{
 		StagingTrie: *t.StagingTrie.Clone(),
+		block:       t.block,
 	}
 }
 
@@ -77,9 +100,14 @@ func (t *stagingStateTrie) Commit() error {
 	return errors.New("not implemented")
 }
 
-// GetIndex returns the index of the current trie.
+// GetIndex returns the index of the source trie, which is the index of the
+// latest block whose state changes have been committed.
 func (t *stagingStateTrie) GetIndex() int {
-	panic("cannot get index in stagingStateTrie")
+	indexBuf := t.GetMetadata([]byte(trieIndexKey))
+	if indexBuf == nil {
+		return -1
+	}
+	return int(binary.LittleEndian.Uint32(indexBuf))
 }
 
 const trieIndexKey = "trieIndexKey"
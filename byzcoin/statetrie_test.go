@@ -36,6 +36,7 @@ func TestStateTrie(t *testing.T) {
 
 	require.NoError(t, st.StoreAll([]StateChange{sc}, 6))
 	require.Equal(t, st.GetIndex(), 6)
+	require.Equal(t, 6, st.MakeStagingStateTrie().GetIndex())
 
 	_, _, _, _, err = st.GetValues(append(key, byte(0)))
 	require.Equal(t, errKeyNotSet, err)
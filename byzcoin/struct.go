@@ -11,6 +11,7 @@ import (
 	"time"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/cothority/byzcoin/trie"
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/onet"
 	"github.com/dedis/protobuf"
@@ -177,7 +178,9 @@ func (s *stateChangeStorage) setMaxSize(size int) {
 // setMaxNbrBlock enables the cleaning of state changes belonging
 // to blocks with an old index.
 func (s *stateChangeStorage) setMaxNbrBlock(nbr int) {
+	s.sortedKeysLock.Lock()
 	s.maxNbrBlock = nbr
+	s.sortedKeysLock.Unlock()
 }
 
 // This will clean the oldest state changes when the total size
@@ -575,6 +578,62 @@ func (s *stateChangeStorage) getStateTrie(scid skipchain.SkipBlockID) (*stagingS
 	return sst, err
 }
 
+// getStateTrieAt rebuilds the state trie as it was after the block with the
+// given index, using the latest version of every instance up to this block.
+// The nonce must be the one of the original trie, so that both tries have the
+// same root. If some state changes have been cleaned, the root will be
+// different.
+func (s *stateChangeStorage) getStateTrieAt(scid skipchain.SkipBlockID, index int, nonce []byte) (*stateTrie, error) {
+	t, err := trie.NewTrie(trie.NewMemDB(), nonce)
+	if err != nil {
+		return nil, err
+	}
+	st := &stateTrie{Trie: *t}
+
+	var scs StateChanges
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := s.getBucket(tx, scid)
+		if b == nil {
+			return nil
+		}
+
+		// The keys are ordered by instance ID and then by version, so the
+		// last entry of an instance up to the block is its state.
+		var last *StateChange
+		add := func() {
+			if last != nil && last.StateAction != Remove {
+				scs = append(scs, *last)
+			}
+			last = nil
+		}
+		var iid []byte
+		err := b.ForEach(func(k, v []byte) error {
+			if iid == nil || !bytes.HasPrefix(k, iid) {
+				add()
+				iid = append([]byte{}, k[:prefixLength]...)
+			}
+			var sce StateChangeEntry
+			if err := protobuf.Decode(v, &sce); err != nil {
+				return err
+			}
+			if sce.BlockIndex <= index {
+				last = &sce.StateChange
+			}
+			return nil
+		})
+		add()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := st.StoreAll(scs, index); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
 // SafeAdd will add a to the value of the coin if there will be no
 // overflow.
 func (c *Coin) SafeAdd(a uint64) error {
@@ -622,7 +681,13 @@ func (bc *bcNotifications) informWaitChannel(ctxHash []byte, valid bool) {
 	defer bc.Unlock()
 	ch := bc.waitChannels[string(ctxHash)]
 	if ch != nil {
-		ch <- valid
+		// If the same transaction has been sent more than once, only the
+		// first copy is reported, the others are refused because of their
+		// counters.
+		select {
+		case ch <- valid:
+		default:
+		}
 	}
 }
 
@@ -669,19 +734,22 @@ func (c ChainConfig) sanityCheck(old *ChainConfig) error {
 	if c.BlockInterval <= 0 {
 		return errors.New("block interval is less or equal to zero")
 	}
-	// too small would make it impossible to even send through a config update tx to fix it,
-	// so don't allow that.
-	if c.MaxBlockSize < 16000 {
-		return errors.New("max block size is less than 16000")
+	if c.MaxBlockSize < minMaxBlockSize {
+		return fmt.Errorf("max block size is less than %d", minMaxBlockSize)
 	}
-	// onet/network.MaxPacketSize is 10 megs, leave some headroom anyway.
-	if c.MaxBlockSize > 8*1e6 {
+	if c.MaxBlockSize > maxMaxBlockSize {
 		return errors.New("max block size is greater than 8 megs")
 	}
 	if len(c.Roster.List) < 3 {
 		return errors.New("need at least 3 nodes to have a majority")
 	}
+	if c.Version > CurrentChainVersion {
+		return fmt.Errorf("unknown chain version %d", c.Version)
+	}
 	if old != nil {
+		if c.Version < old.Version {
+			return errors.New("cannot downgrade the chain version")
+		}
 		return old.checkNewRoster(c.Roster)
 	}
 	return nil
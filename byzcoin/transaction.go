@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/dedis/cothority/byzcoin/trie"
 	"github.com/dedis/cothority/darc"
@@ -89,6 +90,64 @@ func (ctx *ClientTransaction) SignWith(signers ...darc.Signer) error {
 	return nil
 }
 
+// CounterSource returns the latest counters of the given signer identities,
+// in the same order. It is implemented by Client.
+type CounterSource interface {
+	GetSignerCounters(ids ...string) (*GetSignerCountersResponse, error)
+}
+
+// FillSignersAndSignWith sets the signer counters of all instructions,
+// computes the hash of the instructions and signs every instruction with
+// all the signers, in this order. If no instruction has its counters set,
+// they are fetched from cs and incremented for every instruction. If all
+// instructions already have one counter per signer, cs is not used and can
+// be nil. Any other combination returns an error.
+func (ctx *ClientTransaction) FillSignersAndSignWith(cs CounterSource, signers ...darc.Signer) error {
+	if len(ctx.Instructions) == 0 {
+		return errors.New("no instructions to sign")
+	}
+	if len(signers) == 0 {
+		return errors.New("no signers")
+	}
+	var filled int
+	for _, instr := range ctx.Instructions {
+		switch len(instr.SignerCounter) {
+		case 0:
+		case len(signers):
+			filled++
+		default:
+			return errors.New("the number of counters doesn't match the number of signers")
+		}
+	}
+	switch filled {
+	case 0:
+		if cs == nil {
+			return errors.New("no counter source to fetch the counters")
+		}
+		ids := make([]string, len(signers))
+		for i, s := range signers {
+			ids[i] = s.Identity().String()
+		}
+		reply, err := cs.GetSignerCounters(ids...)
+		if err != nil {
+			return err
+		}
+		if len(reply.Counters) != len(ids) {
+			return errors.New("got a wrong number of counters")
+		}
+		for i := range ctx.Instructions {
+			ctx.Instructions[i].SignerCounter = make([]uint64, len(ids))
+			for j, ctr := range reply.Counters {
+				ctx.Instructions[i].SignerCounter[j] = ctr + uint64(i) + 1
+			}
+		}
+	case len(ctx.Instructions):
+	default:
+		return errors.New("only some of the instructions have their counters set")
+	}
+	return ctx.SignWith(signers...)
+}
+
 // Hash computes the digest of the hash function
 func (instr Instruction) Hash() []byte {
 	h := sha256.New()
@@ -219,6 +278,29 @@ func (instr Instruction) GetIdentityStrings() []string {
 	return res
 }
 
+// VerifySignatures checks the signer counters and the signatures of the
+// instruction, but not the rules of the darc of the instance. It is for the
+// contracts that authorize some instructions themselves, all the others
+// must use Verify.
+func (instr Instruction) VerifySignatures(st ReadOnlyStateTrie, msg []byte) error {
+	if err := verifySignerCounters(st, instr.SignerCounter, instr.Signatures); err != nil {
+		return err
+	}
+	if len(instr.Signatures) == 0 {
+		return errors.New("no signatures - nothing to verify")
+	}
+	return instr.verifySignatures(msg)
+}
+
+func (instr Instruction) verifySignatures(msg []byte) error {
+	for _, sig := range instr.Signatures {
+		if err := sig.Signer.Verify(msg, sig.Signature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Verify will look up the darc of the instance pointed to by the instruction
 // and then verify if the signature on the instruction can satisfy the rules of
 // the darc. An error is returned if any of the verification fails.
@@ -229,7 +311,8 @@ func (instr Instruction) Verify(st ReadOnlyStateTrie, msg []byte) error {
 	}
 
 	// get the darc
-	d, err := getInstanceDarc(st, instr.InstanceID)
+	cache := darcCacheOf(st)
+	d, err := cache.instanceDarc(st, instr.InstanceID)
 	if err != nil {
 		return errors.New("darc not found: " + err.Error())
 	}
@@ -243,28 +326,61 @@ func (instr Instruction) Verify(st ReadOnlyStateTrie, msg []byte) error {
 	}
 
 	// check the signature
-	for _, sig := range instr.Signatures {
-		if err := sig.Signer.Verify(msg, sig.Signature); err != nil {
-			return err
-		}
+	if err := instr.verifySignatures(msg); err != nil {
+		return err
 	}
 
-	// check the expression
-	getDarc := func(str string, latest bool) *darc.Darc {
-		if len(str) < 5 || string(str[0:5]) != "darc:" {
-			return nil
+	// check the expression, unless it has already been evaluated for the
+	// same signers in this block
+	action := darc.Action(instr.Action())
+	ids := instr.GetIdentityStrings()
+	key := evaluationKey(d, action, ids)
+	found, err := cache.evaluation(st, key)
+	if !found {
+		deps := make(map[string]uint64)
+		getDarc := func(str string, latest bool) *darc.Darc {
+			if len(str) < 5 || string(str[0:5]) != "darc:" {
+				return nil
+			}
+			darcID, err := hex.DecodeString(str[5:])
+			if err != nil {
+				return nil
+			}
+			d, version, err := cache.loadDarc(st, darcID)
+			if err != nil {
+				deps[string(darcID)] = darcVersion(st, darcID)
+				return nil
+			}
+			deps[string(darcID)] = version
+			return d
 		}
-		darcID, err := hex.DecodeString(str[5:])
-		if err != nil {
-			return nil
-		}
-		d, err := LoadDarcFromTrie(st, darcID)
-		if err != nil {
-			return nil
-		}
-		return d
+		err = darc.EvalExprAttrs(d.Rules.Get(action), getDarc, attrs(st), ids...)
+		cache.storeEvaluation(key, deps, err)
+	}
+	if err != nil {
+		return fmt.Errorf("rule '%v' is not satisfied: %v", instr.Action(), err)
+	}
+	return nil
+}
+
+// explain returns the part of the rule of the instruction that is not
+// satisfied by its signers. It is empty if the rule is satisfied or cannot be
+// evaluated.
+func (instr Instruction) explain(st ReadOnlyStateTrie) string {
+	d, err := getInstanceDarc(st, instr.InstanceID)
+	if err != nil {
+		return ""
+	}
+	action := darc.Action(instr.Action())
+	if !d.Rules.Contains(action) {
+		return ""
 	}
-	return darc.EvalExpr(d.Rules.Get(darc.Action(instr.Action())), getDarc, instr.GetIdentityStrings()...)
+	trace, err := darc.ExplainExpr(d.Rules.Get(action), GetDarcFromTrie(st), attrs(st),
+		instr.GetIdentityStrings()...)
+	if err != nil {
+		return ""
+	}
+	return trace.FailedBranch()
 }
 
 // InstrType is the instruction type, which can be spawn, invoke or delete.
@@ -461,15 +577,31 @@ func (sc StateAction) String() string {
 	}
 }
 
+// defaultMaxTxBuffer is the default maximum number of transactions kept in
+// the buffer of one skipchain.
+const defaultMaxTxBuffer = 1000
+
 // txBuffer is thread-safe data structure that store client transactions.
+// If the buffer of a skipchain is full, new transactions are refused, so that
+// the transactions already waiting cannot be pushed out by a flood of new
+// ones.
 type txBuffer struct {
 	sync.Mutex
-	txsMap map[string][]ClientTransaction
+	txsMap  map[string][]bufferedTx
+	maxSize int
+	dropped map[string]int
+}
+
+type bufferedTx struct {
+	tx      ClientTransaction
+	arrival time.Time
 }
 
 func newTxBuffer() txBuffer {
 	return txBuffer{
-		txsMap: make(map[string][]ClientTransaction),
+		txsMap:  make(map[string][]bufferedTx),
+		maxSize: defaultMaxTxBuffer,
+		dropped: make(map[string]int),
 	}
 }
 
@@ -477,22 +609,50 @@ func (r *txBuffer) take(key string) []ClientTransaction {
 	r.Lock()
 	defer r.Unlock()
 
-	txs, ok := r.txsMap[key]
+	btxs, ok := r.txsMap[key]
 	if !ok {
 		return []ClientTransaction{}
 	}
 	delete(r.txsMap, key)
+	txs := make([]ClientTransaction, len(btxs))
+	for i, btx := range btxs {
+		txs[i] = btx.tx
+	}
 	return txs
 }
 
-func (r *txBuffer) add(key string, newTx ClientTransaction) {
+// add appends the transaction to the buffer of the skipchain, or returns an
+// error if the buffer is full.
+func (r *txBuffer) add(key string, newTx ClientTransaction) error {
 	r.Lock()
 	defer r.Unlock()
 
-	if txs, ok := r.txsMap[key]; !ok {
-		r.txsMap[key] = []ClientTransaction{newTx}
-	} else {
-		txs = append(txs, newTx)
-		r.txsMap[key] = txs
+	if len(r.txsMap[key]) >= r.maxSize {
+		log.Warn("transaction buffer is full, refusing the transaction")
+		r.dropped[key]++
+		return errors.New("transaction buffer is full, try again later")
 	}
+	r.txsMap[key] = append(r.txsMap[key], bufferedTx{newTx, time.Now()})
+	return nil
+}
+
+// setMaxSize sets the maximum number of transactions kept per skipchain,
+// which must be at least 1.
+func (r *txBuffer) setMaxSize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("the size of the buffer must be at least 1, got %d", size)
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.maxSize = size
+	return nil
+}
+
+// pending returns a copy of the transactions waiting in the buffer, oldest
+// first, the number of transactions that have been refused and the maximum
+// size of the buffer.
+func (r *txBuffer) pending(key string) ([]bufferedTx, int, int) {
+	r.Lock()
+	defer r.Unlock()
+	return append([]bufferedTx{}, r.txsMap[key]...), r.dropped[key], r.maxSize
 }
@@ -1,11 +1,13 @@
 package byzcoin
 
 import (
+	"bytes"
 	"encoding/binary"
 	"testing"
 
 	"github.com/dedis/cothority/byzcoin/trie"
 	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
 	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/require"
 )
@@ -26,7 +28,7 @@ func TestTransaction_Signing(t *testing.T) {
 	mdb := trie.NewMemDB()
 	tr, err := trie.NewTrie(mdb, []byte("my nonce"))
 	require.NoError(t, err)
-	sst := &stagingStateTrie{*tr.MakeStagingTrie()}
+	sst := &stagingStateTrie{StagingTrie: *tr.MakeStagingTrie()}
 
 	// verification should fail because trie is empty
 	ctxHash := ctx.InstructionsHash
@@ -38,6 +40,9 @@ func TestTransaction_Signing(t *testing.T) {
 	require.NoError(t, setSignerCounter(sst, signer.Identity().String(), 10))
 	require.Error(t, ctx.Instructions[0].Verify(sst, ctxHash))
 	require.Contains(t, ctx.Instructions[0].Verify(sst, ctxHash).Error(), "got version")
+	cerr, ok := ctx.Instructions[0].Verify(sst, ctxHash).(*CounterError)
+	require.True(t, ok)
+	require.Equal(t, uint64(11), cerr.Expected)
 
 	// set the right version, but darc is missing, verification should fail
 	require.NoError(t, setSignerCounter(sst, signer.Identity().String(), 0))
@@ -59,6 +64,76 @@ func TestTransaction_Signing(t *testing.T) {
 	require.NoError(t, ctx.Instructions[0].Verify(sst, ctxHash))
 }
 
+type testCounterSource map[string]uint64
+
+func (cs testCounterSource) GetSignerCounters(ids ...string) (*GetSignerCountersResponse, error) {
+	reply := &GetSignerCountersResponse{}
+	for _, id := range ids {
+		reply.Counters = append(reply.Counters, cs[id])
+	}
+	return reply, nil
+}
+
+func TestTransaction_FillSignersAndSignWith(t *testing.T) {
+	s1 := darc.NewSignerEd25519(nil, nil)
+	s2 := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{s1.Identity(), s2.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	d.Rules.AddRule("spawn:dummy_kind", d.Rules.GetSignExpr())
+	cs := testCounterSource{s1.Identity().String(): 3, s2.Identity().String(): 7}
+
+	ctx := ClientTransaction{Instructions: Instructions{
+		createInstr(d.GetBaseID(), "dummy_kind", "data", []byte("1")),
+		createInstr(d.GetBaseID(), "dummy_kind", "data", []byte("2")),
+	}}
+	for i := range ctx.Instructions {
+		ctx.Instructions[i].SignerCounter = nil
+	}
+	require.NoError(t, ctx.FillSignersAndSignWith(cs, s1, s2))
+	require.Equal(t, ctx.Instructions.Hash(), ctx.InstructionsHash)
+	require.Equal(t, []uint64{4, 8}, ctx.Instructions[0].SignerCounter)
+	require.Equal(t, []uint64{5, 9}, ctx.Instructions[1].SignerCounter)
+
+	// The instructions must pass the verification of the service, with
+	// the counters being incremented after every instruction.
+	tr, err := trie.NewTrie(trie.NewMemDB(), []byte("my nonce"))
+	require.NoError(t, err)
+	sst := &stagingStateTrie{StagingTrie: *tr.MakeStagingTrie()}
+	darcBuf, err := d.ToProto()
+	require.NoError(t, err)
+	require.NoError(t, sst.StoreAll([]StateChange{{
+		InstanceID:  d.GetBaseID(),
+		StateAction: Create,
+		ContractID:  []byte("darc"),
+		Value:       darcBuf,
+		DarcID:      d.GetBaseID(),
+	}}))
+	for i, instr := range ctx.Instructions {
+		require.NoError(t, setSignerCounter(sst, s1.Identity().String(), uint64(3+i)))
+		require.NoError(t, setSignerCounter(sst, s2.Identity().String(), uint64(7+i)))
+		require.NoError(t, instr.Verify(sst, ctx.InstructionsHash))
+	}
+
+	// Counters that are already set are kept.
+	ctx.Instructions[0].Signatures = nil
+	require.NoError(t, ctx.FillSignersAndSignWith(nil, s1, s2))
+	require.Equal(t, []uint64{4, 8}, ctx.Instructions[0].SignerCounter)
+	require.NoError(t, setSignerCounter(sst, s1.Identity().String(), 3))
+	require.NoError(t, setSignerCounter(sst, s2.Identity().String(), 7))
+	require.NoError(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+
+	// Inconsistent counters are refused.
+	ctx.Instructions[1].SignerCounter = nil
+	require.Error(t, ctx.FillSignersAndSignWith(cs, s1, s2))
+	ctx.Instructions[1].SignerCounter = []uint64{1}
+	require.Error(t, ctx.FillSignersAndSignWith(cs, s1, s2))
+	ctx.Instructions[0].SignerCounter = nil
+	ctx.Instructions[1].SignerCounter = nil
+	require.Error(t, ctx.FillSignersAndSignWith(nil, s1, s2))
+	require.Error(t, ctx.FillSignersAndSignWith(cs))
+	require.Error(t, (&ClientTransaction{}).FillSignersAndSignWith(cs, s1))
+}
+
 func setSignerCounter(sst *stagingStateTrie, id string, v uint64) error {
 	key := publicVersionKey(id)
 	verBuf := make([]byte, 8)
@@ -135,3 +210,96 @@ func combineInstrsAndSign(signer darc.Signer, instrs ...Instruction) (ClientTran
 	}
 	return t, nil
 }
+
+func TestTransaction_VerifyAttributes(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	require.NoError(t, d.Rules.AddRule("spawn:dummy_kind", expression.Expr(signer.Identity().String()+
+		" & attr:before_block:10 & attr:after_time:1500000000")))
+	ctx, err := createOneClientTx(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
+	require.NoError(t, err)
+
+	tr, err := trie.NewTrie(trie.NewMemDB(), []byte("my nonce"))
+	require.NoError(t, err)
+	sst := &stagingStateTrie{StagingTrie: *tr.MakeStagingTrie()}
+	darcBuf, err := d.ToProto()
+	require.NoError(t, err)
+	require.NoError(t, sst.StoreAll([]StateChange{{
+		InstanceID:  d.GetBaseID(),
+		StateAction: Create,
+		ContractID:  []byte("darc"),
+		Value:       darcBuf,
+		DarcID:      d.GetBaseID(),
+	}}))
+	require.NoError(t, setSignerCounter(sst, signer.Identity().String(), 0))
+
+	verify := func(index int, sec int64) error {
+		sst.block = &blockInfo{index: index, prevTimestamp: sec * 1e9}
+		return ctx.Instructions[0].Verify(sst, ctx.InstructionsHash)
+	}
+	require.NoError(t, verify(9, 1500000000))
+	require.Error(t, verify(10, 1500000000))
+	require.Error(t, verify(9, 1499999999))
+
+	// Without a timestamp, the time condition fails.
+	sst.block = nil
+	require.Error(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+}
+
+func TestTransaction_VerifyDelegationCycle(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	ids := []darc.Identity{signer.Identity()}
+	keyA := bytes.Repeat([]byte{0xaa}, 32)
+	keyB := bytes.Repeat([]byte{0xbb}, 32)
+	idA := darc.NewIdentityDarc(keyA).String()
+	idB := darc.NewIdentityDarc(keyB).String()
+
+	d := darc.NewDarc(darc.InitRules(ids, ids), []byte("genesis darc"))
+	require.NoError(t, d.Rules.AddRule("spawn:dummy_kind", expression.Expr(idA)))
+	ctx, err := createOneClientTx(d.GetBaseID(), "dummy_kind", []byte("dummy_value"), signer)
+	require.NoError(t, err)
+
+	// darc A delegates to darc B, which delegates back to darc A.
+	dA := darc.NewDarc(darc.InitRules(ids, ids), []byte("darc A"))
+	require.NoError(t, dA.Rules.UpdateSign(expression.Expr(idB)))
+	dB := darc.NewDarc(darc.InitRules(ids, ids), []byte("darc B"))
+	require.NoError(t, dB.Rules.UpdateSign(expression.Expr(idA+" | "+signer.Identity().String())))
+
+	tr, err := trie.NewTrie(trie.NewMemDB(), []byte("my nonce"))
+	require.NoError(t, err)
+	sst := &stagingStateTrie{StagingTrie: *tr.MakeStagingTrie()}
+	var scs StateChanges
+	for key, dd := range map[string]*darc.Darc{string(d.GetBaseID()): d, string(keyA): dA, string(keyB): dB} {
+		buf, err := dd.ToProto()
+		require.NoError(t, err)
+		scs = append(scs, StateChange{
+			InstanceID:  []byte(key),
+			StateAction: Create,
+			ContractID:  []byte(ContractDarcID),
+			Value:       buf,
+			DarcID:      d.GetBaseID(),
+		})
+	}
+	require.NoError(t, sst.StoreAll(scs))
+	require.NoError(t, setSignerCounter(sst, signer.Identity().String(), 0))
+
+	// The cycle is a branch that is not satisfied, but the signer is
+	// allowed by darc B.
+	require.NoError(t, ctx.Instructions[0].Verify(sst, ctx.InstructionsHash))
+
+	// Without the signer in darc B, only the cycle is left.
+	require.NoError(t, dB.Rules.UpdateSign(expression.Expr(idA)))
+	buf, err := dB.ToProto()
+	require.NoError(t, err)
+	require.NoError(t, sst.StoreAll(StateChanges{{
+		InstanceID:  keyB,
+		StateAction: Update,
+		ContractID:  []byte(ContractDarcID),
+		Value:       buf,
+		DarcID:      d.GetBaseID(),
+	}}))
+	err = ctx.Instructions[0].Verify(sst, ctx.InstructionsHash)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "delegation cycle: "+idA+" -> "+idB+" -> "+idA)
+}
@@ -67,3 +67,19 @@ func (p *countNodeProcessor) OnInterior(n interiorNode, k, v []byte) error {
 	p.total++
 	return nil
 }
+
+type leafNodeProcessor struct {
+	f func(k, v []byte) error
+}
+
+func (p *leafNodeProcessor) OnEmpty(n emptyNode, k, v []byte) error {
+	return nil
+}
+
+func (p *leafNodeProcessor) OnLeaf(n leafNode, k, v []byte) error {
+	return p.f(n.Key, n.Value)
+}
+
+func (p *leafNodeProcessor) OnInterior(n interiorNode, k, v []byte) error {
+	return nil
+}
@@ -71,6 +71,12 @@ func (t *StagingTrie) Get(k []byte) ([]byte, error) {
 	return t.source.Get(k)
 }
 
+// GetMetadata gets the value of the key in the metadata namespace of the
+// source trie. The metadata is not staged.
+func (t *StagingTrie) GetMetadata(key []byte) []byte {
+	return t.source.GetMetadata(key)
+}
+
 // Set sets a key/value pair, it will overwrite if necessary.
 func (t *StagingTrie) Set(k, v []byte) error {
 	t.Lock()
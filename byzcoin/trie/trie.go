@@ -132,6 +132,11 @@ func newRootNode(b Bucket, nonce []byte) error {
 	return nil
 }
 
+// GetNonce returns the nonce of the trie.
+func (t *Trie) GetNonce() []byte {
+	return clone(t.nonce)
+}
+
 // GetRoot returns the root of the trie.
 func (t *Trie) GetRoot() []byte {
 	var root []byte
@@ -560,6 +565,19 @@ func (t *Trie) del(depth int, nodeKey []byte, bits []bool, key []byte, b Bucket)
 	return nil, errors.New("invalid node type")
 }
 
+// ForEach calls f for every key/value pair stored in the trie. The pairs are
+// visited in the order of the bits of the hash of their keys. If f returns
+// an error, the iteration stops and the error is returned.
+func (t *Trie) ForEach(f func(k, v []byte) error) error {
+	return t.db.View(func(b Bucket) error {
+		rootKey := t.getRoot(b)
+		if rootKey == nil {
+			return errors.New("no root key")
+		}
+		return t.dfs(&leafNodeProcessor{f}, rootKey, b)
+	})
+}
+
 // IsValid checks whether the trie is valid.
 func (t *Trie) IsValid() error {
 	p := countNodeProcessor{}
@@ -288,6 +288,45 @@ func testSetDeleteSet(t *testing.T, db DB) {
 	require.NoError(t, testTrie.Set([]byte{0xdf}, []byte{0xdf}))
 }
 
+func TestForEach(t *testing.T) {
+	testMemAndDisk(t, testForEach)
+}
+
+func testForEach(t *testing.T, db DB) {
+	testTrie, err := NewTrie(db, genNonce())
+	require.NoError(t, err)
+
+	// An empty trie has no leaves.
+	require.NoError(t, testTrie.ForEach(func(k, v []byte) error {
+		return errors.New("should not have leaves")
+	}))
+
+	pairs := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		k := []byte{byte(i), 1}
+		pairs[string(k)] = []byte{byte(i), 2}
+		require.NoError(t, testTrie.Set(k, pairs[string(k)]))
+	}
+	require.NoError(t, testTrie.Delete([]byte{5, 1}))
+	delete(pairs, string([]byte{5, 1}))
+
+	found := make(map[string][]byte)
+	require.NoError(t, testTrie.ForEach(func(k, v []byte) error {
+		found[string(k)] = v
+		return nil
+	}))
+	require.Equal(t, pairs, found)
+
+	// Errors stop the iteration.
+	var count int
+	err = testTrie.ForEach(func(k, v []byte) error {
+		count++
+		return errors.New("stop")
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, count)
+}
+
 func TestIsValid(t *testing.T) {
 	mem := NewMemDB()
 	defer mem.Close()
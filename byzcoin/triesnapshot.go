@@ -0,0 +1,78 @@
+package byzcoin
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dedis/cothority/skipchain"
+)
+
+// maxTrieSnapshots is the number of rebuilt state tries kept in memory by
+// GetProofAt.
+const maxTrieSnapshots = 8
+
+// trieSnapshots keeps the last state tries rebuilt for GetProofAt, so that
+// proofs for the same block don't need to rebuild the trie again. The tries
+// of past blocks never change, so they don't need to be invalidated. Only
+// one trie is rebuilt at a time, which bounds the memory and the work a
+// burst of requests for old blocks can cause.
+type trieSnapshots struct {
+	sync.Mutex
+	tries map[string]*stateTrie
+	// order holds the keys of tries, from the oldest to the newest one.
+	order []string
+	// rebuildLock is held while a trie is rebuilt.
+	rebuildLock sync.Mutex
+}
+
+func newTrieSnapshots() trieSnapshots {
+	return trieSnapshots{
+		tries: make(map[string]*stateTrie),
+	}
+}
+
+func snapshotKey(scid skipchain.SkipBlockID, index int) string {
+	return fmt.Sprintf("%x:%d", scid, index)
+}
+
+func (ts *trieSnapshots) get(scid skipchain.SkipBlockID, index int) *stateTrie {
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.tries[snapshotKey(scid, index)]
+}
+
+func (ts *trieSnapshots) add(scid skipchain.SkipBlockID, index int, st *stateTrie) {
+	ts.Lock()
+	defer ts.Unlock()
+	key := snapshotKey(scid, index)
+	if _, ok := ts.tries[key]; ok {
+		return
+	}
+	if len(ts.order) >= maxTrieSnapshots {
+		delete(ts.tries, ts.order[0])
+		ts.order = ts.order[1:]
+	}
+	ts.tries[key] = st
+	ts.order = append(ts.order, key)
+}
+
+// getOrBuild returns the trie of the block with the given index, calling
+// build if it is not stored yet.
+func (ts *trieSnapshots) getOrBuild(scid skipchain.SkipBlockID, index int,
+	build func() (*stateTrie, error)) (*stateTrie, error) {
+	if st := ts.get(scid, index); st != nil {
+		return st, nil
+	}
+	ts.rebuildLock.Lock()
+	defer ts.rebuildLock.Unlock()
+	// Another request might have rebuilt it while we were waiting.
+	if st := ts.get(scid, index); st != nil {
+		return st, nil
+	}
+	st, err := build()
+	if err != nil {
+		return nil, err
+	}
+	ts.add(scid, index, st)
+	return st, nil
+}
@@ -0,0 +1,42 @@
+package byzcoin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrieSnapshots(t *testing.T) {
+	ts := newTrieSnapshots()
+	scid := skipchain.SkipBlockID{1, 2, 3}
+
+	builds := 0
+	build := func() (*stateTrie, error) {
+		builds++
+		return &stateTrie{}, nil
+	}
+	st, err := ts.getOrBuild(scid, 0, build)
+	require.Nil(t, err)
+	st2, err := ts.getOrBuild(scid, 0, build)
+	require.Nil(t, err)
+	require.True(t, st == st2)
+	require.Equal(t, 1, builds)
+
+	// Errors are not stored.
+	_, err = ts.getOrBuild(scid, 1, func() (*stateTrie, error) {
+		return nil, errors.New("failed")
+	})
+	require.NotNil(t, err)
+	require.Nil(t, ts.get(scid, 1))
+
+	// The oldest trie is dropped once the cache is full.
+	for i := 1; i <= maxTrieSnapshots; i++ {
+		_, err = ts.getOrBuild(scid, i, build)
+		require.Nil(t, err)
+	}
+	require.Equal(t, maxTrieSnapshots, len(ts.tries))
+	require.Nil(t, ts.get(scid, 0))
+	require.NotNil(t, ts.get(scid, maxTrieSnapshots))
+}
@@ -0,0 +1,282 @@
+package byzcoin
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/onet/log"
+)
+
+// TxBuilder collects instructions and turns them into a signed
+// ClientTransaction. The counters of the signers are fetched from the
+// ledger the first time they are needed and then cached, so that a builder
+// can be used for more than one transaction:
+//
+//	ctx, _, err := NewTxBuilder(cl).
+//	    Spawn(darcID, "value", args).
+//	    Invoke(valueID, "update", args).
+//	    SignAndSubmit(signer, 10)
+//
+// If an instruction needs to be signed by other signers than the one given
+// to Sign or SignAndSubmit, they can be passed to Spawn, Invoke or Delete.
+// The counters of every signer are incremented once per instruction it
+// signs, in the order of the instructions.
+type TxBuilder struct {
+	client   *Client
+	counters map[string]uint64
+	instrs   Instructions
+	signers  [][]darc.Signer
+}
+
+// NewTxBuilder returns a TxBuilder that uses the given client to fetch the
+// counters and to submit the transactions.
+func NewTxBuilder(c *Client) *TxBuilder {
+	return &TxBuilder{
+		client:   c,
+		counters: make(map[string]uint64),
+	}
+}
+
+// Spawn adds a spawn instruction for the given contract. The instance
+// pointed to by id must hold the darc allowing the spawn.
+func (b *TxBuilder) Spawn(id InstanceID, contractID string, args Arguments,
+	signers ...darc.Signer) *TxBuilder {
+	return b.add(Instruction{
+		InstanceID: id,
+		Spawn:      &Spawn{ContractID: contractID, Args: args},
+	}, signers)
+}
+
+// Invoke adds an invoke instruction with the given command.
+func (b *TxBuilder) Invoke(id InstanceID, command string, args Arguments,
+	signers ...darc.Signer) *TxBuilder {
+	return b.add(Instruction{
+		InstanceID: id,
+		Invoke:     &Invoke{Command: command, Args: args},
+	}, signers)
+}
+
+// Delete adds a delete instruction.
+func (b *TxBuilder) Delete(id InstanceID, signers ...darc.Signer) *TxBuilder {
+	return b.add(Instruction{
+		InstanceID: id,
+		Delete:     &Delete{},
+	}, signers)
+}
+
+func (b *TxBuilder) add(instr Instruction, signers []darc.Signer) *TxBuilder {
+	b.instrs = append(b.instrs, instr)
+	b.signers = append(b.signers, signers)
+	return b
+}
+
+// Sign sets the signer counters of all instructions, computes the hash of
+// the instructions and signs every instruction. Instructions that have been
+// added without signers are signed by the given signer, which can be left
+// empty if all instructions have their own signers. The instructions are
+// removed from the builder, even if an error is returned. The counters are
+// kept, and only incremented if the transaction has been signed.
+func (b *TxBuilder) Sign(signer darc.Signer) (*ClientTransaction, error) {
+	defer b.reset()
+	signers := make([][]darc.Signer, len(b.signers))
+	for i, s := range b.signers {
+		if len(s) == 0 {
+			if signer == (darc.Signer{}) {
+				return nil, errors.New("no signer for instruction")
+			}
+			s = []darc.Signer{signer}
+		}
+		signers[i] = s
+	}
+	ctx, counters, err := b.prepare(identityStrings(signers))
+	if err != nil {
+		return nil, err
+	}
+	for i := range ctx.Instructions {
+		err := ctx.Instructions[i].SignWith(ctx.InstructionsHash, signers[i]...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.setCounters(counters)
+	return ctx, nil
+}
+
+// Prepare is like Sign, but doesn't sign the instructions, so that the
+// transaction can be signed on another machine with
+// ClientTransaction.SignWith. Instructions that have been added without
+// signers are prepared for the identity id, the other signers only need
+// their identity. The signers must be given to SignWith in the same order.
+// If another transaction of the same signers is sent before the prepared
+// one, the prepared transaction is refused and CounterConflict returns the
+// conflict: the transaction must then be prepared and signed again.
+func (b *TxBuilder) Prepare(id darc.Identity) (*ClientTransaction, error) {
+	defer b.reset()
+	ids := make([][]string, len(b.signers))
+	for i, s := range b.signers {
+		if len(s) == 0 {
+			if id == (darc.Identity{}) {
+				return nil, errors.New("no identity for instruction")
+			}
+			ids[i] = []string{id.String()}
+			continue
+		}
+		for _, signer := range s {
+			ids[i] = append(ids[i], signer.Identity().String())
+		}
+	}
+	ctx, counters, err := b.prepare(ids)
+	if err != nil {
+		return nil, err
+	}
+	b.setCounters(counters)
+	return ctx, nil
+}
+
+// identityStrings returns the identities of the signers.
+func identityStrings(signers [][]darc.Signer) [][]string {
+	ids := make([][]string, len(signers))
+	for i, ss := range signers {
+		for _, s := range ss {
+			ids[i] = append(ids[i], s.Identity().String())
+		}
+	}
+	return ids
+}
+
+// prepare sets the counters of the signers given by their identities ids,
+// for every instruction, and computes the hash of the instructions. It
+// returns the new counters of the signers, which are only stored by the
+// caller once the transaction is ready.
+func (b *TxBuilder) prepare(ids [][]string) (*ClientTransaction, map[string]uint64, error) {
+	if len(b.instrs) == 0 {
+		return nil, nil, errors.New("no instructions to sign")
+	}
+	if err := b.fetchCounters(ids); err != nil {
+		return nil, nil, err
+	}
+
+	ctx := &ClientTransaction{Instructions: append(Instructions{}, b.instrs...)}
+	counters := make(map[string]uint64)
+	for i := range ctx.Instructions {
+		ctx.Instructions[i].SignerCounter = make([]uint64, len(ids[i]))
+		for j, id := range ids[i] {
+			if _, ok := counters[id]; !ok {
+				counters[id] = b.counters[id]
+			}
+			counters[id]++
+			ctx.Instructions[i].SignerCounter[j] = counters[id]
+		}
+	}
+	ctx.InstructionsHash = ctx.Instructions.Hash()
+	return ctx, counters, nil
+}
+
+// setCounters stores the counters of a transaction that is ready.
+func (b *TxBuilder) setCounters(counters map[string]uint64) {
+	for id, c := range counters {
+		b.counters[id] = c
+	}
+}
+
+// reset removes the instructions from the builder.
+func (b *TxBuilder) reset() {
+	b.instrs = nil
+	b.signers = nil
+}
+
+// counterRetries is the number of times SignAndSubmit signs a transaction
+// again if it has been refused because of the counters.
+const counterRetries = 3
+
+// CounterConflictError is returned by SignAndSubmit if the transaction is
+// still refused because of the counter of a signer after it has been signed
+// again with the counters of the ledger. This happens if the same signer is
+// used by more than one client at the same time.
+type CounterConflictError struct {
+	Identity string
+	// Used is the counter of the refused transaction.
+	Used uint64
+	// Expected is the counter expected by the ledger.
+	Expected uint64
+}
+
+func (e *CounterConflictError) Error() string {
+	return fmt.Sprintf("counter conflict for %s: used %d, but the ledger expects %d - "+
+		"prepare and sign the transaction again", e.Identity, e.Used, e.Expected)
+}
+
+// CounterConflict returns the conflict if err is the refusal of a
+// transaction because of a counter, or nil otherwise.
+func CounterConflict(err error) *CounterConflictError {
+	rejected, ok := err.(*TxRejectedError)
+	if !ok || rejected.Counter == nil {
+		return nil
+	}
+	c := rejected.Counter
+	return &CounterConflictError{c.Identity, c.Counter, c.Expected}
+}
+
+// SignAndSubmit signs the instructions like Sign and sends the transaction
+// to the ledger, waiting for up to wait blocks for it to be included. If the
+// transaction cannot be sent, the cached counters are dropped and fetched
+// again the next time. If wait is not 0 and the transaction is refused
+// because another client used the same signer, the instructions are signed
+// again with the counters of the ledger and sent, up to counterRetries
+// times, before a *CounterConflictError is returned.
+func (b *TxBuilder) SignAndSubmit(signer darc.Signer, wait int) (*ClientTransaction, *AddTxResponse, error) {
+	instrs, signers := b.instrs, b.signers
+	for i := 0; ; i++ {
+		ctx, err := b.Sign(signer)
+		if err != nil {
+			return nil, nil, err
+		}
+		reply, err := b.client.AddTransactionAndWait(*ctx, wait)
+		if err == nil {
+			return ctx, reply, nil
+		}
+		b.counters = make(map[string]uint64)
+		conflict := CounterConflict(err)
+		if conflict == nil {
+			return nil, nil, err
+		}
+		if i == counterRetries {
+			return nil, nil, conflict
+		}
+		log.Lvlf2("signing the transaction again: %v", conflict)
+		b.instrs, b.signers = instrs, signers
+	}
+}
+
+// fetchCounters gets the counters of all signers that are not yet cached.
+func (b *TxBuilder) fetchCounters(signers [][]string) error {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, ss := range signers {
+		for _, id := range ss {
+			if _, ok := b.counters[id]; ok || seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if b.client == nil {
+		return errors.New("no client to fetch the counters")
+	}
+	reply, err := b.client.GetSignerCounters(ids...)
+	if err != nil {
+		return err
+	}
+	if len(reply.Counters) != len(ids) {
+		return errors.New("got a wrong number of counters")
+	}
+	for i, id := range ids {
+		b.counters[id] = reply.Counters[i]
+	}
+	return nil
+}
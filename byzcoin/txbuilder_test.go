@@ -0,0 +1,199 @@
+package byzcoin
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxBuilder_Counters(t *testing.T) {
+	s1 := darc.NewSignerEd25519(nil, nil)
+	s2 := darc.NewSignerEd25519(nil, nil)
+	id1 := s1.Identity().String()
+	id2 := s2.Identity().String()
+
+	// Without a client, all counters must be known in advance.
+	b := NewTxBuilder(nil)
+	b.counters[id1] = 10
+	b.counters[id2] = 20
+
+	args := Arguments{{Name: "data", Value: []byte("value")}}
+	ctx, err := b.Spawn(genID(), dummyContract, args).
+		Invoke(genID(), "update", args, s2).
+		Spawn(genID(), dummyContract, args, s1, s2).
+		Delete(genID()).
+		Sign(s1)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(ctx.Instructions))
+	require.Equal(t, []uint64{11}, ctx.Instructions[0].SignerCounter)
+	require.Equal(t, []uint64{21}, ctx.Instructions[1].SignerCounter)
+	require.Equal(t, []uint64{12, 22}, ctx.Instructions[2].SignerCounter)
+	require.Equal(t, []uint64{13}, ctx.Instructions[3].SignerCounter)
+
+	// The hash and the signatures must be consistent.
+	require.Equal(t, ctx.Instructions.Hash(), ctx.InstructionsHash)
+	require.Equal(t, []string{id1}, ctx.Instructions[0].GetIdentityStrings())
+	require.Equal(t, []string{id2}, ctx.Instructions[1].GetIdentityStrings())
+	require.Equal(t, []string{id1, id2}, ctx.Instructions[2].GetIdentityStrings())
+	for _, instr := range ctx.Instructions {
+		for _, sig := range instr.Signatures {
+			require.Nil(t, sig.Signer.Verify(ctx.InstructionsHash, sig.Signature))
+		}
+	}
+
+	// The counters are kept for the next transaction.
+	ctx, err = b.Invoke(genID(), "update", args).Sign(s2)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{23}, ctx.Instructions[0].SignerCounter)
+
+	// A transaction that cannot be signed doesn't use the counters.
+	failing := darc.NewSignerProxy("data", s1.Ed25519.Point, func([]byte) ([]byte, error) {
+		return nil, errors.New("refused")
+	})
+	b.counters[failing.Identity().String()] = 30
+	_, err = b.Invoke(genID(), "update", args).
+		Invoke(genID(), "update", args, failing).
+		Sign(s2)
+	require.NotNil(t, err)
+	require.Equal(t, uint64(23), b.counters[id2])
+	require.Equal(t, uint64(30), b.counters[failing.Identity().String()])
+
+	// Errors, which remove the instructions.
+	_, err = b.Sign(s1)
+	require.NotNil(t, err)
+	_, err = b.Delete(genID()).Sign(darc.Signer{})
+	require.NotNil(t, err)
+	require.Equal(t, 0, len(b.instrs))
+	_, err = b.Delete(genID()).Sign(darc.NewSignerEd25519(nil, nil))
+	require.NotNil(t, err)
+	require.Equal(t, 0, len(b.instrs))
+	require.Equal(t, 0, len(b.signers))
+	ctx, err = b.Invoke(genID(), "update", args).Sign(s2)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ctx.Instructions))
+	require.Equal(t, []uint64{24}, ctx.Instructions[0].SignerCounter)
+}
+
+func TestTxBuilder_SignAndSubmit(t *testing.T) {
+	s := newSerN(t, 1, 100*time.Millisecond, 3, false)
+	defer s.local.CloseAll()
+	c := s.client()
+	dID := NewInstanceID(s.darc.GetBaseID())
+
+	b := NewTxBuilder(c)
+	for i := 0; i < 2; i++ {
+		ctx, _, err := b.Spawn(dID, dummyContract,
+			Arguments{{Name: "data", Value: []byte{byte(i)}}}).
+			Spawn(dID, dummyContract,
+				Arguments{{Name: "data", Value: []byte{byte(i), 1}}}).
+			SignAndSubmit(s.signer, 10)
+		require.Nil(t, err)
+		for _, instr := range ctx.Instructions {
+			pr, err := c.GetProof(instr.Hash())
+			require.Nil(t, err)
+			require.True(t, pr.Proof.InclusionProof.Match(instr.Hash()))
+		}
+	}
+	ctrs, err := c.GetSignerCounters(s.signer.Identity().String())
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), ctrs.Counters[0])
+}
+
+func TestTxBuilder_CounterConflict(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := NewGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"},
+		signer.Identity(), WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	c, _, err := NewLedger(msg, false)
+	require.Nil(t, err)
+	dID := NewInstanceID(msg.GenesisDarc.GetBaseID())
+	args := Arguments{{Name: "data", Value: []byte("data")}}
+
+	b := NewTxBuilder(c)
+	_, _, err = b.Spawn(dID, dummyContract, args).SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+
+	// Another client bumps the counter behind the back of b.
+	_, _, err = NewTxBuilder(c).Spawn(dID, dummyContract, args).SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+
+	// b signs with a stale counter, gets refused and signs again.
+	ctx, _, err := b.Spawn(dID, dummyContract, args).SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	require.Equal(t, []uint64{3}, ctx.Instructions[0].SignerCounter)
+	ctrs, err := c.GetSignerCounters(signer.Identity().String())
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), ctrs.Counters[0])
+
+	// Only the refusals because of a counter are conflicts.
+	counter := &CounterError{signer.Identity().String(), 3, 5}
+	conflict := CounterConflict(&TxRejectedError{InstructionIndex: 0,
+		Reason: counter.Error(), Counter: counter})
+	require.NotNil(t, conflict)
+	require.Equal(t, CounterConflictError{signer.Identity().String(), 3, 5}, *conflict)
+	require.Nil(t, CounterConflict(&TxRejectedError{InstructionIndex: 0, Reason: counter.Error()}))
+	require.Nil(t, CounterConflict(&TxRejectedError{InstructionIndex: 0, Reason: "no darc"}))
+	require.Nil(t, CounterConflict(counter))
+}
+
+func TestTxBuilder_Prepare(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	registerDummy(servers)
+	defer l.CloseAll()
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := NewGenesisMsg(CurrentVersion, roster, []string{"spawn:dummy"},
+		signer.Identity(), WithBlockInterval(100*time.Millisecond))
+	require.Nil(t, err)
+	c, _, err := NewLedger(msg, false)
+	require.Nil(t, err)
+	dID := NewInstanceID(msg.GenesisDarc.GetBaseID())
+	args := Arguments{{Name: "data", Value: []byte("data")}}
+
+	// Use the signer before, so that its counter is not the first one.
+	_, _, err = NewTxBuilder(c).Spawn(dID, dummyContract, args).
+		Spawn(dID, dummyContract, args).SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+
+	// The transaction is prepared with the identity only and signed from
+	// its encoding.
+	ctx, err := NewTxBuilder(c).Spawn(dID, dummyContract, args).Prepare(signer.Identity())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ctx.Instructions[0].Signatures))
+	require.Equal(t, []uint64{3}, ctx.Instructions[0].SignerCounter)
+	buf, err := protobuf.Encode(ctx)
+	require.Nil(t, err)
+	var offline ClientTransaction
+	require.Nil(t, protobuf.DecodeWithConstructors(buf, &offline,
+		network.DefaultConstructors(cothority.Suite)))
+	require.Nil(t, offline.SignWith(signer))
+	_, err = c.AddTransactionAndWait(offline, 10)
+	require.Nil(t, err)
+
+	// A prepared transaction is refused once its counter is used.
+	ctx, err = NewTxBuilder(c).Spawn(dID, dummyContract, args).Prepare(signer.Identity())
+	require.Nil(t, err)
+	_, _, err = NewTxBuilder(c).Spawn(dID, dummyContract, args).SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	require.Nil(t, ctx.SignWith(signer))
+	_, err = c.AddTransactionAndWait(*ctx, 10)
+	conflict := CounterConflict(err)
+	require.NotNil(t, conflict)
+	require.Contains(t, conflict.Error(), "prepare and sign the transaction again")
+
+	_, err = NewTxBuilder(c).Spawn(dID, dummyContract, args).Prepare(darc.Identity{})
+	require.NotNil(t, err)
+}
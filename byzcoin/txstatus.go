@@ -0,0 +1,127 @@
+package byzcoin
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dedis/cothority/skipchain"
+)
+
+// txStatusBlocks is the number of blocks during which the status of a
+// transaction is kept.
+const txStatusBlocks = 10
+
+// TxRejectedError is returned by Client.AddTransactionAndWait if the
+// transaction has been included in a block, but got refused.
+type TxRejectedError struct {
+	// InstructionIndex is the index of the refused instruction, or -1 if the
+	// transaction itself is invalid.
+	InstructionIndex int
+	// Reason is the error returned when executing the instruction.
+	Reason string
+	// Counter is set if the instruction has been refused because of the
+	// counter of one of its signers.
+	Counter *CounterError
+}
+
+func newTxRejectedError(status *GetTxStatusResponse) *TxRejectedError {
+	e := &TxRejectedError{
+		InstructionIndex: status.InstructionIndex,
+		Reason:           status.Error,
+	}
+	if status.CounterIdentity != "" {
+		e.Counter = &CounterError{
+			Identity: status.CounterIdentity,
+			Counter:  status.Counter,
+			Expected: status.ExpectedCounter,
+		}
+	}
+	return e
+}
+
+func (e *TxRejectedError) Error() string {
+	if e.InstructionIndex < 0 {
+		return "transaction refused: " + e.Reason
+	}
+	return fmt.Sprintf("transaction refused in instruction %d: %s",
+		e.InstructionIndex, e.Reason)
+}
+
+type txStatus struct {
+	scID       string
+	blockIndex int
+	included   bool
+	accepted   bool
+	instrIndex int
+	reason     string
+	counter    *CounterError
+}
+
+// txStatuses remembers why transactions have been refused, as well as the
+// outcome of the transactions of the latest blocks. Both are indexed by the
+// hash of the instructions of the transaction.
+type txStatuses struct {
+	sync.Mutex
+	statuses map[string]txStatus
+}
+
+func newTxStatuses() txStatuses {
+	return txStatuses{statuses: make(map[string]txStatus)}
+}
+
+// refused stores the error for which a transaction has been refused. index
+// is the index of the latest block of the state the transaction has been
+// executed on.
+func (ts *txStatuses) refused(scID skipchain.SkipBlockID, index int, txHash []byte, instrIndex int, err error) {
+	ts.Lock()
+	defer ts.Unlock()
+	counter, _ := err.(*CounterError)
+	ts.statuses[string(txHash)] = txStatus{
+		scID:       string(scID),
+		blockIndex: index,
+		instrIndex: instrIndex,
+		reason:     err.Error(),
+		counter:    counter,
+	}
+}
+
+// included marks the transactions of a new block and removes all the
+// statuses that are older than txStatusBlocks.
+func (ts *txStatuses) included(scID skipchain.SkipBlockID, index int, txs TxResults) {
+	ts.Lock()
+	defer ts.Unlock()
+	for _, tx := range txs {
+		h := string(tx.ClientTransaction.Instructions.Hash())
+		st := ts.statuses[h]
+		if st.included && st.accepted && !tx.Accepted {
+			// A copy of the transaction has already been accepted,
+			// the other copies are refused because of their counters.
+			continue
+		}
+		st.scID = string(scID)
+		st.blockIndex = index
+		st.included = true
+		st.accepted = tx.Accepted
+		if tx.Accepted {
+			st.instrIndex = 0
+			st.reason = ""
+			st.counter = nil
+		}
+		ts.statuses[h] = st
+	}
+	for h, st := range ts.statuses {
+		if st.scID == string(scID) && index-st.blockIndex > txStatusBlocks {
+			delete(ts.statuses, h)
+		}
+	}
+}
+
+func (ts *txStatuses) get(scID skipchain.SkipBlockID, txHash []byte) (txStatus, bool) {
+	ts.Lock()
+	defer ts.Unlock()
+	st, ok := ts.statuses[string(txHash)]
+	if !ok || st.scID != string(scID) || !st.included {
+		return txStatus{}, false
+	}
+	return st, true
+}
@@ -32,8 +32,8 @@ type ReadReply struct {
 // NewClient instantiates a new Client.
 // It takes as input an "initialized" byzcoin client
 // with an already created ledger
-func NewClient(byzcoin *byzcoin.Client) *Client {
-	return &Client{bcClient: byzcoin, c: onet.NewClient(
+func NewClient(bcClient *byzcoin.Client) *Client {
+	return &Client{bcClient: bcClient, c: onet.NewClient(
 		cothority.Suite, ServiceName)}
 }
 
@@ -41,8 +41,8 @@ func NewClient(byzcoin *byzcoin.Client) *Client {
 // the LTS group created.
 func (c *Client) CreateLTS() (reply *CreateLTSReply, err error) {
 	reply = &CreateLTSReply{}
-	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], &CreateLTS{
-		Roster: c.bcClient.Roster,
+	err = c.c.SendProtobuf(c.bcClient.Roster().List[0], &CreateLTS{
+		Roster: c.bcClient.Roster(),
 		BCID:   c.bcClient.ID,
 	}, reply)
 	if err != nil {
@@ -56,7 +56,20 @@ func (c *Client) CreateLTS() (reply *CreateLTSReply, err error) {
 // given the public key information of the reader.
 func (c *Client) DecryptKey(dkr *DecryptKey) (reply *DecryptKeyReply, err error) {
 	reply = &DecryptKeyReply{}
-	err = c.c.SendProtobuf(c.bcClient.Roster.List[0], dkr, reply)
+	err = c.c.SendProtobuf(c.bcClient.Roster().List[0], dkr, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetReencryptionEvidence returns the signed shares of the last
+// re-encryption of the given read instance, so that a node sending a wrong
+// share can be identified.
+func (c *Client) GetReencryptionEvidence(read byzcoin.InstanceID) (reply *GetReencryptionEvidenceReply, err error) {
+	reply = &GetReencryptionEvidenceReply{}
+	err = c.c.SendProtobuf(c.bcClient.Roster().List[0],
+		&GetReencryptionEvidence{RequestID: read.Slice()}, reply)
 	if err != nil {
 		return nil, err
 	}
@@ -73,103 +86,65 @@ func (c *Client) WaitProof(id byzcoin.InstanceID, interval time.Duration,
 // Input:
 //   - write - A Write structure
 //   - signer - The data owner who will sign the transaction
-//   - signerCtr - A monotonically increaing counter for every signer
 //   - darc - The darc governing this instance
 //   - wait - The number of blocks to wait -- 0 means no wait
 //
 // Output:
 //   - reply - WriteReply containing the transaction response and instance id
 //	 - err - Error if any, nil otherwise.
-func (c *Client) AddWrite(write *Write, signer darc.Signer, signerCtr uint64,
-	darc darc.Darc, wait int) (
-	reply *WriteReply, err error) {
-	reply = &WriteReply{}
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) AddWrite(write *Write, signer darc.Signer, darc darc.Darc,
+	wait int) (reply *WriteReply, err error) {
 	writeBuf, err := protobuf.Encode(write)
 	if err != nil {
 		return nil, err
 	}
-	ctx := byzcoin.ClientTransaction{
-		Instructions: byzcoin.Instructions{{
-			InstanceID: byzcoin.NewInstanceID(darc.GetBaseID()),
-			Spawn: &byzcoin.Spawn{
-				ContractID: ContractWriteID,
-				Args: byzcoin.Arguments{{
-					Name: "write", Value: writeBuf}},
-			},
-			SignerCounter: []uint64{signerCtr},
-		}},
-	}
-	//Sign the transaction
-	err = ctx.SignWith(signer)
+	reply = &WriteReply{}
+	var ctx *byzcoin.ClientTransaction
+	ctx, reply.AddTxResponse, err = byzcoin.NewTxBuilder(c.bcClient).Spawn(byzcoin.NewInstanceID(darc.GetBaseID()),
+		ContractWriteID, byzcoin.Arguments{{Name: "write", Value: writeBuf}}).
+		SignAndSubmit(signer, wait)
 	if err != nil {
 		return nil, err
 	}
 	reply.InstanceID = ctx.Instructions[0].DeriveID("")
-	//Delegate the work to the byzcoin client
-	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
-	if err != nil {
-		return nil, err
-	}
-	return reply, err
+	return reply, nil
 }
 
 // AddRead creates a Read Instance by adding a transaction on the byzcoin client.
 // Input:
 //   - proof - A ByzCoin proof of the Write Operation.
 //   - signer - The data owner who will sign the transaction
-//   - signerCtr - A monotonically increaing counter for every signer
 //   - darc - The darc governing this instance
 //   - wait - The number of blocks to wait -- 0 means no wait
 //
 // Output:
 //   - reply - ReadReply containing the transaction response and instance id
 //	 - err - Error if any, nil otherwise.
-func (c *Client) AddRead(proof *byzcoin.Proof, signer darc.Signer, signerCtr uint64,
-	darc darc.Darc, wait int) (
-	reply *ReadReply, err error) {
-	var readBuf []byte
+func (c *Client) AddRead(proof *byzcoin.Proof, signer darc.Signer, darc darc.Darc,
+	wait int) (reply *ReadReply, err error) {
 	read := &Read{
 		Write: byzcoin.NewInstanceID(proof.InclusionProof.Key()),
 		Xc:    signer.Ed25519.Point,
 	}
-	reply = &ReadReply{}
-	readBuf, err = protobuf.Encode(read)
+	readBuf, err := protobuf.Encode(read)
 	if err != nil {
 		return nil, err
 	}
-
+	reply = &ReadReply{}
+	var ctx *byzcoin.ClientTransaction
+	ctx, reply.AddTxResponse, err = byzcoin.NewTxBuilder(c.bcClient).Spawn(byzcoin.NewInstanceID(proof.InclusionProof.Key()),
+		ContractReadID, byzcoin.Arguments{{Name: "read", Value: readBuf}}).
+		SignAndSubmit(signer, wait)
 	if err != nil {
 		return nil, err
 	}
-	ctx := byzcoin.ClientTransaction{
-		Instructions: byzcoin.Instructions{{
-			InstanceID: byzcoin.NewInstanceID(proof.InclusionProof.Key()),
-			Spawn: &byzcoin.Spawn{
-				ContractID: ContractReadID,
-				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
-			},
-			SignerCounter: []uint64{signerCtr},
-		}},
-	}
-	err = ctx.SignWith(signer)
 	reply.InstanceID = ctx.Instructions[0].DeriveID("")
-	if err != nil {
-		return nil, err
-	}
-	reply.AddTxResponse, err = c.bcClient.AddTransactionAndWait(ctx, wait)
-	if err != nil {
-		return nil, err
-	}
 	return reply, nil
 }
 
 // SpawnDarc spawns a Darc Instance by adding a transaction on the byzcoin client.
 // Input:
 //   - signer - The signer authorizing the spawn of this darc (calypso "admin")
-//   - signerCtr - A monotonically increaing counter for every signer
 //   - controlDarc - The darc governing this spawning
 //	 - spawnDarc - The darc to be spawned
 //   - wait - The number of blocks to wait -- 0 means no wait
@@ -177,34 +152,14 @@ func (c *Client) AddRead(proof *byzcoin.Proof, signer darc.Signer, signerCtr uin
 // Output:
 //   - reply - AddTxResponse containing the transaction response
 //	 - err - Error if any, nil otherwise.
-func (c *Client) SpawnDarc(signer darc.Signer, signerCtr uint64,
-	controlDarc darc.Darc, spawnDarc darc.Darc, wait int) (
-	reply *byzcoin.AddTxResponse, err error) {
-	reply = &byzcoin.AddTxResponse{}
-	if err != nil {
-		return nil, err
-	}
+func (c *Client) SpawnDarc(signer darc.Signer, controlDarc darc.Darc,
+	spawnDarc darc.Darc, wait int) (reply *byzcoin.AddTxResponse, err error) {
 	darcBuf, err := spawnDarc.ToProto()
 	if err != nil {
 		return nil, err
 	}
-
-	ctx := byzcoin.ClientTransaction{
-		Instructions: []byzcoin.Instruction{{
-			InstanceID: byzcoin.NewInstanceID(controlDarc.GetBaseID()),
-			Spawn: &byzcoin.Spawn{
-				ContractID: byzcoin.ContractDarcID,
-				Args: []byzcoin.Argument{{
-					Name:  "darc",
-					Value: darcBuf,
-				}},
-			},
-			SignerCounter: []uint64{signerCtr},
-		}},
-	}
-	err = ctx.SignWith(signer)
-	if err != nil {
-		return nil, err
-	}
-	return c.bcClient.AddTransactionAndWait(ctx, wait)
+	_, reply, err = byzcoin.NewTxBuilder(c.bcClient).Spawn(byzcoin.NewInstanceID(controlDarc.GetBaseID()),
+		byzcoin.ContractDarcID, byzcoin.Arguments{{Name: "darc", Value: darcBuf}}).
+		SignAndSubmit(signer, wait)
+	return
 }
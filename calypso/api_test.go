@@ -21,8 +21,8 @@ func TestClient_CreateLTS(t *testing.T) {
 
 	// Initialise the genesis message and send it to the service.
 	signer := darc.NewSignerEd25519(nil, nil)
-	msg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, roster, []string{"spawn:dummy"}, signer.Identity())
-	msg.BlockInterval = 100 * time.Millisecond
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster, []string{"spawn:dummy"}, signer.Identity(),
+		byzcoin.WithBlockInterval(100*time.Millisecond))
 	require.Nil(t, err)
 
 	// The darc inside it should be valid.
@@ -54,11 +54,9 @@ func TestClient_Calypso(t *testing.T) {
 	reader2 := darc.NewSignerEd25519(nil, nil)
 	// Initialise the genesis message and send it to the service.
 	// The admin has the privilege to spawn darcs
-	msg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, roster,
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
 		[]string{"spawn:" + byzcoin.ContractDarcID},
-		admin.Identity())
-
-	msg.BlockInterval = 100 * time.Millisecond
+		admin.Identity(), byzcoin.WithBlockInterval(100*time.Millisecond))
 	require.Nil(t, err)
 	// The darc inside it should be valid.
 	gDarc := msg.GenesisDarc
@@ -85,7 +83,7 @@ func TestClient_Calypso(t *testing.T) {
 		expression.InitOrExpr(reader1.Identity().String()))
 	require.NotNil(t, darc1)
 	require.Nil(t, err)
-	_, err = calypsoClient.SpawnDarc(admin, 1, gDarc, *darc1, 10)
+	_, err = calypsoClient.SpawnDarc(admin, gDarc, *darc1, 10)
 	require.Nil(t, err)
 
 	//Create a similar darc for provider2, reader2
@@ -97,7 +95,7 @@ func TestClient_Calypso(t *testing.T) {
 	darc2.Rules.AddRule(darc.Action("spawn:"+ContractReadID),
 		expression.InitOrExpr(reader2.Identity().String()))
 	//Spawn it
-	_, err = calypsoClient.SpawnDarc(admin, 2, gDarc, *darc2, 10)
+	_, err = calypsoClient.SpawnDarc(admin, gDarc, *darc2, 10)
 	require.Nil(t, err)
 	//Create a secret key
 	key1 := []byte("secret key 1")
@@ -105,7 +103,7 @@ func TestClient_Calypso(t *testing.T) {
 	write1 := NewWrite(cothority.Suite, calypsoClient.ltsReply.LTSID,
 		darc1.GetBaseID(), calypsoClient.ltsReply.X, key1)
 	//Write it to calypso
-	wr1, err := calypsoClient.AddWrite(write1, provider1, 1, *darc1, 10)
+	wr1, err := calypsoClient.AddWrite(write1, provider1, *darc1, 10)
 	require.Nil(t, err)
 	require.NotNil(t, wr1.InstanceID)
 	//Get the write proof
@@ -113,7 +111,7 @@ func TestClient_Calypso(t *testing.T) {
 	require.Nil(t, err)
 	require.NotNil(t, prWr1)
 
-	re1, err := calypsoClient.AddRead(prWr1, reader1, 1, *darc1, 10)
+	re1, err := calypsoClient.AddRead(prWr1, reader1, *darc1, 10)
 	require.Nil(t, err)
 	prRe1, err := calypsoClient.WaitProof(re1.InstanceID, time.Second, nil)
 	require.Nil(t, err)
@@ -123,12 +121,12 @@ func TestClient_Calypso(t *testing.T) {
 	//Create a Write instance
 	write2 := NewWrite(cothority.Suite, calypsoClient.ltsReply.LTSID,
 		darc2.GetBaseID(), calypsoClient.ltsReply.X, key2)
-	wr2, err := calypsoClient.AddWrite(write2, provider2, 1, *darc2, 10)
+	wr2, err := calypsoClient.AddWrite(write2, provider2, *darc2, 10)
 	require.Nil(t, err)
 	prWr2, err := calypsoClient.WaitProof(wr2.InstanceID, time.Second, nil)
 	require.Nil(t, err)
 	require.True(t, prWr2.InclusionProof.Match(wr2.InstanceID.Slice()))
-	re2, err := calypsoClient.AddRead(prWr2, reader2, 1, *darc2, 10)
+	re2, err := calypsoClient.AddRead(prWr2, reader2, *darc2, 10)
 	require.Nil(t, err)
 	prRe2, err := calypsoClient.WaitProof(re2.InstanceID, time.Second, nil)
 	require.Nil(t, err)
@@ -5,6 +5,7 @@ import (
 	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
 )
 
 // PROTOSTART
@@ -12,6 +13,7 @@ import (
 // package calypso;
 // import "byzcoin.proto";
 // import "onet.proto";
+// import "network.proto";
 //
 // option java_package = "ch.epfl.dedis.lib.proto";
 // option java_outer_classname = "Calypso";
@@ -107,3 +109,39 @@ type SharedPublicReply struct {
 	// X is the distributed public key.
 	X kyber.Point
 }
+
+// GetReencryptionEvidence asks for the shares used in the last re-encryption
+// of a read request.
+type GetReencryptionEvidence struct {
+	// RequestID is the instance ID of the read request.
+	RequestID []byte
+}
+
+// GetReencryptionEvidenceReply holds the signed shares of the nodes.
+type GetReencryptionEvidenceReply struct {
+	// LTSID is the id of the LTS used for the re-encryption.
+	LTSID []byte
+	// WriteID is the instance ID of the write request.
+	WriteID []byte
+	// Partials are the shares received by the node running the
+	// re-encryption, including its own one.
+	Partials []ReencryptionPartial
+	// Xc is the public key of the reader the shares are re-encrypted for.
+	Xc kyber.Point
+}
+
+// ReencryptionPartial is the share of one node, signed by the node. The
+// signature is a Schnorr signature with the key of the node on the hash of
+// the LTSID, the WriteID, the key of the reader, the index and the share.
+type ReencryptionPartial struct {
+	// ServerIdentity is the node that sent the share.
+	ServerIdentity *network.ServerIdentity
+	// Index is the index of the share of the node.
+	Index int
+	// Ui is the re-encrypted share.
+	Ui kyber.Point
+	// Signature is the signature of the node on the share.
+	Signature []byte
+	// Valid is true if the proof of the share is correct.
+	Valid bool
+}
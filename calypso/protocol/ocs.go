@@ -7,6 +7,7 @@ paper-draft about onchain-secrets (called BlockMage).
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"sync"
 	"time"
@@ -15,6 +16,7 @@ import (
 	dkgprotocol "github.com/dedis/cothority/dkg/pedersen"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 )
@@ -35,7 +37,11 @@ type OCS struct {
 	// VerificationData is given to the VerifyRequest and has to hold everything
 	// needed to verify the request is valid.
 	VerificationData []byte
-	Failures         int // How many failures occured so far
+	// LTSID and WriteID identify the request, they are signed by every
+	// node together with its share.
+	LTSID    []byte
+	WriteID  []byte
+	Failures int // How many failures occured so far
 	// Can be set by the service to decide whether or not to
 	// do the reencryption
 	Verify VerifyRequest
@@ -43,10 +49,18 @@ type OCS struct {
 	// or 'false' if not enough shares have been collected.
 	Reencrypted chan bool
 	Uis         []*share.PubShare // re-encrypted shares
+	// Partials holds the signed shares received by the root, including the
+	// invalid ones. The first one is the share of the root.
+	Partials []*SignedPartial
 	// private fields
-	replies  []ReencryptReply
 	timeout  *time.Timer
+	valid    int
 	doneOnce sync.Once
+	// repliesLock protects the replies against the timeout, and finished
+	// makes sure that Partials and Uis don't change once Reencrypted has
+	// been sent.
+	repliesLock sync.Mutex
+	finished    bool
 }
 
 // NewOCS initialises the structure for use in one round
@@ -76,8 +90,10 @@ func (o *OCS) Start() error {
 		return errors.New("please initialize U first")
 	}
 	rc := &Reencrypt{
-		U:  o.U,
-		Xc: o.Xc,
+		U:       o.U,
+		Xc:      o.Xc,
+		LTSID:   o.LTSID,
+		WriteID: o.WriteID,
 	}
 	if len(o.VerificationData) > 0 {
 		rc.VerificationData = &o.VerificationData
@@ -88,9 +104,27 @@ func (o *OCS) Start() error {
 			return errors.New("refused to reencrypt")
 		}
 	}
+	ui, err := o.getUI(o.U, o.Xc)
+	if err != nil {
+		o.finish(false)
+		return err
+	}
+	sig, err := schnorr.Sign(cothority.Suite, o.Private(), PartialMessage(o.LTSID, o.WriteID, o.Xc, ui))
+	if err != nil {
+		o.finish(false)
+		return err
+	}
+	o.Partials = []*SignedPartial{{
+		ServerIdentity: o.ServerIdentity(),
+		Ui:             ui,
+		Signature:      sig,
+		Valid:          true,
+	}}
 	o.timeout = time.AfterFunc(1*time.Minute, func() {
 		log.Lvl1("OCS protocol timeout")
+		o.repliesLock.Lock()
 		o.finish(false)
+		o.repliesLock.Unlock()
 	})
 	errs := o.Broadcast(rc)
 	if len(errs) > (len(o.Roster().List)-1)/3 {
@@ -128,57 +162,74 @@ func (o *OCS) reencrypt(r structReencrypt) error {
 	hiHat.MarshalTo(hash)
 	ei := cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
 
+	sig, err := schnorr.Sign(cothority.Suite, o.Private(), PartialMessage(r.LTSID, r.WriteID, r.Xc, ui))
+	if err != nil {
+		return err
+	}
 	return o.SendToParent(&ReencryptReply{
-		Ui: ui,
-		Ei: ei,
-		Fi: cothority.Suite.Scalar().Add(si, cothority.Suite.Scalar().Mul(ei, o.Shared.V)),
+		Ui:        ui,
+		Ei:        ei,
+		Fi:        cothority.Suite.Scalar().Add(si, cothority.Suite.Scalar().Mul(ei, o.Shared.V)),
+		Signature: sig,
 	})
 }
 
+// PartialMessage returns the message a node signs for its share ui of the
+// request identified by ltsID and writeID, re-encrypted for the reader xc.
+func PartialMessage(ltsID, writeID []byte, xc kyber.Point, ui *share.PubShare) []byte {
+	hash := sha256.New()
+	hash.Write(ltsID)
+	hash.Write(writeID)
+	xc.MarshalTo(hash)
+	binary.Write(hash, binary.LittleEndian, int64(ui.I))
+	ui.V.MarshalTo(hash)
+	return hash.Sum(nil)
+}
+
 // reencryptReply is the root-node waiting for all replies and generating
-// the reencryption key.
+// the reencryption key. A reply without a valid signature or with a wrong
+// share counts as a missing reply.
 func (o *OCS) reencryptReply(rr structReencryptReply) error {
+	o.repliesLock.Lock()
+	defer o.repliesLock.Unlock()
+	if o.finished {
+		return nil
+	}
 	if rr.ReencryptReply.Ui == nil {
 		log.Lvl2("Node", rr.ServerIdentity, "refused to reply")
-		o.Failures++
-		if o.Failures > len(o.Roster().List)-o.Threshold {
-			log.Lvl2(rr.ServerIdentity, "couldn't get enough shares")
-			o.finish(false)
-		}
+		o.fail()
+		return nil
+	}
+	r := rr.ReencryptReply
+	err := schnorr.Verify(cothority.Suite, rr.ServerIdentity.Public,
+		PartialMessage(o.LTSID, o.WriteID, o.Xc, r.Ui), r.Signature)
+	if err != nil {
+		log.Lvl1("Received share with invalid signature from", rr.ServerIdentity)
+		o.fail()
+		return nil
+	}
+	partial := &SignedPartial{
+		ServerIdentity: rr.ServerIdentity,
+		Ui:             r.Ui,
+		Signature:      r.Signature,
+		Valid:          o.verifyProof(r),
+	}
+	o.Partials = append(o.Partials, partial)
+	if !partial.Valid {
+		log.Lvl1("Received invalid share from node", r.Ui.I)
+		o.fail()
 		return nil
 	}
-	o.replies = append(o.replies, rr.ReencryptReply)
 
-	// minus one to exclude the root
-	if len(o.replies) >= int(o.Threshold-1) {
+	if o.Uis == nil {
 		o.Uis = make([]*share.PubShare, len(o.List()))
-		var err error
-		o.Uis[0], err = o.getUI(o.U, o.Xc)
-		if err != nil {
-			return err
-		}
+		o.Uis[0] = o.Partials[0].Ui
+	}
+	o.Uis[r.Ui.I] = r.Ui
+	o.valid++
 
-		for _, r := range o.replies {
-			// Verify proofs
-			ufi := cothority.Suite.Point().Mul(r.Fi, cothority.Suite.Point().Add(o.U, o.Xc))
-			uiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), r.Ui.V)
-			uiHat := cothority.Suite.Point().Add(ufi, uiei)
-
-			gfi := cothority.Suite.Point().Mul(r.Fi, nil)
-			gxi := o.Poly.Eval(r.Ui.I).V
-			hiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), gxi)
-			hiHat := cothority.Suite.Point().Add(gfi, hiei)
-			hash := sha256.New()
-			r.Ui.V.MarshalTo(hash)
-			uiHat.MarshalTo(hash)
-			hiHat.MarshalTo(hash)
-			e := cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
-			if e.Equal(r.Ei) {
-				o.Uis[r.Ui.I] = r.Ui
-			} else {
-				log.Lvl1("Received invalid share from node", r.Ui.I)
-			}
-		}
+	// minus one to exclude the root
+	if o.valid >= o.Threshold-1 {
 		o.finish(true)
 	}
 
@@ -192,6 +243,37 @@ func (o *OCS) reencryptReply(rr structReencryptReply) error {
 	return nil
 }
 
+// fail counts a missing reply and finishes the protocol if there are not
+// enough replies left to reach the threshold.
+func (o *OCS) fail() {
+	o.Failures++
+	if o.Failures > len(o.Roster().List)-o.Threshold {
+		log.Lvl2("couldn't get enough shares")
+		o.finish(false)
+	}
+}
+
+// verifyProof returns true if the proof of the share in r is correct.
+func (o *OCS) verifyProof(r ReencryptReply) bool {
+	if r.Ei == nil || r.Fi == nil || r.Ui.I < 0 || r.Ui.I >= len(o.List()) {
+		return false
+	}
+	ufi := cothority.Suite.Point().Mul(r.Fi, cothority.Suite.Point().Add(o.U, o.Xc))
+	uiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), r.Ui.V)
+	uiHat := cothority.Suite.Point().Add(ufi, uiei)
+
+	gfi := cothority.Suite.Point().Mul(r.Fi, nil)
+	gxi := o.Poly.Eval(r.Ui.I).V
+	hiei := cothority.Suite.Point().Mul(cothority.Suite.Scalar().Neg(r.Ei), gxi)
+	hiHat := cothority.Suite.Point().Add(gfi, hiei)
+	hash := sha256.New()
+	r.Ui.V.MarshalTo(hash)
+	uiHat.MarshalTo(hash)
+	hiHat.MarshalTo(hash)
+	e := cothority.Suite.Scalar().SetBytes(hash.Sum(nil))
+	return e.Equal(r.Ei)
+}
+
 func (o *OCS) getUI(U, Xc kyber.Point) (*share.PubShare, error) {
 	v := cothority.Suite.Point().Mul(o.Shared.V, U)
 	v.Add(v, cothority.Suite.Point().Mul(o.Shared.V, Xc))
@@ -201,8 +283,13 @@ func (o *OCS) getUI(U, Xc kyber.Point) (*share.PubShare, error) {
 	}, nil
 }
 
+// finish sends the result of the protocol and stops accepting replies. Once
+// the replies are broadcast, it must be called with repliesLock held.
 func (o *OCS) finish(result bool) {
-	o.timeout.Stop()
+	o.finished = true
+	if o.timeout != nil {
+		o.timeout.Stop()
+	}
 	select {
 	case o.Reencrypted <- result:
 		// suceeded
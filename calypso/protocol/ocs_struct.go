@@ -33,6 +33,10 @@ type Reencrypt struct {
 	// VerificationData is optional and can be any slice of bytes, so that each
 	// node can verify if the reencryption request is valid or not.
 	VerificationData *[]byte
+	// LTSID and WriteID are signed by the nodes together with their share,
+	// see PartialMessage.
+	LTSID   []byte `protobuf:"opt"`
+	WriteID []byte `protobuf:"opt"`
 }
 
 type structReencrypt struct {
@@ -45,9 +49,21 @@ type ReencryptReply struct {
 	Ui *share.PubShare
 	Ei kyber.Scalar
 	Fi kyber.Scalar
+	// Signature is the Schnorr signature of the node on PartialMessage.
+	Signature []byte `protobuf:"opt"`
 }
 
 type structReencryptReply struct {
 	*onet.TreeNode
 	ReencryptReply
 }
+
+// SignedPartial is the share of one node together with its signature, so
+// that a wrong share can be attributed to the node that sent it.
+type SignedPartial struct {
+	ServerIdentity *network.ServerIdentity
+	Ui             *share.PubShare
+	Signature      []byte
+	// Valid is true if the proof of the share is correct.
+	Valid bool
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/share"
 	dkg "github.com/dedis/kyber/share/dkg/pedersen"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/suites"
 	"github.com/dedis/kyber/util/key"
 	"github.com/dedis/kyber/util/random"
@@ -139,6 +140,65 @@ func ocs(t *testing.T, nbrNodes, threshold, keylen, fail int, refuse bool) {
 	require.Equal(t, k, keyHat)
 }
 
+// Tests that the root keeps the signed shares, so that a node sending a
+// wrong share can be identified.
+func TestOCS_Evidence(t *testing.T) {
+	nbrNodes := 3
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes, true)
+
+	dkgs, err := CreateDKGs(tSuite.(dkg.Suite), nbrNodes, nbrNodes)
+	require.Nil(t, err)
+	services := local.GetServices(servers, testServiceID)
+	for i := range services {
+		services[i].(*testService).Shared, err = dkgprotocol.NewSharedSecret(dkgs[i])
+		require.Nil(t, err)
+	}
+	dks, err := dkgs[0].DistKeyShare()
+	require.Nil(t, err)
+
+	// The last node uses a wrong share.
+	bad := services[nbrNodes-1].(*testService)
+	wrong := *bad.Shared
+	wrong.V = tSuite.Scalar().Pick(tSuite.RandomStream())
+	bad.Shared = &wrong
+
+	U, _ := EncodeKey(tSuite, dks.Public(), []byte("secret"))
+	pi, err := services[0].(*testService).createOCS(tree, nbrNodes)
+	require.Nil(t, err)
+	protocol := pi.(*OCS)
+	protocol.U = U
+	protocol.Xc = key.NewKeyPair(cothority.Suite).Public
+	protocol.Poly = share.NewPubPoly(suite, suite.Point().Base(), dks.Commits)
+	protocol.VerificationData = []byte("correct block")
+	protocol.LTSID = []byte("lts")
+	protocol.WriteID = []byte("write")
+	require.Nil(t, protocol.Start())
+	select {
+	case ok := <-protocol.Reencrypted:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("Didn't finish in time")
+	}
+
+	var found bool
+	for _, p := range protocol.Partials {
+		msg := PartialMessage(protocol.LTSID, protocol.WriteID, protocol.Xc, p.Ui)
+		require.Nil(t, schnorr.Verify(tSuite, p.ServerIdentity.Public, msg, p.Signature))
+		// The share cannot be claimed for another reader.
+		msg = PartialMessage(protocol.LTSID, protocol.WriteID, tSuite.Point().Pick(tSuite.RandomStream()), p.Ui)
+		require.NotNil(t, schnorr.Verify(tSuite, p.ServerIdentity.Public, msg, p.Signature))
+		if p.ServerIdentity.Equal(servers[nbrNodes-1].ServerIdentity) {
+			require.False(t, p.Valid)
+			found = true
+		} else {
+			require.True(t, p.Valid)
+		}
+	}
+	require.True(t, found)
+}
+
 // testService allows setting the dkg-field of the protocol.
 type testService struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
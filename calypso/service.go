@@ -11,6 +11,7 @@ package calypso
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/dedis/cothority"
@@ -36,6 +37,10 @@ var ServiceName = "Calypso"
 // dkgTimeout is how long the system waits for the DKG to finish
 const propagationTimeout = 10 * time.Second
 
+// maxEvidence is the number of read requests whose evidence is kept, the
+// oldest ones are forgotten first.
+const maxEvidence = 1000
+
 func init() {
 	var err error
 	calypsoID, err = onet.RegisterNewService(ServiceName, newService)
@@ -47,6 +52,12 @@ func init() {
 type Service struct {
 	*onet.ServiceProcessor
 	storage *storage1
+	// evidence holds the signed shares of the last re-encryption of the
+	// maxEvidence latest read requests, in the order of evidenceOrder. It
+	// is not saved.
+	evidence      map[string]*GetReencryptionEvidenceReply
+	evidenceOrder []string
+	evidenceLock  sync.Mutex
 }
 
 // pubPoly is a serializable version of share.PubPoly
@@ -180,12 +191,16 @@ func (s *Service) DecryptKey(dkr *DecryptKey) (reply *DecryptKeyReply, err error
 	s.storage.Unlock()
 
 	log.Lvl3("Starting reencryption protocol")
+	ocsProto.LTSID = write.LTSID
+	ocsProto.WriteID = dkr.Write.InclusionProof.Key()
 	ocsProto.SetConfig(&onet.GenericConfig{Data: write.LTSID})
 	err = ocsProto.Start()
 	if err != nil {
 		return nil, err
 	}
-	if !<-ocsProto.Reencrypted {
+	reencrypted := <-ocsProto.Reencrypted
+	s.storeEvidence(dkr.Read.InclusionProof.Key(), ocsProto)
+	if !reencrypted {
 		return nil, errors.New("reencryption got refused")
 	}
 	log.Lvl3("Reencryption protocol is done.")
@@ -199,6 +214,47 @@ func (s *Service) DecryptKey(dkr *DecryptKey) (reply *DecryptKeyReply, err error
 	return
 }
 
+// storeEvidence keeps the signed shares of the protocol for the read request.
+func (s *Service) storeEvidence(readID []byte, ocs *protocol.OCS) {
+	reply := &GetReencryptionEvidenceReply{
+		LTSID:   ocs.LTSID,
+		WriteID: ocs.WriteID,
+		Xc:      ocs.Xc,
+	}
+	for _, p := range ocs.Partials {
+		reply.Partials = append(reply.Partials, ReencryptionPartial{
+			ServerIdentity: p.ServerIdentity,
+			Index:          p.Ui.I,
+			Ui:             p.Ui.V,
+			Signature:      p.Signature,
+			Valid:          p.Valid,
+		})
+	}
+	s.evidenceLock.Lock()
+	defer s.evidenceLock.Unlock()
+	if _, ok := s.evidence[string(readID)]; !ok {
+		s.evidenceOrder = append(s.evidenceOrder, string(readID))
+		if len(s.evidenceOrder) > maxEvidence {
+			delete(s.evidence, s.evidenceOrder[0])
+			s.evidenceOrder = s.evidenceOrder[1:]
+		}
+	}
+	s.evidence[string(readID)] = reply
+}
+
+// GetReencryptionEvidence returns the signed shares of the last
+// re-encryption of a read request done by this node. The shares that are
+// not valid show which node sent a wrong share.
+func (s *Service) GetReencryptionEvidence(req *GetReencryptionEvidence) (*GetReencryptionEvidenceReply, error) {
+	s.evidenceLock.Lock()
+	defer s.evidenceLock.Unlock()
+	reply, ok := s.evidence[string(req.RequestID)]
+	if !ok {
+		return nil, errors.New("no re-encryption for this request")
+	}
+	return reply, nil
+}
+
 // SharedPublic returns the shared public key of an LTSID group.
 func (s *Service) SharedPublic(req *SharedPublic) (reply *SharedPublicReply, err error) {
 	log.Lvl2("Getting shared public key")
@@ -280,6 +336,10 @@ func (s *Service) verifyReencryption(rc *protocol.Reencrypt) bool {
 		if !r.Xc.Equal(rc.Xc) {
 			return errors.New("wrong reader")
 		}
+		// WriteID is only given by nodes that sign it with their share.
+		if rc.WriteID != nil && !r.Write.Equal(byzcoin.NewInstanceID(rc.WriteID)) {
+			return errors.New("wrong write instance")
+		}
 		return nil
 	}()
 	if err != nil {
@@ -295,8 +355,10 @@ func (s *Service) verifyReencryption(rc *protocol.Reencrypt) bool {
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		evidence:         make(map[string]*GetReencryptionEvidenceReply),
 	}
-	if err := s.RegisterHandlers(s.CreateLTS, s.DecryptKey, s.SharedPublic); err != nil {
+	if err := s.RegisterHandlers(s.CreateLTS, s.DecryptKey, s.SharedPublic,
+		s.GetReencryptionEvidence); err != nil {
 		return nil, errors.New("couldn't register messages")
 	}
 	byzcoin.RegisterContract(c, ContractWriteID, s.ContractWrite)
@@ -6,8 +6,11 @@ import (
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/calypso/protocol"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/share"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/util/key"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
@@ -147,6 +150,77 @@ func TestService_DecryptEphemeralKey(t *testing.T) {
 	require.Equal(t, key1, keyCopy1)
 }
 
+// TestService_ReencryptionEvidence makes one node send a wrong share and
+// checks that the evidence of the re-encryption names it.
+func TestService_ReencryptionEvidence(t *testing.T) {
+	s := newTS(t, 3)
+	defer s.closeAll(t)
+
+	key1 := []byte("secret key 1")
+	prWr := s.addWriteAndWait(t, key1)
+	prRe := s.addReadAndWait(t, prWr, s.signer.Ed25519.Point)
+	readID := prRe.InclusionProof.Key()
+
+	_, err := s.services[0].GetReencryptionEvidence(&GetReencryptionEvidence{RequestID: readID})
+	require.NotNil(t, err)
+	_, err = s.services[0].DecryptKey(&DecryptKey{Read: *prRe, Write: *prWr})
+	require.Nil(t, err)
+	ev, err := s.services[0].GetReencryptionEvidence(&GetReencryptionEvidence{RequestID: readID})
+	require.Nil(t, err)
+	require.Equal(t, s.ltsReply.LTSID, ev.LTSID)
+	require.Equal(t, prWr.InclusionProof.Key(), ev.WriteID)
+	require.Equal(t, 3, len(ev.Partials))
+	for _, p := range ev.Partials {
+		require.True(t, p.Valid)
+	}
+
+	// The last node uses a wrong share.
+	bad := s.services[2]
+	bad.storage.Lock()
+	wrong := *bad.storage.Shared[string(s.ltsReply.LTSID)]
+	wrong.V = cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	bad.storage.Shared[string(s.ltsReply.LTSID)] = &wrong
+	bad.storage.Unlock()
+
+	_, err = s.services[0].DecryptKey(&DecryptKey{Read: *prRe, Write: *prWr})
+	require.NotNil(t, err)
+	ev, err = s.services[0].GetReencryptionEvidence(&GetReencryptionEvidence{RequestID: readID})
+	require.Nil(t, err)
+	var found bool
+	for _, p := range ev.Partials {
+		msg := protocol.PartialMessage(ev.LTSID, ev.WriteID, ev.Xc,
+			&share.PubShare{I: p.Index, V: p.Ui})
+		require.Nil(t, schnorr.Verify(cothority.Suite, p.ServerIdentity.Public, msg, p.Signature))
+		if p.ServerIdentity.Equal(bad.ServerIdentity()) {
+			require.False(t, p.Valid)
+			found = true
+		} else {
+			require.True(t, p.Valid)
+		}
+	}
+	require.True(t, found)
+}
+
+// TestService_EvidenceBound checks that only the evidence of the latest read
+// requests is kept.
+func TestService_EvidenceBound(t *testing.T) {
+	s := &Service{evidence: make(map[string]*GetReencryptionEvidenceReply)}
+	readID := func(i int) []byte {
+		return []byte{byte(i >> 8), byte(i)}
+	}
+	for i := 0; i < maxEvidence+10; i++ {
+		s.storeEvidence(readID(i), &protocol.OCS{})
+		// Storing the same request again doesn't forget another one.
+		s.storeEvidence(readID(i), &protocol.OCS{})
+	}
+	require.Equal(t, maxEvidence, len(s.evidence))
+	require.Equal(t, maxEvidence, len(s.evidenceOrder))
+	_, err := s.GetReencryptionEvidence(&GetReencryptionEvidence{RequestID: readID(9)})
+	require.NotNil(t, err)
+	_, err = s.GetReencryptionEvidence(&GetReencryptionEvidence{RequestID: readID(10)})
+	require.Nil(t, err)
+}
+
 type ts struct {
 	local      *onet.LocalTest
 	servers    []*onet.Server
@@ -160,6 +234,8 @@ type ts struct {
 	gDarc      *darc.Darc
 }
 
+// addRead spawns a read instance. If ctr is 0, the counter of the signer is
+// fetched from the ledger.
 func (s *ts) addRead(t *testing.T, write *byzcoin.Proof, Xc kyber.Point, ctr uint64) byzcoin.InstanceID {
 	var readBuf []byte
 	read := &Read{
@@ -176,19 +252,19 @@ func (s *ts) addRead(t *testing.T, write *byzcoin.Proof, Xc kyber.Point, ctr uin
 				ContractID: ContractReadID,
 				Args:       byzcoin.Arguments{{Name: "read", Value: readBuf}},
 			},
-			SignerCounter: []uint64{ctr},
 		}},
 	}
-	require.Nil(t, ctx.SignWith(s.signer))
+	if ctr > 0 {
+		ctx.Instructions[0].SignerCounter = []uint64{ctr}
+	}
+	require.Nil(t, ctx.FillSignersAndSignWith(s.cl, s.signer))
 	_, err = s.cl.AddTransaction(ctx)
 	require.Nil(t, err)
 	return ctx.Instructions[0].DeriveID("")
 }
 
 func (s *ts) addReadAndWait(t *testing.T, write *byzcoin.Proof, Xc kyber.Point) *byzcoin.Proof {
-	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
-	require.NoError(t, err)
-	instID := s.addRead(t, write, Xc, ctr.Counters[0]+1)
+	instID := s.addRead(t, write, Xc, 0)
 	return s.waitInstID(t, instID)
 }
 
@@ -217,11 +293,11 @@ func newTS(t *testing.T, nodes int) ts {
 
 func (s *ts) createGenesis(t *testing.T) {
 	var err error
-	s.genesisMsg, err = byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, s.roster,
-		[]string{"spawn:" + ContractWriteID, "spawn:" + ContractReadID}, s.signer.Identity())
+	s.genesisMsg, err = byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, s.roster,
+		[]string{"spawn:" + ContractWriteID, "spawn:" + ContractReadID}, s.signer.Identity(),
+		byzcoin.WithBlockInterval(time.Second))
 	require.Nil(t, err)
 	s.gDarc = &s.genesisMsg.GenesisDarc
-	s.genesisMsg.BlockInterval = time.Second
 
 	s.cl, s.gbReply, err = byzcoin.NewLedger(s.genesisMsg, false)
 	require.Nil(t, err)
@@ -245,13 +321,12 @@ func (s *ts) waitInstID(t *testing.T, instID byzcoin.InstanceID) *byzcoin.Proof
 }
 
 func (s *ts) addWriteAndWait(t *testing.T, key []byte) *byzcoin.Proof {
-	ctr, err := s.cl.GetSignerCounters(s.signer.Identity().String())
-	require.NoError(t, err)
-
-	instID := s.addWrite(t, key, ctr.Counters[0]+1)
+	instID := s.addWrite(t, key, 0)
 	return s.waitInstID(t, instID)
 }
 
+// addWrite spawns a write instance. If ctr is 0, the counter of the signer is
+// fetched from the ledger.
 func (s *ts) addWrite(t *testing.T, key []byte, ctr uint64) byzcoin.InstanceID {
 	write := NewWrite(cothority.Suite, s.ltsReply.LTSID, s.gDarc.GetBaseID(), s.ltsReply.X, key)
 	writeBuf, err := protobuf.Encode(write)
@@ -264,10 +339,12 @@ func (s *ts) addWrite(t *testing.T, key []byte, ctr uint64) byzcoin.InstanceID {
 				ContractID: ContractWriteID,
 				Args:       byzcoin.Arguments{{Name: "write", Value: writeBuf}},
 			},
-			SignerCounter: []uint64{ctr},
 		}},
 	}
-	require.Nil(t, ctx.SignWith(s.signer))
+	if ctr > 0 {
+		ctx.Instructions[0].SignerCounter = []uint64{ctr}
+	}
+	require.Nil(t, ctx.FillSignersAndSignWith(s.cl, s.signer))
 	_, err = s.cl.AddTransaction(ctx)
 	require.Nil(t, err)
 	return ctx.Instructions[0].DeriveID("")
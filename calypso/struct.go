@@ -13,7 +13,8 @@ import (
 
 func init() {
 	network.RegisterMessages(CreateLTS{}, CreateLTSReply{},
-		DecryptKey{}, DecryptKeyReply{})
+		DecryptKey{}, DecryptKeyReply{},
+		GetReencryptionEvidence{}, GetReencryptionEvidenceReply{})
 }
 
 type suite interface {
@@ -0,0 +1,99 @@
+package darc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dedis/cothority/darc/expression"
+)
+
+// AttrFn evaluates the attribute attr:name:value of an expression. It must
+// return an error if it doesn't know the attribute, so that the expression
+// fails closed.
+type AttrFn func(name, value string) (bool, error)
+
+// BlockAttrs returns an AttrFn that evaluates the attributes against a block.
+// As the expressions must evaluate identically on every node, only the index
+// and the timestamp of the block are available. The timestamp is a Unix
+// timestamp in nanoseconds, and the time attributes are false if it is 0. The
+// supported attributes are:
+//
+//	attr:before_block:N - the index is smaller than N
+//	attr:after_block:N - the index is bigger than or equal to N
+//	attr:before_time:T - the timestamp is before T
+//	attr:after_time:T - the timestamp is T or after T
+//
+// T is either a Unix timestamp in seconds or a date formatted as
+// YYYY-MM-DD, which is midnight UTC.
+func BlockAttrs(index int, timestamp int64) AttrFn {
+	return func(name, value string) (bool, error) {
+		switch name {
+		case "before_block", "after_block":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return false, fmt.Errorf("invalid block index '%s'", value)
+			}
+			if name == "before_block" {
+				return index < n, nil
+			}
+			return index >= n, nil
+		case "before_time", "after_time":
+			t, err := parseAttrTime(value)
+			if err != nil {
+				return false, err
+			}
+			if timestamp == 0 {
+				return false, nil
+			}
+			if name == "before_time" {
+				return time.Unix(0, timestamp).Before(t), nil
+			}
+			return !time.Unix(0, timestamp).Before(t), nil
+		}
+		return false, fmt.Errorf("unknown attribute '%s'", name)
+	}
+}
+
+func parseAttrTime(value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s'", value)
+	}
+	return t, nil
+}
+
+// evalAttr evaluates the attribute s, which starts with "attr:".
+func evalAttr(s string, attrs AttrFn) (bool, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return false, fmt.Errorf("invalid attribute '%s'", s)
+	}
+	if attrs == nil {
+		return false, errors.New("no attributes available for '" + s + "'")
+	}
+	return attrs(parts[1], parts[2])
+}
+
+// EvalExprAttrs checks whether the expression evaluates to true given a list
+// of identities. The attributes in the expression are evaluated by attrs.
+func EvalExprAttrs(expr expression.Expr, getDarc GetDarc, attrs AttrFn, ids ...string) error {
+	return evalExpr(expr, getDarc, false, attrs, nil, ids...)
+}
+
+// EvalExprDarcAttrs is like EvalExprDarc, but evaluates the attributes in the
+// expression with attrs.
+func EvalExprDarcAttrs(expr expression.Expr, getDarc GetDarc, acceptDarc bool, attrs AttrFn, ids ...string) error {
+	return evalExpr(expr, getDarc, acceptDarc, attrs, nil, ids...)
+}
+
+// VerifyWithAttrs is like Verify, but evaluates the attributes of the
+// expressions with attrs.
+func (d *Darc) VerifyWithAttrs(attrs AttrFn, fullVerification bool) error {
+	return d.VerifyWithCBAttrs(DarcsToGetDarcs(d.VerificationDarcs), attrs, fullVerification)
+}
@@ -0,0 +1,82 @@
+package darc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockAttrs(t *testing.T) {
+	attrs := BlockAttrs(99, time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC).UnixNano())
+	for _, c := range []struct {
+		name, value string
+		result      bool
+	}{
+		{"before_block", "100", true},
+		{"before_block", "99", false},
+		{"after_block", "99", true},
+		{"after_block", "100", false},
+		{"before_time", "2025-01-01", true},
+		{"after_time", "2025-01-01", false},
+		{"before_time", "1735689599", false},
+		{"after_time", "1735689599", true},
+	} {
+		ok, err := attrs(c.name, c.value)
+		require.NoError(t, err)
+		require.Equal(t, c.result, ok, c.name+":"+c.value)
+	}
+
+	_, err := attrs("before_block", "abc")
+	require.Error(t, err)
+	_, err = attrs("after_time", "01/01/2025")
+	require.Error(t, err)
+	_, err = attrs("sender", "abc")
+	require.Contains(t, err.Error(), "unknown attribute")
+
+	// Without a timestamp, time conditions are false.
+	ok, err := BlockAttrs(0, 0)("before_time", "2025-01-01")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestEvalExprAttrs(t *testing.T) {
+	id := createIdentity().String()
+	expr := expression.Expr(id + " & attr:before_block:100000")
+	require.NoError(t, EvalExprAttrs(expr, nil, BlockAttrs(99999, 0), id))
+	require.Error(t, EvalExprAttrs(expr, nil, BlockAttrs(100000, 0), id))
+
+	// Unknown attributes and missing attributes fail closed, even if they
+	// are not needed.
+	expr = expression.Expr(id + " | attr:unknown:1")
+	err := EvalExprAttrs(expr, nil, BlockAttrs(0, 0), id)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown attribute 'unknown'")
+	err = EvalExpr(expression.Expr(id+" | attr:before_block:1"), nil, id)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no attributes available")
+}
+
+// TestDarc_VerifyWithAttrs evolves a darc with the signature of a darc whose
+// sign rule has an attribute.
+func TestDarc_VerifyWithAttrs(t *testing.T) {
+	td1 := createDarc(1, "testdarc1")
+	td2 := createDarc(1, "testdarc2")
+	require.Nil(t, td2.darc.Rules.UpdateSign(
+		expression.Expr(td2.ids[0].String()+" & attr:before_block:10")))
+	require.Nil(t, td1.darc.Rules.UpdateEvolution(
+		expression.Expr(NewIdentityDarc(td2.darc.GetID()).String())))
+
+	td3 := createDarc(1, "testdarc3")
+	require.Nil(t, localEvolution(td3.darc, td1.darc, td2.owners[0]))
+	getDarc := DarcsToGetDarcs([]*Darc{td1.darc, td2.darc, td3.darc})
+
+	require.NotNil(t, td3.darc.VerifyWithCB(getDarc, true))
+	require.Nil(t, td3.darc.VerifyWithCBAttrs(getDarc, BlockAttrs(9, 0), true))
+	require.NotNil(t, td3.darc.VerifyWithCBAttrs(getDarc, BlockAttrs(10, 0), true))
+
+	td3.darc.VerificationDarcs = append(td3.darc.VerificationDarcs, td2.darc)
+	require.Nil(t, td3.darc.VerifyWithAttrs(BlockAttrs(9, 0), true))
+	require.NotNil(t, td3.darc.Verify(true))
+}
@@ -0,0 +1,111 @@
+package darc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+)
+
+// SignerBackend holds an Ed25519 key outside of the process, for example in
+// a KMS or an HSM. Sign must return a Schnorr signature of msg, as created
+// by schnorr.Sign with cothority.Suite.
+type SignerBackend interface {
+	Public() kyber.Point
+	Sign(msg []byte) ([]byte, error)
+}
+
+// BackendError is returned by a signer using a SignerBackend if the backend
+// failed or returned an invalid signature.
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return "signer backend: " + e.Err.Error()
+}
+
+// NewSignerBackend returns a signer that uses b to sign. Its identity is the
+// Ed25519 identity of the public key of b, so it can be used everywhere an
+// Ed25519 signer can be used, except for GetPrivate.
+func NewSignerBackend(b SignerBackend) Signer {
+	return Signer{Ed25519: &SignerEd25519{
+		Point:   b.Public(),
+		backend: b,
+	}}
+}
+
+// signBackend signs msg with the backend and verifies the signature, so that
+// a misconfigured backend is detected before the signature is sent.
+func (eds SignerEd25519) signBackend(msg []byte) ([]byte, error) {
+	sig, err := eds.backend.Sign(msg)
+	if err != nil {
+		return nil, &BackendError{err}
+	}
+	if err := schnorr.Verify(cothority.Suite, eds.Point, msg, sig); err != nil {
+		return nil, &BackendError{fmt.Errorf("invalid signature: %v", err)}
+	}
+	return sig, nil
+}
+
+type memoryBackend struct {
+	public kyber.Point
+	secret kyber.Scalar
+}
+
+// NewMemoryBackend returns a SignerBackend that holds the key in memory. It
+// is mostly useful for tests.
+func NewMemoryBackend(public kyber.Point, secret kyber.Scalar) SignerBackend {
+	return &memoryBackend{public, secret}
+}
+
+func (m *memoryBackend) Public() kyber.Point {
+	return m.public
+}
+
+func (m *memoryBackend) Sign(msg []byte) ([]byte, error) {
+	return schnorr.Sign(cothority.Suite, m.secret, msg)
+}
+
+type commandBackend struct {
+	public  kyber.Point
+	command string
+	args    []string
+}
+
+// NewCommandBackend returns a SignerBackend that runs an external command
+// for every signature. The command gets the message hex-encoded on its
+// standard input and must print the signature hex-encoded on its standard
+// output. If it exits with an error, its standard error is returned.
+func NewCommandBackend(public kyber.Point, command string, args ...string) SignerBackend {
+	return &commandBackend{public, command, args}
+}
+
+func (c *commandBackend) Public() kyber.Point {
+	return c.public
+}
+
+func (c *commandBackend) Sign(msg []byte) ([]byte, error) {
+	cmd := exec.Command(c.command, c.args...)
+	cmd.Stdin = strings.NewReader(hex.EncodeToString(msg))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed: %v: %s", c.command, err, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %v", c.command, err)
+	}
+	sig, err := hex.DecodeString(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		return nil, errors.New(c.command + " returned an invalid signature: " + err.Error())
+	}
+	return sig, nil
+}
@@ -0,0 +1,115 @@
+package darc
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
+	"github.com/stretchr/testify/require"
+)
+
+type failingBackend struct {
+	public kyber.Point
+	sig    []byte
+	err    error
+}
+
+func (f failingBackend) Public() kyber.Point {
+	return f.public
+}
+
+func (f failingBackend) Sign(msg []byte) ([]byte, error) {
+	return f.sig, f.err
+}
+
+func TestSignerBackend(t *testing.T) {
+	kp := key.NewKeyPair(cothority.Suite)
+	signer := NewSignerBackend(NewMemoryBackend(kp.Public, kp.Private))
+	id := signer.Identity()
+	require.True(t, id.Equal(&Identity{Ed25519: &IdentityEd25519{Point: kp.Public}}))
+
+	msg := []byte("instruction digest")
+	sig, err := signer.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, id.Verify(msg, sig))
+	_, err = signer.GetPrivate()
+	require.NotNil(t, err)
+
+	// A darc evolved by the backend signer.
+	d := NewDarc(InitRules([]Identity{id}, []Identity{id}), []byte("backend"))
+	d2 := d.Copy()
+	require.Nil(t, localEvolution(d2, d, signer))
+	require.Nil(t, d2.Verify(true))
+
+	// Errors of the backend are passed on.
+	signer = NewSignerBackend(failingBackend{public: kp.Public, err: errors.New("hsm unavailable")})
+	_, err = signer.Sign(msg)
+	require.NotNil(t, err)
+	require.IsType(t, &BackendError{}, err)
+	require.Equal(t, "signer backend: hsm unavailable", err.Error())
+
+	// Signatures of another key are refused.
+	other := key.NewKeyPair(cothority.Suite)
+	otherSig, err := schnorr.Sign(cothority.Suite, other.Private, msg)
+	require.Nil(t, err)
+	signer = NewSignerBackend(failingBackend{public: kp.Public, sig: otherSig})
+	_, err = signer.Sign(msg)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid signature")
+}
+
+// TestSignerBackend_Helper is not a real test, it signs the hex-encoded
+// message on the standard input for TestSignerBackend_Command.
+func TestSignerBackend_Helper(t *testing.T) {
+	secret := os.Getenv("DARC_TEST_SIGNER_SECRET")
+	if secret == "" {
+		return
+	}
+	defer os.Exit(0)
+	buf, err := hex.DecodeString(secret)
+	require.Nil(t, err)
+	priv := cothority.Suite.Scalar()
+	require.Nil(t, priv.UnmarshalBinary(buf))
+	in, err := ioutil.ReadAll(os.Stdin)
+	require.Nil(t, err)
+	msg, err := hex.DecodeString(string(in))
+	require.Nil(t, err)
+	sig, err := schnorr.Sign(cothority.Suite, priv, msg)
+	require.Nil(t, err)
+	fmt.Println(hex.EncodeToString(sig))
+}
+
+func TestSignerBackend_Command(t *testing.T) {
+	kp := key.NewKeyPair(cothority.Suite)
+	buf, err := kp.Private.MarshalBinary()
+	require.Nil(t, err)
+	require.Nil(t, os.Setenv("DARC_TEST_SIGNER_SECRET", hex.EncodeToString(buf)))
+	defer os.Unsetenv("DARC_TEST_SIGNER_SECRET")
+
+	signer := NewSignerBackend(NewCommandBackend(kp.Public, os.Args[0],
+		"-test.run=TestSignerBackend_Helper"))
+	msg := []byte("instruction digest")
+	sig, err := signer.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, signer.Identity().Verify(msg, sig))
+
+	// A failing command returns its standard error.
+	signer = NewSignerBackend(NewCommandBackend(kp.Public, "sh", "-c",
+		"echo device not found >&2; exit 1"))
+	_, err = signer.Sign(msg)
+	require.NotNil(t, err)
+	require.IsType(t, &BackendError{}, err)
+	require.Contains(t, err.Error(), "device not found")
+
+	signer = NewSignerBackend(NewCommandBackend(kp.Public, "echo", "not hex"))
+	_, err = signer.Sign(msg)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid signature")
+}
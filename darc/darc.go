@@ -43,13 +43,15 @@ import (
 	"math/big"
 	"strings"
 
+	// Neither crypto/elliptic nor kyber implement secp256k1, so the
+	// ECDSA identities use the curve of btcd.
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/darc/expression"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/eddsa"
 	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/util/key"
-	"github.com/dedis/onet/log"
 	"github.com/dedis/protobuf"
 )
 
@@ -370,7 +372,9 @@ func (d *Darc) MakeEvolveRequest(prevSigners ...Signer) (*Request, []byte, error
 // something is wrong. This is used for offline verification where
 // Darc.VerificationDarcs has all the required darcs for doing the
 // verification. The function will verify every darc up to the genesis darc
-// (version 0) if the fullVerification flag is set.
+// (version 0) if the fullVerification flag is set. An expression with an
+// attribute fails, because the context of the attributes is not known
+// offline; use VerifyWithAttrs to evaluate them.
 func (d *Darc) Verify(fullVerification bool) error {
 	return d.VerifyWithCB(DarcsToGetDarcs(d.VerificationDarcs), fullVerification)
 }
@@ -381,8 +385,15 @@ func (d *Darc) Verify(fullVerification bool) error {
 // way to retrieve the correct Darc according to that ID. This function will
 // ignore darcs in Darc.VerificationDarcs, please use Darc.Verify if you wish
 // to use it. Further, it verifies every darc up to the genesis darc (version
-// 0) if the fullVerification flag is set.
+// 0) if the fullVerification flag is set. Like Verify, it fails on an
+// expression with an attribute; use VerifyWithCBAttrs to evaluate them.
 func (d *Darc) VerifyWithCB(getDarc GetDarc, fullVerification bool) error {
+	return d.VerifyWithCBAttrs(getDarc, nil, fullVerification)
+}
+
+// VerifyWithCBAttrs is like VerifyWithCB, but evaluates the attributes of the
+// expressions with attrs.
+func (d *Darc) VerifyWithCBAttrs(getDarc GetDarc, attrs AttrFn, fullVerification bool) error {
 	if d == nil {
 		return errors.New("darc is nil")
 	}
@@ -401,9 +412,9 @@ func (d *Darc) VerifyWithCB(getDarc GetDarc, fullVerification bool) error {
 		return errors.New("cannot find the previous darc")
 	}
 	if fullVerification {
-		return verifyEvolutionRecursive(d, prev, getDarc)
+		return verifyEvolutionRecursive(d, prev, getDarc, attrs)
 	}
-	return verifyOneEvolution(d, prev, getDarc)
+	return verifyOneEvolution(d, prev, getDarc, attrs)
 }
 
 // Verify checks the request with the given darc and returns an error if it
@@ -530,24 +541,23 @@ func (d Darc) SanityCheck(prev *Darc) error {
 // is, there exists a signature in the newDarc that is signed by one of the
 // identities with the evolve permission in the oldDarc. The message that
 // prevDarc signs is the digest of a Darc.Request.
-func verifyOneEvolution(newDarc, prevDarc *Darc, getDarc func(string, bool) *Darc) error {
+func verifyOneEvolution(newDarc, prevDarc *Darc, getDarc func(string, bool) *Darc, attrs AttrFn) error {
 	if err := newDarc.SanityCheck(prevDarc); err != nil {
 		return err
 	}
 
 	// check that signers have the permission
-	if err := EvalExprWithSigs(
-		prevDarc.Rules.GetEvolutionExpr(),
-		getDarc,
-		newDarc.Signatures...); err != nil {
-		return err
-	}
-
-	// convert the darc into a request
 	signerIDs := make([]Identity, len(newDarc.Signatures))
+	signers := make([]string, len(newDarc.Signatures))
 	for i, sig := range newDarc.Signatures {
 		signerIDs[i] = sig.Signer
+		signers[i] = sig.Signer.String()
+	}
+	if err := evalExpr(prevDarc.Rules.GetEvolutionExpr(), getDarc, false, attrs, nil, signers...); err != nil {
+		return err
 	}
+
+	// convert the darc into a request
 	req := Request{
 		BaseID:     newDarc.GetBaseID(),
 		Action:     evolve,
@@ -567,12 +577,12 @@ func verifyOneEvolution(newDarc, prevDarc *Darc, getDarc func(string, bool) *Dar
 
 // verifyEvolutionRecursive verifies that evolutions, from the genesis darc
 // (darc of version 0), are performed correctly, recursively.
-func verifyEvolutionRecursive(newDarc, prevDarc *Darc, getDarc func(string, bool) *Darc) error {
-	if err := verifyOneEvolution(newDarc, prevDarc, getDarc); err != nil {
+func verifyEvolutionRecursive(newDarc, prevDarc *Darc, getDarc func(string, bool) *Darc, attrs AttrFn) error {
+	if err := verifyOneEvolution(newDarc, prevDarc, getDarc, attrs); err != nil {
 		return err
 	}
 	// recursively verify the previous darc
-	return prevDarc.VerifyWithCB(getDarc, true)
+	return prevDarc.VerifyWithCBAttrs(getDarc, attrs, true)
 }
 
 // EvalExprWithSigs is a simple wrapper around EvalExpr that extracts Signer
@@ -596,53 +606,159 @@ func EvalExpr(expr expression.Expr, getDarc GetDarc, ids ...string) error {
 
 // EvalExprDarc checks whether the expression evaluates to true given a list of
 // identities. It takes 'acceptDarc', and, if it is true, doesn't recurse into
-// darcs that fit one of the ids.
+// darcs that fit one of the ids. An expression with an attribute fails, use
+// EvalExprDarcAttrs to evaluate them.
 func EvalExprDarc(expr expression.Expr, getDarc GetDarc, acceptDarc bool, ids ...string) error {
-	Y := expression.InitParser(func(s string) bool {
+	return evalExpr(expr, getDarc, acceptDarc, nil, nil, ids...)
+}
+
+// MaxDelegationDepth is the maximum number of darcs that can be chained by
+// delegations during the evaluation of an expression.
+const MaxDelegationDepth = 10
+
+// DelegationError is returned if an expression is not satisfied and some of
+// its darcs delegate to each other in a cycle, or the chain of delegations is
+// longer than MaxDelegationDepth.
+type DelegationError struct {
+	// Chain holds the darcs from the one in the expression to the one
+	// that caused the error.
+	Chain []string
+	// Cycle is true if the last darc of the chain is already in the chain.
+	Cycle bool
+}
+
+func (e *DelegationError) Error() string {
+	if e.Cycle {
+		return "delegation cycle: " + strings.Join(e.Chain, " -> ")
+	}
+	return fmt.Sprintf("more than %d delegations: %s", len(e.Chain)-1, strings.Join(e.Chain, " -> "))
+}
+
+// evalExpr evaluates expr. The chain holds the darcs that delegated to expr.
+func evalExpr(expr expression.Expr, getDarc GetDarc, acceptDarc bool, attrs AttrFn, chain []string, ids ...string) error {
+	t, err := traceExpr(expr, getDarc, acceptDarc, attrs, chain, ids...)
+	if err != nil {
+		return err
+	}
+	if !t.Satisfied {
+		return fmt.Errorf("expression '%s' evaluated to false", expr)
+	}
+	return nil
+}
+
+// traceExpr evaluates expr and returns the trace of the evaluation. The chain
+// holds the darcs that delegated to expr. A delegation cycle or a chain of
+// delegations that is too long is a branch that is not satisfied, so another
+// branch of an OR can still satisfy the expression. If the expression is not
+// satisfied, the first DelegationError is returned with the trace. An
+// attribute that cannot be evaluated fails the whole expression, even if it
+// is not needed for the result: the error is returned with the trace, in
+// which the leaf that caused it and all its parents are not satisfied.
+func traceExpr(expr expression.Expr, getDarc GetDarc, acceptDarc bool, attrs AttrFn, chain []string, ids ...string) (*expression.Trace, error) {
+	var attrErr error
+	var delegationErr *DelegationError
+	failed := make(map[*expression.Trace]bool)
+	fail := func(detail string) *expression.Trace {
+		t := &expression.Trace{Detail: detail}
+		failed[t] = true
+		return t
+	}
+	t, err := expression.EvaluateTrace(expr, func(s string) *expression.Trace {
+		if strings.HasPrefix(s, "attr:") {
+			ok, err := evalAttr(s, attrs)
+			if err != nil {
+				if attrErr == nil {
+					attrErr = err
+				}
+				return fail(err.Error())
+			}
+			if !ok {
+				return &expression.Trace{Detail: "condition not met"}
+			}
+			return &expression.Trace{Satisfied: true}
+		}
 		found := false
 		for _, id := range ids {
 			if id == s {
 				found = true
 			}
 		}
-		if strings.HasPrefix(s, "darc") {
-			if acceptDarc && found {
-				return true
+		if !strings.HasPrefix(s, "darc") || (acceptDarc && found) {
+			if found {
+				return &expression.Trace{Satisfied: true, Detail: "signed"}
 			}
-			// getDarc is responsible for returning the latest Darc
-			d := getDarc(s, true)
-			if d == nil {
-				return false
+			return &expression.Trace{Detail: "no signature"}
+		}
+
+		next := append(append([]string{}, chain...), s)
+		var de *DelegationError
+		for _, c := range chain {
+			if c == s {
+				de = &DelegationError{Chain: next, Cycle: true}
 			}
-			// Evaluate the "sign" action only in the latest darc
-			// because it may have revoked some rules in earlier
-			// darcs. We do this recursively because there may be
-			// further delegations.
-			if !d.Rules.Contains(sign) {
-				return false
+		}
+		if de == nil && len(chain) >= MaxDelegationDepth {
+			de = &DelegationError{Chain: next}
+		}
+		if de != nil {
+			if delegationErr == nil {
+				delegationErr = de
 			}
-			signExpr := d.Rules.GetSignExpr()
-			if bytes.Compare(expr, signExpr) == 0 {
-				log.Warn("Recursive expression!")
-				return false
+			return &expression.Trace{Detail: de.Error()}
+		}
+		if getDarc == nil {
+			return &expression.Trace{Detail: "darc not available"}
+		}
+		// getDarc is responsible for returning the latest Darc
+		d := getDarc(s, true)
+		if d == nil {
+			return &expression.Trace{Detail: "darc not found"}
+		}
+		// Evaluate the "sign" action only in the latest darc because it
+		// may have revoked some rules in earlier darcs. We do this
+		// recursively because there may be further delegations.
+		if !d.Rules.Contains(sign) {
+			return &expression.Trace{Detail: "no sign rule"}
+		}
+		child, err := traceExpr(d.Rules.GetSignExpr(), getDarc, acceptDarc, attrs, next, ids...)
+		if err != nil {
+			if de, ok := err.(*DelegationError); ok && delegationErr == nil {
+				delegationErr = de
 			}
-			// Recursively evaluate the sign expression until we
-			// find the final signer.
-			if err := EvalExprDarc(signExpr, getDarc, acceptDarc, ids...); err != nil {
-				return false
+			leaf := &expression.Trace{Detail: err.Error()}
+			if child != nil {
+				leaf.Children = []*expression.Trace{child}
 			}
-			return true
+			return leaf
 		}
-		return found
+		return &expression.Trace{Satisfied: child.Satisfied, Children: []*expression.Trace{child}}
 	})
-	res, err := expression.Evaluate(Y, expr)
 	if err != nil {
-		return fmt.Errorf("evaluation failed on '%s' with error: %v", expr, err)
+		return nil, fmt.Errorf("evaluation failed on '%s' with error: %v", expr, err)
 	}
-	if res != true {
-		return fmt.Errorf("expression '%s' evaluated to false", expr)
+	markFailed(t, failed)
+	if delegationErr != nil && !t.Satisfied {
+		return t, delegationErr
 	}
-	return nil
+	if attrErr != nil {
+		return t, fmt.Errorf("evaluation failed on '%s' with error: %v", expr, attrErr)
+	}
+	return t, nil
+}
+
+// markFailed marks t as not satisfied if it or one of its children is in
+// failed, and returns true in this case.
+func markFailed(t *expression.Trace, failed map[*expression.Trace]bool) bool {
+	res := failed[t]
+	for _, c := range t.Children {
+		if markFailed(c, failed) {
+			res = true
+		}
+	}
+	if res {
+		t.Satisfied = false
+	}
+	return res
 }
 
 // Type returns an integer representing the type of key held in the signer. It
@@ -655,6 +771,8 @@ func (s Signer) Type() int {
 		return 2
 	case s.Proxy != nil:
 		return 3
+	case s.ECDSA != nil:
+		return 4
 	default:
 		return -1
 	}
@@ -670,6 +788,8 @@ func (s Signer) Identity() Identity {
 		return NewIdentityX509EC(s.X509EC.Point)
 	case 3:
 		return NewIdentityProxy(s.Proxy)
+	case 4:
+		return NewIdentityECDSA(s.ECDSA.Point)
 	default:
 		return Identity{}
 	}
@@ -689,6 +809,8 @@ func (s Signer) Sign(msg []byte) ([]byte, error) {
 		return s.X509EC.Sign(msg)
 	case 3:
 		return s.Proxy.Sign(msg)
+	case 4:
+		return s.ECDSA.Sign(msg)
 	default:
 		return nil, errors.New("unknown signer type")
 	}
@@ -698,9 +820,14 @@ func (s Signer) Sign(msg []byte) ([]byte, error) {
 func (s Signer) GetPrivate() (kyber.Scalar, error) {
 	switch s.Type() {
 	case 1:
+		if s.Ed25519.backend != nil {
+			return nil, errors.New("private key is held by a backend")
+		}
 		return s.Ed25519.Secret, nil
 	case 0, 2, 3:
 		return nil, errors.New("signer lacks a private key")
+	case 4:
+		return nil, errors.New("private key is not on the ed25519 curve")
 	default:
 		return nil, errors.New("signer is of unknown type")
 	}
@@ -721,6 +848,8 @@ func (id Identity) Equal(id2 *Identity) bool {
 		return id.X509EC.Equal(id2.X509EC)
 	case 3:
 		return id.Proxy.Equal(id2.Proxy)
+	case 4:
+		return id.ECDSA.Equal(id2.ECDSA)
 	}
 	return false
 }
@@ -737,6 +866,8 @@ func (id Identity) Type() int {
 		return 2
 	case id.Proxy != nil:
 		return 3
+	case id.ECDSA != nil:
+		return 4
 	}
 	return -1
 }
@@ -753,6 +884,8 @@ func (id Identity) PrimaryIdentity() bool {
 		return true
 	case id.Proxy != nil:
 		return true
+	case id.ECDSA != nil:
+		return true
 	}
 	return false
 }
@@ -768,6 +901,8 @@ func (id Identity) TypeString() string {
 		return "x509ec"
 	case 3:
 		return "proxy"
+	case 4:
+		return "ecdsa"
 	default:
 		return "No identity"
 	}
@@ -784,6 +919,8 @@ func (id Identity) String() string {
 		return fmt.Sprintf("%s:%x", id.TypeString(), id.X509EC.Public)
 	case 3:
 		return fmt.Sprintf("%s:%v:%v", id.TypeString(), id.Proxy.Public, id.Proxy.Data)
+	case 4:
+		return fmt.Sprintf("%s:%x", id.TypeString(), id.ECDSA.Public)
 	default:
 		return "No identity"
 	}
@@ -801,6 +938,8 @@ func (id Identity) Verify(msg, sig []byte) error {
 		return id.X509EC.Verify(msg, sig)
 	case 3:
 		return id.Proxy.Verify(msg, sig)
+	case 4:
+		return id.ECDSA.Verify(msg, sig)
 	default:
 		return errors.New("unknown identity")
 	}
@@ -859,6 +998,20 @@ func NewIdentityProxy(s *SignerProxy) Identity {
 	}
 }
 
+// NewIdentityECDSA creates a new ECDSA identity struct given a secp256k1
+// public key. The key is stored compressed, so that a key has only one
+// identity. A key that cannot be parsed is kept as is and fails to verify.
+func NewIdentityECDSA(public []byte) Identity {
+	if pub, err := btcec.ParsePubKey(public, btcec.S256()); err == nil {
+		public = pub.SerializeCompressed()
+	}
+	return Identity{
+		ECDSA: &IdentityECDSA{
+			Public: public,
+		},
+	}
+}
+
 // Equal returns true if both IdentityX509EC point to the same data.
 func (idkc IdentityX509EC) Equal(idkc2 *IdentityX509EC) bool {
 	return bytes.Compare(idkc.Public, idkc2.Public) == 0
@@ -869,6 +1022,44 @@ func (idp IdentityProxy) Equal(i2 *IdentityProxy) bool {
 	return idp.Data == i2.Data && idp.Public.Equal(i2.Public)
 }
 
+// Equal returns true if both IdentityECDSA hold the same public key.
+func (ide IdentityECDSA) Equal(ide2 *IdentityECDSA) bool {
+	return bytes.Equal(ide.Public, ide2.Public)
+}
+
+// Verify returns nil if the signature is correct, or an error if something
+// fails. The signature is the concatenation of R and S on 32 bytes each, and
+// is done on the sha256 hash of the message. Only compressed public keys and
+// signatures with S in the lower half of the order are accepted, so that
+// neither the identity nor the signature can be changed by a third party.
+func (ide IdentityECDSA) Verify(msg, s []byte) error {
+	if len(ide.Public) != btcec.PubKeyBytesLenCompressed {
+		return errors.New("public key is not compressed")
+	}
+	public, err := btcec.ParsePubKey(ide.Public, btcec.S256())
+	if err != nil {
+		return err
+	}
+	if len(s) != 64 {
+		return errors.New("wrong signature length")
+	}
+	sig := &btcec.Signature{
+		R: new(big.Int).SetBytes(s[:32]),
+		S: new(big.Int).SetBytes(s[32:]),
+	}
+	if sig.S.Cmp(ecdsaHalfOrder) > 0 {
+		return errors.New("signature has a high S")
+	}
+	digest := sha256.Sum256(msg)
+	if !sig.Verify(digest[:], public) {
+		return errors.New("Wrong signature")
+	}
+	return nil
+}
+
+// ecdsaHalfOrder is the biggest S of an accepted ECDSA signature.
+var ecdsaHalfOrder = new(big.Int).Rsh(btcec.S256().N, 1)
+
 type sigRS struct {
 	R *big.Int
 	S *big.Int
@@ -924,9 +1115,52 @@ func NewSignerEd25519(public kyber.Point, private kyber.Scalar) Signer {
 
 // Sign creates a schnorr signautre on the message.
 func (eds SignerEd25519) Sign(msg []byte) ([]byte, error) {
+	if eds.backend != nil {
+		return eds.signBackend(msg)
+	}
 	return schnorr.Sign(cothority.Suite, eds.Secret, msg)
 }
 
+// NewSignerECDSA initializes a new SignerECDSA signer given a secp256k1
+// public key and its private key. If either of the given keys is nil, then a
+// new key pair is generated. The public key is stored compressed.
+func NewSignerECDSA(public, private []byte) (Signer, error) {
+	if public == nil || private == nil {
+		priv, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return Signer{}, err
+		}
+		public = priv.PubKey().SerializeCompressed()
+		private = priv.D.Bytes()
+	} else {
+		pub, err := btcec.ParsePubKey(public, btcec.S256())
+		if err != nil {
+			return Signer{}, err
+		}
+		public = pub.SerializeCompressed()
+	}
+	return Signer{ECDSA: &SignerECDSA{
+		Point:  public,
+		Secret: private,
+	}}, nil
+}
+
+// Sign creates an ECDSA signature on the sha256 hash of the message. The S of
+// the signature is always in the lower half of the order.
+func (s SignerECDSA) Sign(msg []byte) ([]byte, error) {
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), s.Secret)
+	digest := sha256.Sum256(msg)
+	sig, err := priv.Sign(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64)
+	rBuf, sBuf := sig.R.Bytes(), sig.S.Bytes()
+	copy(buf[32-len(rBuf):], rBuf)
+	copy(buf[64-len(sBuf):], sBuf)
+	return buf, nil
+}
+
 // Hash computes the digest of the request, the identities and signatures are
 // not included.
 func (r Request) Hash() []byte {
@@ -1,9 +1,15 @@
 package darc
 
 import (
+	"fmt"
+	"math/big"
+	"strings"
 	"testing"
 
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/onet/network"
 	"github.com/stretchr/testify/require"
 )
 
@@ -383,10 +389,154 @@ func TestDarc_DelegationChain(t *testing.T) {
 	require.Nil(t, td.darc.VerifyWithCB(getDarc, true))
 }
 
+// TestDarc_DelegationCycle makes sure that a cycle of darcs delegating to
+// each other is a branch that is not satisfied, and doesn't fail the other
+// branches of the expression.
+func TestDarc_DelegationCycle(t *testing.T) {
+	id := createIdentity()
+	other := createIdentity()
+	darcs := map[string]*Darc{}
+	add := func(name, signExpr string) {
+		d := NewDarc(NewRules(), []byte(name))
+		require.Nil(t, d.Rules.AddRule(sign, expression.Expr(signExpr)))
+		darcs[name] = d
+	}
+	add("darc:aa", "darc:bb")
+	add("darc:bb", "darc:aa | "+id.String())
+	getDarc := func(s string, latest bool) *Darc {
+		return darcs[s]
+	}
+
+	// The identity in darc:bb satisfies the expression.
+	require.Nil(t, EvalExpr(expression.Expr("darc:aa"), getDarc, id.String()))
+
+	// Without it, the cycle is returned as the reason of the failure.
+	for i := 0; i < 2; i++ {
+		err := EvalExpr(expression.Expr("darc:aa"), getDarc, other.String())
+		require.NotNil(t, err)
+		de, ok := err.(*DelegationError)
+		require.True(t, ok)
+		require.True(t, de.Cycle)
+		require.Equal(t, []string{"darc:aa", "darc:bb", "darc:aa"}, de.Chain)
+		require.Contains(t, err.Error(), "darc:aa -> darc:bb -> darc:aa")
+	}
+
+	// A darc delegating to itself.
+	add("darc:cc", "darc:cc")
+	require.Nil(t, EvalExpr(expression.Expr(id.String()+" | darc:cc"), getDarc, id.String()))
+	err := EvalExpr(expression.Expr(id.String()+" | darc:cc"), getDarc, other.String())
+	require.NotNil(t, err)
+	require.Equal(t, []string{"darc:cc", "darc:cc"}, err.(*DelegationError).Chain)
+}
+
+// TestDarc_DelegationDepth creates a chain of delegations that is one darc
+// too long.
+func TestDarc_DelegationDepth(t *testing.T) {
+	id := createIdentity()
+	n := MaxDelegationDepth + 1
+	darcs := map[string]*Darc{}
+	name := func(i int) string {
+		return fmt.Sprintf("darc:%02x", i)
+	}
+	for i := 0; i < n; i++ {
+		next := id.String()
+		if i < n-1 {
+			next = name(i + 1)
+		}
+		d := NewDarc(NewRules(), []byte(name(i)))
+		require.Nil(t, d.Rules.AddRule(sign, expression.Expr(next)))
+		darcs[name(i)] = d
+	}
+	getDarc := func(s string, latest bool) *Darc {
+		return darcs[s]
+	}
+
+	err := EvalExpr(expression.Expr(name(0)), getDarc, id.String())
+	require.NotNil(t, err)
+	de, ok := err.(*DelegationError)
+	require.True(t, ok)
+	require.False(t, de.Cycle)
+	require.Equal(t, n, len(de.Chain))
+	require.Contains(t, err.Error(), "more than 10 delegations")
+
+	// One darc less is accepted.
+	require.Nil(t, EvalExpr(expression.Expr(name(1)), getDarc, id.String()))
+
+	// The chain that is too long is only a branch that is not satisfied.
+	require.Nil(t, EvalExpr(expression.Expr(name(0)+" | "+id.String()), getDarc, id.String()))
+}
+
 func TestDarc_X509(t *testing.T) {
 	// TODO
 }
 
+func TestDarc_ECDSA(t *testing.T) {
+	signer, err := NewSignerECDSA(nil, nil)
+	require.Nil(t, err)
+	other, err := NewSignerECDSA(nil, nil)
+	require.Nil(t, err)
+	id := signer.Identity()
+	require.True(t, strings.HasPrefix(id.String(), "ecdsa:"))
+	require.True(t, id.PrimaryIdentity())
+
+	msg := []byte("instruction digest")
+	sig, err := signer.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, id.Verify(msg, sig))
+	require.NotNil(t, id.Verify([]byte("another digest"), sig))
+	require.NotNil(t, other.Identity().Verify(msg, sig))
+	require.NotNil(t, id.Verify(msg, sig[1:]))
+
+	// The same signature with a high S is refused.
+	highS := new(big.Int).Sub(btcec.S256().N, new(big.Int).SetBytes(sig[32:]))
+	malleated := append([]byte{}, sig[:32]...)
+	malleated = append(malleated, make([]byte, 32-len(highS.Bytes()))...)
+	malleated = append(malleated, highS.Bytes()...)
+	err = id.Verify(msg, malleated)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "high S")
+
+	// An uncompressed key gives the same identity, and cannot be used
+	// without being compressed.
+	pub, err := btcec.ParsePubKey(signer.ECDSA.Point, btcec.S256())
+	require.Nil(t, err)
+	require.True(t, NewIdentityECDSA(pub.SerializeUncompressed()).Equal(&id))
+	uncompressed, err := NewSignerECDSA(pub.SerializeUncompressed(), signer.ECDSA.Secret)
+	require.Nil(t, err)
+	require.Equal(t, id.String(), uncompressed.Identity().String())
+	require.NotNil(t, IdentityECDSA{Public: pub.SerializeUncompressed()}.Verify(msg, sig))
+
+	// Mixed rule with an ed25519 and an ecdsa identity.
+	ed := createIdentity()
+	expr := expression.InitOrExpr(ed.String(), id.String())
+	require.Nil(t, EvalExpr(expr, nil, id.String()))
+	require.Nil(t, EvalExpr(expr, nil, ed.String()))
+	require.NotNil(t, EvalExpr(expr, nil, other.Identity().String()))
+
+	// A darc evolved by the ecdsa signer.
+	d := NewDarc(InitRules([]Identity{id}, []Identity{id}), []byte("ecdsa"))
+	d2 := d.Copy()
+	require.Nil(t, localEvolution(d2, d, signer))
+	require.Nil(t, d2.Verify(true))
+
+	// Darcs and signers survive a round-trip.
+	buf, err := network.Marshal(d2)
+	require.Nil(t, err)
+	_, msgI, err := network.Unmarshal(buf, cothority.Suite)
+	require.Nil(t, err)
+	d3 := msgI.(*Darc)
+	require.True(t, d3.Signatures[0].Signer.Equal(&id))
+	require.Nil(t, d3.Verify(true))
+	buf, err = network.Marshal(&signer)
+	require.Nil(t, err)
+	_, msgI, err = network.Unmarshal(buf, cothority.Suite)
+	require.Nil(t, err)
+	signer2 := msgI.(*Signer)
+	sig, err = signer2.Sign(msg)
+	require.Nil(t, err)
+	require.Nil(t, id.Verify(msg, sig))
+}
+
 type testDarc struct {
 	darc   *Darc
 	owners []Signer
@@ -0,0 +1,36 @@
+package darc
+
+import (
+	"errors"
+
+	"github.com/dedis/cothority/darc/expression"
+)
+
+// ExplainRequest returns the trace of the evaluation of the rule of action
+// in d for the given identities, which are supposed to have signed the
+// request. The trace tells which part of the rule failed. As the delegated
+// darcs are not available, they are not satisfied, see ExplainExpr.
+func ExplainRequest(d *Darc, action Action, ids []Identity) (*expression.Trace, error) {
+	if !d.Rules.Contains(action) {
+		return nil, errors.New("action '" + string(action) + "' does not exist")
+	}
+	idStrs := make([]string, len(ids))
+	for i, id := range ids {
+		idStrs[i] = id.String()
+	}
+	return ExplainExpr(d.Rules.Get(action), nil, nil, idStrs...)
+}
+
+// ExplainExpr evaluates the expression like EvalExprAttrs, but returns the
+// trace of the evaluation. The delegated darcs are fetched with getDarc, and
+// their traces are the children of the darc ids. getDarc and attrs can be
+// nil. A delegation cycle or an attribute that cannot be evaluated is in the
+// details of the leaf that caused it, which is not satisfied. An error is
+// only returned if the expression cannot be parsed.
+func ExplainExpr(expr expression.Expr, getDarc GetDarc, attrs AttrFn, ids ...string) (*expression.Trace, error) {
+	t, err := traceExpr(expr, getDarc, false, attrs, nil, ids...)
+	if t == nil {
+		return nil, err
+	}
+	return t, nil
+}
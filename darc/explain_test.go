@@ -0,0 +1,97 @@
+package darc
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplainRequest(t *testing.T) {
+	a, b, c := createIdentity(), createIdentity(), createIdentity()
+	d := NewDarc(InitRules([]Identity{a}, []Identity{a}), []byte("explain"))
+	expr := expression.Expr(a.String() + " & (" + b.String() + " | " + c.String() + ")")
+	require.Nil(t, d.Rules.AddRule("spawn:value", expr))
+
+	// b didn't sign, so the or fails.
+	tr, err := ExplainRequest(d, "spawn:value", []Identity{a})
+	require.Nil(t, err)
+	require.False(t, tr.Satisfied)
+	require.Equal(t, "&", tr.Op)
+	require.Equal(t, 2, len(tr.Children))
+	require.True(t, tr.Children[0].Satisfied)
+	require.Equal(t, "signed", tr.Children[0].Detail)
+	or := tr.Children[1]
+	require.False(t, or.Satisfied)
+	require.Equal(t, "|", or.Op)
+	require.Equal(t, b.String(), or.Children[0].ID)
+	require.Equal(t, "no signature", or.Children[0].Detail)
+	require.Equal(t, b.String()+" [no signature] | "+c.String()+" [no signature]", tr.FailedBranch())
+
+	tr, err = ExplainRequest(d, "spawn:value", []Identity{a, c})
+	require.Nil(t, err)
+	require.True(t, tr.Satisfied)
+	require.Equal(t, "", tr.FailedBranch())
+
+	_, err = ExplainRequest(d, "spawn:other", []Identity{a})
+	require.NotNil(t, err)
+}
+
+func TestExplainExpr_Delegation(t *testing.T) {
+	a, b := createIdentity(), createIdentity()
+	delegated := NewDarc(InitRules([]Identity{b}, []Identity{b}), []byte("delegated"))
+	dID := NewIdentityDarc(delegated.GetBaseID())
+	getDarc := func(s string, latest bool) *Darc {
+		if s == dID.String() {
+			return delegated
+		}
+		return nil
+	}
+	expr := expression.Expr(a.String() + " & " + dID.String())
+
+	tr, err := ExplainExpr(expr, getDarc, nil, a.String())
+	require.Nil(t, err)
+	require.False(t, tr.Satisfied)
+	require.Equal(t, dID.String()+" -> "+b.String()+" [no signature]", tr.FailedBranch())
+	require.Nil(t, EvalExpr(expr, getDarc, a.String(), b.String()))
+	tr, err = ExplainExpr(expr, getDarc, nil, a.String(), b.String())
+	require.Nil(t, err)
+	require.True(t, tr.Satisfied)
+
+	tr, err = ExplainExpr(expr, nil, nil, a.String(), b.String())
+	require.Nil(t, err)
+	require.Equal(t, dID.String()+" [darc not available]", tr.FailedBranch())
+}
+
+func TestExplainExpr_Errors(t *testing.T) {
+	a := createIdentity()
+	attr := "attr:before_block:x"
+	expr := expression.Expr(a.String() + " | " + attr)
+
+	// The attribute cannot be evaluated, so the rule fails even if a signed.
+	require.NotNil(t, EvalExprAttrs(expr, nil, BlockAttrs(1, 0), a.String()))
+	tr, err := ExplainExpr(expr, nil, BlockAttrs(1, 0), a.String())
+	require.Nil(t, err)
+	require.False(t, tr.Satisfied)
+	require.True(t, tr.Children[0].Satisfied)
+	require.Contains(t, tr.FailedBranch(), attr+" [")
+
+	// A darc delegating to itself is only a branch that is not satisfied.
+	cyclic := NewDarc(InitRules([]Identity{a}, []Identity{a}), []byte("cyclic"))
+	cID := NewIdentityDarc(cyclic.GetBaseID())
+	require.Nil(t, cyclic.Rules.UpdateSign(expression.Expr(cID.String())))
+	getDarc := func(s string, latest bool) *Darc {
+		if s == cID.String() {
+			return cyclic
+		}
+		return nil
+	}
+	expr = expression.Expr(a.String() + " | " + cID.String())
+	require.Nil(t, EvalExpr(expr, getDarc, a.String()))
+	b := createIdentity()
+	require.IsType(t, &DelegationError{}, EvalExpr(expr, getDarc, b.String()))
+	tr, err = ExplainExpr(expr, getDarc, nil, b.String())
+	require.Nil(t, err)
+	require.False(t, tr.Satisfied)
+	require.Contains(t, tr.FailedBranch(), "delegation cycle")
+}
@@ -3,17 +3,24 @@ Package expression contains the definition and implementation of a simple
 language for defining complex policies. We define the language in extended-BNF notation,
 the syntax we use is from: https://en.wikipedia.org/wiki/Extended_Backus%E2%80%93Naur_form
 
-	expr = term, [ '&', term ]*
-	term = factor, [ '|', factor ]*
-	factor = '(', expr, ')' | id | openid
-	typeHex = (darc|ed25519|x509ec):[0-9a-fA-F]
+	expr = factor, [ ( '&' | '|' ), factor ]*
+	factor = '(', expr, ')' | id | proxy | threshold | attr
+	typeHex = (darc|ed25519|x509ec|ecdsa):[0-9a-fA-F]
     proxy = proxy:ed25519-pubkey:associated_data
+	threshold = 'threshold<', k, ':', n, '>(', typeHex, [ ',', typeHex ]*, ')'
+	attr = attr:[a-zA-Z_]+:value
 
 Examples:
 
     ed25519:deadbeef // every id evaluates to a boolean
 	(ed25519:a & x509ec:b) | (darc:c & ed25519:d)
 
+The operators '&' and '|' have the same precedence and are evaluated from left
+to right, so ed25519:a | ed25519:b & ed25519:c is the same as
+(ed25519:a | ed25519:b) & ed25519:c. As this is easy to get wrong, Validate
+rejects expressions that mix both operators without parentheses, and tools
+should call it before they store a new expression.
+
 In the simplest case, the evaluation of an expression is performed against a
 set of valid ids.  Suppose we have the expression (a:a & b:b) | (c:c & d:d),
 and the set of valid ids is [a:a, b:b], then the expression will evaluate to
@@ -21,9 +28,17 @@ true.  If the set of valid ids is [a:a, c:c], then the expression will evaluate
 to false. However, the user is able to provide a ValueCheckFn to customise how
 the expressions are evaluated.
 
-EXTENSION - NOT YET IMPLEMENTED:
-To support threshold signatures, we extend the syntax to include the following.
-	thexpr = '[', id, [ ',', id ]*, ']', '/', digit
+A threshold evaluates to true if at least k of its n ids evaluate to true. It
+must list exactly n different ids, and k must be between 1 and n. For example,
+threshold<2:3>(ed25519:a, ed25519:b, ed25519:c) evaluates to true with the
+set of valid ids [ed25519:a, ed25519:c].
+
+An attribute, for example attr:before_block:100000, is not an identity but a
+condition. It is passed to the ValueCheckFn like an id, which decides how to
+evaluate it.
+
+If an expression cannot be parsed, the error is a *ParseError, which holds the
+byte offset of the unexpected token.
 */
 package expression
 
@@ -36,10 +51,31 @@ import (
 )
 
 var (
-	errScannerNotEmpty = errors.New("parsing failed - scanner is not empty")
-	errFailedToCast    = errors.New("evauluation failed - result is not bool")
+	errFailedToCast = errors.New("evauluation failed - result is not bool")
 )
 
+// ParseError is returned if an expression cannot be parsed.
+type ParseError struct {
+	// Offset is the byte offset of the unexpected token.
+	Offset int
+	// Token is the unexpected token. It is empty if the expression ended
+	// too early.
+	Token string
+	// Reason explains why the token is not allowed, if it is a valid token.
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	msg := "unexpected end of expression"
+	if e.Token != "" {
+		msg = fmt.Sprintf("unexpected '%s'", e.Token)
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return fmt.Sprintf("parsing failed at offset %d: %s", e.Offset, msg)
+}
+
 // ValueCheckFn is a function that will be called when the parser is
 // parsing/evaluating an expression.
 type ValueCheckFn func(string) bool
@@ -47,17 +83,38 @@ type ValueCheckFn func(string) bool
 // Expr represents the unprocess expression of our DSL.
 type Expr []byte
 
+// leafFn evaluates an id or an attribute to a bool, or to a *Trace.
+type leafFn func(string) parsec.ParsecNode
+
+func boolLeaf(fn ValueCheckFn) leafFn {
+	return func(s string) parsec.ParsecNode {
+		return fn(s)
+	}
+}
+
 // InitParser creates the root parser
 func InitParser(fn ValueCheckFn) parsec.Parser {
+	return initParser(boolLeaf(fn), false, nil)
+}
+
+// initParser creates the root parser. If strict is set, mixing '&' and '|'
+// without parentheses is an error. If furthest is not nil, it is set to the
+// end of the last token that could be parsed.
+func initParser(leaf leafFn, strict bool, furthest *int) parsec.Parser {
 	// Y is root Parser, usually called as `s` in CFG theory.
 	var Y parsec.Parser
 	var sum, value parsec.Parser // circular rats
 
 	// Terminal rats
-	var openparan = parsec.Token(`\(`, "OPENPARAN")
-	var closeparan = parsec.Token(`\)`, "CLOSEPARAN")
-	var andop = parsec.Token(`&`, "AND")
-	var orop = parsec.Token(`\|`, "OR")
+	var openparan = token(`\(`, "OPENPARAN", furthest)
+	var closeparan = token(`\)`, "CLOSEPARAN", furthest)
+	var andop = token(`&`, "AND", furthest)
+	var orop = token(`\|`, "OR", furthest)
+	var thresholdop = token(`threshold<[0-9]+:[0-9]+>`, "THRESHOLD", furthest)
+	var comma = token(`,`, "COMMA", furthest)
+	var typeHex = token(`(darc|ed25519|x509ec|ecdsa):[0-9a-fA-F]+`, "HEX", furthest)
+	var proxy = token(`proxy:[0-9a-fA-F]+:[^ \n\t]*`, "PROXY", furthest)
+	var attr = token(`attr:[a-zA-Z_]+:[^ \n\t()&|,]+`, "ATTR", furthest)
 
 	// NonTerminal rats
 	// andop -> "&" |  "|"
@@ -66,14 +123,18 @@ func InitParser(fn ValueCheckFn) parsec.Parser {
 	// value -> "(" expr ")"
 	var groupExpr = parsec.And(exprNode, openparan, &sum, closeparan)
 
+	// threshold -> "threshold<k:n>" "(" id ("," id)* ")"
+	var thresholdExpr = parsec.And(thresholdNode(leaf), thresholdop, openparan,
+		parsec.Many(nil, typeHex, comma), closeparan)
+
 	// (andop prod)*
 	var prodK = parsec.Kleene(nil, parsec.And(many2many, sumOp, &value), nil)
 
 	// Circular rats come to life
 	// sum -> prod (andop prod)*
-	sum = parsec.And(sumNode(fn), &value, prodK)
-	// value -> id | "(" expr ")"
-	value = parsec.OrdChoice(exprValueNode(fn), typeHex(), proxy(), groupExpr)
+	sum = parsec.And(sumNode(strict), &value, prodK)
+	// value -> id | "(" expr ")" | threshold
+	value = parsec.OrdChoice(exprValueNode(leaf), typeHex, proxy, attr, groupExpr, thresholdExpr)
 	// expr  -> sum
 	Y = parsec.OrdChoice(one2one, sum)
 	return Y
@@ -85,9 +146,11 @@ func InitParser(fn ValueCheckFn) parsec.Parser {
 func Evaluate(parser parsec.Parser, expr Expr) (bool, error) {
 	v, s := parser(parsec.NewScanner(expr))
 	_, s = s.SkipWS()
-	if !s.Endof() {
-		rest, _ := s.Match(".*")
-		return false, fmt.Errorf("%v: (rest = %v)", errScannerNotEmpty, string(rest))
+	if v == nil || !s.Endof() {
+		return false, locateError(expr)
+	}
+	if err, ok := v.(error); ok {
+		return false, err
 	}
 	vv, ok := v.(bool)
 	if !ok {
@@ -96,6 +159,31 @@ func Evaluate(parser parsec.Parser, expr Expr) (bool, error) {
 	return vv, nil
 }
 
+// Validate makes sure that expr can be parsed. Additionally to Evaluate, it
+// refuses expressions that mix '&' and '|' without parentheses.
+func Validate(expr Expr) error {
+	_, err := Evaluate(initParser(boolLeaf(acceptAll), true, nil), expr)
+	return err
+}
+
+// locateError parses expr again to find the first token that cannot be
+// parsed.
+func locateError(expr Expr) error {
+	var furthest int
+	parser := initParser(boolLeaf(acceptAll), false, &furthest)
+	parser(parsec.NewScanner(expr))
+	offset := furthest
+	for offset < len(expr) && strings.ContainsRune(" \n\t", rune(expr[offset])) {
+		offset++
+	}
+	tok, _ := parsec.NewScanner(expr[offset:]).Match(`^([()&|,]|[^ \n\t()&|,]+)`)
+	return &ParseError{Offset: offset, Token: string(tok)}
+}
+
+func acceptAll(string) bool {
+	return true
+}
+
 // DefaultParser creates a parser and evaluates the expression expr, every id
 // in pks will evaluate to true.
 func DefaultParser(expr Expr, ids ...string) (bool, error) {
@@ -121,32 +209,46 @@ func InitOrExpr(ids ...string) Expr {
 	return Expr(strings.Join(ids, " | "))
 }
 
-// Accepts tokens of the form "type:HEX"
-func typeHex() parsec.Parser {
+// token accepts the tokens matching pattern, after skipping whitespace. If
+// furthest is not nil, it records the end of the furthest token it accepted.
+func token(pattern, name string, furthest *int) parsec.Parser {
+	p := parsec.Token(pattern, name)
 	return func(s parsec.Scanner) (parsec.ParsecNode, parsec.Scanner) {
 		_, s = s.SkipAny(`^[ \n\t]+`)
-		p := parsec.Token(`(darc|ed25519|x509ec):[0-9a-fA-F]+`, "HEX")
-		return p(s)
-	}
-}
-
-// Accepts tokens of the form "proxy:edd25519-pubkey:associate_data"
-func proxy() parsec.Parser {
-	return func(s parsec.Scanner) (parsec.ParsecNode, parsec.Scanner) {
-		_, s = s.SkipAny(`^[ \n\t]+`)
-		p := parsec.Token(`proxy:[0-9a-fA-F]+:[^ \n\t]*`, "PROXY")
-		return p(s)
+		n, s := p(s)
+		if n != nil && furthest != nil && s.GetCursor() > *furthest {
+			*furthest = s.GetCursor()
+		}
+		return n, s
 	}
 }
 
-func sumNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+func sumNode(strict bool) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
 		if len(ns) > 0 {
+			// Errors of thresholds are passed on.
+			if err, ok := ns[0].(error); ok {
+				return err
+			}
+			if _, ok := ns[0].(*Trace); ok {
+				return traceSum(ns)
+			}
 			val := ns[0].(bool)
+			var first *parsec.Terminal
 			for _, x := range ns[1].([]parsec.ParsecNode) {
 				y := x.([]parsec.ParsecNode)
+				if err, ok := y[1].(error); ok {
+					return err
+				}
 				n := y[1].(bool)
-				switch y[0].(*parsec.Terminal).Name {
+				op := y[0].(*parsec.Terminal)
+				if first == nil {
+					first = op
+				} else if strict && op.Name != first.Name {
+					return &ParseError{Offset: op.Position, Token: op.Value,
+						Reason: "use parentheses to mix '&' and '|'"}
+				}
+				switch op.Name {
 				case "AND":
 					val = val && n
 				case "OR":
@@ -159,12 +261,57 @@ func sumNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	}
 }
 
-func exprValueNode(fn ValueCheckFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+// thresholdNode counts the ids that evaluate to true. It returns an error if
+// the parameters of the threshold are invalid.
+func thresholdNode(leaf leafFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
+	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
+		if len(ns) != 4 {
+			return nil
+		}
+		var k, n int
+		params := ns[0].(*parsec.Terminal).Value
+		if _, err := fmt.Sscanf(params, "threshold<%d:%d>", &k, &n); err != nil {
+			return fmt.Errorf("invalid threshold '%s': %v", params, err)
+		}
+		ids := ns[2].([]parsec.ParsecNode)
+		if k < 1 || k > n {
+			return fmt.Errorf("invalid threshold '%s': k must be between 1 and n", params)
+		}
+		if len(ids) != n {
+			return fmt.Errorf("invalid threshold '%s': got %d ids instead of %d",
+				params, len(ids), n)
+		}
+		seen := make(map[string]bool)
+		count := 0
+		var children []*Trace
+		for _, id := range ids {
+			v := id.(*parsec.Terminal).Value
+			if seen[v] {
+				return fmt.Errorf("invalid threshold '%s': duplicate id %s", params, v)
+			}
+			seen[v] = true
+			res := leaf(v)
+			if t, ok := res.(*Trace); ok {
+				children = append(children, t)
+				res = t.Satisfied
+			}
+			if res.(bool) {
+				count++
+			}
+		}
+		if children != nil {
+			return &Trace{Op: params, Satisfied: count >= k, Children: children}
+		}
+		return count >= k
+	}
+}
+
+func exprValueNode(leaf leafFn) func(ns []parsec.ParsecNode) parsec.ParsecNode {
 	return func(ns []parsec.ParsecNode) parsec.ParsecNode {
 		if len(ns) == 0 {
 			return nil
 		} else if term, ok := ns[0].(*parsec.Terminal); ok {
-			return fn(term.Value)
+			return leaf(term.Value)
 		}
 		return ns[0]
 	}
@@ -87,8 +87,8 @@ func TestParsing_InvalidID_1(t *testing.T) {
 	if err == nil {
 		t.Fatal("expect an error")
 	}
-	if !strings.HasPrefix(err.Error(), errScannerNotEmpty.Error()) {
-		t.Fatalf("wrong error message, got %v", err.Error())
+	if perr, ok := err.(*ParseError); !ok || perr.Offset != 0 || perr.Token != "x" {
+		t.Fatalf("wrong error, got %v", err)
 	}
 }
 
@@ -106,8 +106,8 @@ func TestParsing_InvalidOp(t *testing.T) {
 	if err == nil {
 		t.Fatal("expect an error")
 	}
-	if !strings.HasPrefix(err.Error(), errScannerNotEmpty.Error()) {
-		t.Fatalf("wrong error message, got %s", err.Error())
+	if perr, ok := err.(*ParseError); !ok || perr.Offset != 12 || perr.Token != "/" {
+		t.Fatalf("wrong error, got %v", err)
 	}
 }
 
@@ -218,3 +218,278 @@ func TestEval_DefaultParser(t *testing.T) {
 		t.Fatal("evaluation should return false")
 	}
 }
+
+func TestParsing_Threshold(t *testing.T) {
+	expr := []byte("threshold<2:3>(ed25519:a, ed25519:b, ed25519:c)")
+	validFn := func(valid ...string) ValueCheckFn {
+		return func(s string) bool {
+			for _, v := range valid {
+				if s == v {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	// Exactly k valid ids.
+	x, err := Evaluate(InitParser(validFn("ed25519:a", "ed25519:c")), expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != true {
+		t.Fatal("wrong result")
+	}
+
+	// k-1 valid ids.
+	x, err = Evaluate(InitParser(validFn("ed25519:b")), expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != false {
+		t.Fatal("wrong result")
+	}
+
+	// Nested in an or.
+	expr = []byte("ed25519:d | threshold<2:3>(ed25519:a,ed25519:b,ed25519:c)")
+	x, err = Evaluate(InitParser(validFn("ed25519:a", "ed25519:b")), expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != true {
+		t.Fatal("wrong result")
+	}
+	x, err = Evaluate(InitParser(validFn("ed25519:a")), expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != false {
+		t.Fatal("wrong result")
+	}
+	x, err = Evaluate(InitParser(validFn("ed25519:d")), expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != true {
+		t.Fatal("wrong result")
+	}
+}
+
+func TestParsing_ThresholdInvalid(t *testing.T) {
+	for expr, msg := range map[string]string{
+		"threshold<3:2>(ed25519:a, ed25519:b)":             "k must be between 1 and n",
+		"threshold<0:2>(ed25519:a, ed25519:b)":             "k must be between 1 and n",
+		"threshold<1:2>(ed25519:a, ed25519:a)":             "duplicate id ed25519:a",
+		"threshold<1:3>(ed25519:a, ed25519:b)":             "got 2 ids instead of 3",
+		"ed25519:c & threshold<2:1>(ed25519:a)":            "k must be between 1 and n",
+		"ed25519:c | threshold<1:1>(ed25519:a, ed25519:b)": "got 2 ids instead of 1",
+	} {
+		_, err := Evaluate(InitParser(trueFn), []byte(expr))
+		if err == nil {
+			t.Fatalf("expected an error for %s", expr)
+		}
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("wrong error message for %s, got %s", expr, err.Error())
+		}
+	}
+}
+
+func TestParsing_Attr(t *testing.T) {
+	var attrs []string
+	fn := func(s string) bool {
+		if strings.HasPrefix(s, "attr:") {
+			attrs = append(attrs, s)
+			return true
+		}
+		return s == "ed25519:a"
+	}
+	expr := []byte("ed25519:a & (attr:before_block:100000|attr:after_time:2025-01-01)")
+	x, err := Evaluate(InitParser(fn), expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x != true {
+		t.Fatal("wrong result")
+	}
+	if len(attrs) != 2 || attrs[0] != "attr:before_block:100000" ||
+		attrs[1] != "attr:after_time:2025-01-01" {
+		t.Fatalf("wrong attributes: %v", attrs)
+	}
+
+	_, err = Evaluate(InitParser(fn), []byte("attr:before_block"))
+	if err == nil {
+		t.Fatal("an attribute without value should fail")
+	}
+}
+
+func TestParsing_Corpus(t *testing.T) {
+	// Expressions as they are stored today must keep their meaning: '&'
+	// and '|' are evaluated from left to right.
+	valid := map[string]bool{"ed25519:a": true, "ed25519:b": true, "darc:d": true,
+		"attr:before_block:10": true}
+	fn := func(s string) bool { return valid[s] }
+	for expr, res := range map[string]bool{
+		"ed25519:a":                                                true,
+		"ed25519:c":                                                false,
+		"ed25519:a & ed25519:b":                                    true,
+		"ed25519:a & ed25519:c":                                    false,
+		"ed25519:c | ed25519:b":                                    true,
+		"ed25519:a | ed25519:c & ed25519:e":                        false,
+		"ed25519:c & ed25519:e | ed25519:a":                        true,
+		"ed25519:a | (ed25519:c & ed25519:e)":                      true,
+		"(ed25519:a & x509ec:c) | (darc:d & ed25519:b)":            true,
+		"ed25519:c|ed25519:e|darc:d":                               true,
+		"  ed25519:a&\ted25519:b\n":                                true,
+		"proxy:0a:user@example.com | ed25519:b":                    true,
+		"threshold<2:3>(ed25519:a, ed25519:c, ed25519:b)":          true,
+		"ed25519:a & attr:before_block:10":                         true,
+		"ed25519:a & (attr:after_block:10 | ed25519:c)":            false,
+		"((ed25519:a))":                                            true,
+		"ed25519:c | (ed25519:e | (darc:d & (ed25519:a)))":         true,
+		"(ed25519:a | ed25519:c) & (ed25519:e | ed25519:c)":        false,
+		"ed25519:a & (ed25519:c | (ed25519:e & ed25519:b))":        false,
+		"(ed25519:c | ed25519:b) & ((ed25519:e) | darc:d)":         true,
+		"x509ec:0123456789abcdef & ed25519:a | ed25519:b":          true,
+		"ecdsa:02ab | x509ec:cd":                                   false,
+		"darc:d & threshold<1:2>(ed25519:c, darc:d) & (ed25519:a)": true,
+	} {
+		x, err := Evaluate(InitParser(fn), []byte(expr))
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if x != res {
+			t.Fatalf("%s: got %v instead of %v", expr, x, res)
+		}
+	}
+}
+
+func TestParsing_ErrorPosition(t *testing.T) {
+	for expr, exp := range map[string]ParseError{
+		"":                                    {Offset: 0},
+		"   ":                                 {Offset: 3},
+		"ed25519:a &":                         {Offset: 11},
+		"ed25519:a & ":                        {Offset: 12},
+		"ed25519:a & & ed25519:b":             {Offset: 12, Token: "&"},
+		"ed25519:a ed25519:b":                 {Offset: 10, Token: "ed25519:b"},
+		"(ed25519:a | ed25519:b":              {Offset: 22},
+		"(ed25519:a | (ed25519:b & foo:c))":   {Offset: 26, Token: "foo:c"},
+		"(ed25519:b | ed25519:c) )":           {Offset: 24, Token: ")"},
+		"ed25519:a | ()":                      {Offset: 13, Token: ")"},
+		"threshold<1:2>(ed25519:a ed25519:b)": {Offset: 25, Token: "ed25519:b"},
+		"threshold<1:2>(, ed25519:a)":         {Offset: 15, Token: ","},
+		"ed25519:a | attr:before_block":       {Offset: 12, Token: "attr:before_block"},
+	} {
+		_, err := Evaluate(InitParser(trueFn), []byte(expr))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("%s: expected a parse error, got %v", expr, err)
+		}
+		if *perr != exp {
+			t.Fatalf("%s: got %+v instead of %+v", expr, *perr, exp)
+		}
+	}
+
+	err := &ParseError{Offset: 12, Token: "&"}
+	if err.Error() != "parsing failed at offset 12: unexpected '&'" {
+		t.Fatal("wrong message:", err.Error())
+	}
+	err = &ParseError{Offset: 11}
+	if err.Error() != "parsing failed at offset 11: unexpected end of expression" {
+		t.Fatal("wrong message:", err.Error())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, expr := range []string{
+		"ed25519:a",
+		"ed25519:a & ed25519:b & darc:c",
+		"ed25519:a | ed25519:b | darc:c",
+		"(ed25519:a & ed25519:b) | darc:c",
+		"ed25519:a & (ed25519:b | (darc:c & ed25519:d))",
+		"threshold<1:2>(ed25519:a, ed25519:b) | attr:before_block:10",
+	} {
+		if err := Validate([]byte(expr)); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+	}
+
+	for expr, exp := range map[string]ParseError{
+		"ed25519:a | ed25519:b & darc:c":            {Offset: 22, Token: "&"},
+		"(ed25519:a & ed25519:b | darc:c)":          {Offset: 23, Token: "|"},
+		"darc:c & (ed25519:a | ed25519:b & darc:c)": {Offset: 32, Token: "&"},
+	} {
+		err := Validate([]byte(expr))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("%s: expected a parse error, got %v", expr, err)
+		}
+		if perr.Offset != exp.Offset || perr.Token != exp.Token || perr.Reason == "" {
+			t.Fatalf("%s: got %+v", expr, *perr)
+		}
+	}
+
+	if err := Validate([]byte("ed25519:a &")); err == nil {
+		t.Fatal("an invalid expression should fail")
+	}
+	if err := Validate([]byte("threshold<3:2>(ed25519:a, ed25519:b)")); err == nil {
+		t.Fatal("an invalid threshold should fail")
+	}
+}
+
+func TestEvaluateTrace(t *testing.T) {
+	valid := map[string]bool{"ed25519:a": true, "ed25519:d": true}
+	fn := func(s string) *Trace {
+		return &Trace{Satisfied: valid[s]}
+	}
+
+	tr, err := EvaluateTrace([]byte("ed25519:a & (ed25519:b | ed25519:c) & ed25519:d"), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Satisfied || tr.Op != "&" || len(tr.Children) != 3 {
+		t.Fatalf("wrong trace: %+v", tr)
+	}
+	or := tr.Children[1]
+	if or.Satisfied || or.Op != "|" || len(or.Children) != 2 || or.Children[0].ID != "ed25519:b" {
+		t.Fatalf("wrong trace: %+v", or)
+	}
+	if tr.String() != "ed25519:a+ & (ed25519:b- | ed25519:c-) & ed25519:d+" {
+		t.Fatal("wrong rendering:", tr.String())
+	}
+	if tr.FailedBranch() != "ed25519:b | ed25519:c" {
+		t.Fatal("wrong failed branch:", tr.FailedBranch())
+	}
+
+	// The trace agrees with Evaluate, also for mixed operators.
+	for _, expr := range []string{
+		"ed25519:a | ed25519:b & ed25519:c",
+		"ed25519:b & ed25519:c | ed25519:a",
+		"threshold<2:3>(ed25519:a, ed25519:b, ed25519:d) & (ed25519:c | ed25519:d)",
+		"(ed25519:b | (ed25519:c & ed25519:a))",
+	} {
+		tr, err := EvaluateTrace([]byte(expr), fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := Evaluate(InitParser(func(s string) bool { return valid[s] }), []byte(expr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.Satisfied != res {
+			t.Fatalf("%s: trace is %v instead of %v", expr, tr.Satisfied, res)
+		}
+	}
+
+	tr, err = EvaluateTrace([]byte("threshold<2:3>(ed25519:a, ed25519:b, ed25519:c)"), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.FailedBranch() != "threshold<2:3>(ed25519:b, ed25519:c)" {
+		t.Fatal("wrong failed branch:", tr.FailedBranch())
+	}
+
+	_, err = EvaluateTrace([]byte("ed25519:a &"), fn)
+	if _, ok := err.(*ParseError); !ok {
+		t.Fatal("expected a parse error, got", err)
+	}
+}
@@ -0,0 +1,155 @@
+package expression
+
+import (
+	"fmt"
+	"strings"
+
+	parsec "github.com/prataprc/goparsec"
+)
+
+// Trace is the result of the evaluation of one node of an expression. The
+// operators and thresholds have the traces of their operands as children,
+// the ids and attributes are the leaves.
+type Trace struct {
+	// Op is "&", "|" or the threshold, like "threshold<2:3>". It is empty
+	// for a leaf.
+	Op string
+	// ID is the id or the attribute of a leaf.
+	ID        string
+	Satisfied bool
+	// Detail explains the result of a leaf, for example that there is no
+	// signature for the id.
+	Detail string
+	// Children holds the operands. A leaf can have children, for example
+	// the trace of a delegated darc.
+	Children []*Trace
+}
+
+// TraceFn returns the trace of an id or an attribute of an expression. The
+// ID of the trace is set by EvaluateTrace.
+type TraceFn func(id string) *Trace
+
+// EvaluateTrace evaluates expr like Evaluate, but returns the trace of the
+// evaluation. Consecutive operands of the same operator are children of the
+// same node.
+func EvaluateTrace(expr Expr, fn TraceFn) (*Trace, error) {
+	leaf := func(s string) parsec.ParsecNode {
+		t := fn(s)
+		t.ID = s
+		return t
+	}
+	v, s := initParser(leaf, false, nil)(parsec.NewScanner(expr))
+	_, s = s.SkipWS()
+	if v == nil || !s.Endof() {
+		return nil, locateError(expr)
+	}
+	if err, ok := v.(error); ok {
+		return nil, err
+	}
+	t, ok := v.(*Trace)
+	if !ok {
+		return nil, errFailedToCast
+	}
+	return t, nil
+}
+
+// traceSum is the equivalent of sumNode for traces.
+func traceSum(ns []parsec.ParsecNode) parsec.ParsecNode {
+	val := ns[0].(*Trace)
+	var node *Trace
+	for _, x := range ns[1].([]parsec.ParsecNode) {
+		y := x.([]parsec.ParsecNode)
+		if err, ok := y[1].(error); ok {
+			return err
+		}
+		n := y[1].(*Trace)
+		op := y[0].(*parsec.Terminal).Value
+		if node == nil || node.Op != op {
+			node = &Trace{Op: op, Satisfied: val.Satisfied, Children: []*Trace{val}}
+		}
+		node.Children = append(node.Children, n)
+		if op == "&" {
+			node.Satisfied = node.Satisfied && n.Satisfied
+		} else {
+			node.Satisfied = node.Satisfied || n.Satisfied
+		}
+		val = node
+	}
+	return val
+}
+
+// String returns the whole trace on one line, every id, attribute and
+// threshold is followed by + if it is satisfied and by - if it is not.
+func (t *Trace) String() string {
+	return t.render(false)
+}
+
+// FailedBranch returns the part of the trace that made the expression fail
+// on one line: the operands of an operator that are satisfied are left out,
+// and the leaves are followed by their detail. It is empty if the expression
+// is satisfied.
+func (t *Trace) FailedBranch() string {
+	if t.Satisfied {
+		return ""
+	}
+	return t.render(true)
+}
+
+func (t *Trace) render(failed bool) string {
+	mark := "-"
+	if t.Satisfied {
+		mark = "+"
+	}
+	var children []string
+	var operators []bool
+	for _, c := range t.Children {
+		if failed && c.Satisfied {
+			continue
+		}
+		children = append(children, c.render(failed))
+		operators = append(operators, (c.Op == "&" || c.Op == "|") &&
+			(!failed || len(c.failedChildren()) > 1))
+	}
+	// Operators only need parentheses if they are not alone, or if they
+	// belong to a delegation.
+	if len(children) > 1 || t.Op == "" {
+		for i := range children {
+			if operators[i] {
+				children[i] = "(" + children[i] + ")"
+			}
+		}
+	}
+
+	if t.Op == "" {
+		s := t.ID
+		if failed {
+			if t.Detail != "" {
+				s += " [" + t.Detail + "]"
+			}
+		} else {
+			s += mark
+		}
+		if len(children) > 0 {
+			s += " -> " + strings.Join(children, ", ")
+		}
+		return s
+	}
+	if strings.HasPrefix(t.Op, "threshold") {
+		s := t.Op + "(" + strings.Join(children, ", ") + ")"
+		if !failed {
+			s += mark
+		}
+		return s
+	}
+	return strings.Join(children, fmt.Sprintf(" %s ", t.Op))
+}
+
+func (t *Trace) failedChildren() []*Trace {
+	var res []*Trace
+	for _, c := range t.Children {
+		if !c.Satisfied {
+			res = append(res, c)
+		}
+	}
+	return res
+}
@@ -8,7 +8,7 @@ import (
 
 func init() {
 	network.RegisterMessages(
-		Darc{}, Identity{}, Signature{},
+		Darc{}, Identity{}, Signature{}, Signer{},
 	)
 }
 
@@ -53,8 +53,8 @@ type Darc struct {
 	VerificationDarcs []*Darc
 }
 
-// Identity is a generic structure can be either an Ed25519 public key, a Darc
-// or a X509 Identity.
+// Identity is a generic structure can be either an Ed25519 public key, a Darc,
+// a X509 Identity or a secp256k1 public key.
 type Identity struct {
 	// Darc identity
 	Darc *IdentityDarc
@@ -64,6 +64,8 @@ type Identity struct {
 	X509EC *IdentityX509EC
 	// A claim which has been signed by a proxy or proxies.
 	Proxy *IdentityProxy
+	// Public-key identity on the secp256k1 curve.
+	ECDSA *IdentityECDSA
 }
 
 // IdentityEd25519 holds a Ed25519 public key (Point)
@@ -83,6 +85,12 @@ type IdentityProxy struct {
 	Public kyber.Point
 }
 
+// IdentityECDSA holds a compressed secp256k1 public key, as used by Bitcoin
+// and Ethereum.
+type IdentityECDSA struct {
+	Public []byte
+}
+
 // IdentityDarc is a structure that points to a Darc with a given ID on a
 // skipchain. The signer should belong to the Darc.
 type IdentityDarc struct {
@@ -104,12 +112,15 @@ type Signer struct {
 	Ed25519 *SignerEd25519
 	X509EC  *SignerX509EC
 	Proxy   *SignerProxy
+	ECDSA   *SignerECDSA
 }
 
-// SignerEd25519 holds a public and private keys necessary to sign Darcs
+// SignerEd25519 holds a public and private keys necessary to sign Darcs,
+// or a backend holding the private key.
 type SignerEd25519 struct {
-	Point  kyber.Point
-	Secret kyber.Scalar
+	Point   kyber.Point
+	Secret  kyber.Scalar
+	backend SignerBackend
 }
 
 // SignerX509EC holds a public and private keys necessary to sign Darcs,
@@ -127,6 +138,12 @@ type SignerProxy struct {
 	getSignature func([]byte) ([]byte, error)
 }
 
+// SignerECDSA holds a compressed secp256k1 public key and its private key.
+type SignerECDSA struct {
+	Point  []byte
+	Secret []byte
+}
+
 // Request is the structure that the client must provide to be verified
 type Request struct {
 	BaseID     ID
@@ -0,0 +1,205 @@
+package main
+
+/*
+The simulation runs the Pedersen DKG of the dkg/pedersen package, unmodified,
+on a tree where the root is connected to all other nodes. Every node
+intercepts the messages of the DKG before they are handed to the protocol,
+which allows to delay them and to drop some of them. The root also uses the
+intercepted messages to measure the duration of the phases of the DKG:
+
+ - init: the root collects the public keys of all nodes
+ - deal: the root receives the deals of all other nodes
+ - response: the responses are exchanged until the root is certified
+
+A round that does not finish within Timeout counts as failed. The
+"success" measure is 1 for a successful round and 0 for a failed one, so
+that its average is the success rate.
+*/
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority/dkg/pedersen"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+func init() {
+	onet.SimulationRegister("PedersenDKG", NewSimulationDKG)
+}
+
+// SimulationDKG implements onet.Simulation.
+type SimulationDKG struct {
+	onet.SimulationBFTree
+	// Threshold of the DKG. If it is 0, the default threshold of the
+	// protocol is used.
+	Threshold int
+	// Delay in milliseconds added to every DKG message a node receives.
+	Delay int
+	// Loss is the percentage of DKG messages dropped by the receiver.
+	Loss int
+	// Timeout after which a round counts as failed, like "1m".
+	Timeout string
+
+	phases *phases
+}
+
+// NewSimulationDKG is used internally to register the simulation (see the
+// init() function above).
+func NewSimulationDKG(config string) (onet.Simulation, error) {
+	s := &SimulationDKG{}
+	_, err := toml.Decode(config, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Setup implements onet.Simulation. The DKG sends its messages directly to
+// all nodes, so the tree has all nodes as children of the root.
+func (s *SimulationDKG) Setup(dir string, hosts []string) (*onet.SimulationConfig, error) {
+	sc := &onet.SimulationConfig{}
+	s.CreateRoster(sc, hosts, 2000)
+	s.BF = s.Hosts - 1
+	err := s.CreateTree(sc)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Node implements onet.Simulation. It registers the interception of the DKG
+// messages before loading the roster and the tree.
+func (s *SimulationDKG) Node(config *onet.SimulationConfig) error {
+	index, _ := config.Roster.Search(config.Server.ServerIdentity.ID)
+	if index < 0 {
+		log.Fatal("Didn't find this node in roster")
+	}
+	if config.Tree.Root.ServerIdentity.ID.Equal(config.Server.ServerIdentity.ID) {
+		s.phases = &phases{}
+	}
+	delay := time.Duration(s.Delay) * time.Millisecond
+
+	config.Server.RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {
+		_, msg, err := network.Unmarshal(e.Msg.(*onet.ProtocolMsg).MsgSlice, config.Server.Suite())
+		if err != nil {
+			log.Error("error while unmarshaling a message:", err)
+			return
+		}
+		switch msg.(type) {
+		case *pedersen.Init, *pedersen.InitReply, *pedersen.StartDeal, *pedersen.Deal,
+			*pedersen.Response, *pedersen.WaitSetup, *pedersen.WaitReply:
+		default:
+			config.Overlay.Process(e)
+			return
+		}
+		if s.Loss > 0 && rand.Intn(100) < s.Loss {
+			log.Lvl3("dropping DKG message from", e.ServerIdentity)
+			return
+		}
+		if s.phases != nil {
+			s.phases.received(msg)
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, func() { config.Overlay.Process(e) })
+			return
+		}
+		config.Overlay.Process(e)
+	})
+	log.Lvl3("Initializing node-index", index)
+	return s.SimulationBFTree.Node(config)
+}
+
+// Run implements onet.Simulation.
+func (s *SimulationDKG) Run(config *onet.SimulationConfig) error {
+	timeout := time.Minute
+	if s.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(s.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	if s.Threshold < 0 || s.Threshold > s.Hosts {
+		return errors.New("threshold must be between 0 and the number of hosts")
+	}
+	log.Lvl2("Size is:", config.Tree.Size(), "rounds:", s.Rounds)
+	for round := 0; round < s.Rounds; round++ {
+		log.Lvl1("Starting round", round)
+		s.phases.reset()
+		roundM := monitor.NewTimeMeasure("round")
+
+		pi, err := config.Overlay.CreateProtocol(pedersen.Name, config.Tree, onet.NilServiceID)
+		if err != nil {
+			return err
+		}
+		setup := pi.(*pedersen.Setup)
+		setup.Wait = true
+		if s.Threshold > 0 {
+			setup.Threshold = uint32(s.Threshold)
+		}
+		start := time.Now()
+		if err = pi.Start(); err != nil {
+			return err
+		}
+		select {
+		case <-setup.Finished:
+			roundM.Record()
+			s.phases.record(start, time.Now())
+			if _, err = setup.SharedSecret(); err != nil {
+				return err
+			}
+			monitor.RecordSingleMeasure("success", 1)
+		case <-time.After(timeout):
+			log.Warn("Round", round, "didn't finish in", timeout)
+			monitor.RecordSingleMeasure("success", 0)
+		}
+	}
+	return nil
+}
+
+// phases holds the time of the last message of every phase received by the
+// root.
+type phases struct {
+	sync.Mutex
+	init time.Time
+	deal time.Time
+}
+
+func (p *phases) reset() {
+	p.Lock()
+	defer p.Unlock()
+	p.init = time.Time{}
+	p.deal = time.Time{}
+}
+
+func (p *phases) received(msg interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	switch msg.(type) {
+	case *pedersen.InitReply:
+		p.init = time.Now()
+	case *pedersen.Deal:
+		p.deal = time.Now()
+	}
+}
+
+// record sends the durations of the phases of a round that went from start
+// to end to the monitor.
+func (p *phases) record(start, end time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	if p.init.IsZero() || p.deal.IsZero() {
+		log.Warn("Missing phases of the round")
+		return
+	}
+	monitor.RecordSingleMeasure("init", p.init.Sub(start).Seconds())
+	monitor.RecordSingleMeasure("deal", p.deal.Sub(p.init).Seconds())
+	monitor.RecordSingleMeasure("response", end.Sub(p.deal).Seconds())
+}
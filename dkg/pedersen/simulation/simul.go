@@ -0,0 +1,15 @@
+// This package contains the simulation of the Pedersen DKG and the code
+// needed to run it.
+//
+// Please see
+// https://github.com/dedis/cothority/blob/master/dkg/pedersen/simulation/README.md
+// for instruction on how to run the simulation.
+package main
+
+import (
+	"github.com/dedis/onet/simul"
+)
+
+func main() {
+	simul.Start()
+}
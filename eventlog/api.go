@@ -191,7 +191,7 @@ func (c *Client) Search(req *SearchRequest) (*SearchResponse, error) {
 	req.Instance = c.Instance
 
 	reply := &SearchResponse{}
-	if err := c.c.SendProtobuf(c.ByzCoin.Roster.List[0], req, reply); err != nil {
+	if err := c.c.SendProtobuf(c.ByzCoin.Roster().List[0], req, reply); err != nil {
 		return nil, err
 	}
 	return reply, nil
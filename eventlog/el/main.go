@@ -607,7 +607,7 @@ func load() (*openidCfg, error) {
 
 func (o *openidCfg) getSigners(cl *eventlog.Client) ([]darc.Signer, error) {
 	ts := o.Config.TokenSource(context.Background(), &o.Token)
-	r := cl.ByzCoin.Roster
+	r := cl.ByzCoin.Roster()
 	n := len(r.List)
 	T := threshold(n)
 
@@ -732,7 +732,7 @@ func getPublic(c *cli.Context, issuer string) (kyber.Point, error) {
 	client := onet.NewClient(cothority.Suite, authprox.ServiceName)
 
 	var resp authprox.EnrollmentsResponse
-	err = client.SendProtobuf(cl.ByzCoin.Roster.List[0], &authprox.EnrollmentsRequest{
+	err = client.SendProtobuf(cl.ByzCoin.Roster().List[0], &authprox.EnrollmentsRequest{
 		Types:   []string{"oidc"},
 		Issuers: []string{issuer},
 	}, &resp)
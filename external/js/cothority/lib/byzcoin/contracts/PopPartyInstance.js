@@ -1,6 +1,7 @@
 const root = require("../../protobuf").root;
 const Instance = require("../Instance");
 const Invoke = require("../Invoke");
+const Argument = require("../Argument");
 const Instruction = require("../Instruction");
 const ClientTransaction = require("../ClientTransaction");
 const crypto = require("crypto");
@@ -59,9 +60,31 @@ class PopPartyInstance {
     return new PopPartyInstance(bc, instanceId).update();
   }
 
+  /**
+   * Close the registration of the attendees. This needs to be done before
+   * the final statement can be stored.
+   *
+   * @param {Signer} signer - one of the organizer of the party
+   * @return {Promise}
+   */
+  freeze(signer) {
+    const inst = Instruction.createInvokeInstruction(
+      this._instanceId,
+      new Uint8Array(32),
+      0,
+      1,
+      new Invoke("freeze", [])
+    );
+    inst.signBy(this._instance.darcId, [signer]);
+    const clientTransaction = new ClientTransaction([inst]);
+
+    return this._bc.sendTransactionAndWait(clientTransaction, 10);
+  }
+
   /**
    * Store the final statement on the ledger. This happens after the
-   * party description has been published an the party finalized
+   * party description has been published an the party finalized and
+   * frozen.
    *
    * @param {Object} finalStatement - the final statement
    * @param {Signer} signer - one of the organizer of the party
@@ -71,11 +94,10 @@ class PopPartyInstance {
     const model = root.lookup("FinalStatement");
     const message = model.create(finalStatement);
     const marshal = model.encode(message).finish();
-    const invoke = Invoke.fromArgumentInfo(
-      "Finalize",
-      "FinalStatement",
-      marshal
-    );
+    const invoke = new Invoke("Finalize", [
+      new Argument("FinalStatement", marshal),
+      new Argument("Signature", finalStatement.signature)
+    ]);
     const inst = Instruction.createInvokeInstruction(
       this._instanceId,
       new Uint8Array(32),
@@ -53,6 +53,29 @@ type FtCosi struct {
 	subProtocolName string
 	verificationFn  VerificationFn
 	suite           cosi.Suite
+	refusals        *cosi.Mask
+	err             error
+}
+
+// errResponseTimeout is the error of a subprotocol that didn't get the
+// responses in time.
+var errResponseTimeout = errors.New("timeout while waiting for responses")
+
+// TimeoutError is returned when the protocol times out before gathering
+// enough commitments or responses. Other failures of the protocol are not
+// returned as a TimeoutError.
+type TimeoutError struct {
+	// Phase is either "commitment" or "response".
+	Phase string
+	// Commits is the number of nodes that committed in time.
+	Commits int
+	// Threshold is the number of commitments needed.
+	Threshold int
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out in the %s phase with %d/%d commits",
+		te.Phase, te.Commits, te.Threshold)
 }
 
 // CreateProtocolFunction is a function type which creates a new protocol
@@ -131,8 +154,7 @@ func (p *FtCosi) Dispatch() error {
 	nNodes := p.Tree().Size()
 	trees, err := genTrees(p.Tree().Roster, p.Tree().Root.RosterIndex, nNodes, p.NSubtrees)
 	if err != nil {
-		p.FinalSignature <- nil
-		return fmt.Errorf("error in tree generation: %s", err)
+		return p.fail(fmt.Errorf("error in tree generation: %s", err))
 	}
 
 	// if one node or threshold is one, sign without subprotocols
@@ -145,17 +167,15 @@ func (p *FtCosi) Dispatch() error {
 	for i, tree := range trees {
 		p.subProtocols[i], err = p.startSubProtocol(tree)
 		if err != nil {
-			p.FinalSignature <- nil
-			return err
+			return p.fail(err)
 		}
 	}
 	log.Lvl3(p.ServerIdentity().Address, "all protocols started")
 
 	// collect commitments
-	commitments, runningSubProtocols, err := p.collectCommitments(trees, p.subProtocols)
+	commitments, runningSubProtocols, refusals, err := p.collectCommitments(trees, p.subProtocols)
 	if err != nil {
-		p.FinalSignature <- nil
-		return err
+		return p.fail(err)
 	}
 
 	var secret kyber.Scalar
@@ -169,8 +189,7 @@ func (p *FtCosi) Dispatch() error {
 	}
 	if !verificationOk {
 		// root should not fail the verification otherwise it would not have started the protocol
-		p.FinalSignature <- nil
-		return fmt.Errorf("verification failed on root node")
+		return p.fail(fmt.Errorf("verification failed on root node"))
 	}
 
 	// add own commitment
@@ -178,25 +197,22 @@ func (p *FtCosi) Dispatch() error {
 	secret, personalCommitment = cosi.Commit(p.suite)
 	personalMask, err := cosi.NewMask(p.suite, p.publics, p.Public())
 	if err != nil {
-		p.FinalSignature <- nil
-		return err
+		return p.fail(err)
 	}
 	personalStructCommitment := StructCommitment{p.TreeNode(),
-		Commitment{personalCommitment, personalMask.Mask(), 0}}
+		Commitment{personalCommitment, personalMask.Mask(), 0, nil}}
 	commitments = append(commitments, personalStructCommitment)
 
 	// generate own aggregated commitment
 	commitment, finalMask, err := aggregateCommitments(p.suite, p.publics, commitments)
 	if err != nil {
-		p.FinalSignature <- nil
-		return err
+		return p.fail(err)
 	}
 
 	log.Lvl3("root-node generating global challenge")
 	cosiChallenge, err := cosi.Challenge(p.suite, commitment, finalMask.AggregatePublic, p.Msg)
 	if err != nil {
-		p.FinalSignature <- nil
-		return err
+		return p.fail(err)
 	}
 
 	// send challenge to every subprotocol
@@ -223,10 +239,13 @@ func (p *FtCosi) Dispatch() error {
 				responsesMut.Lock()
 				responses = append(responses, response)
 				responsesMut.Unlock()
+			case err := <-subProto.subResponseErr:
+				errChan <- err
 			case <-time.After(p.Timeout):
 				// This should never happen, as the subProto should return before that
 				// timeout, even if it didn't receive enough responses.
-				errChan <- fmt.Errorf("timeout should not happen while waiting for response: %d", i)
+				log.Lvlf2("subprotocol %d didn't return in time", i)
+				errChan <- errResponseTimeout
 			}
 		}(i, cosiSubProtocol)
 	}
@@ -238,23 +257,26 @@ func (p *FtCosi) Dispatch() error {
 	for err := range errChan {
 		errs = append(errs, err)
 	}
+	for _, err := range errs {
+		if err != errResponseTimeout {
+			return p.fail(fmt.Errorf("failed to collect responses with errors %v", errs))
+		}
+	}
 	if len(errs) > 0 {
-		p.FinalSignature <- nil
-		return fmt.Errorf("nodes timed out while waiting for response %v", errs)
+		log.Error(p.ServerIdentity(), "nodes timed out while waiting for response:", errs)
+		return p.fail(&TimeoutError{"response", finalMask.CountEnabled(), p.Threshold})
 	}
 
 	// generate own response
 	personalResponse, err := cosi.Response(p.suite, p.Private(), secret, cosiChallenge)
 	if err != nil {
-		p.FinalSignature <- nil
-		return fmt.Errorf("error while generating own response: %s", err)
+		return p.fail(fmt.Errorf("error while generating own response: %s", err))
 	}
 	responses = append(responses, StructResponse{p.TreeNode(), Response{personalResponse}})
 
 	aggResponse, err := aggregateResponses(p.suite, responses)
 	if err != nil {
-		p.FinalSignature <- nil
-		return err
+		return p.fail(err)
 	}
 
 	// starts final signature
@@ -263,15 +285,36 @@ func (p *FtCosi) Dispatch() error {
 	var signature []byte
 	signature, err = cosi.Sign(p.suite, commitment, aggResponse, finalMask)
 	if err != nil {
-		p.FinalSignature <- nil
-		return err
+		return p.fail(err)
 	}
+	p.refusals = refusals
 	p.FinalSignature <- signature
 
 	log.Lvl3("Root-node is done without errors")
 	return nil
 }
 
+// fail sends an empty signature and stores err, so that it can be retrieved
+// with Err. It returns err.
+func (p *FtCosi) fail(err error) error {
+	p.err = err
+	p.FinalSignature <- nil
+	return err
+}
+
+// Err returns the error of the protocol. It is only set once an empty
+// signature has been sent on FinalSignature.
+func (p *FtCosi) Err() error {
+	return p.err
+}
+
+// Refusals returns the mask of the nodes that refused to sign. Nodes that
+// refused after the threshold has been reached are not in it. It is only set
+// once a signature has been sent on FinalSignature, and is nil before.
+func (p *FtCosi) Refusals() *cosi.Mask {
+	return p.refusals
+}
+
 // Start is done only by root and starts the protocol.
 // It also verifies that the protocol has been correctly parameterized.
 func (p *FtCosi) Start() error {
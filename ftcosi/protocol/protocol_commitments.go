@@ -13,7 +13,7 @@ import (
 
 // get all commitments, restart subprotocols where subleaders do not respond
 func (p *FtCosi) collectCommitments(trees []*onet.Tree,
-	subProtocols []*SubFtCosi) ([]StructCommitment, []*SubFtCosi, error) {
+	subProtocols []*SubFtCosi) ([]StructCommitment, []*SubFtCosi, *cosi.Mask, error) {
 
 	type commitmentProtocol struct {
 		structCommitment StructCommitment
@@ -83,7 +83,7 @@ func (p *FtCosi) collectCommitments(trees []*onet.Tree,
 	sharedMask, err := cosi.NewMask(p.suite, p.publics, nil)
 	if err != nil {
 		close(closingChan)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	commitmentsMap := make(map[*SubFtCosi]StructCommitment, len(subProtocols))
 	thresholdReached := true
@@ -107,13 +107,13 @@ func (p *FtCosi) collectCommitments(trees []*onet.Tree,
 				if err != nil {
 					err = fmt.Errorf("error in aggregation of commitment masks: %s", err)
 					close(closingChan)
-					return nil, nil, err
+					return nil, nil, nil, err
 				}
 				err = sharedMask.SetMask(newMask)
 				if err != nil {
 					err = fmt.Errorf("error in setting of shared masks: %s", err)
 					close(closingChan)
-					return nil, nil, err
+					return nil, nil, nil, err
 				}
 				if sharedMask.CountEnabled() >= p.Threshold-1 { // we assume the root accepts the proposal
 					thresholdReached = true
@@ -121,12 +121,13 @@ func (p *FtCosi) collectCommitments(trees []*onet.Tree,
 			case err := <-errChan:
 				err = fmt.Errorf("error in getting commitments: %s", err)
 				close(closingChan)
-				return nil, nil, err
+				return nil, nil, nil, err
 			case <-time.After(p.Timeout):
 				close(closingChan)
-				return nil, nil, fmt.Errorf("not enough replies from nodes at timeout %v "+
-					"for Threshold %d, got %d commitments and %d refusals", p.Timeout,
-					p.Threshold, sharedMask.CountEnabled(), sumRefusals(commitmentsMap))
+				log.Lvlf2("not enough replies from nodes at timeout %v for Threshold %d, "+
+					"got %d commitments and %d refusals", p.Timeout, p.Threshold,
+					sharedMask.CountEnabled(), sumRefusals(commitmentsMap))
+				return nil, nil, nil, &TimeoutError{"commitment", sharedMask.CountEnabled(), p.Threshold}
 			}
 		}
 	}
@@ -141,13 +142,31 @@ func (p *FtCosi) collectCommitments(trees []*onet.Tree,
 	}
 
 	if len(errs) > 0 {
-		return nil, nil, fmt.Errorf("failed to collect commitments with errors %v", errs)
+		return nil, nil, nil, fmt.Errorf("failed to collect commitments with errors %v", errs)
 	}
 	if !thresholdReachable {
-		return nil, nil, fmt.Errorf("too many refusals (got %d), the threshold of %d cannot be achieved",
+		return nil, nil, nil, fmt.Errorf("too many refusals (got %d), the threshold of %d cannot be achieved",
 			sumRefusals(commitmentsMap), p.Threshold)
 	}
 
+	// collect the nodes that refused
+	refusals, err := cosi.NewMask(p.suite, p.publics, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, commitment := range commitmentsMap {
+		if len(commitment.Refusals) == 0 {
+			continue
+		}
+		newMask, err := cosi.AggregateMasks(refusals.Mask(), commitment.Refusals)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error in aggregation of refusal masks: %s", err)
+		}
+		if err = refusals.SetMask(newMask); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
 	// extract protocols and commitments from map
 	runningSubProtocols := make([]*SubFtCosi, 0, len(commitmentsChan))
 	commitments := make([]StructCommitment, 0, len(commitmentsChan))
@@ -159,7 +178,7 @@ func (p *FtCosi) collectCommitments(trees []*onet.Tree,
 		}
 	}
 
-	return commitments, runningSubProtocols, nil
+	return commitments, runningSubProtocols, refusals, nil
 }
 
 func sumRefusals(commitmentsMap map[*SubFtCosi]StructCommitment) int {
@@ -67,6 +67,8 @@ type Commitment struct {
 	CoSiCommitment kyber.Point
 	Mask           []byte
 	NRefusal       int
+	// Refusals is the mask of the nodes that refused to sign.
+	Refusals []byte
 }
 
 // StructCommitment just contains Commitment and the data necessary to identify and
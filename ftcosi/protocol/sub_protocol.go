@@ -34,6 +34,9 @@ type SubFtCosi struct {
 	subleaderNotResponding chan bool
 	subCommitment          chan StructCommitment
 	subResponse            chan StructResponse
+	// subResponseErr gets the error of the root if it couldn't get the
+	// response of its subtree.
+	subResponseErr chan error
 
 	// internodes channels
 	ChannelAnnouncement chan StructAnnouncement
@@ -76,6 +79,7 @@ func NewSubFtCosi(n *onet.TreeNodeInstance, vf VerificationFn, suite cosi.Suite)
 		c.subleaderNotResponding = make(chan bool, 1)
 		c.subCommitment = make(chan StructCommitment, 2) // can send 2 commitments
 		c.subResponse = make(chan StructResponse, 1)
+		c.subResponseErr = make(chan error, 1)
 	}
 
 	err := c.RegisterChannels(&c.ChannelAnnouncement,
@@ -179,6 +183,7 @@ func (p *SubFtCosi) Dispatch() error {
 	var childrenCanResponse = make([]*onet.TreeNode, 0)            // the list of children that can send a response. That is the list of children present in the challenge mask.
 
 	var refusalCount = 0            // number of refusal received. Will be used only for the subleader
+	var refusals []byte             // mask of the nodes that refused, sent along with refusalCount
 	var firstCommitmentSent = false // to avoid sending the quick commitment multiple times
 	var verificationDone = false    // to send the aggregate commitment only once this node has done its verification
 	var timedOut = false            // to refuse new commitments once it times out
@@ -186,6 +191,12 @@ func (p *SubFtCosi) Dispatch() error {
 	responseTimeout := p.Timeout / 2
 	var t = time.After(commitTimeout) // the timeout for the commitment phase
 
+	emptyMask, err := cosi.NewMask(p.suite, p.Publics, nil)
+	if err != nil {
+		return err
+	}
+	refusals = emptyMask.Mask()
+
 	copy(nodesCanCommit, p.Children())
 	if p.IsRoot() {
 		nodesCanCommit = append(nodesCanCommit, p.Children()...) // every node can send quick and final answer
@@ -243,9 +254,15 @@ loop:
 				// checks if commitment is a refusal or acceptance
 				if commitment.CoSiCommitment.Equal(p.suite.Point().Null()) { // refusal
 					refusalCount++
+					if len(commitment.Refusals) > 0 {
+						refusals, err = cosi.AggregateMasks(refusals, commitment.Refusals)
+						if err != nil {
+							return fmt.Errorf("error in aggregation of refusal masks: %s", err)
+						}
+					}
 					if p.IsLeaf() {
 						log.Warn(p.ServerIdentity(), "leaf refused Commitment, marking as not signed")
-						return p.sendAggregatedCommitments([]StructCommitment{}, 1)
+						return p.sendAggregatedCommitments([]StructCommitment{}, 1, refusals)
 					}
 					log.Warn(p.ServerIdentity(), "non-leaf got refusal")
 				} else {
@@ -265,7 +282,7 @@ loop:
 
 				if (quickAnswer || finalAnswer) && verificationDone {
 
-					err = p.sendAggregatedCommitments(commitments, refusalCount)
+					err = p.sendAggregatedCommitments(commitments, refusalCount, refusals)
 					if err != nil {
 						return err
 					}
@@ -342,7 +359,7 @@ loop:
 				p.ServerIdentity(), commitTimeout, len(commitments), refusalCount)
 
 			// sending commits received
-			err = p.sendAggregatedCommitments(commitments, refusalCount)
+			err = p.sendAggregatedCommitments(commitments, refusalCount, refusals)
 			if err != nil {
 				return err
 			}
@@ -371,7 +388,7 @@ loop:
 
 			responses = append(responses, response)
 		case <-timeout:
-			return fmt.Errorf("timeout while waiting for responses")
+			return p.failResponse(errResponseTimeout)
 		}
 	}
 	log.Lvl3(p.ServerIdentity(), "received all", len(responses), "response(s)")
@@ -379,9 +396,9 @@ loop:
 	// if root, send response to super-protocol and finish
 	if p.IsRoot() {
 		if len(responses) != 1 {
-			return fmt.Errorf(
+			return p.failResponse(fmt.Errorf(
 				"root node in subprotocol should have received 1 response, but received %d",
-				len(responses))
+				len(responses)))
 		}
 		p.subResponse <- responses[0]
 		return nil
@@ -437,7 +454,16 @@ loop:
 	return nil
 }
 
-func (p *SubFtCosi) sendAggregatedCommitments(commitments []StructCommitment, NRefusal int) error {
+// failResponse passes err to the main protocol if this node is the root,
+// and returns it.
+func (p *SubFtCosi) failResponse(err error) error {
+	if p.IsRoot() {
+		p.subResponseErr <- err
+	}
+	return err
+}
+
+func (p *SubFtCosi) sendAggregatedCommitments(commitments []StructCommitment, NRefusal int, refusals []byte) error {
 
 	// aggregate commitments
 	commitment, mask, err := aggregateCommitments(p.suite, p.Publics, commitments)
@@ -446,7 +472,7 @@ func (p *SubFtCosi) sendAggregatedCommitments(commitments []StructCommitment, NR
 	}
 
 	// send to parent
-	err = p.SendToParent(&Commitment{commitment, mask.Mask(), NRefusal})
+	err = p.SendToParent(&Commitment{commitment, mask.Mask(), NRefusal, refusals})
 	if err != nil {
 		return err
 	}
@@ -516,7 +542,7 @@ func (p *SubFtCosi) getCommitment(accepts bool) (kyber.Scalar, StructCommitment,
 	}
 
 	structCommitment := StructCommitment{p.TreeNode(),
-		Commitment{p.suite.Point().Null(), emptyMask.Mask(), 0}}
+		Commitment{p.suite.Point().Null(), emptyMask.Mask(), 0, emptyMask.Mask()}}
 
 	var secret kyber.Scalar // nil
 	if accepts {
@@ -529,6 +555,12 @@ func (p *SubFtCosi) getCommitment(accepts bool) (kyber.Scalar, StructCommitment,
 		structCommitment.Mask = personalMask.Mask()
 	} else { // refuses
 		structCommitment.NRefusal++
+		var personalMask *cosi.Mask
+		personalMask, err = cosi.NewMask(p.suite, p.Publics, p.Public())
+		if err != nil {
+			return secret, StructCommitment{}, err
+		}
+		structCommitment.Refusals = personalMask.Mask()
 	}
 
 	return secret, structCommitment, nil
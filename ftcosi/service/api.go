@@ -1,40 +1,455 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/sign/cosi"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 )
 
+// DefaultFailureDelay is the time during which a node that failed to answer
+// is only tried after the other nodes.
+const DefaultFailureDelay = time.Minute
+
+// DefaultPollInterval is the time WaitSignature waits between two requests
+// for the result.
+const DefaultPollInterval = 100 * time.Millisecond
+
 // Client is a structure to communicate with the CoSi
 // service
 type Client struct {
 	*onet.Client
+	// FailureDelay is the time during which a node that failed to answer is
+	// only tried after the other nodes of the roster.
+	FailureDelay time.Duration
+	// PollInterval is the time WaitSignature waits between two requests
+	// for the result.
+	PollInterval time.Duration
+
+	failures     map[network.ServerIdentityID]time.Time
+	failuresLock sync.Mutex
+	// pending holds the node that got each asynchronous request.
+	pending     map[string]*network.ServerIdentity
+	pendingLock sync.Mutex
 }
 
 // NewClient instantiates a new ftcosi.Client
 func NewClient() *Client {
-	return &Client{Client: onet.NewClient(cothority.Suite, ServiceName)}
+	return &Client{
+		Client:       onet.NewClient(cothority.Suite, ServiceName),
+		FailureDelay: DefaultFailureDelay,
+		PollInterval: DefaultPollInterval,
+		failures:     make(map[network.ServerIdentityID]time.Time),
+		pending:      make(map[string]*network.ServerIdentity),
+	}
+}
+
+// NodeError is the error returned by one node of the roster.
+type NodeError struct {
+	Node *network.ServerIdentity
+	Err  error
+}
+
+// FailoverError is returned by SignatureRequest if no node of the roster
+// could coordinate the signature. It holds the errors of all nodes, in the
+// order they have been tried.
+type FailoverError struct {
+	Attempts []NodeError
+}
+
+func (fe *FailoverError) Error() string {
+	errs := make([]string, len(fe.Attempts))
+	for i, a := range fe.Attempts {
+		errs[i] = fmt.Sprintf("%s: %s", a.Node.Address, a.Err)
+	}
+	return "all nodes failed: " + strings.Join(errs, "; ")
 }
 
 // SignatureRequest sends a CoSi sign request to the Cothority defined by the given
-// Roster
+// Roster. The nodes of the roster are tried in a random order until one of
+// them can be reached, the nodes that recently failed being tried last.
+// The Coordinator of the response is the node that returned the signature.
 func (c *Client) SignatureRequest(r *onet.Roster, msg []byte) (*SignatureResponse, error) {
-	serviceReq := &SignatureRequest{
+	return c.Sign(&SignatureRequest{
 		Roster:  r,
 		Message: msg,
+	})
+}
+
+// Sign sends the request to the nodes of its roster, failing over to the
+// next node like SignatureRequest. It lets the caller set all the fields of
+// the request. If the protocol times out, a *protocol.TimeoutError is
+// returned and the other nodes are not tried.
+func (c *Client) Sign(serviceReq *SignatureRequest) (*SignatureResponse, error) {
+	return c.SignContext(context.Background(), serviceReq)
+}
+
+// SignContext is like Sign, but stops waiting for the nodes once ctx is
+// done, in which case it returns the error of ctx. The node keeps running
+// the protocol until the timeout of the request.
+func (c *Client) SignContext(ctx context.Context, serviceReq *SignatureRequest) (*SignatureResponse, error) {
+	// Don't let an invalid request mark the nodes as failed.
+	if err := serviceReq.check(); err != nil {
+		return nil, err
 	}
-	if len(r.List) == 0 {
-		return nil, errors.New("Got an empty roster-list")
-	}
-	dst := r.List[0]
-	log.Lvl4("Sending message to", dst)
 	reply := &SignatureResponse{}
-	err := c.SendProtobuf(dst, serviceReq, reply)
+	if _, err := c.failover(ctx, serviceReq.Roster, serviceReq, reply); err != nil {
+		return nil, err
+	}
+	if reply.Timeout != nil {
+		return nil, reply.Timeout
+	}
+	return reply, nil
+}
+
+// SignDigest asks the roster to sign the digest of a message computed with
+// algorithm, which is either DigestSHA256 or DigestSHA512. The signature is
+// to be verified with VerifyDigest.
+func (c *Client) SignDigest(r *onet.Roster, algorithm string, digest []byte) (*SignatureResponse, error) {
+	return c.Sign(&SignatureRequest{
+		Roster:          r,
+		Digest:          digest,
+		DigestAlgorithm: algorithm,
+	})
+}
+
+// SignReader computes the digest of everything read from rd with algorithm
+// and asks the roster to sign it, like SignDigest. The data is not kept in
+// memory. It returns the digest along with the signature.
+func (c *Client) SignReader(r *onet.Roster, algorithm string, rd io.Reader) (*SignatureResponse, []byte, error) {
+	digest, err := Digest(algorithm, rd)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := c.SignDigest(r, algorithm, digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, digest, nil
+}
+
+// Digest returns the digest of everything read from rd with algorithm,
+// which is either DigestSHA256 or DigestSHA512.
+func Digest(algorithm string, rd io.Reader) ([]byte, error) {
+	newHash, ok := digestAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown digest algorithm %q", algorithm)
+	}
+	h := newHash()
+	if _, err := io.Copy(h, rd); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// GetHealth returns the statistics that si keeps about the nodes it signed
+// with as a coordinator.
+func (c *Client) GetHealth(si *network.ServerIdentity) ([]NodeHealth, error) {
+	reply := &GetHealthReply{}
+	if err := c.SendProtobuf(si, &GetHealth{}, reply); err != nil {
+		return nil, err
+	}
+	return reply.Nodes, nil
+}
+
+// SignatureRequestAsync submits the request to a node of its roster, failing
+// over like Sign, and returns without waiting for the signature. The
+// returned ID is to be given to WaitSignature.
+func (c *Client) SignatureRequestAsync(serviceReq *SignatureRequest) ([]byte, error) {
+	if err := serviceReq.check(); err != nil {
+		return nil, err
+	}
+	reply := &SubmitSignatureReply{}
+	dst, err := c.failover(context.Background(), serviceReq.Roster,
+		&SubmitSignatureRequest{Request: serviceReq}, reply)
 	if err != nil {
 		return nil, err
 	}
+	c.pendingLock.Lock()
+	c.pending[string(reply.ID)] = dst
+	c.pendingLock.Unlock()
+	return reply.ID, nil
+}
+
+// WaitSignature polls the node that got the asynchronous request id until
+// the signature is available or timeout passed. If the node cannot be
+// reached, it is polled again until timeout passed. If it times out, it can
+// be called again with the same id.
+func (c *Client) WaitSignature(id []byte, timeout time.Duration) (*SignatureResponse, error) {
+	c.pendingLock.Lock()
+	dst, ok := c.pending[string(id)]
+	c.pendingLock.Unlock()
+	if !ok {
+		return nil, errors.New("unknown signature request")
+	}
+	done := func() {
+		c.pendingLock.Lock()
+		delete(c.pending, string(id))
+		c.pendingLock.Unlock()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		reply := &GetSignatureResultReply{}
+		err := c.SendProtobuf(dst, &GetSignatureResult{ID: id}, reply)
+		if err != nil {
+			if cothority.IsServiceError(err) {
+				done()
+				return nil, err
+			}
+			log.Lvl2("Couldn't poll", dst, ":", err)
+			if time.Now().After(deadline) {
+				return nil, err
+			}
+			time.Sleep(c.PollInterval)
+			continue
+		}
+		switch reply.Status {
+		case SignatureDone:
+			done()
+			return reply.Response, nil
+		case SignatureFailed:
+			done()
+			if reply.Response != nil && reply.Response.Timeout != nil {
+				return nil, reply.Response.Timeout
+			}
+			return nil, errors.New("signature failed: " + reply.Error)
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("timeout while waiting for the signature")
+		}
+		time.Sleep(c.PollInterval)
+	}
+}
+
+// failover sends msg to the nodes of the roster in the order of
+// coordinators until one of them can be reached, and returns that node.
+// Errors returned by the service of a node are returned without trying the
+// other nodes, as they would refuse the request for the same reason.
+func (c *Client) failover(ctx context.Context, r *onet.Roster, msg interface{}, reply interface{}) (*network.ServerIdentity, error) {
+	fe := &FailoverError{}
+	for _, dst := range c.coordinators(r) {
+		log.Lvl4("Sending message to", dst)
+		err := c.send(ctx, dst, msg, reply)
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			if cothority.IsServiceError(err) {
+				return nil, err
+			}
+			log.Lvl2("Node", dst, "failed:", err)
+			c.setFailure(dst)
+			fe.Attempts = append(fe.Attempts, NodeError{dst, err})
+			continue
+		}
+		return dst, nil
+	}
+	return nil, fe
+}
+
+// send sends msg to dst and fills reply with its answer, unless ctx is done
+// first, in which case it returns the error of ctx. As the connection
+// cannot be interrupted, a request that can be cancelled is sent with its
+// own client and decoded into its own reply, so that it doesn't block the
+// other requests nor write to reply after send returned. It returns once
+// dst answered, which the node does before the timeout of the request.
+func (c *Client) send(ctx context.Context, dst *network.ServerIdentity, msg, reply interface{}) error {
+	if ctx.Done() == nil {
+		return c.SendProtobuf(dst, msg, reply)
+	}
+	cl := onet.NewClient(c.Suite(), ServiceName)
+	r := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+	errChan := make(chan error, 1)
+	go func() {
+		err := cl.SendProtobuf(dst, msg, r)
+		if errClose := cl.Close(); errClose != nil {
+			log.Lvl3("couldn't close the connection:", errClose)
+		}
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		if err == nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r).Elem())
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// coordinators returns the nodes of the roster in a random order, the nodes
+// that failed during the last FailureDelay being at the end.
+func (c *Client) coordinators(r *onet.Roster) []*network.ServerIdentity {
+	c.failuresLock.Lock()
+	defer c.failuresLock.Unlock()
+	var ok, failed []*network.ServerIdentity
+	for _, i := range rand.Perm(len(r.List)) {
+		si := r.List[i]
+		if t, f := c.failures[si.ID]; f && time.Since(t) < c.FailureDelay {
+			failed = append(failed, si)
+		} else {
+			ok = append(ok, si)
+		}
+	}
+	return append(ok, failed...)
+}
+
+func (c *Client) setFailure(si *network.ServerIdentity) {
+	c.failuresLock.Lock()
+	defer c.failuresLock.Unlock()
+	c.failures[si.ID] = time.Now()
+}
+
+// Policy tells how many nodes of the roster need to sign a message for the
+// signature to be accepted.
+type Policy struct {
+	// Complete is true if all nodes need to sign.
+	Complete bool
+	// Threshold is the minimum number of nodes that need to sign, if the
+	// policy is not complete. It must be at least 1.
+	Threshold int
+}
+
+// CompletePolicy asks for the signature of all nodes of the roster.
+var CompletePolicy = Policy{Complete: true}
+
+// ThresholdPolicy asks for the signature of at least t nodes of the roster.
+// Verify refuses the policy if t is smaller than 1.
+func ThresholdPolicy(t int) Policy {
+	return Policy{Threshold: t}
+}
+
+// SignatureError is returned by Verify if the signature is not a valid
+// signature of the message by the nodes given in its mask.
+type SignatureError struct {
+	Err error
+}
+
+func (se *SignatureError) Error() string {
+	return "invalid signature: " + se.Err.Error()
+}
+
+// ParticipationError is returned by Verify if the signature is valid, but
+// not enough nodes signed to satisfy the policy.
+type ParticipationError struct {
+	Signers  int
+	Required int
+}
+
+func (pe *ParticipationError) Error() string {
+	return fmt.Sprintf("only %d nodes signed, but %d are required", pe.Signers, pe.Required)
+}
+
+// acceptAll lets cosi.Verify check the signature only, so that the policy
+// can be checked separately.
+type acceptAll struct{}
+
+func (acceptAll) Check(*cosi.Mask) bool { return true }
+
+// Verify checks that resp holds a signature of msg by the nodes of the
+// roster, and that enough nodes signed for the policy. It returns a
+// *SignatureError if the signature is invalid and a *ParticipationError if
+// the policy is not satisfied. Signatures of a digest are verified with
+// VerifyDigest.
+func (c *Client) Verify(r *onet.Roster, msg []byte, resp *SignatureResponse, policy Policy) error {
+	if bytes.HasPrefix(msg, []byte(digestPrefix)) {
+		return &SignatureError{errors.New("message is in the domain of digests")}
+	}
+	return c.verify(r, msg, resp, policy)
+}
+
+// VerifyDigest is like Verify, but for a signature of the digest of a
+// message, as returned by SignDigest or SignReader.
+func (c *Client) VerifyDigest(r *onet.Roster, algorithm string, digest []byte, resp *SignatureResponse, policy Policy) error {
+	return c.verify(r, DigestMessage(algorithm, digest), resp, policy)
+}
+
+func (c *Client) verify(r *onet.Roster, msg []byte, resp *SignatureResponse, policy Policy) error {
+	if !policy.Complete && policy.Threshold < 1 {
+		return fmt.Errorf("threshold of the policy is %d, but must be at least 1", policy.Threshold)
+	}
+	if resp == nil || len(resp.Signature) == 0 {
+		return &SignatureError{errors.New("no signature given")}
+	}
+	suite, ok := c.Suite().(cosi.Suite)
+	if !ok {
+		return errors.New("not a cosi suite")
+	}
+	if resp.Hash != nil {
+		h := suite.Hash()
+		h.Write(msg)
+		if !bytes.Equal(h.Sum(nil), resp.Hash) {
+			return &SignatureError{errors.New("hash is not the hash of the message")}
+		}
+	}
+	publics := r.Publics()
+	err := cosi.Verify(suite, publics, msg, resp.Signature, acceptAll{})
+	if err != nil {
+		return &SignatureError{err}
+	}
+
+	present, _, err := ParseMask(resp.Signature[suite.PointLen()+suite.ScalarLen():], r)
+	if err != nil {
+		return &SignatureError{err}
+	}
+	required := len(publics)
+	if !policy.Complete {
+		required = policy.Threshold
+	}
+	if len(present) < required {
+		return &ParticipationError{len(present), required}
+	}
+	return nil
+}
+
+// ParseMask returns the nodes of the roster that are present in the mask of
+// a signature, and the nodes that are absent, both in the order of the
+// roster. The mask is ordered as described in MaskOrdering. Like
+// GetAggregateKey, it refuses rosters with nodes without a public key or
+// with duplicate nodes.
+func ParseMask(mask []byte, r *onet.Roster) (present, absent []*network.ServerIdentity, err error) {
+	if err := checkRoster(r); err != nil {
+		return nil, nil, err
+	}
+	if len(mask) != (len(r.List)+7)/8 {
+		return nil, nil, fmt.Errorf("mask has %d bytes, but the roster needs %d",
+			len(mask), (len(r.List)+7)/8)
+	}
+	for i := len(r.List); i < len(mask)*8; i++ {
+		if mask[i/8]&(1<<uint(i%8)) != 0 {
+			return nil, nil, fmt.Errorf("bit %d is set, but the roster has %d nodes", i, len(r.List))
+		}
+	}
+	for i, si := range r.List {
+		if mask[i/8]&(1<<uint(i%8)) != 0 {
+			present = append(present, si)
+		} else {
+			absent = append(absent, si)
+		}
+	}
+	return present, absent, nil
+}
+
+// GetAggregateKey asks a node of the roster for its aggregate key, failing
+// over like Sign.
+func (c *Client) GetAggregateKey(r *onet.Roster) (*GetAggregateKeyReply, error) {
+	reply := &GetAggregateKeyReply{}
+	if _, err := c.failover(context.Background(), r, &GetAggregateKey{r}, reply); err != nil {
+		return nil, err
+	}
 	return reply, nil
 }
@@ -3,12 +3,20 @@
 package service
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
+	"fmt"
+	"hash"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/ftcosi/protocol"
+	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/cosi"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
@@ -23,64 +31,613 @@ import (
 // ServiceName is the name to refer to the CoSi service
 const ServiceName = "ftCoSiService"
 
+// DefaultResultTimeout is the time during which the result of an
+// asynchronous signature request is kept once the protocol is done.
+const DefaultResultTimeout = 10 * time.Minute
+
+// DefaultMaxPending is the number of asynchronous requests a node runs at
+// the same time.
+const DefaultMaxPending = 100
+
+// DefaultTimeout is the timeout of the protocol if the request doesn't give
+// one.
+const DefaultTimeout = 5 * time.Second
+
+// MaxTimeout is the biggest timeout a request can ask for.
+const MaxTimeout = time.Minute
+
+// RefusalWarning is the fraction of the roster above which the refusals to
+// sign are logged as a warning.
+const RefusalWarning = 0.1
+
+// The digest algorithms of SignatureRequest.DigestAlgorithm.
+const (
+	DigestSHA256 = "sha256"
+	DigestSHA512 = "sha512"
+)
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	DigestSHA256: sha256.New,
+	DigestSHA512: sha512.New,
+}
+
+// digestPrefix starts the messages signed for a digest. Messages starting
+// with it cannot be signed directly, so that a signature of a message is
+// never a signature of a digest.
+const digestPrefix = "ftcosi-digest:"
+
+// DigestMessage returns the message that is signed when a request gives the
+// digest of a message instead of the message.
+func DigestMessage(algorithm string, digest []byte) []byte {
+	return append([]byte(digestPrefix+algorithm+":"), digest...)
+}
+
+// healthCheck is sent to the nodes that didn't sign, to find out whether
+// they can be reached.
+type healthCheck struct{}
+
+var healthCheckID = network.RegisterMessage(healthCheck{})
+
+// checkDigestMessage returns an error if msg is in the domain of digests,
+// but is not the message of a digest as returned by DigestMessage. Every
+// node checks it, so that the root cannot get a message signed in the
+// domain of digests.
+func checkDigestMessage(msg []byte) error {
+	if !bytes.HasPrefix(msg, []byte(digestPrefix)) {
+		return nil
+	}
+	rest := msg[len(digestPrefix):]
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return errors.New("digest message without algorithm")
+	}
+	h, ok := digestAlgorithms[string(rest[:i])]
+	if !ok {
+		return fmt.Errorf("unknown digest algorithm %q", rest[:i])
+	}
+	if len(rest[i+1:]) != h().Size() {
+		return fmt.Errorf("digest has %d bytes instead of %d", len(rest[i+1:]), h().Size())
+	}
+	return nil
+}
+
+// The reason why a node didn't sign.
+const (
+	// NonSignerRefused means that the node refused to sign the message.
+	NonSignerRefused = iota + 1
+	// NonSignerUnreachable means that the node didn't answer in time.
+	NonSignerUnreachable
+	// NonSignerSkipped means that the node has been left out because it
+	// failed too often.
+	NonSignerSkipped
+)
+
+// The status of an asynchronous signature request.
+const (
+	// SignaturePending means that the protocol is still running.
+	SignaturePending = iota
+	// SignatureDone means that the signature is available.
+	SignatureDone
+	// SignatureFailed means that the protocol failed.
+	SignatureFailed
+)
+
 func init() {
 	onet.RegisterNewService(ServiceName, newCoSiService)
 	network.RegisterMessage(&SignatureRequest{})
 	network.RegisterMessage(&SignatureResponse{})
+	network.RegisterMessages(&SubmitSignatureRequest{}, &SubmitSignatureReply{},
+		&GetSignatureResult{}, &GetSignatureResultReply{},
+		&GetHealth{}, &GetHealthReply{},
+		&GetAggregateKey{}, &GetAggregateKeyReply{})
 }
 
 // Service is the service that handles collective signing operations
 type Service struct {
 	*onet.ServiceProcessor
 	suite cosi.Suite
+
+	// resultTimeout is the time during which the result of an asynchronous
+	// request is kept.
+	resultTimeout time.Duration
+	// maxPending is the number of asynchronous requests that can be
+	// pending at the same time.
+	maxPending  int
+	pending     int
+	results     map[string]*asyncResult
+	resultsLock sync.Mutex
+	// verify is the verification function of the nodes that are not the
+	// root.
+	verify          protocol.VerificationFn
+	verifiers       map[string]MessageVerifier
+	defaultVerifier string
+	verifiersLock   sync.Mutex
+	health          *healthStats
+}
+
+// MessageVerifier returns true if the message can be signed. For requests
+// giving a digest, it gets the output of DigestMessage.
+type MessageVerifier func(msg []byte) bool
+
+// asyncResult is the state of an asynchronous request. expires is only set
+// once the protocol is done.
+type asyncResult struct {
+	status   int
+	response *SignatureResponse
+	err      error
+	expires  time.Time
 }
 
 // SignatureRequest is what the Cosi service is expected to receive from clients.
 type SignatureRequest struct {
 	Message []byte
 	Roster  *onet.Roster
+	// Subtrees is the number of subtrees of the protocol, each led by a
+	// subleader. It must be smaller than the number of nodes. If it is 0,
+	// the square root of the number of nodes is used.
+	Subtrees int
+	// Timeout of the protocol. If it is 0, DefaultTimeout is used. It cannot
+	// be bigger than MaxTimeout.
+	Timeout time.Duration
+	// Verifier is the name of the MessageVerifier every node runs before
+	// signing. If it is empty, every node runs its default verifier, and
+	// signs any message if it has none.
+	Verifier string
+	// Digest of the message to sign, computed with DigestAlgorithm. If it
+	// is set, Message must be empty and DigestMessage(DigestAlgorithm,
+	// Digest) is signed.
+	Digest []byte
+	// DigestAlgorithm is either DigestSHA256 or DigestSHA512.
+	DigestAlgorithm string
+	// MinParticipation is the number of nodes that need to sign. If it is
+	// 0, all nodes need to sign. If it is given, the nodes that failed too
+	// often are left out of the protocol, as long as the other nodes are
+	// enough to reach MinParticipation.
+	MinParticipation int
 }
 
 // SignatureResponse is what the Cosi service will reply to clients.
 type SignatureResponse struct {
 	Hash      []byte
 	Signature []byte
+	// Coordinator is the node that ran the protocol.
+	Coordinator *network.ServerIdentity
+	// Subtrees is the number of subtrees used by the protocol.
+	Subtrees int
+	// NonSigners holds the nodes that are not in the mask of the signature,
+	// in the order of the roster.
+	NonSigners []NonSigner
+	// Participation is the number of nodes that signed.
+	Participation int
+	// Timeout is set instead of the signature if the protocol timed out.
+	Timeout *protocol.TimeoutError
+}
+
+// NonSigner is a node that didn't sign, and why.
+type NonSigner struct {
+	ServerIdentity *network.ServerIdentity
+	// Reason is one of NonSignerRefused, NonSignerUnreachable or
+	// NonSignerSkipped.
+	Reason int
+}
+
+// MaskOrdering describes how the mask of a signature is to be read.
+const MaskOrdering = "bit i%8 of byte i/8, counting from the least significant bit, is set if Publics[i] signed"
+
+// GetAggregateKey asks for the key that verifies the signatures of all the
+// nodes of the roster.
+type GetAggregateKey struct {
+	Roster *onet.Roster
+}
+
+// GetAggregateKeyReply holds the aggregate key of the roster, and what is
+// needed to verify a signature of only some of its nodes.
+type GetAggregateKeyReply struct {
+	// AggregateKey is the sum of the public keys of the roster.
+	AggregateKey kyber.Point
+	// Publics holds the public keys of the roster, in the order of the mask
+	// of the signatures.
+	Publics []kyber.Point
+	// MaskOrdering describes how the mask is to be read.
+	MaskOrdering string
+}
+
+// GetHealth asks the service for the statistics of the nodes it signed with
+// as a coordinator.
+type GetHealth struct {
+}
+
+// GetHealthReply holds the statistics of the nodes, sorted by address.
+type GetHealthReply struct {
+	Nodes []NodeHealth
+}
+
+// SubmitSignatureRequest asks the service to sign the message of the
+// request in the background.
+type SubmitSignatureRequest struct {
+	Request *SignatureRequest
+}
+
+// SubmitSignatureReply holds the ID to give to GetSignatureResult.
+type SubmitSignatureReply struct {
+	ID []byte
+}
+
+// GetSignatureResult asks for the result of a request submitted with
+// SubmitSignatureRequest. It has to be sent to the node that got the
+// request.
+type GetSignatureResult struct {
+	ID []byte
+}
+
+// GetSignatureResultReply holds the status of the request. Response is only
+// set if the Status is SignatureDone, or if the protocol timed out, and
+// Error if it is SignatureFailed.
+type GetSignatureResultReply struct {
+	Status   int
+	Response *SignatureResponse
+	Error    string
+}
+
+// check returns an error if the parameters of the request are out of bounds.
+func (req *SignatureRequest) check() error {
+	if req.Roster == nil || len(req.Roster.List) == 0 {
+		return errors.New("Got an empty roster-list")
+	}
+	nNodes := len(req.Roster.List)
+	if req.Subtrees < 0 || (req.Subtrees > 0 && req.Subtrees >= nNodes) {
+		return fmt.Errorf("number of subtrees %d is not between 1 and %d",
+			req.Subtrees, nNodes-1)
+	}
+	if req.MinParticipation < 0 || req.MinParticipation > nNodes {
+		return fmt.Errorf("minimum participation %d is not between 0 and %d",
+			req.MinParticipation, nNodes)
+	}
+	if req.Timeout < 0 || req.Timeout > MaxTimeout {
+		return fmt.Errorf("timeout %s is not between 0 and %s", req.Timeout, MaxTimeout)
+	}
+	if len(req.Digest) > 0 {
+		if len(req.Message) > 0 {
+			return errors.New("cannot sign a message and a digest")
+		}
+		h, ok := digestAlgorithms[req.DigestAlgorithm]
+		if !ok {
+			return fmt.Errorf("unknown digest algorithm %q", req.DigestAlgorithm)
+		}
+		if len(req.Digest) != h().Size() {
+			return fmt.Errorf("digest has %d bytes instead of %d", len(req.Digest), h().Size())
+		}
+	} else if bytes.HasPrefix(req.Message, []byte(digestPrefix)) {
+		return errors.New("message cannot start with " + digestPrefix)
+	}
+	return nil
+}
+
+// message returns the message that is signed for the request.
+func (req *SignatureRequest) message() []byte {
+	if len(req.Digest) > 0 {
+		return DigestMessage(req.DigestAlgorithm, req.Digest)
+	}
+	return req.Message
+}
+
+// RegisterMessageVerifier registers f under name, so that requests can ask
+// for it in their Verifier field. A verifier registered under the same name
+// is replaced. As the nodes refuse to sign if they don't know the verifier,
+// it should be registered on all the nodes of the roster.
+func (s *Service) RegisterMessageVerifier(name string, f func(msg []byte) bool) {
+	if name == "" {
+		log.Error("cannot register a verifier without a name")
+		return
+	}
+	s.verifiersLock.Lock()
+	defer s.verifiersLock.Unlock()
+	s.verifiers[name] = f
+}
+
+// SetDefaultVerifier makes the verifier registered under name run for the
+// requests that don't give a verifier, so that clients cannot get any
+// message signed by leaving the Verifier field empty. An empty name removes
+// the default verifier.
+func (s *Service) SetDefaultVerifier(name string) error {
+	s.verifiersLock.Lock()
+	defer s.verifiersLock.Unlock()
+	if name != "" && s.verifiers[name] == nil {
+		return fmt.Errorf("unknown verifier %q", name)
+	}
+	s.defaultVerifier = name
+	return nil
+}
+
+// verifier returns the verifier registered under name, or nil if there is
+// none. The empty name returns the default verifier.
+func (s *Service) verifier(name string) MessageVerifier {
+	s.verifiersLock.Lock()
+	defer s.verifiersLock.Unlock()
+	if name == "" {
+		name = s.defaultVerifier
+	}
+	return s.verifiers[name]
+}
+
+// verifyMessage is the verification function of the protocol. The data is
+// the name of the verifier to run, the default verifier if it is empty.
+// Messages in the domain of digests are only signed if they are the message
+// of a digest.
+func (s *Service) verifyMessage(msg, data []byte) bool {
+	if err := checkDigestMessage(msg); err != nil {
+		log.Lvl2(s.ServerIdentity(), "refusing to sign:", err)
+		return false
+	}
+	f := s.verifier(string(data))
+	if f == nil {
+		if len(data) == 0 {
+			return true
+		}
+		log.Lvl2(s.ServerIdentity(), "refusing to sign with unknown verifier", string(data))
+		return false
+	}
+	return f(msg)
+}
+
+// checkRequest returns an error if the request is not valid, or if its
+// verifier is unknown.
+func (s *Service) checkRequest(req *SignatureRequest) error {
+	if err := req.check(); err != nil {
+		return err
+	}
+	if req.Verifier != "" && s.verifier(req.Verifier) == nil {
+		return fmt.Errorf("unknown verifier %q", req.Verifier)
+	}
+	return nil
 }
 
 // SignatureRequest treats external request to this service.
 func (s *Service) SignatureRequest(req *SignatureRequest) (network.Message, error) {
+	if err := s.checkRequest(req); err != nil {
+		return nil, err
+	}
+	resp, err := s.sign(req)
+	if te, ok := err.(*protocol.TimeoutError); ok {
+		// Let the client tell a timeout from other errors.
+		return &SignatureResponse{Coordinator: s.ServerIdentity(), Timeout: te}, nil
+	}
+	return resp, err
+}
+
+// SubmitSignatureRequest checks the request and starts the protocol in the
+// background. The result can be fetched with GetSignatureResult until
+// resultTimeout after the protocol is done. If maxPending requests are
+// still running, the request is refused.
+func (s *Service) SubmitSignatureRequest(req *SubmitSignatureRequest) (network.Message, error) {
+	if req.Request == nil {
+		return nil, errors.New("no request given")
+	}
+	if err := s.checkRequest(req.Request); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	res := &asyncResult{status: SignaturePending}
+	s.resultsLock.Lock()
+	if s.pending >= s.maxPending {
+		s.resultsLock.Unlock()
+		return nil, errors.New("too many pending requests, try again later")
+	}
+	s.pending++
+	s.removeExpired()
+	s.results[string(id)] = res
+	s.resultsLock.Unlock()
+
+	go func() {
+		resp, err := s.sign(req.Request)
+		s.resultsLock.Lock()
+		defer s.resultsLock.Unlock()
+		s.pending--
+		if err != nil {
+			log.Lvl2("asynchronous request failed:", err)
+			res.status = SignatureFailed
+			res.err = err
+			if te, ok := err.(*protocol.TimeoutError); ok {
+				res.response = &SignatureResponse{Coordinator: s.ServerIdentity(), Timeout: te}
+			}
+		} else {
+			res.status = SignatureDone
+			res.response = resp
+		}
+		res.expires = time.Now().Add(s.resultTimeout)
+	}()
+	return &SubmitSignatureReply{ID: id}, nil
+}
+
+// GetSignatureResult returns the status of an asynchronous request.
+func (s *Service) GetSignatureResult(req *GetSignatureResult) (network.Message, error) {
+	s.resultsLock.Lock()
+	defer s.resultsLock.Unlock()
+	s.removeExpired()
+	res, ok := s.results[string(req.ID)]
+	if !ok {
+		return nil, errors.New("unknown signature request")
+	}
+	reply := &GetSignatureResultReply{Status: res.status, Response: res.response}
+	if res.err != nil {
+		reply.Error = res.err.Error()
+	}
+	return reply, nil
+}
+
+// GetAggregateKey returns the aggregate key of the roster. The roster must
+// not hold nodes without a public key, nor duplicate nodes.
+func (s *Service) GetAggregateKey(req *GetAggregateKey) (network.Message, error) {
+	if err := checkRoster(req.Roster); err != nil {
+		return nil, err
+	}
+	agg := s.suite.Point().Null()
+	for _, si := range req.Roster.List {
+		agg.Add(agg, si.Public)
+	}
+	return &GetAggregateKeyReply{agg, req.Roster.Publics(), MaskOrdering}, nil
+}
+
+// GetHealth returns the statistics of the nodes.
+func (s *Service) GetHealth(req *GetHealth) (network.Message, error) {
+	return &GetHealthReply{s.health.status(time.Now())}, nil
+}
+
+// checkRoster returns an error if the roster is empty, or if it holds nodes
+// without a public key or duplicate nodes.
+func checkRoster(r *onet.Roster) error {
+	if r == nil || len(r.List) == 0 {
+		return errors.New("Got an empty roster-list")
+	}
+	for i, si := range r.List {
+		if si == nil || si.Public == nil {
+			return fmt.Errorf("node %d has no public key", i)
+		}
+		for _, other := range r.List[:i] {
+			if other.ID.Equal(si.ID) || other.Public.Equal(si.Public) {
+				return fmt.Errorf("node %d (%s) is in the roster twice", i, si.Address)
+			}
+		}
+	}
+	return nil
+}
+
+// removeExpired removes the results that are kept for longer than
+// resultTimeout. The caller must hold resultsLock.
+func (s *Service) removeExpired() {
+	now := time.Now()
+	for id, res := range s.results {
+		if res.status != SignaturePending && now.After(res.expires) {
+			delete(s.results, id)
+		}
+	}
+}
+
+// sign runs the protocol for a request that has been checked. If the
+// protocol fails without the unhealthy nodes, it is run again with all the
+// nodes of the roster.
+func (s *Service) sign(req *SignatureRequest) (*SignatureResponse, error) {
+	msg := req.message()
+	// The root doesn't verify the message in the protocol.
+	if !s.verifyMessage(msg, []byte(req.Verifier)) {
+		return nil, fmt.Errorf("message refused by verifier %q", req.Verifier)
+	}
+	roster := req.Roster
+	if i, _ := roster.Search(s.ServerIdentity().ID); i < 0 {
+		return nil, errors.New("we're not in the roster")
+	}
+	var skipped []*network.ServerIdentity
+	if req.MinParticipation > 0 {
+		healthy, unhealthy := s.health.split(roster.List, s.ServerIdentity(), time.Now())
+		if len(unhealthy) > 0 && len(healthy) >= req.MinParticipation {
+			log.Lvl2("leaving out", len(unhealthy), "unhealthy nodes")
+			skipped = unhealthy
+		}
+	}
+
+	start := time.Now()
+	p, rooted, sig, err := s.runProtocol(req, msg, roster, skipped)
+	if err != nil && skipped != nil {
+		log.Lvl2("couldn't sign without the unhealthy nodes, asking all nodes:", err)
+		skipped = nil
+		start = time.Now()
+		p, rooted, sig, err = s.runProtocol(req, msg, roster, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The hash is the message ftcosi actually signs, we recompute it the
+	// same way as ftcosi and then return it.
+	h := s.suite.Hash()
+	h.Write(msg)
+	// The mask of the protocol follows the order of the tree, but the mask
+	// of the response follows the order of the roster, so that it doesn't
+	// depend on the node that ran the protocol.
+	sig, err = s.expandMask(sig, rooted, roster)
+	if err != nil {
+		return nil, err
+	}
+	nonSigners, err := s.nonSigners(roster, sig, p.Refusals(), skipped)
+	if err != nil {
+		return nil, err
+	}
+	s.recordHealth(roster, nonSigners, time.Since(start))
+	return &SignatureResponse{
+		Hash:          h.Sum(nil),
+		Signature:     sig,
+		Coordinator:   s.ServerIdentity(),
+		Subtrees:      p.NSubtrees,
+		NonSigners:    nonSigners,
+		Participation: len(roster.List) - len(nonSigners),
+	}, nil
+}
+
+// runProtocol runs the protocol with the nodes of the roster that are not
+// skipped, and returns it along with the roster of its tree and the
+// signature, whose mask follows the order of this roster.
+func (s *Service) runProtocol(req *SignatureRequest, msg []byte, roster *onet.Roster,
+	skipped []*network.ServerIdentity) (*protocol.FtCosi, *onet.Roster, []byte, error) {
+	signers := roster.List
+	if len(skipped) > 0 {
+		signers = nil
+		for _, si := range roster.List {
+			if !containsNode(skipped, si) {
+				signers = append(signers, si)
+			}
+		}
+	}
+
 	// generate the tree
-	nNodes := len(req.Roster.List)
-	rooted := req.Roster.NewRosterWithRoot(s.ServerIdentity())
+	rooted := onet.NewRoster(signers).NewRosterWithRoot(s.ServerIdentity())
 	if rooted == nil {
-		return nil, errors.New("we're not in the roster")
+		return nil, nil, nil, errors.New("we're not in the roster")
 	}
+	nNodes := len(rooted.List)
 	tree := rooted.GenerateNaryTree(nNodes)
 	if tree == nil {
-		return nil, errors.New("failed to generate tree")
+		return nil, nil, nil, errors.New("failed to generate tree")
 	}
 	pi, err := s.CreateProtocol(protocol.DefaultProtocolName, tree)
 	if err != nil {
-		return nil, errors.New("Couldn't make new protocol: " + err.Error())
+		return nil, nil, nil, errors.New("Couldn't make new protocol: " + err.Error())
 	}
 
 	// configure the protocol
 	p := pi.(*protocol.FtCosi)
 	p.CreateProtocol = s.CreateProtocol
-	p.Msg = req.Message
-	// We set NSubtrees to the square root of n to evenly distribute the load
-	p.NSubtrees = int(math.Sqrt(float64(nNodes)))
-	p.Timeout = time.Second * 5
+	p.Msg = msg
+	p.Data = []byte(req.Verifier)
+	// We set NSubtrees to the square root of n to evenly distribute the load,
+	// if the client didn't ask for another value.
+	p.NSubtrees = req.Subtrees
+	if p.NSubtrees == 0 {
+		p.NSubtrees = int(math.Sqrt(float64(nNodes)))
+	}
+	p.Timeout = DefaultTimeout
+	if req.Timeout > 0 {
+		p.Timeout = req.Timeout
+	}
+	if p.NSubtrees >= nNodes {
+		// Some nodes have been left out.
+		p.NSubtrees = nNodes - 1
+	}
 	if p.NSubtrees < 1 {
 		p.NSubtrees = 1
 	}
-	// Complete Threshold
+	// Complete Threshold, if none is given
 	p.Threshold = p.Tree().Size()
+	if req.MinParticipation > 0 {
+		p.Threshold = req.MinParticipation
+	}
 
 	// start the protocol
 	log.Lvl3("Cosi Service starting up root protocol")
 	if err = pi.Start(); err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	log.Lvlf2("%s: Signed a message.\n", time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
@@ -90,14 +647,119 @@ func (s *Service) SignatureRequest(req *SignatureRequest) (network.Message, erro
 	select {
 	case sig = <-p.FinalSignature:
 	case <-time.After(p.Timeout + time.Second):
-		return nil, errors.New("protocol timed out")
+		return nil, nil, nil, errors.New("protocol timed out")
+	}
+	if sig == nil {
+		if err := p.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, nil, nil, errors.New("protocol failed")
 	}
+	return p, rooted, sig, nil
+}
 
-	// The hash is the message ftcosi actually signs, we recompute it the
-	// same way as ftcosi and then return it.
-	h := s.suite.Hash()
-	h.Write(req.Message)
-	return &SignatureResponse{h.Sum(nil), sig}, nil
+// expandMask returns the signature with a mask over the full roster instead
+// of over signers, which can hold only some of its nodes, in another order.
+// As the aggregate public key only depends on the nodes that signed, the
+// signature can be verified with the full roster.
+func (s *Service) expandMask(sig []byte, signers, full *onet.Roster) ([]byte, error) {
+	l := s.suite.PointLen() + s.suite.ScalarLen()
+	signersMask, err := cosi.NewMask(s.suite, signers.Publics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = signersMask.SetMask(sig[l:]); err != nil {
+		return nil, err
+	}
+	fullMask, err := cosi.NewMask(s.suite, full.Publics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, si := range full.List {
+		if ok, _ := signersMask.KeyEnabled(si.Public); ok {
+			if err = fullMask.SetBit(i, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return append(append([]byte{}, sig[:l]...), fullMask.Mask()...), nil
+}
+
+// recordHealth updates the statistics of the nodes of the roster. Refusing
+// nodes are healthy, and skipped nodes are not updated. The nodes that
+// didn't answer in time are only counted as failing if they cannot be
+// reached, as they might only be slower than the nodes that signed.
+func (s *Service) recordHealth(roster *onet.Roster, nonSigners []NonSigner, latency time.Duration) {
+	now := time.Now()
+	reasons := make(map[network.ServerIdentityID]int)
+	for _, ns := range nonSigners {
+		reasons[ns.ServerIdentity.ID] = ns.Reason
+	}
+	for _, si := range roster.List {
+		switch reasons[si.ID] {
+		case NonSignerUnreachable:
+			go s.checkReachable(si)
+		case NonSignerSkipped:
+		default:
+			s.health.success(si, latency, now)
+		}
+	}
+}
+
+// checkReachable records a failure of si if it cannot be reached.
+func (s *Service) checkReachable(si *network.ServerIdentity) {
+	if err := s.SendRaw(si, &healthCheck{}); err != nil {
+		log.Lvl2(s.ServerIdentity(), "couldn't reach", si, ":", err)
+		s.health.failure(si, time.Now())
+	}
+}
+
+// containsNode returns true if si is in list.
+func containsNode(list []*network.ServerIdentity, si *network.ServerIdentity) bool {
+	for _, other := range list {
+		if other.Equal(si) {
+			return true
+		}
+	}
+	return false
+}
+
+// nonSigners returns the nodes of the roster that are not in the mask of the
+// signature. The nodes that are neither skipped nor in the refusals are
+// considered as unreachable.
+func (s *Service) nonSigners(roster *onet.Roster, sig []byte, refusals *cosi.Mask,
+	skipped []*network.ServerIdentity) ([]NonSigner, error) {
+	mask, err := cosi.NewMask(s.suite, roster.Publics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = mask.SetMask(sig[s.suite.PointLen()+s.suite.ScalarLen():])
+	if err != nil {
+		return nil, err
+	}
+	var nonSigners []NonSigner
+	var nRefused int
+	for i, si := range roster.List {
+		if ok, _ := mask.KeyEnabled(si.Public); ok {
+			continue
+		}
+		reason := NonSignerUnreachable
+		if containsNode(skipped, si) {
+			reason = NonSignerSkipped
+		}
+		if reason == NonSignerUnreachable && refusals != nil {
+			if refused, _ := refusals.KeyEnabled(si.Public); refused {
+				reason = NonSignerRefused
+				nRefused++
+			}
+		}
+		log.Lvlf2("node %d (%s) didn't sign: reason %d", i, si.Address, reason)
+		nonSigners = append(nonSigners, NonSigner{si, reason})
+	}
+	if float64(nRefused) > RefusalWarning*float64(len(roster.List)) {
+		log.Warnf("%d out of %d nodes refused to sign", nRefused, len(roster.List))
+	}
+	return nonSigners, nil
 }
 
 // NewProtocol is called on all nodes of a Tree (except the root, since it is
@@ -109,7 +771,7 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		return protocol.NewDefaultProtocol(tn)
 	}
 	if tn.ProtocolName() == protocol.DefaultSubProtocolName {
-		return protocol.NewDefaultSubProtocol(tn)
+		return protocol.NewSubFtCosi(tn, s.verify, s.suite)
 	}
 	return nil, errors.New("no such protocol " + tn.ProtocolName())
 }
@@ -118,8 +780,16 @@ func newCoSiService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		suite:            cothority.Suite,
+		resultTimeout:    DefaultResultTimeout,
+		maxPending:       DefaultMaxPending,
+		results:          make(map[string]*asyncResult),
+		verifiers:        make(map[string]MessageVerifier),
+		health:           newHealthStats(),
 	}
-	if err := s.RegisterHandler(s.SignatureRequest); err != nil {
+	s.verify = s.verifyMessage
+	s.RegisterProcessorFunc(healthCheckID, func(*network.Envelope) {})
+	if err := s.RegisterHandlers(s.SignatureRequest, s.SubmitSignatureRequest,
+		s.GetSignatureResult, s.GetHealth, s.GetAggregateKey); err != nil {
 		log.Error("couldn't register message:", err)
 		return nil, err
 	}
@@ -1,12 +1,22 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/ftcosi/protocol"
+	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/cosi"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 	"github.com/stretchr/testify/require"
 )
 
@@ -64,3 +74,753 @@ func TestCreateAggregate(t *testing.T) {
 	// verify the response still
 	require.Nil(t, cosi.Verify(tSuite, roster.Publics(), msg, res.Signature, cosi.CompletePolicy{}))
 }
+
+func TestClient_Failover(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+
+	// The first node is down, but the others can still sign.
+	require.Nil(t, servers[0].Close())
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	for i := 0; i < 3; i++ {
+		res, err := client.Sign(&SignatureRequest{
+			Roster:           roster,
+			Message:          msg,
+			MinParticipation: 4,
+		})
+		require.Nil(t, err)
+		require.NotNil(t, res.Coordinator)
+		require.False(t, res.Coordinator.Equal(roster.List[0]))
+		require.Nil(t, cosi.Verify(tSuite, roster.Publics(), msg, res.Signature,
+			cosi.NewThresholdPolicy(4)))
+	}
+
+	// All nodes are down.
+	down := onet.NewRoster(roster.List[:1])
+	_, err := client.SignatureRequest(down, msg)
+	require.NotNil(t, err)
+	fe, ok := err.(*FailoverError)
+	require.True(t, ok)
+	require.Equal(t, 1, len(fe.Attempts))
+	require.True(t, fe.Attempts[0].Node.Equal(roster.List[0]))
+	require.Contains(t, err.Error(), roster.List[0].Address.String())
+
+	// An error of the service is returned without trying the other nodes.
+	client = NewClient()
+	_, err = client.Sign(&SignatureRequest{
+		Roster:   onet.NewRoster(roster.List[1:]),
+		Message:  msg,
+		Verifier: "unknown",
+	})
+	require.NotNil(t, err)
+	_, ok = err.(*FailoverError)
+	require.False(t, ok)
+	require.Contains(t, err.Error(), "unknown verifier")
+	require.Equal(t, 0, len(client.failures))
+}
+
+func TestClient_Coordinators(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	_, roster, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+
+	client := NewClient()
+	require.Equal(t, 5, len(client.coordinators(roster)))
+
+	// Nodes that failed recently are tried last.
+	client.setFailure(roster.List[0])
+	client.setFailure(roster.List[1])
+	for i := 0; i < 10; i++ {
+		nodes := client.coordinators(roster)
+		require.Equal(t, 5, len(nodes))
+		for _, si := range nodes[:3] {
+			require.False(t, si.Equal(roster.List[0]) || si.Equal(roster.List[1]))
+		}
+	}
+	client.FailureDelay = 0
+	found := false
+	for i := 0; i < 50 && !found; i++ {
+		found = client.coordinators(roster)[0].Equal(roster.List[0])
+	}
+	require.True(t, found)
+}
+
+func TestClient_Verify(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	_, roster, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+	privates := make([]kyber.Scalar, len(roster.List))
+	for i, si := range roster.List {
+		privates[i] = local.GetPrivate(local.Servers[si.ID])
+	}
+
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	h := tSuite.Hash()
+	h.Write(msg)
+	full := &SignatureResponse{
+		Hash:      h.Sum(nil),
+		Signature: cosign(t, msg, roster.Publics(), privates, 0, 1, 2, 3, 4),
+	}
+	require.Nil(t, client.Verify(roster, msg, full, CompletePolicy))
+	require.Nil(t, client.Verify(roster, msg, full, ThresholdPolicy(3)))
+
+	partial := &SignatureResponse{
+		Hash:      full.Hash,
+		Signature: cosign(t, msg, roster.Publics(), privates, 0, 2, 4),
+	}
+	require.Nil(t, client.Verify(roster, msg, partial, ThresholdPolicy(3)))
+	err := client.Verify(roster, msg, partial, ThresholdPolicy(4))
+	require.NotNil(t, err)
+	pe, ok := err.(*ParticipationError)
+	require.True(t, ok)
+	require.Equal(t, 3, pe.Signers)
+	require.Equal(t, 4, pe.Required)
+	_, ok = client.Verify(roster, msg, partial, CompletePolicy).(*ParticipationError)
+	require.True(t, ok)
+
+	// A threshold must be given.
+	for _, policy := range []Policy{{}, ThresholdPolicy(0), ThresholdPolicy(-1)} {
+		err = client.Verify(roster, msg, full, policy)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "must be at least 1")
+	}
+
+	// Bad signatures.
+	_, ok = client.Verify(roster, []byte("another message"), partial,
+		ThresholdPolicy(3)).(*SignatureError)
+	require.True(t, ok)
+	partial.Hash = nil
+	_, ok = client.Verify(roster, []byte("another message"), partial,
+		ThresholdPolicy(3)).(*SignatureError)
+	require.True(t, ok)
+	tampered := &SignatureResponse{Signature: append([]byte{}, partial.Signature...)}
+	tampered.Signature[len(tampered.Signature)-1] ^= 2
+	_, ok = client.Verify(roster, msg, tampered, ThresholdPolicy(3)).(*SignatureError)
+	require.True(t, ok)
+	_, ok = client.Verify(roster, msg, &SignatureResponse{}, CompletePolicy).(*SignatureError)
+	require.True(t, ok)
+}
+
+// cosign returns the collective signature of msg by the nodes with the
+// given indexes.
+func cosign(t *testing.T, msg []byte, publics []kyber.Point, privates []kyber.Scalar,
+	signers ...int) []byte {
+	mask, err := cosi.NewMask(tSuite, publics, nil)
+	require.Nil(t, err)
+	var secrets []kyber.Scalar
+	var commits []kyber.Point
+	for _, i := range signers {
+		v, V := cosi.Commit(tSuite)
+		secrets = append(secrets, v)
+		commits = append(commits, V)
+		require.Nil(t, mask.SetBit(i, true))
+	}
+	commit := tSuite.Point().Null()
+	for _, V := range commits {
+		commit.Add(commit, V)
+	}
+	challenge, err := cosi.Challenge(tSuite, commit, mask.AggregatePublic, msg)
+	require.Nil(t, err)
+	var responses []kyber.Scalar
+	for j, i := range signers {
+		r, err := cosi.Response(tSuite, privates[i], secrets[j], challenge)
+		require.Nil(t, err)
+		responses = append(responses, r)
+	}
+	response, err := cosi.AggregateResponses(tSuite, responses)
+	require.Nil(t, err)
+	sig, err := cosi.Sign(tSuite, commit, response, mask)
+	require.Nil(t, err)
+	return sig
+}
+
+func TestServiceCosi_Subtrees(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	_, roster, _ := local.GenTree(10, false)
+	defer local.CloseAll()
+
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	for _, subtrees := range []int{0, 2, 9} {
+		res, err := client.Sign(&SignatureRequest{
+			Roster:   roster,
+			Message:  msg,
+			Subtrees: subtrees,
+		})
+		require.Nil(t, err)
+		if subtrees == 0 {
+			require.Equal(t, 3, res.Subtrees)
+		} else {
+			require.Equal(t, subtrees, res.Subtrees)
+		}
+		require.Nil(t, client.Verify(roster, msg, res, CompletePolicy))
+	}
+
+	for _, subtrees := range []int{-1, 10, 100} {
+		_, err := client.Sign(&SignatureRequest{
+			Roster:   roster,
+			Message:  msg,
+			Subtrees: subtrees,
+		})
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "number of subtrees")
+	}
+	// The service checks the request, too.
+	err := client.SendProtobuf(roster.List[0], &SignatureRequest{
+		Roster:   roster,
+		Message:  msg,
+		Subtrees: 10,
+	}, &SignatureResponse{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "number of subtrees")
+}
+
+func TestClient_Async(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	id, err := client.SignatureRequestAsync(&SignatureRequest{
+		Roster:  roster,
+		Message: msg,
+	})
+	require.Nil(t, err)
+	res, err := client.WaitSignature(id, 10*time.Second)
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(roster, msg, res, CompletePolicy))
+
+	// The request is forgotten by the client once it is done.
+	_, err = client.WaitSignature(id, time.Second)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown signature request")
+
+	// A node that cannot be reached is polled until the timeout, and the
+	// request is kept.
+	down := network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+		network.NewAddress(network.PlainTCP, "127.0.0.1:2"))
+	client.pending["down"] = down
+	start := time.Now()
+	_, err = client.WaitSignature([]byte("down"), 500*time.Millisecond)
+	require.NotNil(t, err)
+	require.True(t, time.Since(start) >= 500*time.Millisecond)
+	require.NotNil(t, client.pending["down"])
+
+	// The nodes refuse new requests if too many are pending.
+	for _, s := range local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName)) {
+		s.(*Service).maxPending = 0
+	}
+	_, err = client.SignatureRequestAsync(&SignatureRequest{
+		Roster:  roster,
+		Message: msg,
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "too many pending requests")
+}
+
+func TestService_AsyncExpiry(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(4, false)
+	defer local.CloseAll()
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	id, err := client.SignatureRequestAsync(&SignatureRequest{
+		Roster:  roster,
+		Message: msg,
+	})
+	require.Nil(t, err)
+	res, err := client.WaitSignature(id, 10*time.Second)
+	require.Nil(t, err)
+
+	// The result is kept for resultTimeout.
+	reply := &GetSignatureResultReply{}
+	require.Nil(t, client.SendProtobuf(res.Coordinator, &GetSignatureResult{ID: id}, reply))
+	require.Equal(t, SignatureDone, reply.Status)
+	require.Equal(t, res.Signature, reply.Response.Signature)
+
+	// Expire the result on the coordinator instead of waiting for it.
+	for _, s := range services {
+		s := s.(*Service)
+		if !s.ServerIdentity().Equal(res.Coordinator) {
+			continue
+		}
+		s.resultsLock.Lock()
+		r := s.results[string(id)]
+		require.NotNil(t, r)
+		require.True(t, time.Until(r.expires) <= s.resultTimeout)
+		r.expires = time.Now().Add(-time.Second)
+		s.resultsLock.Unlock()
+	}
+	err = client.SendProtobuf(res.Coordinator, &GetSignatureResult{ID: id}, reply)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown signature request")
+}
+
+func TestService_NonSigners(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+
+	// With one subtree, node 1 is the subleader of the nodes 2, 3 and 4.
+	// Node 1 refuses to sign and its children only accept once it refused,
+	// so the refusal is part of its first answer. Node 4 is down. The root
+	// verifies the message before starting the protocol, so it doesn't wait.
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+	refused := make(chan struct{})
+	var once sync.Once
+	for i, s := range services {
+		refuse, root := i == 1, i == 0
+		s.(*Service).verify = func(msg, data []byte) bool {
+			if refuse {
+				once.Do(func() { close(refused) })
+				return false
+			}
+			if !root {
+				<-refused
+			}
+			return true
+		}
+	}
+	require.Nil(t, servers[4].Close())
+
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	res := &SignatureResponse{}
+	err := client.SendProtobuf(roster.List[0], &SignatureRequest{
+		Roster:           roster,
+		Message:          msg,
+		MinParticipation: 3,
+		Subtrees:         1,
+	}, res)
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(roster, msg, res, ThresholdPolicy(3)))
+
+	require.Equal(t, 2, len(res.NonSigners))
+	require.True(t, res.NonSigners[0].ServerIdentity.Equal(roster.List[1]))
+	require.Equal(t, NonSignerRefused, res.NonSigners[0].Reason)
+	require.True(t, res.NonSigners[1].ServerIdentity.Equal(roster.List[4]))
+	require.Equal(t, NonSignerUnreachable, res.NonSigners[1].Reason)
+}
+
+func TestClient_Timeout(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(4, false)
+	defer local.CloseAll()
+
+	// Two nodes are slow, so at least one of them is not the root. They
+	// only answer once the test releases them.
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+	release := make(chan struct{})
+	for _, s := range services[2:] {
+		s.(*Service).verify = func(msg, data []byte) bool {
+			<-release
+			return true
+		}
+	}
+
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	_, err := client.Sign(&SignatureRequest{
+		Roster:   roster,
+		Message:  msg,
+		Subtrees: 1,
+		Timeout:  500 * time.Millisecond,
+	})
+	require.NotNil(t, err)
+	te, ok := err.(*protocol.TimeoutError)
+	require.True(t, ok, err.Error())
+	require.Equal(t, "commitment", te.Phase)
+	require.Equal(t, 4, te.Threshold)
+	require.True(t, te.Commits < 3)
+
+	// The context stops the client before the protocol times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.SignContext(ctx, &SignatureRequest{
+		Roster:  roster,
+		Message: msg,
+		Timeout: time.Second,
+	})
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < 500*time.Millisecond)
+	// The cancelled request doesn't hold up the next ones.
+	fast := onet.NewRoster(roster.List[:2])
+	res, err := client.Sign(&SignatureRequest{
+		Roster:  fast,
+		Message: msg,
+	})
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(fast, msg, res, CompletePolicy))
+	require.True(t, time.Since(start) < 500*time.Millisecond)
+
+	_, err = client.Sign(&SignatureRequest{
+		Roster:  roster,
+		Message: msg,
+		Timeout: 2 * MaxTimeout,
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "timeout")
+
+	// Let the protocols and the slow nodes finish before closing.
+	close(release)
+	require.Nil(t, local.WaitDone(10*time.Second))
+}
+
+func TestService_MessageVerifier(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(4, false)
+	defer local.CloseAll()
+
+	// The subleader, node 1, refuses the "slow" message and its children
+	// only accept it once it refused. The root verifies the message before
+	// starting the protocol, so it doesn't wait.
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+	refused := make(chan struct{})
+	var once sync.Once
+	for i, s := range services {
+		refuse, root := i == 1, i == 0
+		s.(*Service).RegisterMessageVerifier("ok", func(msg []byte) bool {
+			return bytes.HasPrefix(msg, []byte("ok:"))
+		})
+		s.(*Service).RegisterMessageVerifier("slow", func(msg []byte) bool {
+			if refuse {
+				once.Do(func() { close(refused) })
+				return false
+			}
+			if !root {
+				<-refused
+			}
+			return true
+		})
+	}
+
+	client := NewClient()
+	sign := func(msg []byte, verifier string, threshold int) (*SignatureResponse, error) {
+		res := &SignatureResponse{}
+		err := client.SendProtobuf(roster.List[0], &SignatureRequest{
+			Roster:           roster,
+			Message:          msg,
+			MinParticipation: threshold,
+			Subtrees:         1,
+			Verifier:         verifier,
+		}, res)
+		return res, err
+	}
+
+	msg := []byte("ok: sign me")
+	res, err := sign(msg, "ok", 0)
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(roster, msg, res, CompletePolicy))
+	require.Equal(t, 0, len(res.NonSigners))
+
+	_, err = sign([]byte("sign me"), "ok", 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "message refused by verifier")
+
+	_, err = sign(msg, "unknown", 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown verifier")
+
+	res, err = sign(msg, "slow", 3)
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(roster, msg, res, ThresholdPolicy(3)))
+	require.Equal(t, 1, len(res.NonSigners))
+	require.True(t, res.NonSigners[0].ServerIdentity.Equal(roster.List[1]))
+	require.Equal(t, NonSignerRefused, res.NonSigners[0].Reason)
+
+	// With a default verifier, requests without verifier are checked too.
+	require.NotNil(t, services[0].(*Service).SetDefaultVerifier("unknown"))
+	_, err = sign([]byte("sign me"), "", 0)
+	require.Nil(t, err)
+	for _, s := range services {
+		require.Nil(t, s.(*Service).SetDefaultVerifier("ok"))
+	}
+	_, err = sign([]byte("sign me"), "", 0)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "message refused by verifier")
+	res, err = sign(msg, "", 0)
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(roster, msg, res, CompletePolicy))
+
+	// A node refuses to sign if its own default verifier refuses.
+	require.Nil(t, services[0].(*Service).SetDefaultVerifier(""))
+	_, err = sign([]byte("sign me"), "", 4)
+	require.NotNil(t, err)
+}
+
+func TestClient_SignReader(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	_, roster, _ := local.GenTree(4, false)
+	defer local.CloseAll()
+
+	client := NewClient()
+	stream := func() io.Reader {
+		return io.LimitReader(rand.New(rand.NewSource(1)), 50<<20)
+	}
+	res, digest, err := client.SignReader(roster, DigestSHA256, stream())
+	require.Nil(t, err)
+	expected, err := Digest(DigestSHA256, stream())
+	require.Nil(t, err)
+	require.Equal(t, expected, digest)
+	require.Nil(t, client.VerifyDigest(roster, DigestSHA256, digest, res, CompletePolicy))
+	require.NotNil(t, client.VerifyDigest(roster, DigestSHA512, digest, res, CompletePolicy))
+	// The signed message cannot be passed as a raw message.
+	require.NotNil(t, client.Verify(roster, DigestMessage(DigestSHA256, digest), res, CompletePolicy))
+
+	// A signature of a raw message doesn't verify as a signature of its
+	// digest, and a raw message cannot be in the domain of digests.
+	msg := []byte("hello ftcosi service")
+	res, err = client.SignatureRequest(roster, msg)
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(roster, msg, res, CompletePolicy))
+	digest, err = Digest(DigestSHA256, bytes.NewReader(msg))
+	require.Nil(t, err)
+	require.NotNil(t, client.VerifyDigest(roster, DigestSHA256, digest, res, CompletePolicy))
+	_, err = client.SignatureRequest(roster, DigestMessage(DigestSHA256, digest))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "message cannot start with")
+
+	_, err = client.SignDigest(roster, "md5", digest)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown digest algorithm")
+	_, err = client.SignDigest(roster, DigestSHA512, digest)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "digest has 32 bytes instead of 64")
+}
+
+func TestService_VerifyDigestMessage(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	servers, _, _ := local.GenTree(1, false)
+	defer local.CloseAll()
+	s := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))[0].(*Service)
+
+	// Every node refuses messages in the domain of digests that are not
+	// the message of a digest, even if the root didn't check them.
+	digest := make([]byte, 32)
+	require.True(t, s.verifyMessage([]byte("hello ftcosi service"), nil))
+	require.True(t, s.verifyMessage(DigestMessage(DigestSHA256, digest), nil))
+	require.False(t, s.verifyMessage(DigestMessage(DigestSHA512, digest), nil))
+	require.False(t, s.verifyMessage(DigestMessage("md5", digest), nil))
+	require.False(t, s.verifyMessage([]byte(digestPrefix+"hello"), nil))
+}
+
+func TestService_Health(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+
+	require.Nil(t, servers[4].Close())
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	sign := func(minParticipation int) (*SignatureResponse, error) {
+		res := &SignatureResponse{}
+		err := client.SendProtobuf(roster.List[0], &SignatureRequest{
+			Roster:           roster,
+			Message:          msg,
+			Subtrees:         1,
+			MinParticipation: minParticipation,
+			Timeout:          time.Second,
+		}, res)
+		return res, err
+	}
+
+	// The first request finds out that node 4 is down.
+	res, err := sign(4)
+	require.Nil(t, err)
+	require.Equal(t, 4, res.Participation)
+	require.Equal(t, 1, len(res.NonSigners))
+	require.Equal(t, NonSignerUnreachable, res.NonSigners[0].Reason)
+	// Node 4 is only counted as failing once it is known that it cannot be
+	// reached. The root checks it in the background, so check it here too
+	// instead of waiting for that check.
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+	root := services[0].(*Service)
+	root.checkReachable(roster.List[4])
+	_, unhealthy := root.health.split(roster.List, roster.List[0], time.Now())
+	require.Equal(t, []*network.ServerIdentity{roster.List[4]}, unhealthy)
+
+	// The next requests don't ask node 4 anymore.
+	for i := 0; i < 2; i++ {
+		res, err = sign(4)
+		require.Nil(t, err)
+		require.Nil(t, client.Verify(roster, msg, res, ThresholdPolicy(4)))
+		require.Equal(t, 4, res.Participation)
+		require.Equal(t, 1, len(res.NonSigners))
+		require.True(t, res.NonSigners[0].ServerIdentity.Equal(roster.List[4]))
+		require.Equal(t, NonSignerSkipped, res.NonSigners[0].Reason)
+	}
+
+	health, err := client.GetHealth(roster.List[0])
+	require.Nil(t, err)
+	require.Equal(t, 5, len(health))
+	for _, h := range health {
+		if h.ServerIdentity.Equal(roster.List[4]) {
+			require.False(t, h.Healthy)
+			require.Equal(t, 0.0, h.SuccessRate)
+		} else {
+			require.True(t, h.Healthy)
+			require.Equal(t, 1.0, h.SuccessRate)
+			require.NotEqual(t, time.Duration(0), h.MedianLatency)
+		}
+	}
+
+	// If the healthy nodes are not enough, the full roster is used. The
+	// timeout is given in the response.
+	res, err = sign(5)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(res.Signature))
+	require.NotNil(t, res.Timeout)
+	require.Equal(t, "commitment", res.Timeout.Phase)
+}
+
+func TestService_HealthFallback(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	servers, roster, _ := local.GenTree(5, false)
+	defer local.CloseAll()
+
+	// Node 1 is considered as failing, but it is up, and node 2 refuses to
+	// sign, so the healthy nodes cannot sign alone.
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+	services[0].(*Service).health.failure(roster.List[1], time.Now())
+	services[2].(*Service).verify = func(msg, data []byte) bool {
+		return false
+	}
+
+	client := NewClient()
+	msg := []byte("hello ftcosi service")
+	res := &SignatureResponse{}
+	err := client.SendProtobuf(roster.List[0], &SignatureRequest{
+		Roster:           roster,
+		Message:          msg,
+		MinParticipation: 4,
+	}, res)
+	require.Nil(t, err)
+	require.Nil(t, client.Verify(roster, msg, res, ThresholdPolicy(4)))
+	require.Equal(t, 4, res.Participation)
+	require.Equal(t, 1, len(res.NonSigners))
+	require.True(t, res.NonSigners[0].ServerIdentity.Equal(roster.List[2]))
+	require.Equal(t, NonSignerRefused, res.NonSigners[0].Reason)
+}
+
+func TestHealthStats(t *testing.T) {
+	si1 := network.NewServerIdentity(tSuite.Point().Base(), network.NewLocalAddress("1"))
+	si2 := network.NewServerIdentity(tSuite.Point().Null(), network.NewLocalAddress("2"))
+	list := []*network.ServerIdentity{si1, si2}
+	hs := newHealthStats()
+	hs.halfLife = time.Minute
+	now := time.Now()
+
+	hs.success(si1, time.Second, now)
+	hs.success(si2, time.Second, now)
+	hs.failure(si2, now)
+	healthy, unhealthy := hs.split(list, si1, now)
+	require.Equal(t, 2, len(healthy))
+	require.Equal(t, 0, len(unhealthy))
+	hs.failure(si2, now)
+	healthy, unhealthy = hs.split(list, si1, now)
+	require.Equal(t, []*network.ServerIdentity{si1}, healthy)
+	require.Equal(t, []*network.ServerIdentity{si2}, unhealthy)
+	// The coordinator is always healthy.
+	healthy, _ = hs.split(list, si2, now)
+	require.Equal(t, 2, len(healthy))
+
+	// The failures decay until they don't count anymore.
+	_, unhealthy = hs.split(list, si1, now.Add(time.Minute))
+	require.Equal(t, 1, len(unhealthy))
+	_, unhealthy = hs.split(list, si1, now.Add(3*time.Minute))
+	require.Equal(t, 0, len(unhealthy))
+	status := hs.status(now.Add(3 * time.Minute))
+	require.Equal(t, 2, len(status))
+	require.InDelta(t, 1.0/3, status[1].SuccessRate, 1e-9)
+	require.Equal(t, time.Second, status[1].MedianLatency)
+
+	// Only the statistics of the last updated nodes are kept.
+	for i := 0; i < maxHealthNodes; i++ {
+		si := network.NewServerIdentity(tSuite.Point().Pick(tSuite.RandomStream()),
+			network.NewLocalAddress(fmt.Sprint("node", i)))
+		hs.failure(si, now.Add(3*time.Minute+time.Duration(i+1)*time.Second))
+	}
+	require.Equal(t, maxHealthNodes, len(hs.nodes))
+	require.Nil(t, hs.nodes[si1.ID])
+	require.Nil(t, hs.nodes[si2.ID])
+}
+
+func TestParseMask(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(10, false)
+
+	// Bits are read from the least significant bit of the first byte.
+	present, absent, err := ParseMask([]byte{0x05, 0x02}, roster)
+	require.Nil(t, err)
+	require.Equal(t, []*network.ServerIdentity{roster.List[0], roster.List[2], roster.List[9]}, present)
+	require.Equal(t, 7, len(absent))
+	require.Equal(t, roster.List[1], absent[0])
+	require.Equal(t, roster.List[8], absent[6])
+
+	// The ordering is the one of the signatures.
+	mask, err := cosi.NewMask(tSuite, roster.Publics(), nil)
+	require.Nil(t, err)
+	require.Nil(t, mask.SetBit(3, true))
+	require.Nil(t, mask.SetBit(8, true))
+	require.Equal(t, []byte{0x08, 0x01}, mask.Mask())
+	present, _, err = ParseMask(mask.Mask(), roster)
+	require.Nil(t, err)
+	require.Equal(t, []*network.ServerIdentity{roster.List[3], roster.List[8]}, present)
+
+	_, _, err = ParseMask([]byte{0x05}, roster)
+	require.NotNil(t, err)
+	_, _, err = ParseMask([]byte{0x05, 0x04}, roster)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "bit 10 is set")
+
+	// Rosters with unknown or duplicate nodes are refused.
+	_, _, err = ParseMask([]byte{0x01}, nil)
+	require.NotNil(t, err)
+	unknown := network.NewServerIdentity(nil, network.NewLocalAddress("unknown"))
+	_, _, err = ParseMask([]byte{0x01}, &onet.Roster{List: []*network.ServerIdentity{roster.List[0], unknown}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no public key")
+	_, _, err = ParseMask([]byte{0x01}, &onet.Roster{List: []*network.ServerIdentity{roster.List[0], roster.List[0]}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "in the roster twice")
+}
+
+func TestService_GetAggregateKey(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	_, roster, _ := local.GenTree(3, false)
+	defer local.CloseAll()
+
+	client := NewClient()
+	reply, err := client.GetAggregateKey(roster)
+	require.Nil(t, err)
+	agg := tSuite.Point().Null()
+	for _, p := range roster.Publics() {
+		agg.Add(agg, p)
+	}
+	require.True(t, agg.Equal(reply.AggregateKey))
+	require.Equal(t, len(roster.List), len(reply.Publics))
+	for i, p := range roster.Publics() {
+		require.True(t, p.Equal(reply.Publics[i]))
+	}
+	require.Equal(t, MaskOrdering, reply.MaskOrdering)
+
+	// A signature of all nodes verifies against the aggregate key.
+	msg := []byte("hello ftcosi service")
+	res, err := client.SignatureRequest(roster, msg)
+	require.Nil(t, err)
+	require.Nil(t, cosi.Verify(tSuite, []kyber.Point{reply.AggregateKey}, msg,
+		append(res.Signature[:len(res.Signature)-1], 1), cosi.CompletePolicy{}))
+
+	double := onet.NewRoster(append(roster.List, roster.List[0]))
+	err = client.SendProtobuf(roster.List[0], &GetAggregateKey{double}, &GetAggregateKeyReply{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "is in the roster twice")
+}
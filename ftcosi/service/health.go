@@ -0,0 +1,181 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dedis/onet/network"
+)
+
+// This file keeps the statistics of the nodes the service signed with as a
+// coordinator, so that it can leave out the nodes that keep failing.
+
+// DefaultHealthHalfLife is the time after which the past signatures of a
+// node only count half in its statistics.
+const DefaultHealthHalfLife = 10 * time.Minute
+
+// healthyRate is the success rate under which a node is not healthy.
+const healthyRate = 0.5
+
+// minFailures is the weight of the failures under which a node is always
+// healthy, so that a node is asked again once its failures decayed.
+const minFailures = 0.5
+
+// maxLatencies is the number of latencies kept for every node.
+const maxLatencies = 16
+
+// maxHealthNodes is the number of nodes for which statistics are kept. Once
+// it is reached, the statistics of the node that has not been updated for
+// the longest time are dropped.
+const maxHealthNodes = 1000
+
+// NodeHealth holds the statistics of a node.
+type NodeHealth struct {
+	ServerIdentity *network.ServerIdentity
+	// SuccessRate is the decayed fraction of the signatures the node took
+	// part in. It is 1 if there are no statistics.
+	SuccessRate float64
+	// MedianLatency is the median of the time the last signatures the node
+	// took part in needed.
+	MedianLatency time.Duration
+	// Healthy is false if the node is left out of requests with a
+	// MinParticipation.
+	Healthy bool
+}
+
+type nodeHealth struct {
+	si        *network.ServerIdentity
+	successes float64
+	failures  float64
+	latencies []time.Duration
+	updated   time.Time
+}
+
+// decay lets the statistics decay until now.
+func (h *nodeHealth) decay(now time.Time, halfLife time.Duration) {
+	if !h.updated.IsZero() && now.After(h.updated) {
+		f := math.Pow(0.5, float64(now.Sub(h.updated))/float64(halfLife))
+		h.successes *= f
+		h.failures *= f
+	}
+	h.updated = now
+}
+
+func (h *nodeHealth) successRate() float64 {
+	if h.successes+h.failures == 0 {
+		return 1
+	}
+	return h.successes / (h.successes + h.failures)
+}
+
+func (h *nodeHealth) healthy() bool {
+	return h.failures < minFailures || h.successRate() >= healthyRate
+}
+
+func (h *nodeHealth) medianLatency() time.Duration {
+	if len(h.latencies) == 0 {
+		return 0
+	}
+	l := append([]time.Duration{}, h.latencies...)
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return l[len(l)/2]
+}
+
+// healthStats holds the statistics of all nodes.
+type healthStats struct {
+	sync.Mutex
+	halfLife time.Duration
+	nodes    map[network.ServerIdentityID]*nodeHealth
+}
+
+func newHealthStats() *healthStats {
+	return &healthStats{
+		halfLife: DefaultHealthHalfLife,
+		nodes:    make(map[network.ServerIdentityID]*nodeHealth),
+	}
+}
+
+// get returns the decayed statistics of si. The caller must hold the lock.
+func (hs *healthStats) get(si *network.ServerIdentity, now time.Time) *nodeHealth {
+	h, ok := hs.nodes[si.ID]
+	if !ok {
+		if len(hs.nodes) >= maxHealthNodes {
+			hs.dropOldest()
+		}
+		h = &nodeHealth{si: si}
+		hs.nodes[si.ID] = h
+	}
+	h.decay(now, hs.halfLife)
+	return h
+}
+
+// dropOldest removes the statistics of the node that has not been updated
+// for the longest time. The caller must hold the lock.
+func (hs *healthStats) dropOldest() {
+	var oldest *nodeHealth
+	for _, h := range hs.nodes {
+		if oldest == nil || h.updated.Before(oldest.updated) {
+			oldest = h
+		}
+	}
+	if oldest != nil {
+		delete(hs.nodes, oldest.si.ID)
+	}
+}
+
+// success records that si took part in a signature that took latency.
+func (hs *healthStats) success(si *network.ServerIdentity, latency time.Duration, now time.Time) {
+	hs.Lock()
+	defer hs.Unlock()
+	h := hs.get(si, now)
+	h.successes++
+	h.latencies = append(h.latencies, latency)
+	if len(h.latencies) > maxLatencies {
+		h.latencies = h.latencies[1:]
+	}
+}
+
+// failure records that si couldn't be reached.
+func (hs *healthStats) failure(si *network.ServerIdentity, now time.Time) {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.get(si, now).failures++
+}
+
+// split returns the healthy and the unhealthy nodes of list, keeping their
+// order. The coordinator is always healthy.
+func (hs *healthStats) split(list []*network.ServerIdentity, coordinator *network.ServerIdentity,
+	now time.Time) (healthy, unhealthy []*network.ServerIdentity) {
+	hs.Lock()
+	defer hs.Unlock()
+	for _, si := range list {
+		if si.Equal(coordinator) || hs.get(si, now).healthy() {
+			healthy = append(healthy, si)
+		} else {
+			unhealthy = append(unhealthy, si)
+		}
+	}
+	return
+}
+
+// status returns the statistics of all nodes, sorted by address.
+func (hs *healthStats) status(now time.Time) []NodeHealth {
+	hs.Lock()
+	defer hs.Unlock()
+	var status []NodeHealth
+	for _, h := range hs.nodes {
+		h.decay(now, hs.halfLife)
+		status = append(status, NodeHealth{
+			ServerIdentity: h.si,
+			SuccessRate:    h.successRate(),
+			MedianLatency:  h.medianLatency(),
+			Healthy:        h.healthy(),
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].ServerIdentity.Address < status[j].ServerIdentity.Address
+	})
+	return status
+}
@@ -6,12 +6,12 @@ runs on the node.
 */
 
 import (
-	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"sort"
 
 	"github.com/dedis/cothority/byzcoin"
+	pop "github.com/dedis/cothority/pop/service"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 )
@@ -216,16 +216,10 @@ func (s *Service) ReadMessage(rm *ReadMessage) (*ReadMessageReply, error) {
 
 	cBuf := make([]byte, 8)
 	binary.LittleEndian.PutUint64(cBuf, msg.Reward)
-	partyCoin := sha256.New()
-	partyCoin.Write(rm.PartyIID)
-	pubBuf, err := party.Signer.Ed25519.Point.MarshalBinary()
-	if err != nil {
-		return nil, errors.New("couldn't marshal party public key: " + err.Error())
-	}
-	partyCoin.Write(pubBuf)
+	partyCoin := pop.AttendeeCoinID(byzcoin.NewInstanceID(rm.PartyIID), party.Signer.Ed25519.Point)
 	ctx := byzcoin.ClientTransaction{
 		Instructions: []byzcoin.Instruction{{
-			InstanceID: byzcoin.NewInstanceID(partyCoin.Sum(nil)),
+			InstanceID: partyCoin,
 			Invoke: &byzcoin.Invoke{
 				Command: "transfer",
 				Args: []byzcoin.Argument{{
@@ -315,7 +315,7 @@ func newS(t *testing.T) (s *sStruct) {
 	s.signer = darc.NewSignerEd25519(nil, nil)
 	var err error
 	s.gMsg, err = byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, s.roster,
-		[]string{"spawn:dummy", "spawn:popParty", "invoke:Finalize"}, s.signer.Identity())
+		[]string{"spawn:dummy", "spawn:popParty", "invoke:freeze", "invoke:Finalize"}, s.signer.Identity())
 	require.Nil(t, err)
 	s.gMsg.BlockInterval = 500 * time.Millisecond
 
@@ -427,6 +427,9 @@ func (s *sStruct) createPoPSpawn(t *testing.T) {
 				Args: byzcoin.Arguments{{
 					Name:  "FinalStatement",
 					Value: fsBuf,
+				}, {
+					Name:  "Organizers",
+					Value: dID,
 				}},
 			},
 			SignerCounter: []uint64{signerCtrs.Counters[0] + 1},
@@ -460,7 +463,13 @@ func (s *sStruct) invokePoPFinalize(t *testing.T) {
 	sBuf, err := s.service.Public.MarshalBinary()
 	require.Nil(t, err)
 	ctx := byzcoin.ClientTransaction{
-		Instructions: byzcoin.Instructions{byzcoin.Instruction{
+		Instructions: byzcoin.Instructions{{
+			InstanceID: s.popI,
+			Invoke: &byzcoin.Invoke{
+				Command: "freeze",
+			},
+			SignerCounter: []uint64{signerCtrs.Counters[0] + 1},
+		}, {
 			InstanceID: s.popI,
 			Invoke: &byzcoin.Invoke{
 				Command: "Finalize",
@@ -469,13 +478,17 @@ func (s *sStruct) invokePoPFinalize(t *testing.T) {
 						Name:  "FinalStatement",
 						Value: fsBuf,
 					},
+					{
+						Name:  "Signature",
+						Value: s.party.Signature,
+					},
 					{
 						Name:  "Service",
 						Value: sBuf,
 					},
 				},
 			},
-			SignerCounter: []uint64{signerCtrs.Counters[0] + 1},
+			SignerCounter: []uint64{signerCtrs.Counters[0] + 2},
 		}},
 	}
 	dID := s.gMsg.GenesisDarc.GetBaseID()
@@ -7,7 +7,6 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -740,9 +739,14 @@ func bcStore(c *cli.Context) error {
 	}
 	// The master signer has the right to create a new party.
 	rules.AddRule("spawn:popParty", expression.Expr(signer.Identity().String()))
-	// We allow any of the organizers to update the proposed configuration. The contract
-	// will make sure that it is correctly signed.
+	// We allow any of the organizers to update the proposed configuration.
+	// The contract will make sure that it is correctly signed.
 	rules.AddRule("invoke:Finalize", expression.Expr(strings.Join(exprSlice, " | ")))
+	// Any of the organizers can start the scanning and close the registration.
+	rules.AddRule("invoke:scan", expression.Expr(strings.Join(exprSlice, " | ")))
+	rules.AddRule("invoke:freeze", expression.Expr(strings.Join(exprSlice, " | ")))
+	// Any of the organizers can delete the party before it is finalized.
+	rules.AddRule("delete", expression.Expr(strings.Join(exprSlice, " | ")))
 	orgDarc := darc.NewDarc(rules, []byte("For party "+fsString))
 	orgDarcBuf, err := orgDarc.ToProto()
 	if err != nil {
@@ -783,6 +787,14 @@ func bcStore(c *cli.Context) error {
 			Args: byzcoin.Arguments{{
 				Name:  "FinalStatement",
 				Value: partyConfigBuf,
+			}, {
+				Name:  "Organizers",
+				Value: orgDarc.GetBaseID(),
+			}, {
+				// The attendees register themselves, the contract
+				// checks the countersignature of an organizer.
+				Name:  "OpenRegistration",
+				Value: []byte{1},
 			}},
 		},
 		SignerCounter: []uint64{signerCtrs.Counters[0] + 2},
@@ -882,24 +894,48 @@ func bcFinalize(c *cli.Context) error {
 		return errors.New("Couldn't get point: " + err.Error())
 	}
 
+	p, err := ocl.GetProof(partyInstance.Slice())
+	if err != nil {
+		return errors.New("couldn't get party instance: " + err.Error())
+	}
+	var ppi service.PopPartyInstance
+	err = p.Proof.VerifyAndDecode(cothority.Suite, service.ContractPopParty, &ppi)
+	if err != nil {
+		return errors.New("couldn't get party instance: " + err.Error())
+	}
+
 	log.Info("Sending finalize-instruction")
-	ctx := byzcoin.ClientTransaction{
-		Instructions: byzcoin.Instructions{byzcoin.Instruction{
+	ctx := byzcoin.ClientTransaction{}
+	if ppi.State != service.PartyFrozen {
+		log.Info("Closing the registration of the party")
+		ctx.Instructions = append(ctx.Instructions, byzcoin.Instruction{
 			InstanceID: partyInstance,
 			Invoke: &byzcoin.Invoke{
-				Command: "Finalize",
-				Args: byzcoin.Arguments{
-					byzcoin.Argument{
-						Name:  "FinalStatement",
-						Value: fsBuf,
-					},
-					{
-						Name:  "Service",
-						Value: sigBuf,
-					}},
+				Command: "freeze",
 			},
-			SignerCounter: []uint64{signerCtrs.Counters[0] + 1},
-		}},
+		})
+	}
+	ctx.Instructions = append(ctx.Instructions, byzcoin.Instruction{
+		InstanceID: partyInstance,
+		Invoke: &byzcoin.Invoke{
+			Command: "Finalize",
+			Args: byzcoin.Arguments{
+				byzcoin.Argument{
+					Name:  "FinalStatement",
+					Value: fsBuf,
+				},
+				{
+					Name:  "Signature",
+					Value: fs.Signature,
+				},
+				{
+					Name:  "Service",
+					Value: sigBuf,
+				}},
+		},
+	})
+	for i := range ctx.Instructions {
+		ctx.Instructions[i].SignerCounter = []uint64{signerCtrs.Counters[0] + uint64(i) + 1}
 	}
 	err = ctx.SignWith(*signer)
 	if err != nil {
@@ -910,15 +946,16 @@ func bcFinalize(c *cli.Context) error {
 	if err != nil {
 		return errors.New("error while sending transaction: " + err.Error())
 	}
-
-	iid := sha256.New()
-	iid.Write(ctx.Instructions[0].InstanceID.Slice())
-	pubBuf, err := signer.Ed25519.Point.MarshalBinary()
+	// The nodes of the party that don't hold the ledger get the final
+	// statement now.
+	_, err = service.NewClient().PropagateFinalStatement(ocl.Roster().List[0].Address,
+		cfg.ByzCoinID, partyInstance)
 	if err != nil {
-		return errors.New("couldn't marshal public key: " + err.Error())
+		log.Warn("couldn't propagate the final statement:", err)
 	}
-	iid.Write(pubBuf)
-	p, err := ocl.GetProof(iid.Sum(nil))
+
+	serviceCoin := service.AttendeeCoinID(ctx.Instructions[0].InstanceID, signer.Ed25519.Point)
+	p, err = ocl.GetProof(serviceCoin.Slice())
 	if err != nil {
 		return errors.New("couldn't calculate service coin address: " + err.Error())
 	}
@@ -986,10 +1023,11 @@ func bcCoinShow(c *cli.Context) error {
 		// This account doesn't exist - try with the account, supposing we got a
 		// public key.
 		log.Info("Interpreting argument as public key.")
-		h := sha256.New()
-		h.Write(partyInstanceID)
-		h.Write(accountID)
-		accountID = h.Sum(nil)
+		pub := cothority.Suite.Point()
+		if err = pub.UnmarshalBinary(accountID); err != nil {
+			return errors.New("didn't find this account and couldn't parse public key: " + err.Error())
+		}
+		accountID = service.AttendeeCoinID(byzcoin.NewInstanceID(partyInstanceID), pub).Slice()
 		accountProof, err = ocl.GetProof(accountID)
 		if err != nil {
 			return errors.New("couldn't get proof for account: " + err.Error())
@@ -1037,27 +1075,13 @@ func bcCoinTransfer(c *cli.Context) error {
 	}
 	srcPub := cothority.Suite.Point().Mul(srcPriv, nil)
 	srcSigner := darc.NewSignerEd25519(srcPub, srcPriv)
-	srcAddrHash := sha256.New()
-	srcAddrHash.Write(partyID)
-	srcPubBuf, err := srcPub.MarshalBinary()
-	if err != nil {
-		return errors.New("couldn't marshal public key: " + err.Error())
-	}
-	srcAddrHash.Write(srcPubBuf)
-	srcAddr := srcAddrHash.Sum(nil)
+	srcAddr := service.AttendeeCoinID(byzcoin.NewInstanceID(partyID), srcPub).Slice()
 
 	dstPub, err := encoding.StringHexToPoint(cothority.Suite, c.Args().Get(3))
 	if err != nil {
 		return errors.New("couldn't parse public key: " + err.Error())
 	}
-	dstAddrHash := sha256.New()
-	dstAddrHash.Write(partyID)
-	dstPubBuf, err := dstPub.MarshalBinary()
-	if err != nil {
-		return errors.New("couldn't marshal public key: " + err.Error())
-	}
-	dstAddrHash.Write(dstPubBuf)
-	dstAddr := dstAddrHash.Sum(nil)
+	dstAddr := service.AttendeeCoinID(byzcoin.NewInstanceID(partyID), dstPub).Slice()
 
 	amount, err := strconv.ParseUint(c.Args().Get(4), 10, 64)
 	if err != nil {
@@ -8,7 +8,9 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
 	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/eddsa"
 	"github.com/dedis/kyber/sign/schnorr"
@@ -222,6 +224,88 @@ func (c *Client) GetSigner(dst network.Address, partyID []byte) (darc.Signer, er
 	return ret.Signer, err
 }
 
+// GetPopCoinAccount asks the service for the coin account of the attendee
+// with the public key pub in the party stored in the given instance.
+func (c *Client) GetPopCoinAccount(dst network.Address, byzcoinID skipchain.SkipBlockID,
+	party byzcoin.InstanceID, pub kyber.Point) (*GetPopCoinAccountReply, error) {
+	si := &network.ServerIdentity{Address: dst}
+	ret := &GetPopCoinAccountReply{}
+
+	err := c.SendProtobuf(si, &GetPopCoinAccount{byzcoinID, party, pub}, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetAttendeeBalance returns the balance of the coin account of the attendee
+// with the public key pub in the party stored in the given instance. The
+// proof of the account is verified against the ledger of bc.
+func (c *Client) GetAttendeeBalance(bc *byzcoin.Client, party byzcoin.InstanceID,
+	pub kyber.Point) (uint64, error) {
+	id, err := PopCoinAccountID(party, pub)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := bc.GetProof(id.Slice())
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Proof.InclusionProof.Match(id.Slice()) {
+		return 0, errors.New("no coin account for this attendee")
+	}
+	var coin byzcoin.Coin
+	err = resp.Proof.VerifyAndDecode(cothority.Suite, contracts.ContractCoinID, &coin)
+	if err != nil {
+		return 0, err
+	}
+	return coin.Value, nil
+}
+
+// GetFinalStatement asks the service for the final statement of the party
+// stored in the given instance. The returned proof needs to be verified by
+// the caller.
+func (c *Client) GetFinalStatement(dst network.Address, byzcoinID skipchain.SkipBlockID,
+	party byzcoin.InstanceID) (*GetFinalStatementReply, error) {
+	si := &network.ServerIdentity{Address: dst}
+	ret := &GetFinalStatementReply{}
+
+	err := c.SendProtobuf(si, &GetFinalStatement{byzcoinID, party}, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// PropagateFinalStatement asks the service to propagate the final statement
+// of the party stored in the given instance to the roster of the party. It
+// returns the number of nodes that received it.
+func (c *Client) PropagateFinalStatement(dst network.Address, byzcoinID skipchain.SkipBlockID,
+	party byzcoin.InstanceID) (int, error) {
+	si := &network.ServerIdentity{Address: dst}
+	ret := &PropagateFinalStatementReply{}
+
+	err := c.SendProtobuf(si, &PropagateFinalStatement{byzcoinID, party}, ret)
+	if err != nil {
+		return 0, err
+	}
+	return ret.Replies, nil
+}
+
+// GetPartyStats asks the service for the statistics of the party stored in
+// the given instance.
+func (c *Client) GetPartyStats(dst network.Address, byzcoinID skipchain.SkipBlockID,
+	party byzcoin.InstanceID) (*GetPartyStatsReply, error) {
+	si := &network.ServerIdentity{Address: dst}
+	ret := &GetPartyStatsReply{}
+
+	err := c.SendProtobuf(si, &GetPartyStats{byzcoinID, party}, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 // The toml-structure for (un)marshaling with toml
 type finalStatementToml struct {
 	Desc      *popDescToml
@@ -466,6 +550,23 @@ func (fs *FinalStatement) Verify() error {
 	return eddsa.Verify(fs.Desc.Roster.Aggregate, h, fs.Signature)
 }
 
+// VerifyAttendance checks that the final statement is signed by the
+// organizers and that pub is one of its attendees.
+func VerifyAttendance(fs *FinalStatement, pub kyber.Point) error {
+	if fs == nil || fs.Desc == nil || fs.Desc.Roster == nil {
+		return errors.New("invalid final statement")
+	}
+	if err := fs.Verify(); err != nil {
+		return errors.New("wrong signature of the final statement: " + err.Error())
+	}
+	for _, att := range fs.Attendees {
+		if att.Equal(pub) {
+			return nil
+		}
+	}
+	return errors.New("not an attendee of this party")
+}
+
 // represents a PopDesc in string-version for toml.
 type popDescToml struct {
 	Name     string
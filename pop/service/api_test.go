@@ -83,6 +83,28 @@ func TestFinalStatement_Verify(t *testing.T) {
 	require.NotNil(t, fs.Verify())
 }
 
+func TestVerifyAttendance(t *testing.T) {
+	eddsa := eddsa.NewEdDSA(random.New())
+	si := network.NewServerIdentity(eddsa.Public, network.NewAddress(network.PlainTCP, "0:2000"))
+	att := key.NewKeyPair(tSuite).Public
+	fs := &FinalStatement{
+		Desc: &PopDesc{
+			Name:     "test",
+			DateTime: "yesterday",
+			Roster:   onet.NewRoster([]*network.ServerIdentity{si}),
+		},
+		Attendees: []kyber.Point{att},
+	}
+	require.NotNil(t, VerifyAttendance(fs, att))
+	h, err := fs.Hash()
+	require.Nil(t, err)
+	fs.Signature, err = eddsa.Sign(h)
+	require.Nil(t, err)
+	require.Nil(t, VerifyAttendance(fs, att))
+	require.NotNil(t, VerifyAttendance(fs, eddsa.Public))
+	require.NotNil(t, VerifyAttendance(nil, att))
+}
+
 func TestClient_GetLink(t *testing.T) {
 	ts := newTSer(t)
 	defer ts.Close()
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+)
+
+// ContractPopBridge converts popcoins to the standard coins of ByzCoin.
+var ContractPopBridge = "popBridge"
+
+// ContractPopBridge holds a reserve of standard coins that the attendees of
+// a party can get in exchange of their popcoins. It has the following
+// functionalities:
+//   * Spawn - creates the bridge with the following arguments:
+//     * "Party" - mandatory, the instanceID of the finalized party whose
+//       attendees can convert their popcoins.
+//     * "PopCoins" and "Coins" - mandatory, 64-bit uints in LittleEndian.
+//       For every "PopCoins" popcoins, an attendee gets "Coins" standard
+//       coins.
+//     The reserve of the bridge is made of the standard coins given to the
+//     instruction, e.g. by a "fetch" on a coin account.
+//   * Invoke - has the following Command
+//     * "convert" - burns popcoins of the account given in the "Source"
+//       argument and transfers the converted amount from the reserve to the
+//       standard coin account given in the "Destination" argument. The
+//       source must be the coin account of an attendee of the party of the
+//       bridge, or of a party merged into it, and the signers must satisfy
+//       the "invoke:transfer" rule of its darc. The number of popcoins to
+//       convert is given in the "PopCoins" argument, as a 64-bit uint in
+//       LittleEndian. The converted amount is rounded down, and the popcoins
+//       that are not enough to get one more coin stay in the source
+//       account. The conversion is refused if the reserve doesn't have
+//       enough coins. Popcoins given to the instruction are not converted,
+//       as they could come from any account.
+//   * Delete - removes the bridge and passes the remaining reserve on to the
+//     next instruction.
+func (s *Service) ContractPopBridge(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte, coins []byzcoin.Coin) (scs []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
+	cOut = coins
+
+	err = inst.Verify(cdb, ctxHash)
+	if err != nil {
+		return
+	}
+
+	var darcID darc.ID
+	var pbi PopBridgeInstance
+	if inst.Spawn == nil {
+		var pbiBuf []byte
+		pbiBuf, _, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
+		if err != nil {
+			return nil, nil, errors.New("couldn't get instance data: " + err.Error())
+		}
+		err = protobuf.Decode(pbiBuf, &pbi)
+		if err != nil {
+			return nil, nil, errors.New("couldn't unmarshal existing PopBridgeInstance: " + err.Error())
+		}
+	}
+
+	switch {
+	case inst.Spawn != nil:
+		popCoins := inst.Spawn.Args.Search("PopCoins")
+		stdCoins := inst.Spawn.Args.Search("Coins")
+		if len(popCoins) != 8 || len(stdCoins) != 8 {
+			return nil, nil, errors.New("need PopCoins and Coins arguments as 64-bit uints")
+		}
+		pbi.PopCoins = binary.LittleEndian.Uint64(popCoins)
+		pbi.Coins = binary.LittleEndian.Uint64(stdCoins)
+		if pbi.PopCoins == 0 {
+			return nil, nil, errors.New("PopCoins cannot be 0")
+		}
+		party := inst.Spawn.Args.Search("Party")
+		if len(party) != len(byzcoin.InstanceID{}) {
+			return nil, nil, errors.New("missing argument: Party")
+		}
+		pbi.Party = byzcoin.NewInstanceID(party)
+		_, err = getFinalizedParty(cdb, pbi.Party)
+		if err != nil {
+			return nil, nil, err
+		}
+		cOut = []byzcoin.Coin{}
+		for _, c := range coins {
+			if c.Name.Equal(contracts.CoinName) {
+				err = pbi.Reserve.SafeAdd(c.Value)
+				if err != nil {
+					return
+				}
+			} else {
+				cOut = append(cOut, c)
+			}
+		}
+		pbi.Reserve.Name = contracts.CoinName
+		pbiBuf, err := protobuf.Encode(&pbi)
+		if err != nil {
+			return nil, nil, errors.New("couldn't marshal PopBridgeInstance: " + err.Error())
+		}
+		return byzcoin.StateChanges{
+			byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""), ContractPopBridge,
+				pbiBuf, darc.ID(inst.InstanceID.Slice())),
+		}, cOut, nil
+
+	case inst.Invoke != nil:
+		if inst.Invoke.Command != "convert" {
+			return nil, nil, errors.New("can only convert popcoins")
+		}
+		target := inst.Invoke.Args.Search("Destination")
+		v, _, cid, did, err := cdb.GetValues(target)
+		if err == nil && cid != contracts.ContractCoinID {
+			err = errors.New("destination is not a coin contract")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var targetCI byzcoin.Coin
+		err = protobuf.Decode(v, &targetCI)
+		if err != nil {
+			return nil, nil, errors.New("couldn't unmarshal target account: " + err.Error())
+		}
+		if !targetCI.Name.Equal(contracts.CoinName) {
+			return nil, nil, errors.New("destination doesn't hold standard coins")
+		}
+
+		popCoins, err := decodeUint64(inst.Invoke.Args.Search("PopCoins"))
+		if err != nil {
+			return nil, nil, errors.New("invalid PopCoins: " + err.Error())
+		}
+		if popCoins < pbi.PopCoins {
+			return nil, nil, fmt.Errorf("need at least %d popcoins", pbi.PopCoins)
+		}
+		source := byzcoin.NewInstanceID(inst.Invoke.Args.Search("Source"))
+		err = pbi.checkAttendeeAccount(cdb, source)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, _, _, sourceDarcID, err := cdb.GetValues(source.Slice())
+		if err != nil {
+			return nil, nil, errors.New("couldn't get source account: " + err.Error())
+		}
+		err = verifyRuleSigners(cdb, inst, sourceDarcID, darc.Action("invoke:transfer"))
+		if err != nil {
+			return nil, nil, errors.New("source account: " + err.Error())
+		}
+		var sourceCI byzcoin.Coin
+		err = protobuf.Decode(v, &sourceCI)
+		if err != nil {
+			return nil, nil, errors.New("couldn't unmarshal source account: " + err.Error())
+		}
+
+		converted, rest := pbi.convert(popCoins)
+		if converted > pbi.Reserve.Value {
+			return nil, nil, fmt.Errorf("reserve has only %d coins, but %d are needed",
+				pbi.Reserve.Value, converted)
+		}
+		err = sourceCI.SafeSub(popCoins - rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = pbi.Reserve.SafeSub(converted)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = targetCI.SafeAdd(converted)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sourceBuf, err := protobuf.Encode(&sourceCI)
+		if err != nil {
+			return nil, nil, errors.New("couldn't marshal source account: " + err.Error())
+		}
+		targetBuf, err := protobuf.Encode(&targetCI)
+		if err != nil {
+			return nil, nil, errors.New("couldn't marshal target account: " + err.Error())
+		}
+		pbiBuf, err := protobuf.Encode(&pbi)
+		if err != nil {
+			return nil, nil, errors.New("couldn't marshal PopBridgeInstance: " + err.Error())
+		}
+		log.Lvlf2("converting %d popcoins to %d coins for %x", popCoins-rest, converted, target)
+		return byzcoin.StateChanges{
+			byzcoin.NewStateChange(byzcoin.Update, source,
+				contracts.ContractCoinID, sourceBuf, sourceDarcID),
+			byzcoin.NewStateChange(byzcoin.Update, byzcoin.NewInstanceID(target),
+				contracts.ContractCoinID, targetBuf, did),
+			byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID,
+				ContractPopBridge, pbiBuf, darcID),
+		}, cOut, nil
+
+	case inst.Delete != nil:
+		if pbi.Reserve.Value > 0 {
+			cOut = append(cOut, pbi.Reserve)
+		}
+		return byzcoin.StateChanges{
+			byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractPopBridge, nil, darcID),
+		}, cOut, nil
+	}
+	return nil, nil, errors.New("unknown instruction type")
+}
+
+// checkAttendeeAccount returns an error if account is not the coin account
+// of an attendee of the party of the bridge, or of a party merged into it.
+func (pbi PopBridgeInstance) checkAttendeeAccount(cdb byzcoin.ReadOnlyStateTrie, account byzcoin.InstanceID) error {
+	ppi, err := getFinalizedParty(cdb, pbi.Party)
+	if err != nil {
+		return err
+	}
+	atts := ppi.FinalStatement.Attendees
+	for _, m := range ppi.Merged {
+		other, err := getFinalizedParty(cdb, m)
+		if err != nil {
+			return err
+		}
+		atts = append(atts, other.FinalStatement.Attendees...)
+	}
+	for _, pub := range atts {
+		if AttendeeCoinID(pbi.Party, pub).Equal(account) {
+			return nil
+		}
+	}
+	return errors.New("source is not the account of an attendee of the party")
+}
+
+// getFinalizedParty returns the party stored in the given instance, or an
+// error if it is not a finalized party.
+func getFinalizedParty(cdb byzcoin.ReadOnlyStateTrie, id byzcoin.InstanceID) (*PopPartyInstance, error) {
+	buf, _, contractID, _, err := cdb.GetValues(id.Slice())
+	if err != nil {
+		return nil, errors.New("couldn't get party: " + err.Error())
+	}
+	if contractID != ContractPopParty {
+		return nil, errors.New("instance is not a pop-party")
+	}
+	var ppi PopPartyInstance
+	err = protobuf.DecodeWithConstructors(buf, &ppi, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't unmarshal PopPartyInstance: " + err.Error())
+	}
+	if ppi.State != PartyFinalized {
+		return nil, errors.New("party is not finalized")
+	}
+	return &ppi, nil
+}
+
+// convert returns the number of standard coins for popCoins popcoins, and
+// the popcoins that are left over. The result is rounded down.
+func (pbi PopBridgeInstance) convert(popCoins uint64) (coins, rest uint64) {
+	steps := popCoins / pbi.PopCoins
+	rest = popCoins % pbi.PopCoins
+	c := new(big.Int).Mul(new(big.Int).SetUint64(steps), new(big.Int).SetUint64(pbi.Coins))
+	if !c.IsUint64() {
+		// More coins than can ever be in the reserve.
+		return ^uint64(0), rest
+	}
+	return c.Uint64(), rest
+}
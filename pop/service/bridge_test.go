@@ -0,0 +1,178 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContractPopBridge(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+
+	c, msg, signer := newPopLedger(t, roster,
+		"spawn:"+contracts.ContractCoinID, "invoke:mint", "invoke:fetch",
+		"spawn:"+ContractPopBridge, "invoke:convert")
+	gID := byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID())
+
+	// A finalized party with one attendee.
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyID := spawnParty(t, c, msg, signer, &fs)
+	require.Nil(t, invokeParty(t, c, signer, partyID, "freeze"))
+	attendee := key.NewKeyPair(tSuite)
+	fs.Attendees = []kyber.Point{attendee.Public}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+	require.Nil(t, finalizeParty(t, c, signer, partyID, &fs, fs.Signature))
+	attSigner := darc.NewSignerEd25519(attendee.Public, attendee.Private)
+
+	coins := func(n uint64) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, n)
+		return buf
+	}
+	// account spawns a coin account with the given coins.
+	account := func(name byzcoin.InstanceID, n uint64) byzcoin.InstanceID {
+		ctx, _, err := byzcoin.NewTxBuilder(c).
+			Spawn(gID, contracts.ContractCoinID, byzcoin.Arguments{{Name: "type", Value: name.Slice()}}).
+			SignAndSubmit(signer, 10)
+		require.Nil(t, err)
+		id := ctx.Instructions[0].DeriveID("")
+		if n > 0 {
+			_, _, err = byzcoin.NewTxBuilder(c).
+				Invoke(id, "mint", byzcoin.Arguments{{Name: "coins", Value: coins(n)}}).
+				SignAndSubmit(signer, 10)
+			require.Nil(t, err)
+		}
+		return id
+	}
+	balance := func(id byzcoin.InstanceID) uint64 {
+		p, err := c.GetProof(id.Slice())
+		require.Nil(t, err)
+		var coin byzcoin.Coin
+		require.Nil(t, p.Proof.VerifyAndDecode(tSuite, contracts.ContractCoinID, &coin))
+		return coin.Value
+	}
+
+	// The organizers put 6 coins in the reserve, and give 1 coin for
+	// 2 popcoins. The bridge needs a finalized party.
+	reserve := account(contracts.CoinName, 10)
+	spawnBridge := func(party byzcoin.InstanceID) (byzcoin.InstanceID, error) {
+		ctx, _, err := byzcoin.NewTxBuilder(c).
+			Invoke(reserve, "fetch", byzcoin.Arguments{{Name: "coins", Value: coins(6)}}).
+			Spawn(gID, ContractPopBridge, byzcoin.Arguments{
+				{Name: "Party", Value: party.Slice()},
+				{Name: "PopCoins", Value: coins(2)},
+				{Name: "Coins", Value: coins(1)}}).
+			SignAndSubmit(signer, 10)
+		if err != nil {
+			return byzcoin.InstanceID{}, err
+		}
+		return ctx.Instructions[1].DeriveID(""), nil
+	}
+	_, err := spawnBridge(gID)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "instance is not a pop-party")
+	bridge, err := spawnBridge(partyID)
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), balance(reserve))
+	getBridge := func() PopBridgeInstance {
+		p, err := c.GetProof(bridge.Slice())
+		require.Nil(t, err)
+		var pbi PopBridgeInstance
+		require.Nil(t, p.Proof.VerifyAndDecode(tSuite, ContractPopBridge, &pbi))
+		return pbi
+	}
+	require.Equal(t, uint64(6), getBridge().Reserve.Value)
+	require.True(t, getBridge().Party.Equal(partyID))
+
+	popAccount := AttendeeCoinID(partyID, attendee.Public)
+	stdAccount := account(contracts.CoinName, 0)
+	convertFrom := func(source byzcoin.InstanceID, n uint64, signers ...darc.Signer) error {
+		_, _, err := byzcoin.NewTxBuilder(c).
+			Invoke(bridge, "convert", byzcoin.Arguments{
+				{Name: "Source", Value: source.Slice()},
+				{Name: "PopCoins", Value: coins(n)},
+				{Name: "Destination", Value: stdAccount.Slice()}}, signers...).
+			SignAndSubmit(signer, 10)
+		return err
+	}
+	convert := func(n uint64) error {
+		return convertFrom(popAccount, n, signer, attSigner)
+	}
+
+	// Converting an even amount.
+	require.Nil(t, convert(4))
+	require.Equal(t, DefaultInitialCoins-4, balance(popAccount))
+	require.Equal(t, uint64(2), balance(stdAccount))
+	require.Equal(t, uint64(4), getBridge().Reserve.Value)
+
+	// The popcoin left over by an odd amount stays in the account.
+	require.Nil(t, convert(5))
+	require.Equal(t, DefaultInitialCoins-8, balance(popAccount))
+	require.Equal(t, uint64(4), balance(stdAccount))
+	require.Equal(t, uint64(2), getBridge().Reserve.Value)
+	err = convert(1)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "need at least 2 popcoins")
+
+	// A self-minted popcoin account is not the account of an attendee.
+	fake := account(PoPCoinName, 20)
+	err = convertFrom(fake, 2)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "source is not the account of an attendee of the party")
+	require.Equal(t, uint64(20), balance(fake))
+
+	// Only the attendee can convert the popcoins of its account.
+	err = convertFrom(popAccount, 2)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "rule 'invoke:transfer' is not satisfied")
+
+	// The reserve doesn't have enough coins left.
+	err = convert(6)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "reserve has only 2 coins, but 3 are needed")
+	require.Nil(t, convert(4))
+	require.Equal(t, uint64(0), getBridge().Reserve.Value)
+	err = convert(2)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "reserve has only 0 coins")
+	require.Equal(t, DefaultInitialCoins-12, balance(popAccount))
+	require.Equal(t, uint64(6), balance(stdAccount))
+}
+
+func TestPopBridgeInstance_Convert(t *testing.T) {
+	pbi := PopBridgeInstance{PopCoins: 3, Coins: 2}
+	coins, rest := pbi.convert(10)
+	require.Equal(t, uint64(6), coins)
+	require.Equal(t, uint64(1), rest)
+	coins, rest = pbi.convert(2)
+	require.Equal(t, uint64(0), coins)
+	require.Equal(t, uint64(2), rest)
+
+	pbi = PopBridgeInstance{PopCoins: 1, Coins: 1 << 40}
+	coins, _ = pbi.convert(1 << 40)
+	require.Equal(t, ^uint64(0), coins)
+
+	buf, err := protobuf.Encode(&pbi)
+	require.Nil(t, err)
+	var decoded PopBridgeInstance
+	require.Nil(t, protobuf.Decode(buf, &decoded))
+	require.Equal(t, pbi, decoded)
+}
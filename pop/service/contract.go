@@ -1,9 +1,12 @@
 package service
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
@@ -11,6 +14,9 @@ import (
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/darc/expression"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/eddsa"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
 	"github.com/dedis/protobuf"
@@ -31,6 +37,166 @@ var ContractPopCoinAccount = "popCoinAccount"
 // PoPCoinName is the identifier of the popcoins.
 var PoPCoinName byzcoin.InstanceID
 
+// The states of a pop-party. PartyConfigured and PartyFinalized keep the
+// values of the first version of the contract, so that old instances are
+// still valid.
+const (
+	// PartyConfigured is the state of a newly spawned party.
+	PartyConfigured = 1
+	// PartyFinalized is the state of a party with a final statement.
+	PartyFinalized = 2
+	// PartyScanning is the state of a party while the organizers scan the
+	// keys of the attendees.
+	PartyScanning = 3
+	// PartyFrozen is the state of a party whose registration is closed and
+	// that waits for its final statement.
+	PartyFrozen = 4
+)
+
+var partyStateNames = map[int]string{
+	PartyConfigured: "Configured",
+	PartyFinalized:  "Finalized",
+	PartyScanning:   "Scanning",
+	PartyFrozen:     "Frozen",
+}
+
+// partyTransitions holds, for every state, the states it can be reached
+// from.
+var partyTransitions = map[int][]int{
+	PartyScanning:  {PartyConfigured},
+	PartyFrozen:    {PartyConfigured, PartyScanning},
+	PartyFinalized: {PartyFrozen},
+}
+
+// setState changes the state of the party and records the index of the
+// block holding the transition. The instruction is executed on the trie of
+// the latest block, so it ends up in the next block.
+func (ppi *PopPartyInstance) setState(cdb byzcoin.ReadOnlyStateTrie, state int) {
+	ppi.State = state
+	ppi.Transitions = append(ppi.Transitions, PartyTransition{
+		State: state,
+		Index: cdb.GetIndex() + 1,
+	})
+}
+
+func partyStateName(state int) string {
+	if name, ok := partyStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown state %d", state)
+}
+
+// registerAttendee adds the attendee given in the arguments of the
+// instruction to the registered attendees of the party.
+func registerAttendee(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ppi *PopPartyInstance) error {
+	if ppi.State != PartyScanning {
+		return fmt.Errorf("can only register attendees in state %s, but current state is %s",
+			partyStateName(PartyScanning), partyStateName(ppi.State))
+	}
+	if len(ppi.Organizers) == 0 {
+		return errors.New("party has no organizers darc")
+	}
+	pubBuf := inst.Invoke.Args.Search("Public")
+	orgBuf := inst.Invoke.Args.Search("Organizer")
+	sig := inst.Invoke.Args.Search("Signature")
+	if pubBuf == nil || orgBuf == nil || sig == nil {
+		return errors.New("need Public, Organizer and Signature arguments")
+	}
+	pub := cothority.Suite.Point()
+	if err := pub.UnmarshalBinary(pubBuf); err != nil {
+		return errors.New("couldn't unmarshal public key: " + err.Error())
+	}
+	org := cothority.Suite.Point()
+	if err := org.UnmarshalBinary(orgBuf); err != nil {
+		return errors.New("couldn't unmarshal organizer: " + err.Error())
+	}
+	msg := append(inst.InstanceID.Slice(), pubBuf...)
+	if err := schnorr.Verify(cothority.Suite, org, msg, sig); err != nil {
+		return errors.New("wrong signature of the organizer: " + err.Error())
+	}
+	orgInst := byzcoin.Instruction{
+		Signatures: []darc.Signature{{Signer: darc.NewIdentityEd25519(org)}},
+	}
+	if err := verifyOrganizerSigners(cdb, orgInst, ppi.Organizers); err != nil {
+		return err
+	}
+	atts := append(append([]kyber.Point{}, ppi.Registered...), pub)
+	if err := checkAttendees(atts, nil); err != nil {
+		return err
+	}
+	ppi.Registered = atts
+	return nil
+}
+
+// verifyOrganizerSigners returns an error if the signers of the instruction
+// don't satisfy the "_sign" rule of the organizers darc.
+func verifyOrganizerSigners(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, orgs darc.ID) error {
+	d, err := byzcoin.LoadDarcFromTrie(cdb, orgs)
+	if err != nil {
+		return errors.New("couldn't get organizers darc: " + err.Error())
+	}
+	err = evalSigners(cdb, inst, d.Rules.GetSignExpr())
+	if err != nil {
+		return errors.New("signers are not organizers of this party: " + err.Error())
+	}
+	return nil
+}
+
+// verifyRuleSigners returns an error if the signers of the instruction don't
+// satisfy the rule for action of the given darc.
+func verifyRuleSigners(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, darcID darc.ID, action darc.Action) error {
+	d, err := byzcoin.LoadDarcFromTrie(cdb, darcID)
+	if err != nil {
+		return errors.New("couldn't get darc: " + err.Error())
+	}
+	if !d.Rules.Contains(action) {
+		return fmt.Errorf("action '%v' does not exist", action)
+	}
+	err = evalSigners(cdb, inst, d.Rules.Get(action))
+	if err != nil {
+		return fmt.Errorf("rule '%v' is not satisfied: %v", action, err)
+	}
+	return nil
+}
+
+// evalSigners evaluates the expression with the signers of the instruction.
+// The signatures themselves must have been verified by the caller.
+func evalSigners(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, expr expression.Expr) error {
+	return darc.EvalExpr(expr, byzcoin.GetDarcFromTrie(cdb), inst.GetIdentityStrings()...)
+}
+
+// checkTransition returns an error if a party cannot go from the state from
+// to the state to.
+func checkTransition(from, to int) error {
+	for _, s := range partyTransitions[to] {
+		if s == from {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot go from state %s to state %s",
+		partyStateName(from), partyStateName(to))
+}
+
+// initialCoins returns the number of popcoins every attendee got when the
+// party has been finalized.
+func (ppi *PopPartyInstance) initialCoins() uint64 {
+	if ppi.InitialCoins == nil {
+		return DefaultInitialCoins
+	}
+	return *ppi.InitialCoins
+}
+
+// attendeeActions are the actions that can be added to the darcs of the
+// attendees, besides "invoke:transfer".
+var attendeeActions = map[string]bool{
+	"invoke:fetch": true,
+	"invoke:store": true,
+}
+
+// DefaultInitialCoins is the number of popcoins every attendee gets if the
+// party doesn't define it.
+const DefaultInitialCoins = uint64(1000000)
+
 func init() {
 	h := sha256.New()
 	h.Write([]byte("popcoin"))
@@ -40,27 +206,75 @@ func init() {
 // ContractPopParty represents a pop-party in ByzCoin. It has the following
 // functionalities:
 //   * Spawn - takes a "FinalStatement" argument with the binary representation
-//     of the final statement to store.
+//     of the final statement to store. The mandatory "Organizers" argument
+//     is the ID of the darc of the organizers, whose "_sign" rule must be
+//     satisfied by the signers of the spawn and of all later invocations.
+//     The optional "MaxInitialCoins" argument is a 64-bit uint in
+//     LittleEndian and limits the number of popcoins each attendee can get.
+//     It defaults to DefaultInitialCoins.
+//     The optional "AttendeeRules" argument is a comma-separated list of
+//     actions that are added to the darcs of the attendees. Only
+//     "invoke:fetch" and "invoke:store" are allowed.
+//     If the optional "OpenRegistration" argument is given, the attendees
+//     can register without an "invoke:register" rule in the darc.
 //   * Invoke - hast the following Command
+//     * "scan" - tells that the organizers started to scan the keys of the
+//       attendees.
+//     * "freeze" - closes the registration of the attendees. A party can be
+//       frozen when it is configured or when the attendees are being scanned.
+//       Parties spawned before the parties had states are in darcs without
+//       an "invoke:freeze" rule: the owner of the darc needs to evolve it to
+//       add the rule before the party can be frozen and finalized.
+//     * "register" - adds an attendee to the party while the keys are being
+//       scanned. It doesn't need to be signed by the organizers. If the
+//       party has an open registration, the signatures of the attendee only
+//       need to be valid, else the darc of the party needs an
+//       "invoke:register" rule that the attendee can satisfy. It has the
+//       following arguments:
+//       * "Public" - the marshalled public key of the attendee.
+//       * "Organizer" - the marshalled public key of an organizer, that
+//         must satisfy the "_sign" rule of the organizers darc.
+//       * "Signature" - the schnorr signature of the organizer on the
+//         instanceID of the party followed by the public key of the
+//         attendee.
 //     * "Finalize" - that stores a final statement and doesn't let it be
-//       changed afterwards. It will also create a darc for every attendee
-//       and bind that darc to a coin account, putting an initial 1.000.000
-//       popCoins in it.
+//       changed afterwards. The party needs to be frozen. If the final
+//       statement has no attendees, the registered attendees are used. It
+//       will also create a darc for every attendee and bind that darc to a
+//       coin account, putting the initial popCoins in it.
 //        This command has the following arguments:
 //       * "FinalStatement" - mandatory, to give the new final statement. It
-//         needs to be correctly finalized by the pop-service.
+//         needs to be correctly finalized by the pop-service. Every attendee
+//         must have a different key, which must not be the service key.
+//       * "Signature" - mandatory, the collective signature of the organizers
+//         on the hash of the final statement. The organizers are the conodes
+//         of the roster given in the configuration when the party has been
+//         spawned.
 //       * "Service" - when given, will create a darc and a coin-account for
 //         the service to use.
+//       * "InitialCoins" - the number of popcoins of every attendee as a
+//         64-bit uint in LittleEndian. It defaults to DefaultInitialCoins and
+//         must not be bigger than the maximum given when spawning the party.
+//     * "merge" - merges a finalized party of another location into this
+//       finalized party. Both parties need to have each other in the Parties
+//       of their configuration, and the signers must be organizers of both
+//       parties, or satisfy the "invoke:merge" rule of the darc of the
+//       other party if it has no organizers darc. Attendees of the other
+//       party that are not yet attendees of this party get a coin account
+//       of this party, with the initial popcoins of this party.
+//       Merging twice the same parties doesn't change anything.
+//        This command has the following arguments:
+//       * "Party" - mandatory, the instanceID of the other party.
+//       * "FinalStatement" - mandatory, the final statement of the other
+//         party, as stored in its instance.
+//   * Delete - removes a party that is not finalized yet, e.g. because it has
+//     been misconfigured.
 func (s *Service) ContractPopParty(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, ctxHash []byte, coins []byzcoin.Coin) (scs []byzcoin.StateChange, cOut []byzcoin.Coin, err error) {
 	cOut = coins
 
-	err = inst.Verify(cdb, ctxHash)
-	if err != nil {
-		return
-	}
-
 	var darcID darc.ID
 	var ppi PopPartyInstance
+	register := inst.Invoke != nil && inst.Invoke.Command == "register"
 	if inst.Spawn == nil {
 		var ppiBuf []byte
 		ppiBuf, _, _, darcID, err = cdb.GetValues(inst.InstanceID.Slice())
@@ -74,15 +288,58 @@ func (s *Service) ContractPopParty(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.I
 	} else {
 		darcID = inst.InstanceID.Slice()
 	}
+	// Anybody can register to a party with an open registration: the
+	// countersignature of an organizer is checked instead of the darc.
+	if register && ppi.OpenRegistration {
+		err = inst.VerifySignatures(cdb, ctxHash)
+	} else {
+		err = inst.Verify(cdb, ctxHash)
+	}
+	if err != nil {
+		return
+	}
+	// Parties spawned before the organizers darc has been introduced only
+	// depend on the darc of the instance. Attendees register themselves
+	// with the signature of an organizer.
+	if len(ppi.Organizers) > 0 && !register {
+		err = verifyOrganizerSigners(cdb, inst, ppi.Organizers)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	switch {
 	case inst.Spawn != nil:
 		fsBuf := inst.Spawn.Args.Search("FinalStatement")
 		if fsBuf == nil {
 			return nil, nil, errors.New("need FinalStatement argument")
 		}
+		orgs := inst.Spawn.Args.Search("Organizers")
+		if orgs == nil {
+			return nil, nil, errors.New("missing argument: Organizers")
+		}
+		err = verifyOrganizerSigners(cdb, inst, orgs)
+		if err != nil {
+			return nil, nil, err
+		}
 		ppData := &PopPartyInstance{
-			State:          1,
-			FinalStatement: &FinalStatement{},
+			FinalStatement:   &FinalStatement{},
+			Organizers:       orgs,
+			OpenRegistration: inst.Spawn.Args.Search("OpenRegistration") != nil,
+		}
+		ppData.setState(cdb, PartyConfigured)
+		if maxBuf := inst.Spawn.Args.Search("MaxInitialCoins"); maxBuf != nil {
+			max, err := decodeUint64(maxBuf)
+			if err != nil {
+				return nil, nil, errors.New("invalid MaxInitialCoins: " + err.Error())
+			}
+			ppData.MaxInitialCoins = &max
+		}
+		if rulesBuf := inst.Spawn.Args.Search("AttendeeRules"); rulesBuf != nil {
+			ppData.AttendeeRules = strings.Split(string(rulesBuf), ",")
+			err = checkAttendeeRules(ppData.AttendeeRules)
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 		err = protobuf.DecodeWithConstructors(fsBuf, ppData.
 			FinalStatement, network.DefaultConstructors(cothority.Suite))
@@ -98,10 +355,39 @@ func (s *Service) ContractPopParty(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.I
 		}, cOut, nil
 	case inst.Invoke != nil:
 		switch inst.Invoke.Command {
+		case "scan", "freeze":
+			state := PartyScanning
+			if inst.Invoke.Command == "freeze" {
+				state = PartyFrozen
+			}
+			err = checkTransition(ppi.State, state)
+			if err != nil {
+				return nil, nil, err
+			}
+			ppi.setState(cdb, state)
+			ppiBuf, err := protobuf.Encode(&ppi)
+			if err != nil {
+				return nil, nil, errors.New("couldn't marshal PopPartyInstance: " + err.Error())
+			}
+			return byzcoin.StateChanges{
+				byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractPopParty, ppiBuf, darcID),
+			}, coins, nil
+		case "register":
+			err = registerAttendee(cdb, inst, &ppi)
+			if err != nil {
+				return nil, nil, err
+			}
+			ppiBuf, err := protobuf.Encode(&ppi)
+			if err != nil {
+				return nil, nil, errors.New("couldn't marshal PopPartyInstance: " + err.Error())
+			}
+			return byzcoin.StateChanges{
+				byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractPopParty, ppiBuf, darcID),
+			}, coins, nil
 		case "Finalize":
-			if ppi.State != 1 {
-				return nil, nil, fmt.Errorf("can only finalize party with state 1, but current state is %d",
-					ppi.State)
+			err = checkTransition(ppi.State, PartyFinalized)
+			if err != nil {
+				return nil, nil, err
 			}
 			fsBuf := inst.Invoke.Args.Search("FinalStatement")
 			if fsBuf == nil {
@@ -112,22 +398,72 @@ func (s *Service) ContractPopParty(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.I
 			if err != nil {
 				return nil, nil, errors.New("argument is not a valid FinalStatement")
 			}
+			if len(fs.Attendees) == 0 {
+				fs.Attendees = ppi.Registered
+			}
 
-			// TODO: check for aggregate signature of all organizers
+			sig := inst.Invoke.Args.Search("Signature")
+			if sig == nil {
+				return nil, nil, errors.New("missing argument: Signature")
+			}
+			err = verifyOrganizers(ppi.FinalStatement, &fs, sig)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Store the verified signature, not the one that came with
+			// the final statement, so that the stored statement verifies.
+			fs.Signature = sig
+			initial := DefaultInitialCoins
+			if initBuf := inst.Invoke.Args.Search("InitialCoins"); initBuf != nil {
+				initial, err = decodeUint64(initBuf)
+				if err != nil {
+					return nil, nil, errors.New("invalid InitialCoins: " + err.Error())
+				}
+			}
+			max := DefaultInitialCoins
+			if ppi.MaxInitialCoins != nil {
+				max = *ppi.MaxInitialCoins
+			}
+			if initial > max {
+				return nil, nil, fmt.Errorf("cannot give %d initial coins, maximum is %d",
+					initial, max)
+			}
 			ppi := PopPartyInstance{
-				State:          2,
-				FinalStatement: &fs,
+				FinalStatement:  &fs,
+				MaxInitialCoins: ppi.MaxInitialCoins,
+				InitialCoins:    &initial,
+				AttendeeRules:   ppi.AttendeeRules,
+				Organizers:      ppi.Organizers,
+				Transitions:     ppi.Transitions,
+			}
+			ppi.setState(cdb, PartyFinalized)
+			sBuf := inst.Invoke.Args.Search("Service")
+			if sBuf != nil {
+				ppi.Service = cothority.Suite.Point()
+				err = ppi.Service.UnmarshalBinary(sBuf)
+				if err != nil {
+					return nil, nil, errors.New("couldn't unmarshal point: " + err.Error())
+				}
+			}
+			err = checkAttendees(fs.Attendees, ppi.Service)
+			if err != nil {
+				return nil, nil, err
 			}
 
 			for i, pub := range fs.Attendees {
 				log.Lvlf3("Creating darc for attendee %d %s", i, pub)
-				d, sc, err := createDarc(darcID, pub)
+				d, sc, err := createDarc(darcID, pub, ppi.AttendeeRules)
 				if err != nil {
 					return nil, nil, err
 				}
-				scs = append(scs, sc)
+				// The attendee might already have a darc from another
+				// party.
+				_, _, _, _, err = cdb.GetValues(d.GetBaseID())
+				if err != nil {
+					scs = append(scs, sc)
+				}
 
-				sc, err = createCoin(inst, d, pub, 1000000)
+				sc, err = createCoin(inst, d, pub, initial)
 				if err != nil {
 					return nil, nil, err
 				}
@@ -135,16 +471,9 @@ func (s *Service) ContractPopParty(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.I
 			}
 
 			// And add a service if the argument is given
-			sBuf := inst.Invoke.Args.Search("Service")
-			if sBuf != nil {
-				ppi.Service = cothority.Suite.Point()
-				err = ppi.Service.UnmarshalBinary(sBuf)
-				if err != nil {
-					return nil, nil, errors.New("couldn't unmarshal point: " + err.Error())
-				}
-
+			if ppi.Service != nil {
 				log.Lvlf3("Checking if service-darc and account for %s should be appended", ppi.Service)
-				d, sc, err := createDarc(darcID, ppi.Service)
+				d, sc, err := createDarc(darcID, ppi.Service, nil)
 				if err != nil {
 					return nil, nil, err
 				}
@@ -172,21 +501,256 @@ func (s *Service) ContractPopParty(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.I
 			scs = append(scs, byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractPopParty, ppiBuf, darcID))
 
 			return scs, coins, nil
+		case "merge":
+			scs, err = mergeParty(cdb, inst, darcID, ppi)
+			return scs, coins, err
 		case "AddParty":
 			return nil, nil, errors.New("not yet implemented")
 		default:
 			return nil, nil, errors.New("can only finalize Pop-party contract")
 		}
 
+	case inst.Delete != nil:
+		if ppi.State == PartyFinalized {
+			return nil, nil, errors.New("cannot delete a finalized party, " +
+				"as the accounts of its attendees depend on it")
+		}
+		// No other instances are created before the party is finalized.
+		return byzcoin.StateChanges{
+			byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractPopParty, nil, darcID),
+		}, coins, nil
 	default:
-		return nil, nil, errors.New("Only invoke and spawn are defined yet")
+		return nil, nil, errors.New("unknown instruction type")
 	}
 }
 
-func createDarc(darcID darc.ID, pub kyber.Point) (d *darc.Darc, sc byzcoin.StateChange, err error) {
+// mergeParty creates the coin accounts of the attendees of the party given
+// in the "Party" argument that are missing in the party of the instruction,
+// and marks both parties as merged.
+func mergeParty(cdb byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	darcID darc.ID, ppi PopPartyInstance) (scs []byzcoin.StateChange, err error) {
+	if ppi.State != PartyFinalized {
+		return nil, errors.New("can only merge a finalized party")
+	}
+	otherID := inst.Invoke.Args.Search("Party")
+	if len(otherID) != len(byzcoin.InstanceID{}) {
+		return nil, errors.New("missing argument: Party")
+	}
+	other := byzcoin.NewInstanceID(otherID)
+	if other.Equal(inst.InstanceID) {
+		return nil, errors.New("cannot merge a party with itself")
+	}
+	for _, m := range ppi.Merged {
+		if m.Equal(other) {
+			log.Lvl2("Parties are already merged")
+			return nil, nil
+		}
+	}
+
+	otherBuf, _, contractID, otherDarcID, err := cdb.GetValues(other.Slice())
+	if err != nil {
+		return nil, errors.New("couldn't get other party: " + err.Error())
+	}
+	if contractID != ContractPopParty {
+		return nil, errors.New("other instance is not a pop-party")
+	}
+	var otherPPI PopPartyInstance
+	err = protobuf.DecodeWithConstructors(otherBuf, &otherPPI, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("couldn't unmarshal other PopPartyInstance: " + err.Error())
+	}
+	if otherPPI.State != PartyFinalized {
+		return nil, errors.New("other party is not finalized")
+	}
+	// The other party is changed too, so its organizers must agree.
+	if len(otherPPI.Organizers) > 0 {
+		err = verifyOrganizerSigners(cdb, inst, otherPPI.Organizers)
+	} else {
+		err = verifyRuleSigners(cdb, inst, otherDarcID, darc.Action("invoke:merge"))
+	}
+	if err != nil {
+		return nil, errors.New("other party: " + err.Error())
+	}
+
+	fsBuf := inst.Invoke.Args.Search("FinalStatement")
+	if fsBuf == nil {
+		return nil, errors.New("missing argument: FinalStatement")
+	}
+	fs := FinalStatement{}
+	err = protobuf.DecodeWithConstructors(fsBuf, &fs, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, errors.New("argument is not a valid FinalStatement")
+	}
+	err = verifyOrganizers(otherPPI.FinalStatement, &fs, fs.Signature)
+	if err != nil {
+		return nil, err
+	}
+	h, err := fs.Hash()
+	if err != nil {
+		return nil, err
+	}
+	hOther, err := otherPPI.FinalStatement.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h, hOther) {
+		return nil, errors.New("final statement is not the one of the other party")
+	}
+
+	desc, otherDesc := ppi.FinalStatement.Desc, otherPPI.FinalStatement.Desc
+	if !inMergeList(desc, otherDesc) || !inMergeList(otherDesc, desc) {
+		return nil, errors.New("parties are not in each other's merge list")
+	}
+
+	present := make(map[string]bool)
+	for _, pub := range ppi.FinalStatement.Attendees {
+		present[pub.String()] = true
+	}
+	for _, pub := range fs.Attendees {
+		if present[pub.String()] {
+			continue
+		}
+		present[pub.String()] = true
+		d, sc, err := createDarc(darcID, pub, ppi.AttendeeRules)
+		if err != nil {
+			return nil, err
+		}
+		_, _, _, _, err = cdb.GetValues(d.GetBaseID())
+		if err != nil {
+			scs = append(scs, sc)
+		}
+		sc, err = createCoin(inst, d, pub, ppi.initialCoins())
+		if err != nil {
+			return nil, err
+		}
+		// The account might exist from an earlier merge with another
+		// party.
+		_, _, _, _, err = cdb.GetValues(sc.InstanceID)
+		if err != nil {
+			scs = append(scs, sc)
+		}
+	}
+
+	ppi.Merged = append(ppi.Merged, other)
+	ppiBuf, err := protobuf.Encode(&ppi)
+	if err != nil {
+		return nil, errors.New("couldn't marshal PopPartyInstance: " + err.Error())
+	}
+	scs = append(scs, byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractPopParty, ppiBuf, darcID))
+	otherPPI.Merged = append(otherPPI.Merged, inst.InstanceID)
+	otherBuf, err = protobuf.Encode(&otherPPI)
+	if err != nil {
+		return nil, errors.New("couldn't marshal PopPartyInstance: " + err.Error())
+	}
+	scs = append(scs, byzcoin.NewStateChange(byzcoin.Update, other, ContractPopParty, otherBuf, otherDarcID))
+	return scs, nil
+}
+
+func decodeUint64(buf []byte) (uint64, error) {
+	if len(buf) != 8 {
+		return 0, errors.New("need a 64-bit uint")
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// checkAttendees makes sure that every attendee gets its own darc and coin
+// account, by refusing duplicate keys, the identity point and the key of the
+// service, which can be nil.
+func checkAttendees(atts []kyber.Point, service kyber.Point) error {
+	null := cothority.Suite.Point().Null()
+	seen := make(map[string]int)
+	for i, pub := range atts {
+		if pub == nil || pub.Equal(null) {
+			return fmt.Errorf("attendee %d has an invalid key", i)
+		}
+		if service != nil && pub.Equal(service) {
+			return fmt.Errorf("attendee %d has the key of the service", i)
+		}
+		if j, ok := seen[pub.String()]; ok {
+			return fmt.Errorf("attendee %d has the same key as attendee %d", i, j)
+		}
+		seen[pub.String()] = i
+	}
+	return nil
+}
+
+// inMergeList returns true if the party described by other is part of the
+// Parties of desc.
+func inMergeList(desc, other *PopDesc) bool {
+	if desc.Name != other.Name || desc.DateTime != other.DateTime {
+		return false
+	}
+	party := PopDesc{
+		Name:     desc.Name,
+		DateTime: desc.DateTime,
+		Parties:  desc.Parties,
+	}
+	for _, sd := range desc.Parties {
+		party.Location = sd.Location
+		party.Roster = sd.Roster
+		if bytes.Equal(party.Hash(), other.Hash()) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyOrganizers checks that fs has the same description as the party
+// configuration conf and that sig is the collective signature of the
+// organizers of conf on the hash of fs.
+func verifyOrganizers(conf, fs *FinalStatement, sig []byte) error {
+	if conf == nil || conf.Desc == nil || conf.Desc.Roster == nil {
+		return errors.New("party has no configuration")
+	}
+	if fs.Desc == nil || fs.Desc.Roster == nil ||
+		!bytes.Equal(fs.Desc.Hash(), conf.Desc.Hash()) {
+		return errors.New("final statement is not for this party")
+	}
+	h, err := fs.Hash()
+	if err != nil {
+		return errors.New("couldn't hash final statement: " + err.Error())
+	}
+	// Only use the keys of the organizers, not the aggregate given in the
+	// configuration.
+	orgs := onet.NewRoster(conf.Desc.Roster.List)
+	if orgs == nil {
+		return errors.New("invalid roster of organizers")
+	}
+	if err := eddsa.Verify(orgs.Aggregate, h, sig); err != nil {
+		return errors.New("wrong signature of the organizers: " + err.Error())
+	}
+	return nil
+}
+
+// checkAttendeeRules makes sure only allowed actions are given to the darcs
+// of the attendees.
+func checkAttendeeRules(actions []string) error {
+	seen := make(map[string]bool)
+	for _, a := range actions {
+		if !attendeeActions[a] {
+			return fmt.Errorf("action %q cannot be given to attendees", a)
+		}
+		if seen[a] {
+			return fmt.Errorf("action %q is given twice", a)
+		}
+		seen[a] = true
+	}
+	return nil
+}
+
+// createDarc returns the darc of an attendee or a service, where the owner
+// of pub can transfer coins and has the additional actions given in rules.
+func createDarc(darcID darc.ID, pub kyber.Point, actions []string) (d *darc.Darc, sc byzcoin.StateChange, err error) {
 	id := darc.NewIdentityEd25519(pub)
 	rules := darc.InitRules([]darc.Identity{id}, []darc.Identity{id})
 	rules.AddRule(darc.Action("invoke:transfer"), expression.Expr(id.String()))
+	for _, a := range actions {
+		err = rules.AddRule(darc.Action(a), expression.Expr(id.String()))
+		if err != nil {
+			err = errors.New("couldn't add rule: " + err.Error())
+			return
+		}
+	}
 	d = darc.NewDarc(rules, []byte("Attendee darc for pop-party"))
 	darcBuf, err := d.ToProto()
 	if err != nil {
@@ -199,15 +763,35 @@ func createDarc(darcID darc.ID, pub kyber.Point) (d *darc.Darc, sc byzcoin.State
 	return
 }
 
-func createCoin(inst byzcoin.Instruction, d *darc.Darc, pub kyber.Point, balance uint64) (sc byzcoin.StateChange, err error) {
+// AttendeeCoinID returns the instanceID of the coin account created for
+// the attendee with the public key pub when the party has been finalized.
+// It is the sha256 of the instanceID of the party followed by the
+// marshalled public key. pub must not be nil: keys given by a client should
+// be checked with PopCoinAccountID.
+func AttendeeCoinID(party byzcoin.InstanceID, pub kyber.Point) byzcoin.InstanceID {
+	// Marshalling a point of the suite never fails.
+	pubBuf, _ := pub.MarshalBinary()
 	iid := sha256.New()
-	iid.Write(inst.InstanceID.Slice())
-	pubBuf, err := pub.MarshalBinary()
-	if err != nil {
-		err = errors.New("couldn't marshal public key: " + err.Error())
-		return
-	}
+	iid.Write(party.Slice())
 	iid.Write(pubBuf)
+	return byzcoin.NewInstanceID(iid.Sum(nil))
+}
+
+// PopCoinAccountID is like AttendeeCoinID, but returns an error if pub is
+// nil or cannot be marshalled, so it can be used with keys given by a
+// client.
+func PopCoinAccountID(party byzcoin.InstanceID, pub kyber.Point) (byzcoin.InstanceID, error) {
+	if pub == nil {
+		return byzcoin.InstanceID{}, errors.New("no public key given")
+	}
+	if _, err := pub.MarshalBinary(); err != nil {
+		return byzcoin.InstanceID{}, errors.New("couldn't marshal public key: " + err.Error())
+	}
+	return AttendeeCoinID(party, pub), nil
+}
+
+func createCoin(inst byzcoin.Instruction, d *darc.Darc, pub kyber.Point, balance uint64) (sc byzcoin.StateChange, err error) {
+	coinID := AttendeeCoinID(inst.InstanceID, pub)
 	cci := byzcoin.Coin{
 		Name:  PoPCoinName,
 		Value: balance,
@@ -217,8 +801,7 @@ func createCoin(inst byzcoin.Instruction, d *darc.Darc, pub kyber.Point, balance
 		err = errors.New("couldn't encode CoinInstance: " + err.Error())
 		return
 	}
-	coinID := iid.Sum(nil)
-	log.Lvlf3("Creating account %x", coinID)
-	return byzcoin.NewStateChange(byzcoin.Create, byzcoin.NewInstanceID(coinID),
+	log.Lvlf3("Creating account %x", coinID[:])
+	return byzcoin.NewStateChange(byzcoin.Create, coinID,
 		contracts.ContractCoinID, cciBuf, d.GetBaseID()), nil
 }
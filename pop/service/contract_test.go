@@ -0,0 +1,811 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
+	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/darc/expression"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/eddsa"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContractPopParty_Finalize(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+
+	c, msg, signer := newPopLedger(t, roster)
+
+	// Spawn the party with the conodes as organizers.
+	party := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyID := spawnParty(t, c, msg, signer, &party)
+	require.Nil(t, invokeParty(t, c, signer, partyID, "freeze"))
+
+	// The organizers collectively sign the final statement.
+	sign := orgsSigner(t, local, nodes, roster)
+	final := party
+	for i := 0; i < 2; i++ {
+		final.Attendees = append(final.Attendees, key.NewKeyPair(tSuite).Public)
+	}
+	final.Signature = sign(&final)
+	require.Nil(t, final.Verify())
+
+	finalize := func(fs *FinalStatement, sig []byte) error {
+		return finalizeParty(t, c, signer, partyID, fs, sig)
+	}
+
+	// Missing signature.
+	require.NotNil(t, finalize(&final, nil))
+
+	// Signature over another final statement.
+	other := final
+	other.Attendees = append([]kyber.Point{key.NewKeyPair(tSuite).Public}, final.Attendees...)
+	require.NotNil(t, finalize(&other, final.Signature))
+
+	// Correctly signed final statement of another party.
+	desc := *party.Desc
+	desc.Location = "elsewhere"
+	other = final
+	other.Desc = &desc
+	other.Signature = sign(&other)
+	require.NotNil(t, finalize(&other, other.Signature))
+
+	// The party is still waiting to be finalized.
+	require.Equal(t, PartyFrozen, getParty(t, c, partyID).State)
+
+	// The signature is only given as an argument: the stored final
+	// statement must still verify.
+	unsigned := final
+	unsigned.Signature = nil
+	require.Nil(t, finalize(&unsigned, final.Signature))
+	ppi := getParty(t, c, partyID)
+	require.Equal(t, PartyFinalized, ppi.State)
+	require.Equal(t, final.Signature, ppi.FinalStatement.Signature)
+	require.Nil(t, ppi.FinalStatement.Verify())
+}
+
+func TestContractPopParty_FinalizeAttendees(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+
+	c, msg, signer := newPopLedger(t, roster)
+
+	party := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyID := spawnParty(t, c, msg, signer, &party)
+	require.Nil(t, invokeParty(t, c, signer, partyID, "freeze"))
+	sign := orgsSigner(t, local, nodes, roster)
+	att1 := key.NewKeyPair(tSuite).Public
+	att2 := key.NewKeyPair(tSuite).Public
+
+	finalize := func(atts ...kyber.Point) error {
+		fs := party
+		fs.Attendees = atts
+		fs.Signature = sign(&fs)
+		return finalizeParty(t, c, signer, partyID, &fs, fs.Signature)
+	}
+	err := finalize(att1, att2, att1)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "attendee 2 has the same key as attendee 0")
+	err = finalize(att1, tSuite.Point().Null(), att2)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "attendee 1 has an invalid key")
+	require.Equal(t, PartyFrozen, getParty(t, c, partyID).State)
+
+	require.Nil(t, finalize(att1, att2))
+	require.Equal(t, PartyFinalized, getParty(t, c, partyID).State)
+}
+
+func TestCheckAttendees(t *testing.T) {
+	att1 := key.NewKeyPair(tSuite).Public
+	att2 := key.NewKeyPair(tSuite).Public
+	require.Nil(t, checkAttendees(nil, nil))
+	require.Nil(t, checkAttendees([]kyber.Point{att1, att2}, nil))
+	require.NotNil(t, checkAttendees([]kyber.Point{att1, att2}, att2))
+	require.NotNil(t, checkAttendees([]kyber.Point{att1, att1}, nil))
+	require.NotNil(t, checkAttendees([]kyber.Point{tSuite.Point().Null()}, nil))
+}
+
+func TestContractPopParty_InitialCoins(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+
+	c, msg, signer := newPopLedger(t, roster)
+	sign := orgsSigner(t, local, nodes, roster)
+	coins := func(n uint64) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, n)
+		return buf
+	}
+	balance := func(party byzcoin.InstanceID, pub kyber.Point) uint64 {
+		b, err := NewClient().GetAttendeeBalance(c, party, pub)
+		require.Nil(t, err)
+		return b
+	}
+
+	for i, test := range []struct {
+		max     []byte
+		initial []byte
+		ok      bool
+		balance uint64
+	}{
+		{nil, nil, true, DefaultInitialCoins},
+		{nil, coins(10), true, 10},
+		{nil, coins(DefaultInitialCoins + 1), false, 0},
+		{coins(100), nil, false, 0},
+		{coins(100), coins(101), false, 0},
+		{coins(100), coins(100), true, 100},
+		{coins(0), coins(0), true, 0},
+	} {
+		fs := FinalStatement{
+			Desc: &PopDesc{
+				Name:     "name",
+				DateTime: "2017-07-31 00:00",
+				Location: fmt.Sprintf("city%d", i),
+				Roster:   roster,
+			},
+		}
+		var args []byzcoin.Argument
+		if test.max != nil {
+			args = append(args, byzcoin.Argument{Name: "MaxInitialCoins", Value: test.max})
+		}
+		id := spawnParty(t, c, msg, signer, &fs, args...)
+		require.Nil(t, invokeParty(t, c, signer, id, "freeze"))
+
+		fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public}
+		fs.Signature = sign(&fs)
+		args = nil
+		if test.initial != nil {
+			args = append(args, byzcoin.Argument{Name: "InitialCoins", Value: test.initial})
+		}
+		err := finalizeParty(t, c, signer, id, &fs, fs.Signature, args...)
+		if !test.ok {
+			require.NotNil(t, err, "test %d", i)
+			continue
+		}
+		require.Nil(t, err, "test %d", i)
+		require.Equal(t, test.balance, *getParty(t, c, id).InitialCoins)
+		require.Equal(t, test.balance, balance(id, fs.Attendees[0]))
+	}
+}
+
+// TestPopPartyInstance_InitialCoins makes sure that the attendees of the
+// parties finalized before InitialCoins was stored keep the default.
+func TestPopPartyInstance_InitialCoins(t *testing.T) {
+	buf, err := protobuf.Encode(&PopPartyInstance{State: PartyFinalized})
+	require.Nil(t, err)
+	var ppi PopPartyInstance
+	require.Nil(t, protobuf.DecodeWithConstructors(buf, &ppi, network.DefaultConstructors(tSuite)))
+	require.Nil(t, ppi.InitialCoins)
+	require.Equal(t, DefaultInitialCoins, ppi.initialCoins())
+
+	initial := uint64(0)
+	ppi.InitialCoins = &initial
+	require.Equal(t, uint64(0), ppi.initialCoins())
+}
+
+func TestAttendeeCoinID(t *testing.T) {
+	// The accounts of the attendees must not change, else they cannot find
+	// their coins anymore.
+	var party byzcoin.InstanceID
+	for i := range party {
+		party[i] = byte(i)
+	}
+	pub := tSuite.Point().Base()
+	require.Equal(t, "92c42c5632e6c092995b9d8be9b55bb70cfa19a9ca5f8278712b001cf281483c", fmt.Sprintf("%x", AttendeeCoinID(party, pub).Slice()))
+	id, err := PopCoinAccountID(party, pub)
+	require.Nil(t, err)
+	require.Equal(t, AttendeeCoinID(party, pub), id)
+	_, err = PopCoinAccountID(party, nil)
+	require.NotNil(t, err)
+}
+
+func TestContractPopParty_AttendeeRules(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+
+	c, msg, signer := newPopLedger(t, roster)
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyBuf, err := protobuf.Encode(&fs)
+	require.Nil(t, err)
+	_, _, err = byzcoin.NewTxBuilder(c).
+		Spawn(byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID()), ContractPopParty,
+			byzcoin.Arguments{
+				{Name: "FinalStatement", Value: partyBuf},
+				{Name: "Organizers", Value: msg.GenesisDarc.GetBaseID()},
+				{Name: "AttendeeRules", Value: []byte("invoke:fetch,spawn:darc")},
+			}).
+		SignAndSubmit(signer, 10)
+	require.NotNil(t, err)
+
+	id := spawnParty(t, c, msg, signer, &fs,
+		byzcoin.Argument{Name: "AttendeeRules", Value: []byte("invoke:fetch")})
+	require.Equal(t, []string{"invoke:fetch"}, getParty(t, c, id).AttendeeRules)
+	require.Nil(t, invokeParty(t, c, signer, id, "freeze"))
+	attendee := key.NewKeyPair(tSuite)
+	fs.Attendees = []kyber.Point{attendee.Public}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+	require.Nil(t, finalizeParty(t, c, signer, id, &fs, fs.Signature))
+
+	account := AttendeeCoinID(id, attendee.Public)
+	fetch := func(s darc.Signer) error {
+		coins := make([]byte, 8)
+		binary.LittleEndian.PutUint64(coins, 10)
+		_, _, err := byzcoin.NewTxBuilder(c).
+			Invoke(account, "fetch", byzcoin.Arguments{{Name: "coins", Value: coins}}).
+			SignAndSubmit(s, 10)
+		return err
+	}
+	stranger := darc.NewSignerEd25519(nil, nil)
+	require.NotNil(t, fetch(stranger))
+	require.Nil(t, fetch(darc.NewSignerEd25519(attendee.Public, attendee.Private)))
+
+	p, err := c.GetProof(account.Slice())
+	require.Nil(t, err)
+	var coin byzcoin.Coin
+	require.Nil(t, p.Proof.VerifyAndDecode(tSuite, contracts.ContractCoinID, &coin))
+	require.Equal(t, DefaultInitialCoins-10, coin.Value)
+}
+
+func TestCheckAttendeeRules(t *testing.T) {
+	require.Nil(t, checkAttendeeRules(nil))
+	require.Nil(t, checkAttendeeRules([]string{"invoke:fetch", "invoke:store"}))
+	require.NotNil(t, checkAttendeeRules([]string{"invoke:fetch", "invoke:fetch"}))
+	require.NotNil(t, checkAttendeeRules([]string{"invoke:transfer"}))
+	require.NotNil(t, checkAttendeeRules([]string{"invoke:mint"}))
+}
+
+func TestContractPopParty_Merge(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+
+	c, msg, signer := newPopLedger(t, roster)
+	sign := orgsSigner(t, local, nodes, roster)
+
+	// Three parties in three cities, each having its own attendee plus an
+	// attendee that went to all parties.
+	locations := []string{"city1", "city2", "city3"}
+	var sds []*ShortDesc
+	for _, l := range locations {
+		sds = append(sds, &ShortDesc{Location: l, Roster: roster})
+	}
+	both := key.NewKeyPair(tSuite).Public
+	var parties []FinalStatement
+	var ids []byzcoin.InstanceID
+	for _, l := range locations {
+		fs := FinalStatement{
+			Desc: &PopDesc{
+				Name:     "name",
+				DateTime: "2017-07-31 00:00",
+				Location: l,
+				Roster:   roster,
+				Parties:  sds,
+			},
+		}
+		ids = append(ids, spawnParty(t, c, msg, signer, &fs))
+		require.Nil(t, invokeParty(t, c, signer, ids[len(ids)-1], "freeze"))
+		fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public, both}
+		fs.Signature = sign(&fs)
+		require.Nil(t, finalizeParty(t, c, signer, ids[len(ids)-1], &fs, fs.Signature))
+		parties = append(parties, fs)
+	}
+
+	merge := func(i, j int, fs *FinalStatement) error {
+		fsBuf, err := protobuf.Encode(fs)
+		require.Nil(t, err)
+		_, _, err = byzcoin.NewTxBuilder(c).
+			Invoke(ids[i], "merge", byzcoin.Arguments{
+				{Name: "Party", Value: ids[j].Slice()},
+				{Name: "FinalStatement", Value: fsBuf},
+			}).
+			SignAndSubmit(signer, 10)
+		return err
+	}
+
+	// Final statement that doesn't correspond to the other party.
+	require.NotNil(t, merge(0, 1, &parties[2]))
+	fake := parties[1]
+	fake.Attendees = append(fake.Attendees, key.NewKeyPair(tSuite).Public)
+	fake.Signature = sign(&fake)
+	require.NotNil(t, merge(0, 1, &fake))
+
+	require.Nil(t, merge(0, 1, &parties[1]))
+	// Merging again, in both directions, doesn't change anything.
+	require.Nil(t, merge(0, 1, &parties[1]))
+	require.Nil(t, merge(1, 0, &parties[0]))
+
+	ppi := getParty(t, c, ids[0])
+	require.Equal(t, []byzcoin.InstanceID{ids[1]}, ppi.Merged)
+	ppi = getParty(t, c, ids[1])
+	require.Equal(t, []byzcoin.InstanceID{ids[0]}, ppi.Merged)
+
+	// Every attendee of the merged parties has an account in the namespace
+	// of the first party.
+	hasAccount := func(pub kyber.Point) bool {
+		sc, err := createCoin(byzcoin.Instruction{InstanceID: ids[0]}, &darc.Darc{}, pub, 0)
+		require.Nil(t, err)
+		p, err := c.GetProof(sc.InstanceID)
+		require.Nil(t, err)
+		return p.Proof.InclusionProof.Match(sc.InstanceID)
+	}
+	for _, pub := range []kyber.Point{both, parties[0].Attendees[0], parties[1].Attendees[0]} {
+		require.True(t, hasAccount(pub))
+	}
+	require.False(t, hasAccount(parties[2].Attendees[0]))
+
+	// Merging the third party only adds its own attendee, as the account
+	// of the common attendee already exists.
+	require.Nil(t, merge(0, 2, &parties[2]))
+	require.True(t, hasAccount(parties[2].Attendees[0]))
+	id := AttendeeCoinID(ids[0], parties[2].Attendees[0])
+	p, err := c.GetProof(id.Slice())
+	require.Nil(t, err)
+	var coin byzcoin.Coin
+	require.Nil(t, p.Proof.VerifyAndDecode(tSuite, contracts.ContractCoinID, &coin))
+	require.Equal(t, DefaultInitialCoins, coin.Value)
+	require.Equal(t, 2, len(getParty(t, c, ids[0]).Merged))
+}
+
+func TestContractPopParty_MergeOrganizers(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+	sign := orgsSigner(t, local, nodes, roster)
+
+	// The first party is organized by signer, the second one by org.
+	signer := darc.NewSignerEd25519(nil, nil)
+	org := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:darc"}, signer.Identity(),
+		byzcoin.WithBlockInterval(500*time.Millisecond))
+	require.Nil(t, err)
+	both := expression.InitOrExpr(signer.Identity().String(), org.Identity().String())
+	for _, action := range []string{"spawn:" + ContractPopParty, "invoke:freeze",
+		"invoke:Finalize", "invoke:merge"} {
+		require.Nil(t, msg.GenesisDarc.Rules.AddRule(darc.Action(action), both))
+	}
+	c, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+	orgDarc := darc.NewDarc(darc.InitRules([]darc.Identity{org.Identity()},
+		[]darc.Identity{org.Identity()}), []byte("organizers"))
+	orgDarcBuf, err := orgDarc.ToProto()
+	require.Nil(t, err)
+	_, _, err = byzcoin.NewTxBuilder(c).
+		Spawn(byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID()), byzcoin.ContractDarcID,
+			byzcoin.Arguments{{Name: "darc", Value: orgDarcBuf}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+
+	sds := []*ShortDesc{{Location: "city1", Roster: roster}, {Location: "city2", Roster: roster}}
+	var parties []FinalStatement
+	var ids []byzcoin.InstanceID
+	for i, s := range []darc.Signer{signer, org} {
+		fs := FinalStatement{
+			Desc: &PopDesc{
+				Name:     "name",
+				DateTime: "2017-07-31 00:00",
+				Location: sds[i].Location,
+				Roster:   roster,
+				Parties:  sds,
+			},
+		}
+		orgs := msg.GenesisDarc.GetBaseID()
+		if i == 1 {
+			orgs = orgDarc.GetBaseID()
+		}
+		id := spawnParty(t, c, msg, s, &fs, byzcoin.Argument{Name: "Organizers", Value: orgs})
+		require.Nil(t, invokeParty(t, c, s, id, "freeze"))
+		fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public}
+		fs.Signature = sign(&fs)
+		require.Nil(t, finalizeParty(t, c, s, id, &fs, fs.Signature))
+		parties = append(parties, fs)
+		ids = append(ids, id)
+	}
+
+	fsBuf, err := protobuf.Encode(&parties[1])
+	require.Nil(t, err)
+	merge := func(signers ...darc.Signer) error {
+		_, _, err := byzcoin.NewTxBuilder(c).
+			Invoke(ids[0], "merge", byzcoin.Arguments{
+				{Name: "Party", Value: ids[1].Slice()},
+				{Name: "FinalStatement", Value: fsBuf},
+			}, signers...).
+			SignAndSubmit(darc.Signer{}, 10)
+		return err
+	}
+
+	// The organizers of the first party cannot change the second party.
+	err = merge(signer)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "other party: signers are not organizers")
+	require.Equal(t, 0, len(getParty(t, c, ids[1]).Merged))
+
+	require.Nil(t, merge(signer, org))
+	require.Equal(t, []byzcoin.InstanceID{ids[0]}, getParty(t, c, ids[1]).Merged)
+}
+
+func TestContractPopParty_States(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+	c, msg, signer := newPopLedger(t, roster)
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	id := spawnParty(t, c, msg, signer, &fs)
+	require.Equal(t, PartyConfigured, getParty(t, c, id).State)
+	fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+
+	// Finalizing before the registration is closed.
+	err := finalizeParty(t, c, signer, id, &fs, fs.Signature)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cannot go from state Configured to state Finalized")
+
+	require.Nil(t, invokeParty(t, c, signer, id, "scan"))
+	require.Equal(t, PartyScanning, getParty(t, c, id).State)
+	require.Nil(t, invokeParty(t, c, signer, id, "freeze"))
+	require.Equal(t, PartyFrozen, getParty(t, c, id).State)
+
+	// Scanning again once the registration is closed.
+	err = invokeParty(t, c, signer, id, "scan")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cannot go from state Frozen to state Scanning")
+
+	require.Nil(t, finalizeParty(t, c, signer, id, &fs, fs.Signature))
+	require.Equal(t, PartyFinalized, getParty(t, c, id).State)
+	require.NotNil(t, invokeParty(t, c, signer, id, "freeze"))
+}
+
+func TestContractPopParty_Organizers(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+
+	// Everybody is allowed by the darc of the ledger, but only org is an
+	// organizer of the party.
+	signer := darc.NewSignerEd25519(nil, nil)
+	org := darc.NewSignerEd25519(nil, nil)
+	stranger := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		[]string{"spawn:darc"}, signer.Identity(),
+		byzcoin.WithBlockInterval(500*time.Millisecond))
+	require.Nil(t, err)
+	everybody := expression.InitOrExpr(signer.Identity().String(),
+		org.Identity().String(), stranger.Identity().String())
+	for _, action := range []string{"spawn:" + ContractPopParty, "invoke:freeze", "invoke:Finalize"} {
+		require.Nil(t, msg.GenesisDarc.Rules.AddRule(darc.Action(action), everybody))
+	}
+	c, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+
+	orgDarc := darc.NewDarc(darc.InitRules([]darc.Identity{org.Identity()},
+		[]darc.Identity{org.Identity()}), []byte("organizers"))
+	orgDarcBuf, err := orgDarc.ToProto()
+	require.Nil(t, err)
+	gID := byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID())
+	_, _, err = byzcoin.NewTxBuilder(c).
+		Spawn(gID, byzcoin.ContractDarcID, byzcoin.Arguments{{Name: "darc", Value: orgDarcBuf}}).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	fsBuf, err := protobuf.Encode(&fs)
+	require.Nil(t, err)
+	spawn := func(s darc.Signer, args ...byzcoin.Argument) (byzcoin.InstanceID, error) {
+		args = append(args, byzcoin.Argument{Name: "FinalStatement", Value: fsBuf})
+		ctx, _, err := byzcoin.NewTxBuilder(c).
+			Spawn(gID, ContractPopParty, args).
+			SignAndSubmit(s, 10)
+		if err != nil {
+			return byzcoin.InstanceID{}, err
+		}
+		return ctx.Instructions[0].DeriveID(""), nil
+	}
+	orgsArg := byzcoin.Argument{Name: "Organizers", Value: orgDarc.GetBaseID()}
+
+	_, err = spawn(org)
+	require.NotNil(t, err)
+	_, err = spawn(stranger, orgsArg)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not organizers")
+	id, err := spawn(org, orgsArg)
+	require.Nil(t, err)
+	require.Equal(t, orgDarc.GetBaseID(), getParty(t, c, id).Organizers)
+
+	// The darc of the ledger is not enough to change the party.
+	require.NotNil(t, invokeParty(t, c, stranger, id, "freeze"))
+	require.Nil(t, invokeParty(t, c, org, id, "freeze"))
+	fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+	require.NotNil(t, finalizeParty(t, c, stranger, id, &fs, fs.Signature))
+	require.Nil(t, finalizeParty(t, c, org, id, &fs, fs.Signature))
+	require.Equal(t, PartyFinalized, getParty(t, c, id).State)
+}
+
+func TestContractPopParty_Delete(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+	c, msg, signer := newPopLedger(t, roster)
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	deleteParty := func(id byzcoin.InstanceID) error {
+		_, _, err := byzcoin.NewTxBuilder(c).Delete(id).SignAndSubmit(signer, 10)
+		return err
+	}
+	exists := func(id byzcoin.InstanceID) bool {
+		p, err := c.GetProof(id.Slice())
+		require.Nil(t, err)
+		return p.Proof.InclusionProof.Match(id.Slice())
+	}
+
+	// Delete a configured and a frozen party.
+	id := spawnParty(t, c, msg, signer, &fs)
+	require.Nil(t, deleteParty(id))
+	require.False(t, exists(id))
+	fs.Desc.Location = "city2"
+	id = spawnParty(t, c, msg, signer, &fs)
+	require.Nil(t, invokeParty(t, c, signer, id, "freeze"))
+	require.Nil(t, deleteParty(id))
+	require.False(t, exists(id))
+
+	fs.Desc.Location = "city3"
+	id = spawnParty(t, c, msg, signer, &fs)
+	require.Nil(t, invokeParty(t, c, signer, id, "freeze"))
+	fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+	require.Nil(t, finalizeParty(t, c, signer, id, &fs, fs.Signature))
+	err := deleteParty(id)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "cannot delete a finalized party")
+	require.True(t, exists(id))
+}
+
+func TestContractPopParty_Register(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+	c, msg, signer := newPopLedger(t, roster)
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+
+	// Without an open registration, the darc of the party needs an
+	// "invoke:register" rule.
+	closed := spawnParty(t, c, msg, signer, &fs)
+	require.Nil(t, invokeParty(t, c, signer, closed, "scan"))
+	_, _, err := byzcoin.NewTxBuilder(c).
+		Invoke(closed, "register", byzcoin.Arguments{}).
+		SignAndSubmit(darc.NewSignerEd25519(nil, nil), 10)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "action 'invoke:register' does not exist")
+
+	id := spawnParty(t, c, msg, signer, &fs,
+		byzcoin.Argument{Name: "OpenRegistration", Value: []byte{1}})
+	require.True(t, getParty(t, c, id).OpenRegistration)
+	orgBuf, err := signer.Ed25519.Point.MarshalBinary()
+	require.Nil(t, err)
+	countersign := func(pub kyber.Point) []byte {
+		pubBuf, err := pub.MarshalBinary()
+		require.Nil(t, err)
+		sig, err := schnorr.Sign(tSuite, signer.Ed25519.Secret, append(id.Slice(), pubBuf...))
+		require.Nil(t, err)
+		return sig
+	}
+	// The attendees sign the registration themselves.
+	register := func(pub kyber.Point, sig []byte) error {
+		pubBuf, err := pub.MarshalBinary()
+		require.Nil(t, err)
+		_, _, err = byzcoin.NewTxBuilder(c).
+			Invoke(id, "register", byzcoin.Arguments{
+				{Name: "Public", Value: pubBuf},
+				{Name: "Organizer", Value: orgBuf},
+				{Name: "Signature", Value: sig}}).
+			SignAndSubmit(darc.NewSignerEd25519(nil, nil), 10)
+		return err
+	}
+	att1 := key.NewKeyPair(tSuite).Public
+	att2 := key.NewKeyPair(tSuite).Public
+
+	// Registering before the keys are scanned.
+	err = register(att1, countersign(att1))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "current state is Configured")
+	require.Nil(t, invokeParty(t, c, signer, id, "scan"))
+
+	require.Nil(t, register(att1, countersign(att1)))
+	require.Nil(t, register(att2, countersign(att2)))
+	err = register(key.NewKeyPair(tSuite).Public, countersign(att1))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "wrong signature")
+	err = register(att1, countersign(att1))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "attendee 2 has the same key as attendee 0")
+	registered := getParty(t, c, id).Registered
+	require.Equal(t, 2, len(registered))
+	require.True(t, att1.Equal(registered[0]))
+	require.True(t, att2.Equal(registered[1]))
+
+	// The organizers sign the final statement with the registered attendees,
+	// but don't need to send them again.
+	require.Nil(t, invokeParty(t, c, signer, id, "freeze"))
+	final := fs
+	final.Attendees = []kyber.Point{att1, att2}
+	sig := orgsSigner(t, local, nodes, roster)(&final)
+	require.Nil(t, finalizeParty(t, c, signer, id, &fs, sig))
+	ppi := getParty(t, c, id)
+	require.Equal(t, PartyFinalized, ppi.State)
+	require.Equal(t, 2, len(ppi.FinalStatement.Attendees))
+	for _, att := range final.Attendees {
+		coinID := AttendeeCoinID(id, att)
+		p, err := c.GetProof(coinID.Slice())
+		require.Nil(t, err)
+		require.True(t, p.Proof.InclusionProof.Match(coinID.Slice()))
+	}
+}
+
+func TestCheckTransition(t *testing.T) {
+	require.Nil(t, checkTransition(PartyConfigured, PartyScanning))
+	require.Nil(t, checkTransition(PartyConfigured, PartyFrozen))
+	require.Nil(t, checkTransition(PartyScanning, PartyFrozen))
+	require.Nil(t, checkTransition(PartyFrozen, PartyFinalized))
+	require.NotNil(t, checkTransition(PartyConfigured, PartyFinalized))
+	require.NotNil(t, checkTransition(PartyScanning, PartyFinalized))
+	require.NotNil(t, checkTransition(PartyFinalized, PartyFrozen))
+	require.NotNil(t, checkTransition(PartyFrozen, PartyScanning))
+	require.NotNil(t, checkTransition(PartyFrozen, PartyConfigured))
+	require.NotNil(t, checkTransition(0, PartyScanning))
+}
+
+// newPopLedger creates a ledger where the returned signer can spawn parties
+// and invoke all commands of the parties. The signer also gets the
+// additional rules.
+func newPopLedger(t *testing.T, roster *onet.Roster, rules ...string) (*byzcoin.Client, *byzcoin.CreateGenesisBlock, darc.Signer) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	msg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, roster,
+		append([]string{"spawn:" + ContractPopParty, "invoke:scan", "invoke:freeze",
+			"invoke:Finalize", "invoke:merge", "delete"}, rules...),
+		signer.Identity(), byzcoin.WithBlockInterval(500*time.Millisecond))
+	require.Nil(t, err)
+	c, _, err := byzcoin.NewLedger(msg, false)
+	require.Nil(t, err)
+	return c, msg, signer
+}
+
+func spawnParty(t *testing.T, c *byzcoin.Client, msg *byzcoin.CreateGenesisBlock,
+	signer darc.Signer, fs *FinalStatement, args ...byzcoin.Argument) byzcoin.InstanceID {
+	fsBuf, err := protobuf.Encode(fs)
+	require.Nil(t, err)
+	// The arguments given by the caller take precedence over the default
+	// organizers.
+	args = append(args, byzcoin.Argument{Name: "FinalStatement", Value: fsBuf},
+		byzcoin.Argument{Name: "Organizers", Value: msg.GenesisDarc.GetBaseID()})
+	ctx, _, err := byzcoin.NewTxBuilder(c).
+		Spawn(byzcoin.NewInstanceID(msg.GenesisDarc.GetBaseID()), ContractPopParty, args).
+		SignAndSubmit(signer, 10)
+	require.Nil(t, err)
+	return ctx.Instructions[0].DeriveID("")
+}
+
+func invokeParty(t *testing.T, c *byzcoin.Client, signer darc.Signer,
+	id byzcoin.InstanceID, command string) error {
+	_, _, err := byzcoin.NewTxBuilder(c).
+		Invoke(id, command, nil).
+		SignAndSubmit(signer, 10)
+	return err
+}
+
+func finalizeParty(t *testing.T, c *byzcoin.Client, signer darc.Signer,
+	id byzcoin.InstanceID, fs *FinalStatement, sig []byte, args ...byzcoin.Argument) error {
+	fsBuf, err := protobuf.Encode(fs)
+	require.Nil(t, err)
+	args = append(args, byzcoin.Argument{Name: "FinalStatement", Value: fsBuf})
+	if sig != nil {
+		args = append(args, byzcoin.Argument{Name: "Signature", Value: sig})
+	}
+	_, _, err = byzcoin.NewTxBuilder(c).
+		Invoke(id, "Finalize", args).
+		SignAndSubmit(signer, 10)
+	return err
+}
+
+// orgsSigner returns a function creating the collective signature of all
+// nodes on a final statement.
+func orgsSigner(t *testing.T, local *onet.LocalTest, nodes []*onet.Server,
+	roster *onet.Roster) func(*FinalStatement) []byte {
+	priv := tSuite.Scalar().Zero()
+	for _, si := range nodes {
+		priv.Add(priv, local.GetPrivate(si))
+	}
+	return func(fs *FinalStatement) []byte {
+		h, err := fs.Hash()
+		require.Nil(t, err)
+		sig, err := (&eddsa.EdDSA{Secret: priv, Public: roster.Aggregate}).Sign(h)
+		require.Nil(t, err)
+		return sig
+	}
+}
+
+func getParty(t *testing.T, c *byzcoin.Client, id byzcoin.InstanceID) *PopPartyInstance {
+	p, err := c.GetProof(id.Slice())
+	require.Nil(t, err)
+	require.True(t, p.Proof.InclusionProof.Match(id.Slice()))
+	_, buf, _, _, err := p.Proof.KeyValue()
+	require.Nil(t, err)
+	var ppi PopPartyInstance
+	require.Nil(t, protobuf.DecodeWithConstructors(buf, &ppi, network.DefaultConstructors(tSuite)))
+	return &ppi
+}
@@ -7,6 +7,7 @@ This holds the messages used to communicate with the service over the network.
 import (
 	"github.com/dedis/cothority/byzcoin"
 	"github.com/dedis/cothority/darc"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/network"
@@ -21,7 +22,12 @@ func init() {
 		VerifyLink{}, VerifyLinkReply{},
 		PopPartyInstance{}, StoreInstanceID{},
 		StoreInstanceIDReply{},
-		GetInstanceID{}, GetInstanceIDReply{})
+		GetInstanceID{}, GetInstanceIDReply{},
+		GetPopCoinAccount{}, GetPopCoinAccountReply{},
+		GetFinalStatement{}, GetFinalStatementReply{},
+		PropagateFinalStatement{}, PropagateFinalStatementReply{},
+		PopBridgeInstance{},
+		GetPartyStats{}, GetPartyStatsReply{})
 }
 
 // PROTOSTART
@@ -29,8 +35,10 @@ func init() {
 // type :map\[string\]FinalStatement:map<string, FinalStatement>
 // type :byzcoin.InstanceID:bytes
 // type :darc.ID:bytes
+// type :skipchain.SkipBlockID:bytes
 // import "onet.proto";
 // import "darc.proto";
+// import "byzcoin.proto";
 //
 // option java_package = "ch.epfl.dedis.lib.proto";
 // option java_outer_classname = "PoPProto";
@@ -264,9 +272,11 @@ type PopPartyInstance struct {
 	// State has one of the following values:
 	// 1: it is a configuration only
 	// 2: it is a finalized pop-party
+	// 3: the keys of the attendees are being scanned
+	// 4: the registration is closed and the party waits to be finalized
 	State int
-	// FinalStatement has either only the Desc inside if State == 1, or all fields
-	// set if State == 2.
+	// FinalStatement has only the Desc inside until the party is finalized,
+	// then all fields are set.
 	FinalStatement *FinalStatement
 	// Previous is the link to the instanceID of the previous party, it can be
 	// nil for the first party.
@@ -276,4 +286,135 @@ type PopPartyInstance struct {
 	Next byzcoin.InstanceID
 	// Public key of service - can be nil.
 	Service kyber.Point `protobuf:"opt"`
+	// Merged holds the instanceIDs of the parties this party has been merged
+	// with.
+	Merged []byzcoin.InstanceID
+	// MaxInitialCoins is the maximum number of popcoins an attendee can get
+	// when the party is finalized. If it is nil, DefaultInitialCoins is used.
+	MaxInitialCoins *uint64 `protobuf:"opt"`
+	// InitialCoins is the number of popcoins every attendee got when the
+	// party has been finalized. It is nil for the parties finalized before
+	// it was introduced, whose attendees got DefaultInitialCoins.
+	InitialCoins *uint64 `protobuf:"opt"`
+	// AttendeeRules are the actions added to the darcs of the attendees,
+	// besides "invoke:transfer".
+	AttendeeRules []string
+	// Organizers is the ID of the darc of the organizers. It is nil for
+	// parties spawned before it has been introduced.
+	Organizers darc.ID
+	// Registered holds the attendees that registered themselves while the
+	// keys were being scanned.
+	Registered []kyber.Point
+	// Transitions holds the states the party went through, in order. It is
+	// empty for parties spawned before it has been introduced.
+	Transitions []PartyTransition
+	// OpenRegistration is true if the attendees can register without an
+	// "invoke:register" rule in the darc of the party.
+	OpenRegistration bool
+}
+
+// PartyTransition tells when a party reached a state.
+type PartyTransition struct {
+	// State is the state the party reached.
+	State int
+	// Index of the block holding the transition.
+	Index int
+}
+
+// GetPartyStats asks for the statistics of a party stored in ByzCoin.
+type GetPartyStats struct {
+	// ByzCoinID is the ID of the ledger holding the party.
+	ByzCoinID skipchain.SkipBlockID
+	// PartyInstanceID is the instanceID of the party.
+	PartyInstanceID byzcoin.InstanceID
+}
+
+// GetPartyStatsReply holds the statistics of a party.
+type GetPartyStatsReply struct {
+	// State is the current state of the party.
+	State int
+	// Attendees is the number of attendees in the final statement. Attendees
+	// of merged parties are not counted.
+	Attendees int
+	// InitialCoins is the total number of popcoins given to the attendees
+	// when the party has been finalized.
+	InitialCoins uint64
+	// ServiceAccounts holds the instanceIDs of the coin accounts of the
+	// services.
+	ServiceAccounts []byzcoin.InstanceID
+	// Transitions holds the states the party went through.
+	Transitions []PartyTransition
+	// Proof of the party instance that can be verified with the genesis
+	// block of the ledger.
+	Proof byzcoin.Proof
+}
+
+// PopBridgeInstance is the data that is stored in a pop-bridge instance.
+type PopBridgeInstance struct {
+	// PopCoins is the number of popcoins that are converted to Coins
+	// standard coins.
+	PopCoins uint64
+	// Coins is the number of standard coins given for PopCoins popcoins.
+	Coins uint64
+	// Reserve holds the standard coins that are not converted yet.
+	Reserve byzcoin.Coin
+	// Party is the instanceID of the party whose attendees can convert
+	// their popcoins.
+	Party byzcoin.InstanceID
+}
+
+// GetPopCoinAccount asks for the coin account created for an attendee when
+// the party has been finalized.
+type GetPopCoinAccount struct {
+	// ByzCoinID is the ID of the ledger holding the party.
+	ByzCoinID skipchain.SkipBlockID
+	// PartyInstanceID is the instanceID of the party.
+	PartyInstanceID byzcoin.InstanceID
+	// Public is the key of the attendee.
+	Public kyber.Point
+}
+
+// GetPopCoinAccountReply returns the coin account of the attendee.
+type GetPopCoinAccountReply struct {
+	// InstanceID of the coin account.
+	InstanceID byzcoin.InstanceID
+	// Balance of the coin account.
+	Balance uint64
+	// Proof of the coin account that can be verified with the genesis block
+	// of the ledger.
+	Proof byzcoin.Proof
+}
+
+// GetFinalStatement asks for the final statement of a party stored in
+// ByzCoin.
+type GetFinalStatement struct {
+	// ByzCoinID is the ID of the ledger holding the party.
+	ByzCoinID skipchain.SkipBlockID
+	// PartyInstanceID is the instanceID of the party.
+	PartyInstanceID byzcoin.InstanceID
+}
+
+// GetFinalStatementReply returns the final statement of the party.
+type GetFinalStatementReply struct {
+	// FinalStatement of the party.
+	FinalStatement *FinalStatement
+	// Proof of the party instance that can be verified with the genesis
+	// block of the ledger.
+	Proof byzcoin.Proof
+}
+
+// PropagateFinalStatement asks a node holding the ledger to propagate the
+// final statement of a party to the roster of the party.
+type PropagateFinalStatement struct {
+	// ByzCoinID is the ID of the ledger holding the party.
+	ByzCoinID skipchain.SkipBlockID
+	// PartyInstanceID is the instanceID of the party.
+	PartyInstanceID byzcoin.InstanceID
+}
+
+// PropagateFinalStatementReply returns the number of nodes that received the
+// final statement.
+type PropagateFinalStatementReply struct {
+	// Replies is the number of nodes that received the final statement.
+	Replies int
 }
@@ -33,10 +33,12 @@ import (
 
 	"github.com/dedis/cothority"
 	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/byzcoin/contracts"
 	"github.com/dedis/cothority/byzcoinx"
 	"github.com/dedis/cothority/darc"
 	"github.com/dedis/cothority/ftcosi/protocol"
 	"github.com/dedis/cothority/messaging"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/suites"
@@ -44,6 +46,7 @@ import (
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
 )
 
 func init() {
@@ -67,6 +70,7 @@ const bftSignFinal = "BFTFinal"
 const bftSignMerge = "PopBFTSignMerge"
 const propagFinal = "PoPPropagateFinal"
 const propagDescription = "PoPPropagateDescription"
+const propagPartyFinal = "PoPPropagatePartyFinal"
 const timeout = 60 * time.Second
 
 // SIGSIZE size of signature
@@ -97,6 +101,10 @@ type Service struct {
 	propagateFinalize messaging.PropagationFunc
 	// propagate possible new descriptions
 	propagateDescription messaging.PropagationFunc
+	// propagate final statements read from ByzCoin
+	propagatePartyFinal messaging.PropagationFunc
+	// partyFinalsLock protects data.PartyFinals
+	partyFinalsLock sync.Mutex
 	// Sync tools
 	// key of map is ID of party
 	// synchronizing inside one party
@@ -135,6 +143,9 @@ type saveData struct {
 	// StoredKeys is a temporary storage for saving keys of attendees while
 	// scanning.
 	StoredKeys map[string]*keyList
+	// PartyFinals stores a map of party instanceID to the final statement
+	// read from ByzCoin. They are only stored once verified.
+	PartyFinals map[string]*storedPartyFinal
 	// The info used in merge process
 	// key is ID of party
 	merges map[string]*merge
@@ -431,6 +442,14 @@ func (s *Service) GetFinalStatements(req *GetFinalStatements) (*GetFinalStatemen
 	for k, v := range s.data.Finals {
 		rep.FinalStatements[k] = v
 	}
+	s.partyFinalsLock.Lock()
+	defer s.partyFinalsLock.Unlock()
+	for _, spf := range s.data.PartyFinals {
+		k := string(spf.FinalStatement.Desc.Hash())
+		if _, ok := rep.FinalStatements[k]; !ok {
+			rep.FinalStatements[k] = spf.FinalStatement
+		}
+	}
 	return rep, nil
 }
 
@@ -490,6 +509,160 @@ func (s *Service) GetSigner(req *GetSigner) (*GetSignerReply, error) {
 	return &GetSignerReply{*sig}, nil
 }
 
+// GetPopCoinAccount returns the coin account of an attendee of a finalized
+// party, together with its proof.
+func (s *Service) GetPopCoinAccount(req *GetPopCoinAccount) (*GetPopCoinAccountReply, error) {
+	id, err := PopCoinAccountID(req.PartyInstanceID, req.Public)
+	if err != nil {
+		return nil, err
+	}
+	bc := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	resp, err := bc.GetProof(&byzcoin.GetProof{
+		Version: byzcoin.CurrentVersion,
+		Key:     id.Slice(),
+		ID:      req.ByzCoinID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Proof.InclusionProof.Match(id.Slice()) {
+		return nil, errors.New("no coin account for this attendee")
+	}
+	_, value, contractID, _, err := resp.Proof.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if contractID != contracts.ContractCoinID {
+		return nil, errors.New("instance is not a coin account")
+	}
+	var coin byzcoin.Coin
+	err = protobuf.Decode(value, &coin)
+	if err != nil {
+		return nil, errors.New("couldn't decode coin account: " + err.Error())
+	}
+	return &GetPopCoinAccountReply{
+		InstanceID: id,
+		Balance:    coin.Value,
+		Proof:      resp.Proof,
+	}, nil
+}
+
+// ErrNotFinalized is returned by GetFinalStatement if the party has not been
+// finalized yet.
+var ErrNotFinalized = errors.New("party is not finalized yet")
+
+// GetFinalStatement returns the final statement of a party stored in
+// ByzCoin, together with the proof of the party instance. The final statement
+// stored on the node, which has been read or propagated at finalize time, is
+// returned first. Otherwise it is read from ByzCoin, verified and stored.
+// As a finalized party doesn't change its final statement, the stored proof
+// can be older than the latest block.
+func (s *Service) GetFinalStatement(req *GetFinalStatement) (*GetFinalStatementReply, error) {
+	s.partyFinalsLock.Lock()
+	spf, ok := s.data.PartyFinals[string(req.PartyInstanceID.Slice())]
+	s.partyFinalsLock.Unlock()
+	if ok && spf.PartyFinal.ByzCoinID.Equal(req.ByzCoinID) {
+		return &GetFinalStatementReply{
+			FinalStatement: spf.FinalStatement,
+			Proof:          spf.PartyFinal.Proof,
+		}, nil
+	}
+
+	spf, err := s.fetchPartyFinal(req.ByzCoinID, req.PartyInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	s.storePartyFinal(spf)
+	return &GetFinalStatementReply{
+		FinalStatement: spf.FinalStatement,
+		Proof:          spf.PartyFinal.Proof,
+	}, nil
+}
+
+// PropagateFinalStatement reads the final statement of a party from ByzCoin,
+// stores it and propagates it to the roster of the party, so that the nodes
+// that don't hold the ledger can return it. The pop app calls it once the
+// party is finalized.
+func (s *Service) PropagateFinalStatement(req *PropagateFinalStatement) (*PropagateFinalStatementReply, error) {
+	spf, err := s.fetchPartyFinal(req.ByzCoinID, req.PartyInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	s.storePartyFinal(spf)
+	replies, err := s.propagatePartyFinal(spf.FinalStatement.Desc.Roster, spf.PartyFinal, 10*time.Second)
+	if err != nil {
+		return nil, errors.New("couldn't propagate final statement: " + err.Error())
+	}
+	return &PropagateFinalStatementReply{Replies: replies}, nil
+}
+
+// fetchPartyFinal reads the final statement of a party from the ByzCoin
+// service of this node and verifies it against the genesis block.
+func (s *Service) fetchPartyFinal(byzcoinID skipchain.SkipBlockID, party byzcoin.InstanceID) (*storedPartyFinal, error) {
+	bc := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	resp, err := bc.GetProof(&byzcoin.GetProof{
+		Version: byzcoin.CurrentVersion,
+		Key:     party.Slice(),
+		ID:      byzcoinID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := s.Service(skipchain.ServiceName).(*skipchain.Service).
+		GetSingleBlock(&skipchain.GetSingleBlock{ID: byzcoinID})
+	if err != nil {
+		return nil, errors.New("couldn't get genesis block: " + err.Error())
+	}
+
+	pf := &PartyFinal{
+		ByzCoinID:       byzcoinID,
+		PartyInstanceID: party,
+		Genesis:         genesis,
+		Proof:           resp.Proof,
+	}
+	fs, version, err := pf.verify()
+	if err != nil {
+		return nil, err
+	}
+	return &storedPartyFinal{pf, fs, version}, nil
+}
+
+// GetPartyStats returns the statistics of a party stored in ByzCoin,
+// together with the proof of the party instance.
+func (s *Service) GetPartyStats(req *GetPartyStats) (*GetPartyStatsReply, error) {
+	bc := s.Service(byzcoin.ServiceName).(*byzcoin.Service)
+	resp, err := bc.GetProof(&byzcoin.GetProof{
+		Version: byzcoin.CurrentVersion,
+		Key:     req.PartyInstanceID.Slice(),
+		ID:      req.ByzCoinID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Proof.InclusionProof.Match(req.PartyInstanceID.Slice()) {
+		return nil, errors.New("unknown party instance")
+	}
+	var ppi PopPartyInstance
+	err = resp.Proof.VerifyAndDecode(cothority.Suite, ContractPopParty, &ppi)
+	if err != nil {
+		return nil, errors.New("couldn't get party: " + err.Error())
+	}
+	reply := &GetPartyStatsReply{
+		State:       ppi.State,
+		Transitions: ppi.Transitions,
+		Proof:       resp.Proof,
+	}
+	if ppi.State == PartyFinalized {
+		reply.Attendees = len(ppi.FinalStatement.Attendees)
+		reply.InitialCoins = ppi.initialCoins() * uint64(reply.Attendees)
+		if ppi.Service != nil {
+			reply.ServiceAccounts = []byzcoin.InstanceID{
+				AttendeeCoinID(req.PartyInstanceID, ppi.Service)}
+		}
+	}
+	return reply, nil
+}
+
 // MergeConfig receives a final statement of requesting party,
 // hash of local party. Checks if they are from one merge party and responses with
 // own finalStatement
@@ -882,6 +1055,46 @@ func (s *Service) PropagateFinal(msg network.Message) {
 	log.Lvlf2("%s Stored final statement %v", s.ServerIdentity(), fs)
 }
 
+// PropagatePartyFinal stores a final statement read from ByzCoin by another
+// node. It is only stored if this node is in the roster of the party, which
+// signed the final statement.
+func (s *Service) PropagatePartyFinal(msg network.Message) {
+	pf, ok := msg.(*PartyFinal)
+	if !ok {
+		log.Error("Couldn't convert to a PartyFinal")
+		return
+	}
+	fs, version, err := pf.verify()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if i, _ := fs.Desc.Roster.Search(s.ServerIdentity().ID); i < 0 {
+		log.Error("Not in the roster of the party")
+		return
+	}
+	if s.storePartyFinal(&storedPartyFinal{pf, fs, version}) {
+		log.Lvlf2("%s Stored final statement of party %x", s.ServerIdentity(),
+			pf.PartyInstanceID.Slice())
+	}
+}
+
+// storePartyFinal stores the verified final statement, unless the stored
+// final statement of the party has the same or a newer version. It returns
+// true if spf has been stored.
+func (s *Service) storePartyFinal(spf *storedPartyFinal) bool {
+	s.partyFinalsLock.Lock()
+	defer s.partyFinalsLock.Unlock()
+	key := string(spf.PartyFinal.PartyInstanceID.Slice())
+	if old, ok := s.data.PartyFinals[key]; ok &&
+		old.PartyFinal.ByzCoinID.Equal(spf.PartyFinal.ByzCoinID) && old.Version >= spf.Version {
+		return false
+	}
+	s.data.PartyFinals[key] = spf
+	s.save()
+	return true
+}
+
 // PropagateDescription is called to store new descriptions on the nodes that
 // are supposed to participate.
 func (s *Service) PropagateDescription(msg network.Message) {
@@ -1150,7 +1363,9 @@ func newService(c *onet.Context) (onet.Service, error) {
 	err := s.RegisterHandlers(s.PinRequest, s.VerifyLink, s.StoreConfig, s.FinalizeRequest,
 		s.FetchFinal, s.MergeRequest, s.GetProposals, s.GetLink, s.GetFinalStatements,
 		s.StoreKeys, s.StoreInstanceID, s.GetInstanceID,
-		s.StoreSigner, s.GetSigner, s.GetKeys, s.StoreKeys)
+		s.StoreSigner, s.GetSigner, s.GetKeys, s.StoreKeys,
+		s.GetPopCoinAccount, s.GetFinalStatement,
+		s.PropagateFinalStatement, s.GetPartyStats)
 	if err != nil {
 		return nil, err
 	}
@@ -1175,6 +1390,9 @@ func newService(c *onet.Context) (onet.Service, error) {
 	if len(s.data.StoredKeys) == 0 {
 		s.data.StoredKeys = map[string]*keyList{}
 	}
+	if len(s.data.PartyFinals) == 0 {
+		s.data.PartyFinals = map[string]*storedPartyFinal{}
+	}
 	s.syncs = make(map[string]*syncChans)
 	s.propagateFinalize, err = messaging.NewPropagationFunc(c, propagFinal, s.PropagateFinal, 0)
 	if err != nil {
@@ -1184,6 +1402,10 @@ func newService(c *onet.Context) (onet.Service, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.propagatePartyFinal, err = messaging.NewPropagationFunc(c, propagPartyFinal, s.PropagatePartyFinal, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	s.RegisterProcessorFunc(checkConfigID, s.CheckConfig)
 	s.RegisterProcessorFunc(checkConfigReplyID, s.CheckConfigReply)
@@ -1199,6 +1421,7 @@ func newService(c *onet.Context) (onet.Service, error) {
 	}
 
 	byzcoin.RegisterContract(c, ContractPopParty, s.ContractPopParty)
+	byzcoin.RegisterContract(c, ContractPopBridge, s.ContractPopBridge)
 
 	return s, nil
 }
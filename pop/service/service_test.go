@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
 	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/kyber/suites"
@@ -508,6 +510,240 @@ func TestService_GetFinalStatement(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestService_GetPopCoinAccount(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+	service := local.GetServices(nodes, serviceID)[0].(*Service)
+
+	c, msg, signer := newPopLedger(t, roster)
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyID := spawnParty(t, c, msg, signer, &fs)
+	require.Nil(t, invokeParty(t, c, signer, partyID, "freeze"))
+	fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public, key.NewKeyPair(tSuite).Public}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+	require.Nil(t, finalizeParty(t, c, signer, partyID, &fs, fs.Signature))
+
+	for _, pub := range fs.Attendees {
+		reply, err := service.GetPopCoinAccount(&GetPopCoinAccount{
+			ByzCoinID:       c.ID,
+			PartyInstanceID: partyID,
+			Public:          pub,
+		})
+		require.Nil(t, err)
+		id := AttendeeCoinID(partyID, pub)
+		require.Equal(t, id, reply.InstanceID)
+		require.Equal(t, uint64(1000000), reply.Balance)
+		require.Nil(t, reply.Proof.Verify(c.ID))
+		require.True(t, reply.Proof.InclusionProof.Match(id.Slice()))
+	}
+
+	_, err := service.GetPopCoinAccount(&GetPopCoinAccount{
+		ByzCoinID:       c.ID,
+		PartyInstanceID: partyID,
+		Public:          key.NewKeyPair(tSuite).Public,
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_GetFinalStatementFromByzCoin(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+	c, msg, signer := newPopLedger(t, roster)
+	addr := roster.List[0].Address
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyID := spawnParty(t, c, msg, signer, &fs)
+	_, err := NewClient().GetFinalStatement(addr, c.ID, partyID)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ErrNotFinalized.Error())
+
+	_, err = NewClient().GetFinalStatement(addr, c.ID, byzcoin.NewInstanceID([]byte("unknown")))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unknown party instance")
+
+	require.Nil(t, invokeParty(t, c, signer, partyID, "freeze"))
+	att := key.NewKeyPair(tSuite).Public
+	fs.Attendees = []kyber.Point{att}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+	require.Nil(t, finalizeParty(t, c, signer, partyID, &fs, fs.Signature))
+
+	reply, err := NewClient().GetFinalStatement(addr, c.ID, partyID)
+	require.Nil(t, err)
+	require.Nil(t, reply.Proof.Verify(c.ID))
+	require.True(t, reply.Proof.InclusionProof.Match(partyID.Slice()))
+	h, err := reply.FinalStatement.Hash()
+	require.Nil(t, err)
+	h2, err := fs.Hash()
+	require.Nil(t, err)
+	require.Equal(t, h2, h)
+	require.Nil(t, VerifyAttendance(reply.FinalStatement, att))
+	require.NotNil(t, VerifyAttendance(reply.FinalStatement, key.NewKeyPair(tSuite).Public))
+}
+
+func TestService_PropagatePartyFinal(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(4, true)
+	services := local.GetServices(nodes, serviceID)
+	// Node 2 is in the roster of the party, but doesn't hold the ledger.
+	bcRoster := onet.NewRoster([]*network.ServerIdentity{roster.List[0],
+		roster.List[1], roster.List[3]})
+	c, msg, signer := newPopLedger(t, bcRoster)
+	genesis, err := c.GenesisBlock()
+	require.Nil(t, err)
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyID := spawnParty(t, c, msg, signer, &fs)
+	require.Nil(t, invokeParty(t, c, signer, partyID, "freeze"))
+	fs.Attendees = []kyber.Point{key.NewKeyPair(tSuite).Public}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+
+	// A party that is not finalized is not stored.
+	s2 := services[2].(*Service)
+	p, err := c.GetProof(partyID.Slice())
+	require.Nil(t, err)
+	s2.PropagatePartyFinal(&PartyFinal{c.ID, partyID, genesis, p.Proof})
+	_, err = NewClient().GetFinalStatement(roster.List[2].Address, c.ID, partyID)
+	require.NotNil(t, err)
+
+	require.Nil(t, finalizeParty(t, c, signer, partyID, &fs, fs.Signature))
+	h, err := fs.Hash()
+	require.Nil(t, err)
+
+	// The proof must come from the chain of the genesis block.
+	p, err = c.GetProof(partyID.Slice())
+	require.Nil(t, err)
+	_, otherRoster, _ := local.GenTree(3, true)
+	otherMsg, err := byzcoin.NewGenesisMsg(byzcoin.CurrentVersion, otherRoster,
+		[]string{"spawn:" + ContractPopParty}, signer.Identity())
+	require.Nil(t, err)
+	otherC, _, err := byzcoin.NewLedger(otherMsg, false)
+	require.Nil(t, err)
+	otherGenesis, err := otherC.GenesisBlock()
+	require.Nil(t, err)
+	s2.PropagatePartyFinal(&PartyFinal{c.ID, partyID, otherGenesis, p.Proof})
+	s2.PropagatePartyFinal(&PartyFinal{otherC.ID, partyID, otherGenesis, p.Proof})
+	_, err = NewClient().GetFinalStatement(roster.List[2].Address, c.ID, partyID)
+	require.NotNil(t, err)
+
+	// Reading the final statement on node 0 only stores it on node 0.
+	_, err = NewClient().GetFinalStatement(roster.List[0].Address, c.ID, partyID)
+	require.Nil(t, err)
+	_, err = NewClient().GetFinalStatement(roster.List[2].Address, c.ID, partyID)
+	require.NotNil(t, err)
+
+	// Node 0 propagates it to the roster of the party.
+	replies, err := NewClient().PropagateFinalStatement(roster.List[0].Address, c.ID, partyID)
+	require.Nil(t, err)
+	require.Equal(t, len(roster.List), replies)
+	reply, err := NewClient().GetFinalStatement(roster.List[2].Address, c.ID, partyID)
+	require.Nil(t, err)
+	k, _, _, _, err := byzcoin.VerifyProofOffline(genesis, &reply.Proof)
+	require.Nil(t, err)
+	require.Equal(t, partyID.Slice(), k)
+	h2, err := reply.FinalStatement.Hash()
+	require.Nil(t, err)
+	require.Equal(t, h, h2)
+	fss, err := NewClient().GetFinalStatements(roster.List[2].Address)
+	require.Nil(t, err)
+	require.NotNil(t, fss[string(fs.Desc.Hash())])
+}
+
+func TestService_GetPartyStats(t *testing.T) {
+	suiteSkip(t)
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	nodes, roster, _ := local.GenTree(3, true)
+	c, msg, signer := newPopLedger(t, roster)
+	addr := roster.List[0].Address
+
+	fs := FinalStatement{
+		Desc: &PopDesc{
+			Name:     "name",
+			DateTime: "2017-07-31 00:00",
+			Location: "city",
+			Roster:   roster,
+		},
+	}
+	partyID := spawnParty(t, c, msg, signer, &fs)
+	stats, err := NewClient().GetPartyStats(addr, c.ID, partyID)
+	require.Nil(t, err)
+	require.Equal(t, PartyConfigured, stats.State)
+	require.Equal(t, 0, stats.Attendees)
+	require.Equal(t, 1, len(stats.Transitions))
+
+	require.Nil(t, invokeParty(t, c, signer, partyID, "scan"))
+	require.Nil(t, invokeParty(t, c, signer, partyID, "freeze"))
+	for i := 0; i < 5; i++ {
+		fs.Attendees = append(fs.Attendees, key.NewKeyPair(tSuite).Public)
+	}
+	fs.Signature = orgsSigner(t, local, nodes, roster)(&fs)
+	service := key.NewKeyPair(tSuite).Public
+	serviceBuf, err := service.MarshalBinary()
+	require.Nil(t, err)
+	require.Nil(t, finalizeParty(t, c, signer, partyID, &fs, fs.Signature,
+		byzcoin.Argument{Name: "Service", Value: serviceBuf}))
+
+	stats, err = NewClient().GetPartyStats(addr, c.ID, partyID)
+	require.Nil(t, err)
+	require.Nil(t, stats.Proof.Verify(c.ID))
+	require.True(t, stats.Proof.InclusionProof.Match(partyID.Slice()))
+	require.Equal(t, PartyFinalized, stats.State)
+	require.Equal(t, 5, stats.Attendees)
+	require.Equal(t, 5*DefaultInitialCoins, stats.InitialCoins)
+	require.Equal(t, []byzcoin.InstanceID{AttendeeCoinID(partyID, service)}, stats.ServiceAccounts)
+
+	states := []int{PartyConfigured, PartyScanning, PartyFrozen, PartyFinalized}
+	require.Equal(t, len(states), len(stats.Transitions))
+	for i, tr := range stats.Transitions {
+		require.Equal(t, states[i], tr.State)
+		if i > 0 {
+			require.True(t, tr.Index > stats.Transitions[i-1].Index)
+		}
+	}
+
+	// The finalize instruction is in the recorded block.
+	final := stats.Transitions[3]
+	sb, err := skipchain.NewClient().GetSingleBlockByIndex(roster, c.ID, final.Index)
+	require.Nil(t, err)
+	sum, err := byzcoin.DecodeBlock(sb.SkipBlock)
+	require.Nil(t, err)
+	var commands []string
+	for _, tx := range sum.Transactions {
+		for _, instr := range tx.Instructions {
+			commands = append(commands, instr.Command)
+		}
+	}
+	require.Contains(t, commands, "Finalize")
+}
+
 func storeDesc(srvcs []onet.Service, el *onet.Roster, nbr int,
 	nprts int) ([]*PopDesc, []kyber.Point, []*Service, []kyber.Scalar) {
 	descs := make([]*PopDesc, nprts)
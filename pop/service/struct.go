@@ -5,11 +5,17 @@ This holds the messages used to communicate with the service over the network.
 */
 
 import (
+	"bytes"
+	"errors"
 	"sort"
 
 	"github.com/dedis/cothority"
+	"github.com/dedis/cothority/byzcoin"
+	"github.com/dedis/cothority/skipchain"
 	"github.com/dedis/kyber"
+	"github.com/dedis/onet"
 	"github.com/dedis/onet/network"
+	"github.com/dedis/protobuf"
 )
 
 // We need to register all messages so the network knows how to handle them.
@@ -20,7 +26,80 @@ func init() {
 		GetProposals{}, GetProposalsReply{},
 		VerifyLink{}, VerifyLinkReply{},
 		GetLink{}, GetLinkReply{},
-		GetFinalStatements{}, GetFinalStatementsReply{})
+		GetFinalStatements{}, GetFinalStatementsReply{},
+		PartyFinal{})
+}
+
+// PartyFinal is the final statement of a party stored in ByzCoin, as it is
+// propagated to and stored by the nodes of the roster of the party. Only the
+// proof is sent, from which the final statement is read.
+type PartyFinal struct {
+	// ByzCoinID is the ID of the ledger holding the party.
+	ByzCoinID skipchain.SkipBlockID
+	// PartyInstanceID is the instanceID of the party.
+	PartyInstanceID byzcoin.InstanceID
+	// Genesis is the genesis block of the ledger, the proof is verified
+	// against it.
+	Genesis *skipchain.SkipBlock
+	// Proof of the party instance.
+	Proof byzcoin.Proof
+}
+
+// verify checks the proof against the genesis block, whose hash must be the
+// ID of the ledger, and returns the final statement of the party and the
+// version of its instance. The final statement must be signed by the roster
+// of the party.
+func (pf *PartyFinal) verify() (*FinalStatement, uint64, error) {
+	if pf.Genesis == nil || !pf.Genesis.Hash.Equal(pf.ByzCoinID) {
+		return nil, 0, errors.New("genesis block is not the one of the ledger")
+	}
+	if !pf.Proof.InclusionProof.Match(pf.PartyInstanceID.Slice()) {
+		return nil, 0, errors.New("unknown party instance")
+	}
+	key, value, contractID, _, err := byzcoin.VerifyProofOffline(pf.Genesis, &pf.Proof)
+	if err != nil {
+		return nil, 0, errors.New("invalid proof: " + err.Error())
+	}
+	if !bytes.Equal(key, pf.PartyInstanceID.Slice()) {
+		return nil, 0, errors.New("unknown party instance")
+	}
+	if string(contractID) != ContractPopParty {
+		return nil, 0, errors.New("couldn't get party: not an instance of this contract")
+	}
+	var ppi PopPartyInstance
+	err = protobuf.DecodeWithConstructors(value, &ppi, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, 0, errors.New("couldn't get party: " + err.Error())
+	}
+	if ppi.State != PartyFinalized {
+		return nil, 0, ErrNotFinalized
+	}
+	fs := ppi.FinalStatement
+	if fs == nil || fs.Desc == nil || fs.Desc.Roster == nil {
+		return nil, 0, errors.New("invalid final statement")
+	}
+	roster := onet.NewRoster(fs.Desc.Roster.List)
+	if roster == nil || !roster.Aggregate.Equal(fs.Desc.Roster.Aggregate) {
+		return nil, 0, errors.New("invalid roster of the party")
+	}
+	if err = fs.Verify(); err != nil {
+		return nil, 0, errors.New("wrong signature of the final statement: " + err.Error())
+	}
+	_, vals := pf.Proof.InclusionProof.KeyValue()
+	var body byzcoin.StateChangeBody
+	err = protobuf.Decode(vals, &body)
+	if err != nil {
+		return nil, 0, errors.New("couldn't decode instance: " + err.Error())
+	}
+	return fs, body.Version, nil
+}
+
+// storedPartyFinal is a verified PartyFinal, together with the final
+// statement and the version of the party instance read from its proof.
+type storedPartyFinal struct {
+	PartyFinal     *PartyFinal
+	FinalStatement *FinalStatement
+	Version        uint64
 }
 
 func newMerge() *merge {
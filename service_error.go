@@ -0,0 +1,14 @@
+package cothority
+
+import "github.com/gorilla/websocket"
+
+// ServiceErrorCode is the code with which onet closes the websocket when the
+// service of the node returns an error.
+const ServiceErrorCode = 4000
+
+// IsServiceError returns true if err has been returned by the service of the
+// node, and false if the node couldn't be reached or didn't answer in time.
+func IsServiceError(err error) bool {
+	ce, ok := err.(*websocket.CloseError)
+	return ok && ce.Code == ServiceErrorCode
+}